@@ -0,0 +1,68 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// listenFdsStart is the first file descriptor systemd passes sockets on, see sd_listen_fds(3).
+const listenFdsStart = 3
+
+var (
+	activatedOnce sync.Once
+	activated     map[string]net.Listener
+)
+
+// activatedListener returns the listening socket systemd passed us under name, as set with
+// FileDescriptorName= in the .socket unit, or nil if there is none. With socket activation
+// systemd can bind sockets before we run, on demand and on privileged ports, without us
+// needing root. Each socket can only be taken once.
+func activatedListener(name string) net.Listener {
+	activatedOnce.Do(func() {
+		activated = listenFds()
+	})
+	l := activated[name]
+	delete(activated, name)
+	return l
+}
+
+// listenFds picks up the sockets from LISTEN_FDS and LISTEN_FDNAMES if they are meant for
+// us (LISTEN_PID), and clears the variables so they don't leak into child processes.
+func listenFds() map[string]net.Listener {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	listeners := map[string]net.Listener{}
+	for i := 0; i < n; i++ {
+		fd := listenFdsStart + i
+		syscall.CloseOnExec(fd)
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			slog.Warn("Ignoring activated socket", "name", name, "error", err)
+			continue
+		}
+		listeners[name] = l
+	}
+	return listeners
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The audit sink keeps a tamper-evident record of every scan: an append-only file with one
+// JSON line per scan, each holding the hash of the line before it. Changing, removing or
+// reordering a line breaks the chain from there on, which `usbscanner audit verify` points
+// out. With a signing key every hash is also signed, so the chain can't simply be rebuilt
+// after editing the file by someone without the key.
+//
+// A line is {"entry":{...},"hash":"...","sig":"..."}, where hash is the hex SHA-256 of the
+// entry exactly as written and sig the base64 ed25519 signature of the hash bytes.
+
+func init() {
+	RegisterSink("audit", func(cfg *SinkConfig) (Sink, error) {
+		if cfg.Arg == "" {
+			return nil, fmt.Errorf("audit sink needs a path")
+		}
+		s := &auditSink{}
+		if keyFile := cfg.Option("key", ""); keyFile != "" {
+			key, err := readAuditKey(keyFile)
+			if err != nil {
+				return nil, err
+			}
+			s.key = key
+		}
+		fsync, err := cfg.BoolOption("sync", true)
+		if err != nil {
+			return nil, err
+		}
+		chain, err := openAuditChain(cfg.Arg, fsync)
+		if err != nil {
+			return nil, err
+		}
+		s.chain = chain
+		return s, nil
+	})
+}
+
+// auditGenesis is the prev of the first entry.
+var auditGenesis = strings.Repeat("0", 64)
+
+type auditEntry struct {
+	Seq       uint64    `json:"seq"`
+	ID        string    `json:"id,omitempty"`
+	Time      time.Time `json:"time"`
+	Code      string    `json:"code"`
+	Device    string    `json:"device"`
+	Symbology string    `json:"symbology,omitempty"`
+	Tags      []string  `json:"tags,omitempty"`
+	Prev      string    `json:"prev"`
+}
+
+type auditLine struct {
+	Entry json.RawMessage `json:"entry"`
+	Hash  string          `json:"hash"`
+	Sig   string          `json:"sig,omitempty"`
+}
+
+type auditSink struct {
+	chain *auditChain
+	key   ed25519.PrivateKey
+}
+
+func (s *auditSink) Send(ctx context.Context, scan Scan) error {
+	return s.chain.append(scan, s.key)
+}
+
+func (s *auditSink) Close() error {
+	return s.chain.release()
+}
+
+// auditChain is the end of the chain in one file. It is shared by all sinks writing to
+// that file, a reload has the old and new sink open at the same time and the chain mustn't
+// fork.
+type auditChain struct {
+	path  string
+	fsync bool
+
+	mu   sync.Mutex
+	f    *os.File
+	seq  uint64
+	prev string
+	refs int
+}
+
+var (
+	auditChainsMu sync.Mutex
+	auditChains   = map[string]*auditChain{}
+)
+
+// openAuditChain opens the file and picks up the chain where its last line left off. On a
+// reload the chain already open is shared, and takes the sync of the new config.
+func openAuditChain(path string, fsync bool) (*auditChain, error) {
+	auditChainsMu.Lock()
+	defer auditChainsMu.Unlock()
+	if c, ok := auditChains[path]; ok {
+		c.mu.Lock()
+		if c.fsync != fsync {
+			slog.Warn("Audit sync changed, the file takes it from now on", "path", path, "sync", fsync)
+			c.fsync = fsync
+		}
+		c.mu.Unlock()
+		c.refs++
+		return c, nil
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	c := &auditChain{path: path, fsync: fsync, f: f, prev: auditGenesis, refs: 1}
+	last, err := lastLine(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if len(last) > 0 {
+		var line auditLine
+		var entry auditEntry
+		if err := json.Unmarshal(last, &line); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("%s: last line is damaged, not appending to it: %v", path, err)
+		}
+		if err := json.Unmarshal(line.Entry, &entry); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("%s: last line is damaged, not appending to it: %v", path, err)
+		}
+		c.seq, c.prev = entry.Seq, line.Hash
+	}
+	auditChains[path] = c
+	return c, nil
+}
+
+func (c *auditChain) append(scan Scan, key ed25519.PrivateKey) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, err := json.Marshal(auditEntry{
+		Seq:       c.seq + 1,
+		ID:        scan.ID,
+		Time:      scan.Time,
+		Code:      scan.Code,
+		Device:    scan.Device,
+		Symbology: scan.Symbology,
+		Tags:      scan.Tags,
+		Prev:      c.prev,
+	})
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(entry)
+	line := auditLine{Entry: entry, Hash: hex.EncodeToString(sum[:])}
+	if key != nil {
+		line.Sig = base64.StdEncoding.EncodeToString(ed25519.Sign(key, sum[:]))
+	}
+	data, err := json.Marshal(line)
+	if err != nil {
+		return err
+	}
+	if _, err := c.f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if c.fsync {
+		if err := c.f.Sync(); err != nil {
+			return err
+		}
+	}
+	c.seq++
+	c.prev = line.Hash
+	return nil
+}
+
+func (c *auditChain) release() error {
+	auditChainsMu.Lock()
+	defer auditChainsMu.Unlock()
+	c.refs--
+	if c.refs > 0 {
+		return nil
+	}
+	delete(auditChains, c.path)
+	return c.f.Close()
+}
+
+// lastLine reads the last non-empty line of f, reading backwards from the end so a big log
+// doesn't have to be read in full.
+func lastLine(f *os.File) ([]byte, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	var tail []byte
+	buf := make([]byte, 4096)
+	for end := fi.Size(); end > 0; {
+		n := int64(len(buf))
+		if end < n {
+			n = end
+		}
+		end -= n
+		if _, err := f.ReadAt(buf[:n], end); err != nil && err != io.EOF {
+			return nil, err
+		}
+		tail = append(append([]byte{}, buf[:n]...), tail...)
+		trimmed := bytes.TrimRight(tail, "\n")
+		if i := bytes.LastIndexByte(trimmed, '\n'); i >= 0 {
+			return trimmed[i+1:], nil
+		}
+	}
+	return bytes.TrimRight(tail, "\n"), nil
+}
+
+// readAuditKey reads a base64 ed25519 private key, either the 32 byte seed or the full key.
+func readAuditKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	switch {
+	case err != nil:
+	case len(raw) == ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(raw), nil
+	case len(raw) == ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(raw), nil
+	}
+	return nil, fmt.Errorf("%s: not a base64 ed25519 private key", path)
+}
+
+// runAudit implements `usbscanner audit`: verify checks the chain of an audit log, keygen
+// makes a signing key.
+func runAudit(args []string) {
+	usage := func() {
+		fmt.Fprintf(os.Stderr, "Usage: usbscanner audit verify [-key public key file] <log>\n       usbscanner audit keygen <key file>\n")
+		os.Exit(2)
+	}
+	if len(args) == 0 {
+		usage()
+	}
+	switch args[0] {
+	case "verify":
+		fs := flag.NewFlagSet("audit verify", flag.ExitOnError)
+		keyFile := fs.String("key", "", "base64 ed25519 public key the entries have to be signed with")
+		fs.Parse(args[1:])
+		if fs.NArg() != 1 {
+			usage()
+		}
+		var key ed25519.PublicKey
+		if *keyFile != "" {
+			data, err := os.ReadFile(*keyFile)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+			if err != nil || len(raw) != ed25519.PublicKeySize {
+				fmt.Fprintf(os.Stderr, "%s: not a base64 ed25519 public key\n", *keyFile)
+				os.Exit(1)
+			}
+			key = ed25519.PublicKey(raw)
+		}
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		n, err := verifyAudit(f, key)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", fs.Arg(0), err)
+			os.Exit(1)
+		}
+		fmt.Printf("%s: %d entries, chain intact\n", fs.Arg(0), n)
+	case "keygen":
+		if len(args) != 2 {
+			usage()
+		}
+		pub, priv, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if err := os.WriteFile(args[1], []byte(base64.StdEncoding.EncodeToString(priv.Seed())+"\n"), 0600); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if err := os.WriteFile(args[1]+".pub", []byte(base64.StdEncoding.EncodeToString(pub)+"\n"), 0644); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Wrote %s and %s.pub\n", args[1], args[1])
+	default:
+		usage()
+	}
+}
+
+// verifyAudit checks every line of an audit log: that its hash matches, that it follows on
+// from the line before, and with a key that it is signed. It returns the number of entries,
+// or where the chain breaks.
+func verifyAudit(r io.Reader, key ed25519.PublicKey) (int, error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+	prev, seq, n := auditGenesis, uint64(0), 0
+	for lineNo := 1; sc.Scan(); lineNo++ {
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+		var line auditLine
+		var entry auditEntry
+		if err := json.Unmarshal(sc.Bytes(), &line); err != nil {
+			return n, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+		if err := json.Unmarshal(line.Entry, &entry); err != nil {
+			return n, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+		sum := sha256.Sum256(line.Entry)
+		switch {
+		case hex.EncodeToString(sum[:]) != line.Hash:
+			return n, fmt.Errorf("line %d: hash doesn't match, the entry was changed", lineNo)
+		case entry.Prev != prev:
+			return n, fmt.Errorf("line %d: doesn't follow on from the line before, entries were removed, added or reordered", lineNo)
+		case entry.Seq != seq+1:
+			return n, fmt.Errorf("line %d: sequence number %d after %d", lineNo, entry.Seq, seq)
+		}
+		if key != nil {
+			sig, err := base64.StdEncoding.DecodeString(line.Sig)
+			if err != nil || !ed25519.Verify(key, sum[:], sig) {
+				return n, fmt.Errorf("line %d: missing or bad signature", lineNo)
+			}
+		}
+		prev, seq = line.Hash, entry.Seq
+		n++
+	}
+	return n, sc.Err()
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// azureAuth produces the Authorization header for Service Bus and Event Hubs requests,
+// either as a shared access signature from a connection string or as an AAD token.
+type azureAuth interface {
+	header(resource string) (string, error)
+}
+
+// azureSAS signs requests with a shared access key from a connection string.
+type azureSAS struct {
+	keyName string
+	key     string
+}
+
+// header builds a SharedAccessSignature token for resource valid for an hour, see
+// https://learn.microsoft.com/azure/service-bus-messaging/service-bus-sas
+func (a azureSAS) header(resource string) (string, error) {
+	uri := url.QueryEscape(strings.ToLower(resource))
+	expiry := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(a.key))
+	mac.Write([]byte(uri + "\n" + expiry))
+	sig := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return "SharedAccessSignature sr=" + uri + "&sig=" + url.QueryEscape(sig) + "&se=" + expiry + "&skn=" + a.keyName, nil
+}
+
+// azureAAD gets tokens from Azure AD. With AZURE_TENANT_ID, AZURE_CLIENT_ID and
+// AZURE_CLIENT_SECRET set it uses the client credentials flow, otherwise the managed
+// identity of the VM we run on.
+type azureAAD struct {
+	scope  string
+	client *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func (a *azureAAD) header(resource string) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.token != "" && time.Until(a.expires) > time.Minute {
+		return "Bearer " + a.token, nil
+	}
+	var req *http.Request
+	tenant, clientID, secret := os.Getenv("AZURE_TENANT_ID"), os.Getenv("AZURE_CLIENT_ID"), os.Getenv("AZURE_CLIENT_SECRET")
+	if tenant != "" && clientID != "" && secret != "" {
+		form := url.Values{
+			"grant_type":    {"client_credentials"},
+			"client_id":     {clientID},
+			"client_secret": {secret},
+			"scope":         {a.scope + "/.default"},
+		}
+		req, _ = http.NewRequest(http.MethodPost, "https://login.microsoftonline.com/"+tenant+"/oauth2/v2.0/token", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		q := url.Values{"api-version": {"2018-02-01"}, "resource": {a.scope + "/"}}
+		if clientID != "" {
+			q.Set("client_id", clientID)
+		}
+		req, _ = http.NewRequest(http.MethodGet, "http://169.254.169.254/metadata/identity/oauth2/token?"+q.Encode(), nil)
+		req.Header.Set("Metadata", "true")
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("getting AAD token: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("getting AAD token: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	// The managed identity endpoint sends expires_in as a string, the token endpoint as a number.
+	var token struct {
+		AccessToken string      `json:"access_token"`
+		ExpiresIn   json.Number `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return "", err
+	}
+	seconds, _ := token.ExpiresIn.Int64()
+	a.token = token.AccessToken
+	a.expires = time.Now().Add(time.Duration(seconds) * time.Second)
+	return "Bearer " + a.token, nil
+}
+
+// parseAzureTarget works out the entity URL and authentication from a sink argument, which
+// is either a connection string as shown in the portal
+//
+//	Endpoint=sb://<namespace>.servicebus.windows.net/;SharedAccessKeyName=...;SharedAccessKey=...;EntityPath=<queue>
+//
+// (EntityPath may be left out if the entity option is set), or the plain entity URL
+// https://<namespace>.servicebus.windows.net/<queue> to authenticate with Azure AD.
+func parseAzureTarget(arg string, entity string, scope string) (string, azureAuth, error) {
+	if strings.HasPrefix(arg, "https://") {
+		return strings.TrimSuffix(arg, "/"), &azureAAD{scope: scope, client: &http.Client{Timeout: 10 * time.Second}}, nil
+	}
+	parts := map[string]string{}
+	for _, part := range strings.Split(arg, ";") {
+		if k, v, ok := strings.Cut(part, "="); ok {
+			parts[strings.ToLower(strings.TrimSpace(k))] = strings.TrimSpace(v)
+		}
+	}
+	endpoint := parts["endpoint"]
+	if endpoint == "" || parts["sharedaccesskeyname"] == "" || parts["sharedaccesskey"] == "" {
+		return "", nil, fmt.Errorf("need a connection string with Endpoint, SharedAccessKeyName and SharedAccessKey, or an https:// entity URL")
+	}
+	if parts["entitypath"] != "" {
+		entity = parts["entitypath"]
+	}
+	if entity == "" {
+		return "", nil, fmt.Errorf("connection string has no EntityPath, set the entity option")
+	}
+	host := strings.TrimSuffix(strings.TrimPrefix(endpoint, "sb://"), "/")
+	return "https://" + host + "/" + entity, azureSAS{keyName: parts["sharedaccesskeyname"], key: parts["sharedaccesskey"]}, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"log/slog"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// backoff is how long to wait before trying again something that keeps failing: the delay
+// doubles with every failure in a row, from min up to max. Each delay is cut short by up
+// to a fifth at random, so sinks that failed together, say when the network went down,
+// don't all try again at the same moment.
+type backoff struct {
+	min, max time.Duration
+	delay    time.Duration // the next one, 0 after a reset
+}
+
+// backoffJitter is the share of a delay that is random.
+const backoffJitter = 0.2
+
+// next returns the delay before the next try.
+func (b *backoff) next() time.Duration {
+	if b.delay == 0 {
+		b.delay = b.min
+	}
+	d := b.delay
+	if b.delay *= 2; b.delay > b.max {
+		b.delay = b.max
+	}
+	return d - time.Duration(rand.Float64()*backoffJitter*float64(d))
+}
+
+// reset starts over at min.
+func (b *backoff) reset() {
+	b.delay = 0
+}
+
+// breaker keeps track of whether a sink is up. While deliveries fail, the next attempt has
+// to wait for the backoff. After downAfter failures in a row the sink counts as down: that
+// is logged and counted, and until the backoff is over scans don't even try it, see open.
+// The first delivery to go through brings it back up.
+type breaker struct {
+	sink      string
+	device    string // of the station, for the metrics
+	downAfter int
+
+	mu       sync.Mutex
+	backoff  backoff
+	failures int // in a row
+	down     bool
+	since    time.Time // of the last change between up and down
+	until    time.Time // no attempts before this
+}
+
+func newBreaker(sink string, min, max time.Duration, downAfter int) *breaker {
+	return &breaker{sink: sink, downAfter: downAfter, backoff: backoff{min: min, max: max}, since: time.Now()}
+}
+
+// failure records a failed delivery.
+func (b *breaker) failure(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.until = time.Now().Add(b.backoff.next())
+	if !b.down && b.downAfter > 0 && b.failures >= b.downAfter {
+		b.down = true
+		slog.Warn("Sink is down", "sink", b.sink, "error", err, "failures", b.failures, "up_for", time.Since(b.since).Round(time.Second))
+		b.since = time.Now()
+		sinkStateChanges.inc(b.device, b.sink, "down")
+	}
+}
+
+// success records a delivery that went through.
+func (b *breaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.down {
+		b.down = false
+		slog.Info("Sink is up again", "sink", b.sink, "down_for", time.Since(b.since).Round(time.Second), "failures", b.failures)
+		b.since = time.Now()
+		sinkStateChanges.inc(b.device, b.sink, "up")
+	}
+	b.failures = 0
+	b.backoff.reset()
+	b.until = time.Time{}
+}
+
+// wait is how long the next attempt has to wait, 0 if it can go right away.
+func (b *breaker) wait() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if d := time.Until(b.until); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// open reports whether the sink is down and has to wait before it is tried again.
+func (b *breaker) open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.down && time.Now().Before(b.until)
+}
+
+// isDown reports whether the sink is down, for the status and the metrics.
+func (b *breaker) isDown() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.down
+}
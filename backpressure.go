@@ -0,0 +1,81 @@
+package main
+
+import "fmt"
+
+// overflowPolicy is what happens when something comes in while its queue is full, which is
+// whenever whatever takes from the queue can't keep up or is stuck.
+type overflowPolicy int
+
+const (
+	// overflowBlock waits for room. Nothing is lost, but everything in front of the queue
+	// waits too, up to the read loop, and once that stops reading the kernel drops events.
+	overflowBlock overflowPolicy = iota
+	// overflowDropOldest makes room by throwing away what has been waiting the longest.
+	overflowDropOldest
+	// overflowDropNewest throws away what just came in.
+	overflowDropNewest
+	// overflowSpill moves what doesn't fit to disk, to be taken from there once the queue
+	// is empty. Only sinks do this, see sinkRunner.enqueue.
+	overflowSpill
+)
+
+var overflowPolicies = map[string]overflowPolicy{
+	"block":         overflowBlock,
+	"drop-oldest":   overflowDropOldest,
+	"drop-newest":   overflowDropNewest,
+	"spill-to-disk": overflowSpill,
+}
+
+// parseOverflow reads the policy set as key, block if s is empty. spill says whether
+// spill-to-disk is possible for the queue.
+func parseOverflow(key, s string, spill bool) (overflowPolicy, error) {
+	if s == "" {
+		return overflowBlock, nil
+	}
+	p, ok := overflowPolicies[s]
+	if !ok || (p == overflowSpill && !spill) {
+		if spill {
+			return 0, fmt.Errorf("%s should be block, drop-oldest, drop-newest or spill-to-disk, not %q", key, s)
+		}
+		return 0, fmt.Errorf("%s should be block, drop-oldest or drop-newest, not %q", key, s)
+	}
+	return p, nil
+}
+
+// offer puts v on ch. If ch is full the policy decides what happens, each decision is
+// counted for device and queue in usbscanner_backpressure_total. drop is called with
+// whatever gets thrown away. It reports whether v went on ch; with spill-to-disk it doesn't,
+// and it is up to the caller where v goes instead.
+func offer[T any](ch chan T, v T, policy overflowPolicy, device, queue string, drop func(T)) bool {
+	select {
+	case ch <- v:
+		return true
+	default:
+	}
+	switch policy {
+	case overflowDropNewest:
+		backpressure.inc(device, queue, "dropped_newest")
+		drop(v)
+		return false
+	case overflowDropOldest:
+		for {
+			select {
+			case ch <- v:
+				return true
+			default:
+			}
+			select {
+			case old := <-ch:
+				backpressure.inc(device, queue, "dropped_oldest")
+				drop(old)
+			default: // taken in the meantime, there's room now
+			}
+		}
+	case overflowSpill:
+		backpressure.inc(device, queue, "spilled")
+		return false
+	}
+	backpressure.inc(device, queue, "blocked")
+	ch <- v
+	return true
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"strings"
+)
+
+// Magstripe badge readers in keyboard mode type the tracks of a card the way scanners type
+// barcodes, each track between its sentinels as ISO 7811 has them: track 1 from % to ?,
+// letters and digits with ^ between its fields, tracks 2 and 3 from ; to ?, digits with =
+// between the fields. Where the card follows ISO 7813, as bank cards and many badges do,
+// the fields are the card number, on track 1 the holder's name, and the expiry date, the
+// service code and data of the issuer's own. With reader = "badge" the tracks are read
+// from the scan, its code is the card number and its symbology badge, and the tracks go
+// along with it in badge.
+
+// BadgeScan is what a badge reader read off a card, by track.
+type BadgeScan struct {
+	Track1 *BadgeTrack `json:"track1,omitempty"`
+	Track2 *BadgeTrack `json:"track2,omitempty"`
+	Track3 *BadgeTrack `json:"track3,omitempty"`
+
+	Wiegand *WiegandCard `json:"wiegand,omitempty"` // a card of an access control reader, see wiegand.go
+	Prox    *ProxCard    `json:"prox,omitempty"`    // a card a proximity reader typed, see prox.go
+}
+
+// BadgeTrack is a track of a card, with the fields of ISO 7813 that it has.
+type BadgeTrack struct {
+	Data    string `json:"data"`              // between the sentinels
+	Format  string `json:"format,omitempty"`  // track 1: the format code, B for bank cards
+	Number  string `json:"number,omitempty"`  // the card number
+	Name    string `json:"name,omitempty"`    // track 1: the card holder, SURNAME/GIVEN NAMES
+	Expiry  string `json:"expiry,omitempty"`  // YYMM
+	Service string `json:"service,omitempty"` // service code
+	Extra   string `json:"extra,omitempty"`   // discretionary data
+}
+
+// badgeKeys are the characters of the sentinels and separators of the tracks, by key
+// unshifted and shifted on a US keyboard, which the decoder gives no names of their own.
+var badgeKeys = map[string][2]string{
+	"KEY_5":         {"5", "%"},
+	"KEY_6":         {"6", "^"},
+	"KEY_SLASH":     {"/", "?"},
+	"KEY_EQUAL":     {"=", "+"},
+	"KEY_SEMICOLON": {";", ":"},
+}
+
+// badgeCharacter is the character of the key name for a badge reader, key as the decoder
+// has it unless it's one of badgeKeys the keymap doesn't have.
+func badgeCharacter(name string, shifted bool, key string, keymap map[string]string) string {
+	chars, ok := badgeKeys[name]
+	if !ok {
+		return key
+	}
+	k := strings.TrimPrefix(name, "KEY_")
+	if !shifted {
+		k = strings.ToLower(k)
+	}
+	if _, mapped := keymap[k]; mapped {
+		return key
+	}
+	if shifted {
+		return chars[1]
+	}
+	return chars[0]
+}
+
+// parseBadge reads the tracks from what a badge reader sent. Tracks the reader couldn't
+// read, which it sends as E, are left out.
+func parseBadge(s string) (*BadgeScan, error) {
+	var b BadgeScan
+	for s != "" {
+		start := strings.IndexAny(s, "%;+")
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(s[start:], '?')
+		if end < 0 {
+			return nil, errors.New("badge: a track has no end sentinel")
+		}
+		sentinel, data := s[start], s[start+1:start+end]
+		s = s[start+end+1:]
+		if data == "E" {
+			continue
+		}
+		switch {
+		case sentinel == '%':
+			b.Track1 = parseTrack(data, '^')
+		case sentinel == ';' && b.Track2 == nil:
+			b.Track2 = parseTrack(data, '=')
+		default: // the second ; or a +
+			b.Track3 = &BadgeTrack{Data: data}
+		}
+	}
+	if b.Track1 == nil && b.Track2 == nil && b.Track3 == nil {
+		return nil, errors.New("badge: no track could be read")
+	}
+	return &b, nil
+}
+
+// parseTrack splits the data of track 1 or 2 into its fields at sep. Track 1 starts with
+// its format code and has the name between the number and the rest.
+func parseTrack(data string, sep byte) *BadgeTrack {
+	t := &BadgeTrack{Data: data}
+	if sep == '^' && data != "" && data[0] >= 'A' && data[0] <= 'Z' {
+		t.Format, data = data[:1], data[1:]
+	}
+	number, rest, ok := strings.Cut(data, string(sep))
+	t.Number = number
+	if !ok {
+		return t
+	}
+	if sep == '^' {
+		t.Name, rest, _ = strings.Cut(rest, "^")
+		t.Name = strings.TrimSpace(t.Name)
+	}
+	if len(rest) >= 4 {
+		t.Expiry, rest = rest[:4], rest[4:]
+	}
+	if len(rest) >= 3 {
+		t.Service, rest = rest[:3], rest[3:]
+	}
+	t.Extra = rest
+	return t
+}
+
+// badgeScan is the scan of a badge reader with its tracks read. One whose tracks can't be
+// read is passed on as it came.
+func badgeScan(scan Scan) Scan {
+	scan.Symbology = "badge"
+	b, err := parseBadge(scan.Code)
+	if err != nil {
+		slog.Warn("Could not read the tracks of a badge", "device", scan.Device, "error", err)
+		return scan
+	}
+	scan.Badge = b
+	for _, t := range []*BadgeTrack{b.Track2, b.Track1, b.Track3} {
+		if t != nil {
+			scan.Code = t.Number
+			if t.Number == "" {
+				scan.Code = t.Data
+			}
+			break
+		}
+	}
+	return scan
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Benchmarks of the way from events to a scan handed to the sinks. Each op is one scan, so
+// allocs/op is allocations per scan, but for the replay; the decoder benchmarks report
+// events/s as well. Compare runs with benchstat:
+//
+//	go test -run '^$' -bench . -count 10 > old.txt
+
+func benchmarkDecoder(b *testing.B, code string, keymap map[string]string) {
+	events := typedEvents(&virtualScanner{keys: typingKeys()}, code)
+	if events == nil {
+		b.Fatalf("can't type %q", code)
+	}
+	now := time.Unix(1700000000, 0)
+	d := decoder{device: "bench"}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := range events {
+			d.event(&events[j], now, keymap)
+		}
+		if scan, _ := d.complete(now); scan.Code != code {
+			b.Fatalf("decoded %q, not %q", scan.Code, code)
+		}
+	}
+	b.ReportMetric(float64(b.N*len(events))/b.Elapsed().Seconds(), "events/s")
+}
+
+// BenchmarkDecoderGTIN is a 13 digit EAN, the bulk of what retail scanners read.
+func BenchmarkDecoderGTIN(b *testing.B) {
+	benchmarkDecoder(b, "4006381333931", nil)
+}
+
+// BenchmarkDecoderURL is a QR code with shifted characters, which take twice the events.
+func BenchmarkDecoderURL(b *testing.B) {
+	benchmarkDecoder(b, "https://example.com/T/Item-4006381333931/Lot-A12,B7", nil)
+}
+
+// BenchmarkDecoderKeymap is the same with a keymap, which is looked up for every key.
+func BenchmarkDecoderKeymap(b *testing.B) {
+	benchmarkDecoder(b, "https://example.com/T/Item-4006381333931/Lot-A12,B7", map[string]string{"minus": "-", "SEMICOLON": ":"})
+}
+
+// BenchmarkTimedDecoder is the decoder going by event timestamps, as replay and record use
+// it, with a gap between scans so every one of them is completed by the next.
+func BenchmarkTimedDecoder(b *testing.B) {
+	events := typedEvents(&virtualScanner{keys: typingKeys()}, "4006381333931")
+	td := newTimedDecoder(timerDuration, nil)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		offset := int64(i) * int64(time.Second)
+		for j := range events {
+			ev := events[j]
+			ev.Time = syscall.NsecToTimeval(syscall.TimevalToNsec(ev.Time) + offset)
+			td.event("bench", &ev)
+		}
+	}
+	td.flush()
+	b.ReportMetric(float64(b.N*len(events))/b.Elapsed().Seconds(), "events/s")
+}
+
+func BenchmarkProcessCharacter(b *testing.B) {
+	keys := []string{"KEY_LEFTSHIFT", "KEY_H", "KEY_T", "KEY_SEMICOLON", "KEY_SLASH", "KEY_4", "KEY_DOT"}
+	b.ReportAllocs()
+	var capNext bool
+	for i := 0; i < b.N; i++ {
+		_, capNext = processCharacter(keys[i%len(keys)], capNext, nil)
+	}
+}
+
+// BenchmarkNewScan is making the scan of a barcode: its ID and the AIM identifier.
+func BenchmarkNewScan(b *testing.B) {
+	now := time.Now()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		newScan("]E04006381333931", "bench", now)
+	}
+}
+
+// BenchmarkHandle is a scan through validation, dedup and the tag rules, without sinks.
+func BenchmarkHandle(b *testing.B) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	cfg := defaultConfig()
+	cfg.Validate = ValidateConfig{Pattern: `^[0-9]{8,14}$`, MinLength: 8}
+	cfg.Tags = map[string]string{"ean": `^[0-9]{13}$`, "local": `^2[0-9]{12}$`}
+	cfg.Dedup = DedupConfig{Window: duration{time.Second}}
+	p, err := newPipeline(cfg)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer p.stop()
+	scan := newScan("4006381333931", "bench", time.Unix(1700000000, 0))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		scan.Time = scan.Time.Add(2 * time.Second)
+		p.handle(scan)
+	}
+}
+
+// BenchmarkReplayCapture is replaying a capture of a hundred scans.
+func BenchmarkReplayCapture(b *testing.B) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.Encode(captureRecord{Kind: "start", Version: captureVersion})
+	events := typedEvents(&virtualScanner{keys: typingKeys()}, "4006381333931")
+	for i := 0; i < 100; i++ {
+		for _, ev := range events {
+			nsec := syscall.TimevalToNsec(ev.Time) + int64(i)*int64(time.Second)
+			enc.Encode(captureRecord{Kind: "event", Device: "bench", Event: &captureEvent{
+				Sec: nsec / int64(time.Second), Usec: nsec % int64(time.Second) / 1000, Type: ev.Type, Code: ev.Code, Value: ev.Value,
+			}})
+		}
+	}
+	data := buf.Bytes()
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		n := 0
+		if _, err := replayCapture(bytes.NewReader(data), newTimedDecoder(timerDuration, nil), "", func(Scan) { n++ }); err != nil || n != 100 {
+			b.Fatalf("%d scans, %v", n, err)
+		}
+	}
+	b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*100), "ns/scan")
+}
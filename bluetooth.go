@@ -0,0 +1,89 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gvalkov/golang-evdev"
+)
+
+// Cordless scanners paired with the host over Bluetooth rather than through their cradle
+// are HID devices BlueZ makes input devices of, with uhid or hidp. They go away when the
+// scanner goes to sleep and come back when the trigger wakes it up, under another event node
+// more often than not. That is no error: the station waits for an input device with the
+// scanner's Bluetooth address, looking often enough that the scan that woke it isn't held
+// up, and takes it up where it left off.
+
+const busBluetooth = 0x05
+
+// bluetoothPoll is how often to look for a Bluetooth scanner that went away.
+const bluetoothPoll = 500 * time.Millisecond
+
+// inputUniq is the unique ID of the input device at path, for Bluetooth devices their address.
+func inputUniq(path string) string {
+	b, _ := os.ReadFile(filepath.Join("/sys/class/input", filepath.Base(path), "device/uniq"))
+	return strings.TrimSpace(string(b))
+}
+
+// findBluetooth finds the input device with the Bluetooth address addr among those cfg
+// takes, "" if it isn't there.
+func findBluetooth(cfg *Config, addr string) string {
+	devices, _ := evdev.ListInputDevices()
+	path := ""
+	for _, dev := range devices {
+		if path == "" && dev.Bustype == busBluetooth && inputUniq(dev.Fn) == addr && cfg.findDevice([]*evdev.InputDevice{dev}) != nil {
+			path = dev.Fn
+		}
+		dev.File.Close()
+	}
+	return path
+}
+
+// reconnect waits for the Bluetooth scanner of the station to come back after its input
+// device went away, and opens and grabs it in place of the old one.
+func (s *station) reconnect() {
+	slog.Info("Scanner disconnected, waiting for it to come back", "device", s.device.Name, "address", s.btAddr)
+	s.device.File.Close()
+	gone := time.Now()
+	for !s.stopping.Load() {
+		time.Sleep(bluetoothPoll)
+		path := findBluetooth(s.d.config(), s.btAddr)
+		if path == "" {
+			continue
+		}
+		lock := s.lock
+		if path != s.device.Fn {
+			var err error
+			if lock, err = lockDevice(s.d.config().LockDir, path); err != nil {
+				s.setError(err)
+				continue
+			}
+		}
+		dev, err := evdev.Open(path)
+		if err == nil {
+			if err = dev.Grab(); err != nil {
+				dev.File.Close()
+			}
+		}
+		if err != nil {
+			if lock != s.lock {
+				lock.Close()
+			}
+			s.setError(err)
+			continue
+		}
+		if lock != s.lock {
+			s.lock.Close()
+			s.lock = lock
+		}
+		s.fileMu.Lock()
+		s.device.Fn, s.device.File = path, dev.File
+		s.fileMu.Unlock()
+		deviceReconnects.inc(s.device.Name)
+		slog.Info("Scanner reconnected", "device", s.device.Name, "path", path, "away", time.Since(gone).Round(time.Second))
+		return
+	}
+}
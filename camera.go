@@ -0,0 +1,341 @@
+package main
+
+import (
+	"image"
+	"log/slog"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A webcam can stand in for a scanner that a station lacks or that broke. Frames are read
+// off the camera, see video.go, and decoded here rather than by a library: lines across the
+// frame are cut into the widths of their bars and spaces, in both directions, and searched
+// for an EAN-13 (or UPC-A) or a Code 128 barcode, the ones of products and of labels. Both
+// have check digits, so a line read wrong doesn't pass. A barcode held in front of the
+// camera is in every frame, it is passed on once and again once it was gone for a while.
+
+// cameraLines is how many lines across a frame are looked at for a barcode.
+const cameraLines = 32
+
+// cameraGone is how long a barcode has to be out of sight to be passed on again.
+const cameraGone = time.Second
+
+// eanPatterns are the widths of the digits of the L code, space first; those of the G code
+// are the same backwards and those of the R code the same starting with a bar.
+var eanPatterns = [10][4]int{
+	{3, 2, 1, 1}, {2, 2, 2, 1}, {2, 1, 2, 2}, {1, 4, 1, 1}, {1, 1, 3, 2},
+	{1, 2, 3, 1}, {1, 1, 1, 4}, {1, 3, 1, 2}, {1, 2, 1, 3}, {3, 1, 1, 2},
+}
+
+// eanFirstDigits are the first digits of EAN-13 by the codes of the digits on the left, a
+// bit set for G.
+var eanFirstDigits = map[int]int{
+	0b000000: 0, 0b001011: 1, 0b001101: 2, 0b001110: 3, 0b010011: 4,
+	0b011001: 5, 0b011100: 6, 0b010101: 7, 0b010110: 8, 0b011010: 9,
+}
+
+// lineRuns are the widths of the bars and spaces of a line of pixels, starting with a bar:
+// darker than halfway between the darkest and the lightest pixel. A line without contrast
+// has none.
+func lineRuns(line []byte) []int {
+	lo, hi := byte(255), byte(0)
+	for _, p := range line {
+		lo, hi = min(lo, p), max(hi, p)
+	}
+	if hi-lo < 40 {
+		return nil
+	}
+	threshold := (int(lo) + int(hi)) / 2
+	var runs []int
+	dark := false
+	for _, p := range line {
+		d := int(p) < threshold
+		if len(runs) > 0 && d == dark {
+			runs[len(runs)-1]++
+		} else if d || len(runs) > 0 {
+			runs = append(runs, 1)
+			dark = d
+		}
+	}
+	if len(runs)%2 == 0 && len(runs) > 0 {
+		runs = runs[:len(runs)-1] // the light after the last bar
+	}
+	return runs
+}
+
+// matchWidths is how far the widths are off pattern once scaled to its modules.
+func matchWidths(widths []int, pattern []int) float64 {
+	sum, modules := 0, 0
+	for i := range widths {
+		sum += widths[i]
+		modules += pattern[i]
+	}
+	off := 0.0
+	for i := range widths {
+		off += math.Abs(float64(widths[i]*modules)/float64(sum) - float64(pattern[i]))
+	}
+	return off
+}
+
+// bestMatch is the pattern closest to widths, -1 if none is close enough.
+func bestMatch(widths []int, patterns [][]int) int {
+	best, bestOff := -1, 1.5
+	for i, p := range patterns {
+		if off := matchWidths(widths, p); off < bestOff {
+			best, bestOff = i, off
+		}
+	}
+	return best
+}
+
+// decodeEAN13 looks for an EAN-13 in runs, 59 of them: the start guard, six digits of four
+// widths, the middle guard, six digits more and the end guard.
+func decodeEAN13(runs []int) (string, bool) {
+	var left, right [][]int
+	for _, p := range eanPatterns {
+		left = append(left, p[:], []int{p[3], p[2], p[1], p[0]})
+		right = append(right, p[:])
+	}
+	for i := 0; i+59 <= len(runs); i += 2 {
+		if matchWidths(runs[i:i+3], []int{1, 1, 1}) > 0.6 {
+			continue
+		}
+		digits := make([]byte, 13)
+		parity, ok := 0, true
+		for d := 0; d < 12 && ok; d++ {
+			at := i + 3 + 4*d
+			if d >= 6 {
+				at += 5
+			}
+			var m int
+			if d < 6 {
+				m = bestMatch(runs[at:at+4], left)
+				parity = parity<<1 | m%2
+				m /= 2
+			} else {
+				m = bestMatch(runs[at:at+4], right)
+			}
+			ok = m >= 0
+			digits[d+1] = byte('0' + m)
+		}
+		first, known := eanFirstDigits[parity]
+		if !ok || !known {
+			continue
+		}
+		digits[0] = byte('0' + first)
+		if eanCheck(digits) {
+			return string(digits), true
+		}
+	}
+	return "", false
+}
+
+// eanCheck checks the check digit of an EAN.
+func eanCheck(digits []byte) bool {
+	sum := 0
+	for i, d := range digits[:len(digits)-1] {
+		w := 1
+		if (len(digits)-1-i)%2 == 1 {
+			w = 3
+		}
+		sum += int(d-'0') * w
+	}
+	return (10-sum%10)%10 == int(digits[len(digits)-1]-'0')
+}
+
+// code128Widths are code128Patterns as numbers.
+var code128Widths = func() [][]int {
+	var widths [][]int
+	for _, p := range code128Patterns {
+		var w []int
+		for _, c := range p {
+			w = append(w, int(c-'0'))
+		}
+		widths = append(widths, w)
+	}
+	return widths
+}()
+
+// decodeCode128 looks for a Code 128 in runs: a start symbol, the symbols of six widths
+// each, the check symbol and the stop symbol of seven.
+func decodeCode128(runs []int) (string, bool) {
+	symbols := code128Widths[:code128Stop]
+	for i := 0; i+6 <= len(runs); i += 2 {
+		start := bestMatch(runs[i:i+6], symbols)
+		if start < 103 {
+			continue
+		}
+		values := []int{start}
+		stopped := false
+		for at := i + 6; at+6 <= len(runs); at += 6 {
+			if at+7 <= len(runs) && matchWidths(runs[at:at+7], code128Widths[code128Stop]) < 1.5 {
+				stopped = true
+				break
+			}
+			v := bestMatch(runs[at:at+6], symbols)
+			if v < 0 {
+				break
+			}
+			values = append(values, v)
+		}
+		if !stopped || len(values) < 3 {
+			continue
+		}
+		check := values[0]
+		for n, v := range values[1 : len(values)-1] {
+			check += (n + 1) * v
+		}
+		if check%103 != values[len(values)-1] {
+			continue
+		}
+		if text, ok := code128Text(values[:len(values)-1]); ok {
+			return text, true
+		}
+	}
+	return "", false
+}
+
+// code128Text is the text of the values of a Code 128 without its check symbol, the start
+// symbol first, following the switches between code sets A, B and C.
+func code128Text(values []int) (string, bool) {
+	var b strings.Builder
+	set := "ABC"[values[0]-103]
+	shift := false
+	for _, v := range values[1:] {
+		current := set
+		if shift {
+			current = "BA"[strings.IndexByte("AB", set)]
+			shift = false
+		}
+		switch {
+		case current == 'C' && v < 100:
+			b.WriteByte(byte('0' + v/10))
+			b.WriteByte(byte('0' + v%10))
+		case current != 'C' && v < 64:
+			b.WriteByte(byte(v + 32))
+		case current == 'A' && v < 96:
+			b.WriteByte(byte(v - 64))
+		case current == 'B' && v < 96:
+			b.WriteByte(byte(v + 32))
+		case v == 98 && current != 'C':
+			shift = true
+		case v == 99 && current != 'C':
+			set = 'C'
+		case v == 100 && current != 'B':
+			set = 'B'
+		case v == 101 && current != 'A':
+			set = 'A'
+		case v == 102 || v == 96 || v == 97 || v == 100 || v == 101:
+			// FNC1 to FNC4, nothing to pass on
+		default:
+			return "", false
+		}
+	}
+	return b.String(), b.Len() > 0
+}
+
+// decodeFrame looks for a barcode in a frame, in lines across it and both ways along
+// them.
+func decodeFrame(img *image.Gray) (code, symbology string, ok bool) {
+	b := img.Bounds()
+	line := make([]byte, b.Dx())
+	for n := 0; n < cameraLines; n++ {
+		y := b.Min.Y + (2*n+1)*b.Dy()/(2*cameraLines)
+		copy(line, img.Pix[(y-b.Min.Y)*img.Stride:])
+		for dir := 0; dir < 2; dir++ {
+			if dir == 1 {
+				for i, j := 0, len(line)-1; i < j; i, j = i+1, j-1 {
+					line[i], line[j] = line[j], line[i]
+				}
+			}
+			runs := lineRuns(line)
+			if code, ok := decodeEAN13(runs); ok {
+				return code, "ean", true
+			}
+			if code, ok := decodeCode128(runs); ok {
+				return code, "code128", true
+			}
+		}
+	}
+	return "", "", false
+}
+
+// cameraScanner reads barcodes off a webcam.
+type cameraScanner struct {
+	cfg  CameraConfig
+	name string
+
+	mu       sync.Mutex
+	v        *videoCapture
+	last     string // the barcode passed on last
+	lastSeen time.Time
+}
+
+func openCameraScanner(cfg CameraConfig, name string) (*cameraScanner, error) {
+	v, err := openVideo(cfg.Device, cfg.width(), cfg.height())
+	if err != nil {
+		return nil, err
+	}
+	return &cameraScanner{cfg: cfg, name: name, v: v}, nil
+}
+
+// readScan waits for a barcode to come into sight.
+func (c *cameraScanner) readScan() (Scan, error) {
+	c.mu.Lock()
+	v := c.v
+	c.mu.Unlock()
+	for {
+		img, err := v.frame()
+		if err != nil {
+			return Scan{}, err
+		}
+		code, symbology, ok := decodeFrame(img)
+		if !ok {
+			continue
+		}
+		now := time.Now()
+		if code == c.last && now.Sub(c.lastSeen) < cameraGone {
+			c.lastSeen = now
+			continue
+		}
+		c.last, c.lastSeen = code, now
+		scan := newScan(code, c.name, now)
+		scan.Symbology = symbology
+		return scan, nil
+	}
+}
+
+func (c *cameraScanner) reopen() error {
+	c.close()
+	v, err := openVideo(c.cfg.Device, c.cfg.width(), c.cfg.height())
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.v = v
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *cameraScanner) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.v.close()
+}
+
+// openCameraStation opens the station for a webcam.
+func openCameraStation(profile string, cfg *Config) (*station, error) {
+	name := cfg.Camera.Name
+	if name == "" {
+		name = cfg.Camera.Device
+	}
+	return openSourceStation(profile, cfg, cfg.Camera.Device, name, "camera", func() (scanSource, error) {
+		s, err := openCameraScanner(cfg.Camera, name)
+		if err == nil {
+			slog.Info("Camera streaming", "device", name, "width", s.v.width, "height", s.v.height, "format", fourcc(s.v.format))
+		}
+		return s, err
+	})
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"image"
+	"slices"
+	"testing"
+)
+
+// drawEAN13 draws the bars of an EAN-13 as a line of pixels, module pixels to a module,
+// with a quiet zone either side. It takes the check digit as given, right or not.
+func drawEAN13(code string, module int) []byte {
+	var parity int
+	for p, first := range eanFirstDigits {
+		if first == int(code[0]-'0') {
+			parity = p
+		}
+	}
+	var widths []int // bar first
+	widths = append(widths, 1, 1, 1)
+	for d := 1; d <= 6; d++ {
+		p := eanPatterns[code[d]-'0']
+		if parity&(1<<(6-d)) != 0 {
+			p = [4]int{p[3], p[2], p[1], p[0]}
+		}
+		widths = append(widths, p[:]...)
+	}
+	widths = append(widths, 1, 1, 1, 1, 1)
+	for d := 7; d <= 12; d++ {
+		p := eanPatterns[code[d]-'0']
+		widths = append(widths, p[:]...)
+	}
+	widths = append(widths, 1, 1, 1)
+
+	quiet := make([]byte, 10*module)
+	for i := range quiet {
+		quiet[i] = 230
+	}
+	line := append([]byte(nil), quiet...)
+	for i, w := range widths {
+		shade := byte(230)
+		if i%2 == 0 {
+			shade = 20
+		}
+		for n := 0; n < w*module; n++ {
+			line = append(line, shade)
+		}
+	}
+	return append(line, quiet...)
+}
+
+// frameOf is a frame with line as every row.
+func frameOf(line []byte) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, len(line), 48))
+	for y := 0; y < 48; y++ {
+		copy(img.Pix[y*img.Stride:], line)
+	}
+	return img
+}
+
+func TestCameraEAN13(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		code     string
+		module   int
+		reversed bool // upside down in front of the camera
+		want     string
+	}{
+		{name: "line", code: "4006381333931", module: 2, want: "4006381333931"},
+		{name: "wide", code: "4006381333931", module: 5, want: "4006381333931"},
+		{name: "first digit 0", code: "0036000291452", module: 3, want: "0036000291452"},
+		{name: "reversed", code: "4006381333931", module: 3, reversed: true, want: "4006381333931"},
+		{name: "wrong check digit", code: "4006381333932", module: 3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			line := drawEAN13(tc.code, tc.module)
+			if tc.reversed {
+				slices.Reverse(line)
+			}
+			// Read the one way only, a reversed line is for decodeFrame to turn around.
+			want := tc.want
+			if tc.reversed {
+				want = ""
+			}
+			if code, ok := decodeEAN13(lineRuns(line)); code != want || ok != (want != "") {
+				t.Errorf("line decodes to %q, %v", code, ok)
+			}
+			code, symbology, ok := decodeFrame(frameOf(line))
+			if tc.want == "" {
+				if ok {
+					t.Errorf("frame decodes to %q (%s)", code, symbology)
+				}
+				return
+			}
+			if code != tc.want || symbology != "ean" || !ok {
+				t.Errorf("frame decodes to %q (%s), %v", code, symbology, ok)
+			}
+		})
+	}
+}
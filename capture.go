@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gvalkov/golang-evdev"
+)
+
+// A capture is a recording of a session: every raw input event read from the devices and
+// every scan decoded from them, so a problem seen in the field can be looked at, and played
+// back, later. It is newline delimited JSON, one captureRecord per line, starting with a
+// "start" record. Event records carry the event as the kernel gave it, timestamp included.
+
+const captureVersion = 1
+
+type captureRecord struct {
+	Kind    string        `json:"kind"` // start, event or scan
+	Time    time.Time     `json:"time"` // when we got it
+	Version int           `json:"version,omitempty"`
+	Device  string        `json:"device,omitempty"`
+	Event   *captureEvent `json:"event,omitempty"`
+	Scan    *Scan         `json:"scan,omitempty"`
+}
+
+type captureEvent struct {
+	Sec   int64  `json:"sec"`
+	Usec  int64  `json:"usec"`
+	Type  uint16 `json:"type"`
+	Code  uint16 `json:"code"`
+	Value int32  `json:"value"`
+}
+
+// recorder writes the capture. recording is nil unless a capture was asked for, and its
+// methods do nothing then.
+type recorder struct {
+	path string
+
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+	err error // the first write error, after which we stop recording
+}
+
+var recording *recorder
+
+// setupRecording starts a capture file named after the current time in dir, if dir is set.
+func setupRecording(dir string) error {
+	if dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return fmt.Errorf("record: %v", err)
+	}
+	path := filepath.Join(dir, "usbscanner-"+time.Now().Format("20060102-150405")+".ndjson")
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+	if err != nil {
+		return fmt.Errorf("record: %v", err)
+	}
+	recording = &recorder{path: path, f: f, enc: json.NewEncoder(f)}
+	recording.write(captureRecord{Kind: "start", Time: time.Now(), Version: captureVersion})
+	slog.Info("Recording session", "path", path)
+	return nil
+}
+
+// event records a raw input event read from device.
+func (r *recorder) event(device string, ev *evdev.InputEvent) {
+	if r == nil {
+		return
+	}
+	r.write(captureRecord{Kind: "event", Time: time.Now(), Device: device, Event: &captureEvent{
+		Sec:   int64(ev.Time.Sec),
+		Usec:  int64(ev.Time.Usec),
+		Type:  ev.Type,
+		Code:  ev.Code,
+		Value: ev.Value,
+	}})
+}
+
+// scan records a completed scan, before anything is done with it.
+func (r *recorder) scan(scan Scan) {
+	if r == nil {
+		return
+	}
+	r.write(captureRecord{Kind: "scan", Time: time.Now(), Device: scan.Device, Scan: &scan})
+}
+
+func (r *recorder) write(rec captureRecord) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return
+	}
+	if r.err = r.enc.Encode(rec); r.err != nil {
+		slog.Error("Could not record, stopping the recording", "path", r.path, "error", r.err)
+	}
+}
+
+func (r *recorder) close() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.f.Close(); err != nil && r.err == nil {
+		slog.Warn("Could not close the recording", "path", r.path, "error", err)
+	}
+	r.err = os.ErrClosed
+}
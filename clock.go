@@ -0,0 +1,33 @@
+package main
+
+import "time"
+
+// clock is where processEvents gets the time from and its timers, so that the timeout that
+// completes a scan can be tested with a clock that only moves when told to, rather than
+// with sleeps that fail on a busy machine.
+type clock interface {
+	now() time.Time
+	newTimer(d time.Duration) timer
+}
+
+// timer is the part of time.Timer we use.
+type timer interface {
+	c() <-chan time.Time
+	reset(d time.Duration) bool
+	stop() bool
+}
+
+// systemClock is the real time.
+var systemClock clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) now() time.Time { return time.Now() }
+
+func (realClock) newTimer(d time.Duration) timer { return realTimer{time.NewTimer(d)} }
+
+type realTimer struct{ t *time.Timer }
+
+func (t realTimer) c() <-chan time.Time        { return t.t.C }
+func (t realTimer) reset(d time.Duration) bool { return t.t.Reset(d) }
+func (t realTimer) stop() bool                 { return t.t.Stop() }
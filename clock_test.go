@@ -0,0 +1,209 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gvalkov/golang-evdev"
+)
+
+// fakeClock only moves when advanced, firing the timers that are due then.
+type fakeClock struct {
+	mu     sync.Mutex
+	t      time.Time
+	timers []*fakeTimer
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{t: time.Unix(1700000000, 0)}
+}
+
+func (c *fakeClock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) newTimer(d time.Duration) timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, ch: make(chan time.Time, 1), when: c.t.Add(d), active: true}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+	for _, t := range c.timers {
+		if t.active && !t.when.After(c.t) {
+			t.active = false
+			select {
+			case t.ch <- c.t:
+			default:
+			}
+		}
+	}
+}
+
+type fakeTimer struct {
+	clock  *fakeClock
+	ch     chan time.Time
+	when   time.Time
+	active bool
+}
+
+func (t *fakeTimer) c() <-chan time.Time { return t.ch }
+
+func (t *fakeTimer) reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	was := t.active
+	t.when, t.active = t.clock.t.Add(d), true
+	return was
+}
+
+func (t *fakeTimer) stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	was := t.active
+	t.active = false
+	return was
+}
+
+// eventsHarness runs processEvents on a fake clock. The event channel isn't buffered and
+// processEvents handles one thing at a time, so once sync returns everything sent before it
+// has been handled.
+type eventsHarness struct {
+	t     *testing.T
+	clock *fakeClock
+	live  *liveness
+	event chan evdev.InputEvent
+	scans chan Scan
+	stop  chan struct{}
+}
+
+func newEventsHarness(t *testing.T, timeout time.Duration) *eventsHarness {
+	cfg := defaultConfig()
+	cfg.Timeout.Duration = timeout
+	return startEventsHarness(t, cfg)
+}
+
+func startEventsHarness(t *testing.T, cfg *Config) *eventsHarness {
+	h := &eventsHarness{t: t, clock: newFakeClock(), live: newLiveness(),
+		event: make(chan evdev.InputEvent), scans: make(chan Scan, 8), stop: make(chan struct{})}
+	go processEvents("test", &dispatcher{current: &pipeline{cfg: cfg}}, h.live, h.event, h.scans, overflowBlock, h.clock, h.stop)
+	return h
+}
+
+// press types a key and lets go of it, taking no time.
+func (h *eventsHarness) press(code uint16) {
+	h.event <- evdev.InputEvent{Type: evdev.EV_KEY, Code: code, Value: 1}
+	h.event <- evdev.InputEvent{Type: evdev.EV_KEY, Code: code, Value: 0}
+	h.event <- evdev.InputEvent{Type: evdev.EV_SYN, Code: evdev.SYN_REPORT}
+}
+
+func (h *eventsHarness) sync() {
+	reply := make(chan struct{})
+	h.live.heartbeat <- reply
+	<-reply
+}
+
+// noScan checks that no scan was completed, after letting processEvents catch up.
+func (h *eventsHarness) noScan() {
+	h.t.Helper()
+	h.sync()
+	select {
+	case scan := <-h.scans:
+		h.t.Fatalf("scan %q completed early", scan.Code)
+	default:
+	}
+}
+
+// scan waits for the next scan. The real timeout is only there so a broken test fails
+// rather than hangs.
+func (h *eventsHarness) scan() Scan {
+	h.t.Helper()
+	select {
+	case scan := <-h.scans:
+		return scan
+	case <-time.After(10 * time.Second):
+		h.t.Fatal("no scan completed")
+		return Scan{}
+	}
+}
+
+func TestProcessEventsTimeout(t *testing.T) {
+	h := newEventsHarness(t, 10*time.Millisecond)
+	start := h.clock.now()
+	h.press(evdev.KEY_4)
+	h.clock.advance(6 * time.Millisecond)
+	h.press(evdev.KEY_2)
+	h.sync()
+	// 12ms after the first key but only 6ms after the last one, still coming in.
+	h.clock.advance(6 * time.Millisecond)
+	h.noScan()
+	h.clock.advance(4 * time.Millisecond)
+	scan := h.scan()
+	if scan.Code != "42" {
+		t.Fatalf("scan %q, not 42", scan.Code)
+	}
+	if !scan.Started.Equal(start) || !scan.Time.Equal(start.Add(16*time.Millisecond)) {
+		t.Fatalf("scan started %v and completed %v, not at 0 and 16ms", scan.Started.Sub(start), scan.Time.Sub(start))
+	}
+
+	// The next key starts a scan of its own, stopping completes it right away.
+	h.clock.advance(time.Second)
+	h.event <- evdev.InputEvent{Type: evdev.EV_KEY, Code: evdev.KEY_LEFTSHIFT, Value: 1}
+	h.press(evdev.KEY_A)
+	h.noScan()
+	close(h.stop)
+	if scan := h.scan(); scan.Code != "A" {
+		t.Fatalf("scan %q, not A", scan.Code)
+	}
+	if _, ok := <-h.scans; ok {
+		t.Fatal("scans not closed after stop")
+	}
+}
+
+func TestProcessEventsLostEvents(t *testing.T) {
+	h := newEventsHarness(t, 10*time.Millisecond)
+	h.press(evdev.KEY_1)
+	h.event <- evdev.InputEvent{Type: evdev.EV_SYN, Code: evdev.SYN_DROPPED}
+	h.press(evdev.KEY_2) // the kernel catching up, up to its SYN_REPORT
+	h.press(evdev.KEY_3)
+	h.clock.advance(10 * time.Millisecond)
+	if scan := h.scan(); scan.Code != "3" {
+		t.Fatalf("scan %q, not 3 after losing events", scan.Code)
+	}
+	close(h.stop)
+}
+
+func TestProcessEventsKeypad(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Reader = "keypad"
+	h := startEventsHarness(t, cfg)
+	h.press(evdev.KEY_KP1)
+	h.clock.advance(time.Second) // people take their time
+	h.press(evdev.KEY_KP5)
+	h.press(evdev.KEY_KP9)
+	h.press(evdev.KEY_BACKSPACE)
+	h.press(evdev.KEY_KP2)
+	h.noScan()
+	h.press(evdev.KEY_KPENTER)
+	if scan := h.scan(); scan.Code != "152" || scan.Symbology != "keypad" {
+		t.Fatalf("entry %q of symbology %q, not 152 of keypad", scan.Code, scan.Symbology)
+	}
+
+	// Esc starts over, an entry without Enter is thrown away.
+	h.press(evdev.KEY_KP7)
+	h.press(evdev.KEY_ESC)
+	h.press(evdev.KEY_KPENTER)
+	h.press(evdev.KEY_KP3)
+	h.sync()
+	h.clock.advance(keypadTimeout)
+	h.noScan()
+	close(h.stop)
+}
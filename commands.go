@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// command is a subcommand of usbscanner. Each parses its own flags, with -h for its help,
+// and exits 2 on a usage error.
+type command struct {
+	name    string
+	summary string
+	run     func(args []string)
+}
+
+// commands are the subcommands in the order the help lists them. Without one, usbscanner
+// runs listen, so `usbscanner -config x.toml` keeps working.
+var commands []command
+
+func init() {
+	commands = []command{
+		{"listen", "read the scanners and pass on their scans, the daemon", runListen},
+		{"config", "check a config file before the daemon is started or reloaded with it", runConfig},
+		{"list-devices", "list the input devices and which of them the config takes", runListDevices},
+		{"read-one", "wait for a barcode and print it, for scripts", runReadOne},
+		{"read", "read a batch of scans and print them as JSON or CSV", runRead},
+		{"ctl", "send a command to a running daemon", runCtl},
+		{"top", "dashboard of a running daemon", runTop},
+		{"console", "prompt for the commands of ctl, showing the scans as they come in", runConsole},
+		{"record", "capture the events of a scanner to a file", runRecord},
+		{"replay", "decode a capture again and check its scans", runReplay},
+		{"decode", "show what the decoder makes of keys", runDecode},
+		{"emulate", "make up a scanner that types barcodes", runEmulate},
+		{"generate", "print made up barcodes", runGenerate},
+		{"selftest", "scan a barcode through the whole pipeline", runSelftest},
+		{"loadtest", "send scans at a steady rate through the pipeline", runLoadtest},
+		{"program", "make the programming barcodes for a scanner", runProgram},
+		{"pair", "pair a Bluetooth scanner", runPair},
+		{"service", "install the systemd unit and udev rule", runService},
+		{"audit", "verify an audit log or make its key", runAudit},
+		{"help", "show the help of a command", runHelp},
+	}
+}
+
+// findCommand is the command by its name, nil if there is none.
+func findCommand(name string) *command {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+func usage() {
+	var b strings.Builder
+	b.WriteString("Usage: usbscanner <command> [flags]\n       usbscanner [flags]  (the same as listen)\n\nCommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(&b, "  %-13s %s\n", c.name, c.summary)
+	}
+	b.WriteString("\nRun usbscanner <command> -h for the flags of a command.\n")
+	fmt.Fprint(os.Stderr, b.String())
+}
+
+// runHelp implements `usbscanner help [command]`.
+func runHelp(args []string) {
+	if len(args) == 0 {
+		usage()
+		return
+	}
+	c := findCommand(args[0])
+	if c == nil || c.name == "help" {
+		usage()
+		os.Exit(2)
+	}
+	c.run([]string{"-h"})
+}
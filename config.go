@@ -0,0 +1,862 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/gvalkov/golang-evdev"
+)
+
+// Config holds all runtime settings. It is read from a TOML file given with -config (see
+// usbscanner.example.toml), then environment variables are applied on top, see applyEnv,
+// and finally the command line flags.
+type Config struct {
+	Timeout duration `toml:"timeout"` // inter-character timeout that completes a scan
+	Reader  string   `toml:"reader"`  // scanner, badge for a magstripe badge reader, prox or keypad
+	User    string   `toml:"user"`    // drop to this user once the scanner is open
+	Group   string   `toml:"group"`   // and this group, the user's own by default
+
+	ControlSocket string `toml:"control_socket"`  // unix socket for `usbscanner ctl`, off if empty
+	Lockdown      bool   `toml:"lockdown"`        // no control socket and no SIGHUP reloads
+	HTTPListen    string `toml:"http_listen"`     // address for /metrics, off if empty
+	Pprof         bool   `toml:"pprof"`           // serve /debug/pprof/ on http_listen too
+	PprofToken    string `toml:"pprof_token"`     // bearer token /debug/pprof/ asks for, if set
+	LockDir       string `toml:"lock_dir"`        // where the per-device lock files go
+	Record        string `toml:"record"`          // directory to write a capture of the session to
+	Input         string `toml:"input"`           // device, stdin for a capture piped in, or lines
+	QueueDir      string `toml:"queue_dir"`       // where sinks with queue=disk keep their queues
+	DeadLetterDir string `toml:"dead_letter_dir"` // where sinks put scans they gave up on
+	ImageDir      string `toml:"image_dir"`       // where ctl image saves pictures from the scanner
+	DryRun        bool   `toml:"dry_run"`         // sinks log scans instead of sending them
+
+	Log          LogConfig          `toml:"log"`
+	Tracing      TracingConfig      `toml:"tracing"`
+	Backpressure BackpressureConfig `toml:"backpressure"`
+
+	ShutdownTimeout duration `toml:"shutdown_timeout"` // how long sinks get to deliver queued scans on exit
+	ReadTimeout     duration `toml:"read_timeout"`     // reopen a device nothing was read from for this long, off if 0
+	IdleAfter       duration `toml:"idle_after"`       // put the scanner to sleep once nothing was scanned for this long
+
+	Devices  []DeviceMatcher   `toml:"device"`
+	Serial   SerialConfig      `toml:"serial"` // a scanner on a serial port instead of a device
+	SNAPI    SNAPIConfig       `toml:"snapi"`  // or a Zebra scanner in SNAPI mode
+	HIDPOS   HIDConfig         `toml:"hidpos"` // or a scanner in HID POS mode
+	Hidraw   HIDConfig         `toml:"hidraw"` // or a keyboard read through hidraw
+	PCSC     PCSCConfig        `toml:"pcsc"`   // or a contactless reader through pcscd
+	Scale    HIDConfig         `toml:"scale"`  // or a USB scale
+	Wiegand  WiegandConfig     `toml:"wiegand"`
+	Camera   CameraConfig      `toml:"camera"`
+	Prox     ProxConfig        `toml:"prox"`
+	Keymap   map[string]string `toml:"keymap"`
+	Validate ValidateConfig    `toml:"validate"`
+	Feedback FeedbackConfig    `toml:"feedback"`
+	Params   scannerParams     `toml:"params"` // of the scanner, set when it is attached
+	Dedup    DedupConfig       `toml:"dedup"`
+	Session  SessionConfig     `toml:"session"`
+	Schedule ScheduleConfig    `toml:"schedule"`
+	Tags     map[string]string `toml:"tags"` // tag name to regular expression
+	Sinks    []SinkEntry       `toml:"sink"`
+
+	Profiles []ProfileConfig `toml:"profile"`
+}
+
+// ProfileConfig is a station of its own when one machine serves several: a scanner and
+// everything about its scans, under a name. Timeout and keymap default to the top level
+// ones, the rest is only what the profile says, so profiles never share sinks or rules.
+type ProfileConfig struct {
+	Name     string            `toml:"name"`
+	Timeout  duration          `toml:"timeout"`
+	Reader   string            `toml:"reader"`
+	Devices  []DeviceMatcher   `toml:"device"`
+	Serial   SerialConfig      `toml:"serial"`
+	SNAPI    SNAPIConfig       `toml:"snapi"`
+	HIDPOS   HIDConfig         `toml:"hidpos"`
+	Hidraw   HIDConfig         `toml:"hidraw"`
+	PCSC     PCSCConfig        `toml:"pcsc"`
+	Scale    HIDConfig         `toml:"scale"`
+	Wiegand  WiegandConfig     `toml:"wiegand"`
+	Camera   CameraConfig      `toml:"camera"`
+	Prox     ProxConfig        `toml:"prox"`
+	Keymap   map[string]string `toml:"keymap"`
+	Validate ValidateConfig    `toml:"validate"`
+	Feedback FeedbackConfig    `toml:"feedback"`
+	Params   scannerParams     `toml:"params"`
+	Dedup    DedupConfig       `toml:"dedup"`
+	Session  SessionConfig     `toml:"session"`
+	Schedule ScheduleConfig    `toml:"schedule"`
+	Tags     map[string]string `toml:"tags"`
+	Sinks    []SinkEntry       `toml:"sink"`
+}
+
+// DeviceMatcher picks the input device to use. All fields that are set have to match.
+type DeviceMatcher struct {
+	Name    string `toml:"name"` // substring of the device name
+	Path    string `toml:"path"` // device node, e.g. /dev/input/event3
+	Vendor  uint16 `toml:"vendor"`
+	Product uint16 `toml:"product"`
+
+	Keyboard bool `toml:"keyboard"` // take it even though it looks like a keyboard, see keyboard.go
+}
+
+// ValidateConfig has the rules a scan has to pass before it is sent anywhere.
+type ValidateConfig struct {
+	Pattern   string `toml:"pattern"` // regular expression the code has to match
+	MinLength int    `toml:"min_length"`
+	MaxLength int    `toml:"max_length"`
+
+	// CheckDigit rejects GTINs, codes of 8, 12, 13 or 14 digits, whose check digit is wrong.
+	CheckDigit bool `toml:"check_digit"`
+
+	// Taken off the code before it is checked and passed on, e.g. what a scanner was set up
+	// to send before and after every barcode.
+	StripPrefix string `toml:"strip_prefix"`
+	StripSuffix string `toml:"strip_suffix"`
+}
+
+// DedupConfig suppresses repeats of a scan, see dedup. Off unless window or last is set.
+type DedupConfig struct {
+	Window    duration `toml:"window"`     // the same code within this long is a repeat
+	Last      int      `toml:"last"`       // the same code as one of this many scans before is a repeat
+	PerDevice bool     `toml:"per_device"` // only count repeats from the same device
+	Action    string   `toml:"action"`     // drop repeats, or tag them "duplicate"
+	File      string   `toml:"file"`       // keep the scans in this file, so they count across restarts
+}
+
+// SessionConfig pairs scans with the badge of the operator scanned before them, see
+// session.go.
+type SessionConfig struct {
+	Window   duration `toml:"window"`   // the session ends once nothing was scanned for this long, off if 0
+	Group    string   `toml:"group"`    // profiles with the same group share the session, by default each has its own
+	Operator string   `toml:"operator"` // scans with this tag are badges too, e.g. barcodes on ID cards
+	Unpaired string   `toml:"unpaired"` // pass, drop or tag "unpaired" the scans made without a session
+}
+
+// LogConfig sets up logging. Output is stderr, journal or a file to append to.
+type LogConfig struct {
+	Level  string `toml:"level"`  // debug, info, warn or error
+	Format string `toml:"format"` // text or json
+	Output string `toml:"output"`
+}
+
+// TracingConfig sends traces to an OpenTelemetry collector. Both fall back to the standard
+// OTEL_EXPORTER_OTLP_ENDPOINT and OTEL_SERVICE_NAME.
+type TracingConfig struct {
+	Endpoint    string `toml:"endpoint"` // OTLP/HTTP traces URL, e.g. http://localhost:4318/v1/traces
+	ServiceName string `toml:"service_name"`
+}
+
+// BackpressureConfig says what happens when the station's queues fill up, see
+// overflowPolicy: block (the default), drop-oldest or drop-newest. Sinks have an overflow
+// option for their queues.
+type BackpressureConfig struct {
+	Events string `toml:"events"` // raw input events waiting to be decoded
+	Scans  string `toml:"scans"`  // completed scans waiting for the pipeline
+}
+
+// SerialConfig is a scanner in serial mode, on an RS-232 port or as a USB CDC-ACM device,
+// which sends whole scans over its protocol: ssi for Zebra's Simple Serial Interface, or
+// raw for the characters of the barcode as they are, ended by the suffix. A scanner paired
+// over Bluetooth as a serial port is given by its address instead of a port.
+type SerialConfig struct {
+	Port      string  `toml:"port"`      // e.g. /dev/ttyACM0
+	Bluetooth string  `toml:"bluetooth"` // or the address of the scanner, e.g. 00:11:22:33:44:55
+	Channel   int     `toml:"channel"`   // its RFCOMM channel, 1 if not set
+	Baud      int     `toml:"baud"`      // 9600 if not set
+	DataBits  int     `toml:"data_bits"` // 8 if not set, or 7
+	Parity    string  `toml:"parity"`    // none if not set, even or odd
+	StopBits  int     `toml:"stop_bits"` // 1 if not set, or 2
+	RTSCTS    bool    `toml:"rtscts"`    // hardware flow control
+	HostAck   bool    `toml:"host_ack"`  // ssi: ACK decode data only once the scan passed validation
+	Protocol  string  `toml:"protocol"`
+	Prefix    string  `toml:"prefix"` // raw: taken off the start of scans that have it
+	Suffix    *string `toml:"suffix"` // raw: ends a scan, CR or LF if not set, "" for the timeout only
+	Name      string  `toml:"name"`   // device name of its scans, the port by default
+}
+
+func (c SerialConfig) enabled() bool { return c.Port != "" || c.Bluetooth != "" }
+
+// open opens the scanner's port, or connects to it over Bluetooth.
+func (c SerialConfig) open() (*os.File, error) {
+	if c.Bluetooth != "" {
+		return dialRFCOMM(c.Bluetooth, max(c.Channel, 1))
+	}
+	return openSerial(c)
+}
+
+// FeedbackConfig signals on the scanner whether a scan passed validation, see feedback.go.
+// Beeps are beep codes, LED the time the LED is lit for.
+type FeedbackConfig struct {
+	GoodBeep *int     `toml:"good_beep"`
+	BadBeep  *int     `toml:"bad_beep"`
+	GoodLED  duration `toml:"good_led"`
+	BadLED   duration `toml:"bad_led"`
+	HIDLED   string   `toml:"hid_led"` // the keyboard LED to use for a scanner in keyboard mode
+}
+
+// SNAPIConfig is a Zebra scanner in SNAPI mode, its USB mode for Zebra's own software, found
+// by its USB product ID among the hidraw devices, or at path.
+type SNAPIConfig struct {
+	Product int    `toml:"product"` // e.g. 0x1900
+	Path    string `toml:"path"`    // e.g. /dev/hidraw2, instead of looking by product
+	Name    string `toml:"name"`    // device name of its scans, the one the scanner reports by default
+}
+
+func (c SNAPIConfig) enabled() bool { return c.Product != 0 || c.Path != "" }
+
+// PCSCConfig is a contactless card reader run by pcscd, the first one with reader in its
+// name, see pcsc.go.
+type PCSCConfig struct {
+	Reader string `toml:"reader"` // e.g. ACR122
+	Socket string `toml:"socket"` // pcscd's, /run/pcscd/pcscd.comm if not set
+	Name   string `toml:"name"`   // device name of its scans, the reader's name by default
+}
+
+func (c PCSCConfig) enabled() bool { return c.Reader != "" }
+
+// WiegandConfig is an access control reader with its D0 and D1 on two lines of a GPIO chip,
+// see wiegand.go.
+type WiegandConfig struct {
+	Chip string `toml:"chip"` // e.g. /dev/gpiochip0
+	D0   int    `toml:"d0"`   // offsets of the lines on the chip
+	D1   int    `toml:"d1"`
+	Name string `toml:"name"` // device name of its scans, wiegand by default
+}
+
+func (c WiegandConfig) enabled() bool { return c.Chip != "" }
+
+// ProxConfig is how a proximity card reader with reader = "prox" types a card, see prox.go.
+type ProxConfig struct {
+	Format   string `toml:"format"`   // decimal, hex, or wiegand for the facility code and card number
+	Reverse  bool   `toml:"reverse"`  // the ID is typed least significant byte first
+	Facility bool   `toml:"facility"` // take the facility code and card number out of the ID
+}
+
+// CameraConfig is a webcam to read barcodes off, see camera.go.
+type CameraConfig struct {
+	Device string `toml:"device"` // e.g. /dev/video0
+	Width  int    `toml:"width"`  // of the frames, 640 by 480 if not set, the camera may pick others
+	Height int    `toml:"height"`
+	Name   string `toml:"name"` // device name of its scans, device by default
+}
+
+func (c CameraConfig) enabled() bool { return c.Device != "" }
+
+func (c CameraConfig) width() int {
+	if c.Width > 0 {
+		return c.Width
+	}
+	return 640
+}
+
+func (c CameraConfig) height() int {
+	if c.Height > 0 {
+		return c.Height
+	}
+	return 480
+}
+
+// HIDConfig is a scanner read through hidraw: the first hidraw device with the vendor and
+// product IDs that are set whose reports fit, decoded data for a scanner in the USB HID
+// Point of Sale mode, keys for a keyboard or weights for a scale, or the one at path.
+type HIDConfig struct {
+	Vendor  int    `toml:"vendor"`
+	Product int    `toml:"product"`
+	Path    string `toml:"path"`
+	Name    string `toml:"name"` // device name of its scans, the one the scanner reports by default
+}
+
+func (c HIDConfig) enabled() bool { return c.Vendor != 0 || c.Product != 0 || c.Path != "" }
+
+// ScheduleConfig restricts scanning to active hours, see parseWindow for the format of the
+// windows.
+type ScheduleConfig struct {
+	Windows   []string `toml:"windows"`
+	Outside   string   `toml:"outside"`    // what to do with scans outside the windows: drop or queue
+	MaxQueued int      `toml:"max_queued"` // scans held with outside = "queue" before dropping the oldest
+}
+
+// SinkEntry configures one sink, see -sink, -sink-opt, -template and -route for what the
+// fields mean. Options may be given as any TOML value, they are passed on as strings.
+type SinkEntry struct {
+	Name     string                 `toml:"name"`
+	Type     string                 `toml:"type"`
+	Arg      string                 `toml:"arg"`
+	Template string                 `toml:"template"`
+	Options  map[string]interface{} `toml:"options"`
+	Routes   []RouteEntry           `toml:"route"`
+}
+
+// RouteEntry is a single routing rule of a sink.
+type RouteEntry struct {
+	Device    string `toml:"device"`
+	Class     string `toml:"class"`
+	Symbology string `toml:"symbology"`
+	Tag       string `toml:"tag"`
+	Match     string `toml:"match"`
+}
+
+// duration lets durations be written as strings like "10ms" in the config file.
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+func (d duration) MarshalText() ([]byte, error) {
+	return []byte(d.Duration.String()), nil
+}
+
+// defaultConfig is what we run with if there is no config file, matching what the tool did
+// before it had one.
+func defaultConfig() *Config {
+	return &Config{
+		Timeout:  duration{timerDuration},
+		LockDir:  defaultLockDir,
+		QueueDir: "/var/lib/usbscanner/queue",
+
+		DeadLetterDir: "/var/lib/usbscanner/dead-letter",
+		Devices:       []DeviceMatcher{{Name: "Symbol Technologies"}},
+
+		ShutdownTimeout: duration{5 * time.Second},
+	}
+}
+
+// loadConfig reads a config file over the defaults. Keys we don't know about are an error,
+// since a typo would otherwise silently leave a setting at its default.
+func loadConfig(path string) (*Config, error) {
+	cfg := defaultConfig()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// Devices from the file replace the default matcher rather than adding to it.
+	cfg.Devices = nil
+	md, err := toml.Decode(string(data), cfg)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		keys := make([]string, len(undecoded))
+		for i, k := range undecoded {
+			keys[i] = k.String()
+		}
+		return nil, fmt.Errorf("%s: unknown settings %s", path, strings.Join(keys, ", "))
+	}
+	if len(cfg.Profiles) > 0 && (len(cfg.Devices) > 0 || len(cfg.Sinks) > 0) {
+		return nil, fmt.Errorf("%s: with profiles, devices and sinks go into the profiles", path)
+	}
+	matchers := cfg.Devices
+	for _, p := range cfg.Profiles {
+		matchers = append(matchers, p.Devices...)
+	}
+	for _, m := range matchers {
+		if err := m.checkKeyboard(); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	seen := map[string]bool{}
+	for _, p := range cfg.Profiles {
+		if p.Name == "" {
+			return nil, fmt.Errorf("%s: profile without a name", path)
+		}
+		if seen[p.Name] {
+			return nil, fmt.Errorf("%s: profile %s defined twice", path, p.Name)
+		}
+		seen[p.Name] = true
+		if len(p.Devices) == 0 && !p.Serial.enabled() && !p.SNAPI.enabled() && !p.HIDPOS.enabled() && !p.Hidraw.enabled() && !p.PCSC.enabled() && !p.Scale.enabled() && !p.Wiegand.enabled() && !p.Camera.enabled() {
+			return nil, fmt.Errorf("%s: profile %s has no devices", path, p.Name)
+		}
+	}
+	if len(cfg.Devices) == 0 {
+		cfg.Devices = defaultConfig().Devices
+	}
+	return cfg, nil
+}
+
+// setupConfig puts together the configuration from the file at path (if any), the
+// environment and the command line flags.
+func setupConfig(path string, flags *cmdlineFlags) (*Config, error) {
+	cfg := defaultConfig()
+	if path != "" {
+		var err error
+		if cfg, err = loadConfig(path); err != nil {
+			return nil, err
+		}
+	}
+	if err := cfg.applyEnv(os.Environ()); err != nil {
+		return nil, err
+	}
+	if len(cfg.Profiles) > 0 && flags.sinkFlags() {
+		return nil, errors.New("sink flags can't be used with profiles, configure the sinks in the profiles")
+	}
+	if len(cfg.Profiles) > 0 && flags.filters.set() {
+		return nil, errors.New("filter flags can't be used with profiles, set [validate] in the profiles")
+	}
+	if err := flags.apply(cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// profileNames lists the configured profiles, or just "" for the top level configuration if
+// there are none.
+func (cfg *Config) profileNames() []string {
+	if len(cfg.Profiles) == 0 {
+		return []string{""}
+	}
+	names := make([]string, len(cfg.Profiles))
+	for i, p := range cfg.Profiles {
+		names[i] = p.Name
+	}
+	return names
+}
+
+// profile returns the configuration a profile's station runs with. The empty name stands for
+// the top level configuration when there are no profiles.
+func (cfg *Config) profile(name string) (*Config, error) {
+	if name == "" {
+		if len(cfg.Profiles) > 0 {
+			return nil, errors.New("profiles were added, that needs a restart")
+		}
+		return cfg, nil
+	}
+	for _, p := range cfg.Profiles {
+		if p.Name != name {
+			continue
+		}
+		c := *cfg
+		c.Profiles = nil
+		if p.Timeout.Duration != 0 {
+			c.Timeout = p.Timeout
+		}
+		if p.Keymap != nil {
+			c.Keymap = p.Keymap
+		}
+		c.Reader = p.Reader
+		c.Devices = p.Devices
+		c.Serial = p.Serial
+		c.SNAPI = p.SNAPI
+		c.HIDPOS = p.HIDPOS
+		c.Hidraw = p.Hidraw
+		c.PCSC = p.PCSC
+		c.Scale = p.Scale
+		c.Wiegand = p.Wiegand
+		c.Camera = p.Camera
+		c.Prox = p.Prox
+		c.Validate = p.Validate
+		c.Feedback = p.Feedback
+		c.Params = p.Params
+		c.Dedup = p.Dedup
+		c.Session = p.Session
+		if c.Session.Group == "" {
+			c.Session.Group = p.Name
+		}
+		c.Schedule = p.Schedule
+		c.Tags = p.Tags
+		c.Sinks = p.Sinks
+		c.QueueDir = filepath.Join(cfg.QueueDir, p.Name)
+		c.DeadLetterDir = filepath.Join(cfg.DeadLetterDir, p.Name)
+		if len(c.Sinks) == 0 {
+			c.Sinks = []SinkEntry{{Name: "stdout", Type: "stdout"}}
+		}
+		return &c, nil
+	}
+	return nil, fmt.Errorf("no profile %s anymore, removing profiles needs a restart", name)
+}
+
+var nonAlnum = regexp.MustCompile(`[^A-Za-z0-9]+`)
+
+// envName turns a sink name into the form used in environment variables.
+func envName(name string) string {
+	return strings.ToUpper(nonAlnum.ReplaceAllString(name, "_"))
+}
+
+// applyEnv overrides settings from the environment, which is handy for containers and for
+// keeping secrets out of config files:
+//
+//	USBSCANNER_TIMEOUT                   inter-character timeout, e.g. 20ms
+//	USBSCANNER_USER, USBSCANNER_GROUP    user and group to run as after opening the scanner
+//	USBSCANNER_LOCKDOWN                  true to turn off local control, see lockdown
+//	USBSCANNER_LOG_LEVEL, ..._FORMAT, ..._OUTPUT
+//	                                     see [log]
+//	USBSCANNER_DEVICE                    use the device whose name contains this
+//	USBSCANNER_VALIDATE_PATTERN          see [validate]
+//	USBSCANNER_VALIDATE_MIN_LENGTH
+//	USBSCANNER_VALIDATE_MAX_LENGTH
+//	USBSCANNER_SINK_<NAME>_ARG           argument of the sink called <name>
+//	USBSCANNER_SINK_<NAME>_OPT_<OPTION>  option of that sink, e.g. ..._OPT_TOKEN
+//	USBSCANNER_PROFILE_<PROFILE>_SINK_<NAME>_ARG, ..._OPT_<OPTION>
+//	                                     the same for the sinks of a profile
+func (cfg *Config) applyEnv(environ []string) error {
+	env := map[string]string{}
+	for _, kv := range environ {
+		if k, v, ok := strings.Cut(kv, "="); ok && strings.HasPrefix(k, "USBSCANNER_") {
+			env[k] = v
+		}
+	}
+	var err error
+	if v, ok := env["USBSCANNER_TIMEOUT"]; ok {
+		if cfg.Timeout.Duration, err = time.ParseDuration(v); err != nil {
+			return fmt.Errorf("USBSCANNER_TIMEOUT: %v", err)
+		}
+	}
+	if v, ok := env["USBSCANNER_USER"]; ok {
+		cfg.User = v
+	}
+	if v, ok := env["USBSCANNER_GROUP"]; ok {
+		cfg.Group = v
+	}
+	for key, field := range map[string]*string{
+		"USBSCANNER_LOG_LEVEL":   &cfg.Log.Level,
+		"USBSCANNER_LOG_FORMAT":  &cfg.Log.Format,
+		"USBSCANNER_LOG_OUTPUT":  &cfg.Log.Output,
+		"USBSCANNER_RECORD":      &cfg.Record,
+		"USBSCANNER_INPUT":       &cfg.Input,
+		"USBSCANNER_PPROF_TOKEN": &cfg.PprofToken,
+	} {
+		if v, ok := env[key]; ok {
+			*field = v
+		}
+	}
+	if v, ok := env["USBSCANNER_LOCKDOWN"]; ok {
+		if cfg.Lockdown, err = strconv.ParseBool(v); err != nil {
+			return fmt.Errorf("USBSCANNER_LOCKDOWN: %v", err)
+		}
+	}
+	if v, ok := env["USBSCANNER_DEVICE"]; ok {
+		cfg.Devices = []DeviceMatcher{{Name: v}}
+	}
+	if v, ok := env["USBSCANNER_VALIDATE_PATTERN"]; ok {
+		cfg.Validate.Pattern = v
+	}
+	for key, field := range map[string]*int{
+		"USBSCANNER_VALIDATE_MIN_LENGTH": &cfg.Validate.MinLength,
+		"USBSCANNER_VALIDATE_MAX_LENGTH": &cfg.Validate.MaxLength,
+	} {
+		if v, ok := env[key]; ok {
+			if *field, err = strconv.Atoi(v); err != nil {
+				return fmt.Errorf("%s: %v", key, err)
+			}
+		}
+	}
+	applySinkEnv(env, "USBSCANNER_SINK_", cfg.Sinks)
+	for _, p := range cfg.Profiles {
+		applySinkEnv(env, "USBSCANNER_PROFILE_"+envName(p.Name)+"_SINK_", p.Sinks)
+	}
+	return nil
+}
+
+// applySinkEnv sets the arguments and options of sinks from <prefix><NAME>_ARG and
+// <prefix><NAME>_OPT_<OPTION>.
+func applySinkEnv(env map[string]string, prefix string, sinks []SinkEntry) {
+	for i := range sinks {
+		s := &sinks[i]
+		prefix := prefix + envName(s.sinkName()) + "_"
+		if v, ok := env[prefix+"ARG"]; ok {
+			s.Arg = v
+		}
+		for k, v := range env {
+			if opt, ok := strings.CutPrefix(k, prefix+"OPT_"); ok {
+				if s.Options == nil {
+					s.Options = map[string]interface{}{}
+				}
+				s.Options[strings.ToLower(opt)] = v
+			}
+		}
+	}
+}
+
+// sinkName is what the sink is called: its name, or without one its type, as setupSinks
+// calls it.
+func (e *SinkEntry) sinkName() string {
+	if e.Name == "" {
+		return e.Type
+	}
+	return e.Name
+}
+
+// sinkByName finds a configured sink by the name setupSinks gives it, or nil.
+func (cfg *Config) sinkByName(name string) *SinkEntry {
+	for i := range cfg.Sinks {
+		if cfg.Sinks[i].sinkName() == name {
+			return &cfg.Sinks[i]
+		}
+	}
+	return nil
+}
+
+// tagRules compiles the tags, sorted by name so scans always get their tags in the same order.
+func (cfg *Config) tagRules() ([]tagRule, error) {
+	var names []string
+	for name := range cfg.Tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var rules []tagRule
+	for _, name := range names {
+		re, err := regexp.Compile(cfg.Tags[name])
+		if err != nil {
+			return nil, fmt.Errorf("tag %s: %v", name, err)
+		}
+		rules = append(rules, tagRule{tag: name, re: re})
+	}
+	return rules, nil
+}
+
+// matches checks a device against the matcher.
+func (m DeviceMatcher) matches(dev *evdev.InputDevice) bool {
+	if !m.Keyboard && looksLikeKeyboard(dev) {
+		return false
+	}
+	if m.Name != "" && !strings.Contains(dev.Name, m.Name) {
+		return false
+	}
+	if m.Path != "" && m.Path != dev.Fn {
+		return false
+	}
+	if m.Vendor != 0 && m.Vendor != dev.Vendor {
+		return false
+	}
+	if m.Product != 0 && m.Product != dev.Product {
+		return false
+	}
+	return true
+}
+
+// findDevice returns the first input device matching any of the matchers.
+func (cfg *Config) findDevice(devices []*evdev.InputDevice) *evdev.InputDevice {
+	for _, dev := range devices {
+		for _, m := range cfg.Devices {
+			if m.matches(dev) {
+				return dev
+			}
+		}
+	}
+	return nil
+}
+
+// cmdlineFlags are the sink settings that can also be given on the command line. They are
+// applied after the config file and environment and add to what is configured there.
+type cmdlineFlags struct {
+	sinks     listFlag
+	options   listFlag
+	routes    listFlag
+	tags      listFlag
+	templates listFlag
+	filters   filterFlags
+	format    string
+	fifo      string
+	lockdown  bool
+	record    string
+	input     string
+	pprof     bool
+	dryRun    bool
+	tui       bool
+
+	// How much is logged: -q only errors, -v operational info, -vv everything.
+	quiet, verbose, debug bool
+}
+
+func (f *cmdlineFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.fifo, "fifo", "", "also write scans line-by-line to this named pipe (created if missing)")
+	fs.Var(&f.sinks, "sink", "add a sink as name=type:arg, e.g. items=fifo:/tmp/items (repeatable)")
+	fs.Var(&f.options, "sink-opt", "set a sink option, as sink:key=value (repeatable)")
+	fs.Var(&f.routes, "route", "only send matching scans to a sink, as sink:device=..,class=..,symbology=..,tag=..,match=regex (repeatable)")
+	fs.Var(&f.templates, "template", "format a sink's output with a Go template, as sink=template (repeatable)")
+	fs.StringVar(&f.format, "format", "", "what stdout prints for a scan: raw, json, csv, or template for the -template without a sink")
+	fs.Var(&f.tags, "tag", "tag scans matching a regex, as tag=regex (repeatable)")
+	fs.BoolVar(&f.lockdown, "lockdown", false, "no control socket and no reloads through SIGHUP, only scanning")
+	fs.StringVar(&f.record, "record", "", "record raw input events and scans to a capture file in this directory")
+	fs.StringVar(&f.input, "input", "", "where events come from: device (the default), stdin for a capture piped in, or lines for codes typed on stdin")
+	fs.BoolVar(&f.pprof, "pprof", false, "serve profiles at /debug/pprof/ on the HTTP listener")
+	fs.BoolVar(&f.dryRun, "dry-run", false, "run everything but only log what the sinks would send, as dry_run = true")
+	fs.BoolVar(&f.tui, "tui", false, "show the scans on the terminal as a list to scroll through, instead of printing them")
+	fs.BoolVar(&f.quiet, "q", false, "log only errors, so the terminal shows nothing but the scans")
+	fs.BoolVar(&f.verbose, "v", false, "log what the daemon does, as level = \"info\", over a quieter level in the config")
+	fs.BoolVar(&f.debug, "vv", false, "log everything, every scan included, as level = \"debug\"")
+	f.filters.register(fs)
+}
+
+// filterFlags are the [validate] rules as flags, for a quick setup without a config file.
+type filterFlags struct {
+	match                    string
+	minLength, maxLength     int
+	stripPrefix, stripSuffix string
+}
+
+func (f *filterFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.match, "match", "", "only take codes matching this regular expression, as [validate] pattern")
+	fs.IntVar(&f.minLength, "min-length", 0, "only take codes of at least this many characters")
+	fs.IntVar(&f.maxLength, "max-length", 0, "only take codes of at most this many characters")
+	fs.StringVar(&f.stripPrefix, "strip-prefix", "", "take this off the start of codes that have it, before the checks")
+	fs.StringVar(&f.stripSuffix, "strip-suffix", "", "take this off the end of codes that have it, before the checks")
+}
+
+// set checks whether any of the filter flags were given.
+func (f *filterFlags) set() bool {
+	return *f != filterFlags{}
+}
+
+// apply overrides the rules of v with the flags that were given.
+func (f *filterFlags) apply(v *ValidateConfig) {
+	if f.match != "" {
+		v.Pattern = f.match
+	}
+	if f.minLength != 0 {
+		v.MinLength = f.minLength
+	}
+	if f.maxLength != 0 {
+		v.MaxLength = f.maxLength
+	}
+	if f.stripPrefix != "" {
+		v.StripPrefix = f.stripPrefix
+	}
+	if f.stripSuffix != "" {
+		v.StripSuffix = f.stripSuffix
+	}
+}
+
+// sinkFlags checks whether any of the flags about sinks were given.
+func (f *cmdlineFlags) sinkFlags() bool {
+	return len(f.sinks)+len(f.options)+len(f.routes)+len(f.templates) > 0 || f.fifo != "" || f.format != ""
+}
+
+// apply adds the flags to the configuration. Sinks are given as "name=type:arg", or just
+// "type:arg" in which case the type doubles as the name. Options, routes and templates refer
+// to sinks by name and may also refer to sinks from the config file.
+func (f *cmdlineFlags) apply(cfg *Config) error {
+	if f.lockdown {
+		cfg.Lockdown = true
+	}
+	if f.record != "" {
+		cfg.Record = f.record
+	}
+	if f.input != "" {
+		cfg.Input = f.input
+	}
+	switch {
+	case f.quiet && (f.verbose || f.debug || debugEvents):
+		return fmt.Errorf("-q doesn't go with -v, -vv or -debug-events")
+	case f.quiet:
+		cfg.Log.Level = "error"
+	case f.debug || debugEvents: // the events are logged at debug
+		cfg.Log.Level = "debug"
+	case f.verbose:
+		cfg.Log.Level = "info"
+	}
+	if f.tui && (cfg.Input == "stdin" || cfg.Input == "lines") {
+		return fmt.Errorf("-tui reads keys from stdin, so the input can't come from it too")
+	}
+	if f.pprof {
+		cfg.Pprof = true
+	}
+	if f.dryRun {
+		cfg.DryRun = true
+	}
+	f.filters.apply(&cfg.Validate)
+	// Without any sinks configured we keep the old behaviour of printing to the terminal.
+	if len(cfg.Sinks) == 0 && len(f.sinks) == 0 {
+		cfg.Sinks = append(cfg.Sinks, SinkEntry{Name: "stdout", Type: "stdout"})
+	}
+	specs := f.sinks
+	if f.fifo != "" {
+		specs = append(specs, "fifo:"+f.fifo)
+	}
+	for _, spec := range specs {
+		name, def, ok := strings.Cut(spec, "=")
+		if !ok || strings.Contains(name, ":") {
+			def = spec
+			name, _, _ = strings.Cut(spec, ":")
+		}
+		if cfg.sinkByName(name) != nil {
+			return fmt.Errorf("sink %s defined twice", name)
+		}
+		e := SinkEntry{Name: name}
+		e.Type, e.Arg, _ = strings.Cut(def, ":")
+		cfg.Sinks = append(cfg.Sinks, e)
+	}
+	stdout := cfg.sinkByName("stdout")
+	switch f.format {
+	case "":
+	case "raw", "json", "csv", "template":
+		if stdout == nil {
+			return fmt.Errorf("-format is for the stdout sink, and there is none")
+		}
+		if f.format != "template" {
+			if stdout.Options == nil {
+				stdout.Options = map[string]interface{}{}
+			}
+			stdout.Options["format"] = f.format
+		}
+	default:
+		return fmt.Errorf("format should be raw, json, csv or template, not %q", f.format)
+	}
+	for _, spec := range f.options {
+		name, opt, _ := strings.Cut(spec, ":")
+		key, value, ok := strings.Cut(opt, "=")
+		if !ok {
+			return fmt.Errorf("sink option %q should look like sink:key=value", spec)
+		}
+		e := cfg.sinkByName(name)
+		if e == nil {
+			return fmt.Errorf("option for unknown sink %s", name)
+		}
+		if e.Options == nil {
+			e.Options = map[string]interface{}{}
+		}
+		e.Options[key] = value
+	}
+	for _, spec := range f.routes {
+		name, r, err := parseRoute(spec)
+		if err != nil {
+			return err
+		}
+		e := cfg.sinkByName(name)
+		if e == nil {
+			return fmt.Errorf("route for unknown sink %s", name)
+		}
+		e.Routes = append(e.Routes, r)
+	}
+	for _, spec := range f.templates {
+		name, text, ok := strings.Cut(spec, "=")
+		e := cfg.sinkByName(name)
+		if f.format == "template" && (!ok || e == nil) {
+			// Not for a sink, so for stdout.
+			e, text = stdout, spec
+		}
+		if !ok && e == nil {
+			return fmt.Errorf("template %q should look like sink=template", spec)
+		}
+		if e == nil {
+			return fmt.Errorf("template for unknown sink %s", name)
+		}
+		e.Template = text
+	}
+	if f.format == "template" && stdout.Template == "" {
+		return fmt.Errorf("-format template needs a -template")
+	}
+	for _, spec := range f.tags {
+		tag, expr, ok := strings.Cut(spec, "=")
+		if !ok || tag == "" {
+			return fmt.Errorf("tag %q should look like name=regex", spec)
+		}
+		if cfg.Tags == nil {
+			cfg.Tags = map[string]string{}
+		}
+		cfg.Tags[tag] = expr
+	}
+	return nil
+}
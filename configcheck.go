@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// runConfig implements `usbscanner config`, of which there is only check so far.
+func runConfig(args []string) {
+	if len(args) == 0 || args[0] != "check" {
+		fmt.Fprintf(os.Stderr, "Usage: usbscanner config check [-config path] [path]\n")
+		if len(args) > 0 && (args[0] == "-h" || args[0] == "-help" || args[0] == "--help") {
+			return
+		}
+		os.Exit(2)
+	}
+	runConfigCheck(args[1:])
+}
+
+// runConfigCheck implements `usbscanner config check`, which checks a config file the way
+// the daemon would take it, before it is started or reloaded with it: the TOML itself, the
+// settings it doesn't know, and then for every profile the validation rules, tags,
+// schedule, session and dedup, and every sink with its options, URL, template and routes.
+// It reports all the errors it finds, each with the line of the file it is about, where
+// that can be told, and exits 1 if there were any.
+func runConfigCheck(args []string) {
+	fs := flag.NewFlagSet("config check", flag.ExitOnError)
+	configPath := fs.String("config", os.Getenv("USBSCANNER_CONFIG"), "the TOML file to check")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: usbscanner config check [-config path] [path]\n\nThe environment is applied to the file as for the daemon. Sinks are set up in dry run, so nothing is sent, but file, fifo and audit sinks open their files.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	switch fs.NArg() {
+	case 0:
+	case 1:
+		*configPath = fs.Arg(0)
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *configPath == "" {
+		fmt.Fprintln(os.Stderr, "Which config? Give its path, or -config")
+		os.Exit(2)
+	}
+	errs := checkConfig(*configPath)
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if len(errs) > 0 {
+		os.Exit(1)
+	}
+	fmt.Printf("%s: ok\n", *configPath)
+}
+
+// checkConfig is every error of the config file at path, each as path:line: message.
+func checkConfig(path string) []error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return []error{err}
+	}
+	lines := newConfigLines(string(data))
+	at := func(line int, err error) error {
+		if line == 0 {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		return fmt.Errorf("%s:%d: %v", path, line, err)
+	}
+
+	// The TOML, and keys that are misspelt or in the wrong table, rather than only the first
+	// of them as loadConfig reports it.
+	cfg := defaultConfig()
+	cfg.Devices = nil
+	md, err := toml.Decode(string(data), cfg)
+	var perr toml.ParseError
+	if errors.As(err, &perr) {
+		msg := perr.Message
+		if perr.Usage != "" {
+			msg += "\n" + perr.Usage
+		}
+		return []error{fmt.Errorf("%s:%d:%d: %s", path, perr.Position.Line, perr.Position.Col, msg)}
+	} else if err != nil {
+		return []error{at(0, err)}
+	}
+	var errs []error
+	unknown := map[string]bool{}
+	for _, k := range md.Undecoded() {
+		unknown[k.String()] = true
+		if unknown[k[:len(k)-1].String()] {
+			continue // within an unknown table, which says it
+		}
+		table, key := strings.Join(k[:len(k)-1], "."), k[len(k)-1]
+		errs = append(errs, at(lines.find(table, "", key, 0), fmt.Errorf("unknown setting %s", k)))
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+
+	// The rest of what loadConfig checks, with the environment on top as for the daemon.
+	cfg, err = setupConfig(path, &cmdlineFlags{})
+	if err != nil {
+		return []error{err}
+	}
+	switch cfg.Input {
+	case "", "device", "stdin", "lines":
+	default:
+		errs = append(errs, at(lines.find("", "", "input", 0), fmt.Errorf("input should be device, stdin or lines, not %q", cfg.Input)))
+	}
+	if err := setLogLevel(cfg.Log.Level); err != nil {
+		errs = append(errs, at(lines.find("log", "", "level", 0), err))
+	}
+	if f := cfg.Log.Format; f != "" && f != "text" && f != "json" {
+		errs = append(errs, at(lines.find("log", "", "format", 0), fmt.Errorf("log: unknown format %q, use text or json", f)))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, name := range cfg.profileNames() {
+		pcfg, err := cfg.profile(name)
+		if err != nil {
+			errs = append(errs, at(0, err))
+			continue
+		}
+		prefix, after := "", 0
+		if name != "" {
+			prefix, after = "profile.", lines.find("profile", name, "", 0)
+		}
+		inProfile := func(err error) error {
+			if name != "" {
+				return fmt.Errorf("profile %s: %v", name, err)
+			}
+			return err
+		}
+
+		// Each part of the pipeline on its own, so each gets its errors, and the sinks one
+		// at a time, in dry run.
+		check := func(table, key string, err error) {
+			if err == nil {
+				return
+			}
+			if words := strings.Fields(err.Error()); key == "" && len(words) > 1 {
+				key = strings.TrimSuffix(words[1], ":") // as in "validate pattern: ..."
+			}
+			line := lines.find(prefix+table, "", key, after)
+			if table == "" && name != "" {
+				line = lines.find("profile", name, key, 0)
+			}
+			errs = append(errs, at(line, inProfile(err)))
+		}
+		if err := pcfg.checkReader(); strings.HasPrefix(fmt.Sprint(err), "prox") {
+			check("prox", "format", err)
+		} else {
+			check("", "reader", err)
+		}
+		_, err = newValidator(pcfg.Validate)
+		check("validate", "", err)
+		_, err = pcfg.tagRules()
+		if tag, ok := strings.CutPrefix(fmt.Sprint(err), "tag "); ok {
+			tag, _, _ = strings.Cut(tag, ":")
+			check("tags", tag, err)
+		}
+		_, err = newSchedule(pcfg.Schedule)
+		check("schedule", "", err)
+		_, err = newSession(pcfg.Session)
+		check("session", "", err)
+		dc := pcfg.Dedup
+		dc.File = ""
+		dd, err := newDedup(dc)
+		check("dedup", "", err)
+		dd.close()
+		c := *pcfg
+		c.DryRun = true
+		for _, e := range pcfg.Sinks {
+			c.Sinks = []SinkEntry{e}
+			sinks, err := setupSinks(&c)
+			if err != nil {
+				sink := e.Name
+				if sink == "" {
+					sink = e.Type
+				}
+				if !strings.HasPrefix(err.Error(), "sink ") {
+					err = fmt.Errorf("sink %s: %v", sink, err)
+				}
+				errs = append(errs, at(lines.find(prefix+"sink", sink, "", after), inProfile(err)))
+				continue
+			}
+			p := &pipeline{sinks: sinks}
+			p.start(ctx)
+			p.stop()
+		}
+	}
+	return errs
+}
+
+// configBlock is a table of a config file: its path, as in profile.sink, the line of its
+// header and of each of its keys, and its name, for [[profile]] and [[sink]].
+type configBlock struct {
+	path  string
+	start int
+	keys  map[string]int
+	name  string
+}
+
+// configLines finds the settings of a config file by line. It only knows the tables and
+// keys of TOML as the config is written, one per line, not inline tables or dotted keys;
+// which is all it needs for telling where an error is.
+type configLines struct {
+	blocks []configBlock
+}
+
+func newConfigLines(data string) configLines {
+	var c configLines
+	cur := configBlock{keys: map[string]int{}}
+	for i, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+		case strings.HasPrefix(line, "["):
+			c.blocks = append(c.blocks, cur)
+			header, _, _ := strings.Cut(strings.TrimLeft(line, "["), "]")
+			cur = configBlock{path: strings.TrimSpace(header), start: i + 1, keys: map[string]int{}}
+		default:
+			key, value, ok := strings.Cut(line, "=")
+			if !ok {
+				continue
+			}
+			key = strings.Trim(strings.TrimSpace(key), `"'`)
+			if _, seen := cur.keys[key]; !seen {
+				cur.keys[key] = i + 1
+			}
+			if key == "name" || key == "type" && cur.name == "" {
+				value = strings.TrimSpace(value)
+				if q := value[:min(1, len(value))]; q == `"` || q == "'" {
+					value, _, _ = strings.Cut(value[1:], q)
+				}
+				cur.name = value
+			}
+		}
+	}
+	c.blocks = append(c.blocks, cur)
+	return c
+}
+
+// find is the line of key in the first table at path with that name, if name isn't "",
+// that starts after the line after, or the line of its header if key is "" or not in it.
+// With after, the line of a [[profile]], only the tables of that profile are looked at.
+// Without such a table it is the line of a table whose path is path.key, as for an unknown
+// table, and 0 if there isn't one either.
+func (c configLines) find(path, name, key string, after int) int {
+	for _, b := range c.blocks {
+		if after > 0 && b.path == "profile" && b.start > after {
+			break // the tables of a profile end with the next one
+		}
+		if b.path != path || b.start < after || name != "" && b.name != name {
+			continue
+		}
+		if line, ok := b.keys[key]; ok {
+			return line
+		}
+		if b.start > 0 {
+			return b.start
+		}
+	}
+	if key != "" {
+		full := key
+		if path != "" {
+			full = path + "." + key
+		}
+		for _, b := range c.blocks {
+			if b.path == full && b.start >= after {
+				return b.start
+			}
+		}
+	}
+	return 0
+}
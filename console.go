@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The console is for a technician at the station: a prompt that takes the commands of ctl,
+// as in `beep 3` or `param 0x2D`, without the usbscanner ctl in front, and prints the scans
+// as they come in between them, so a setting can be tried and the result scanned right
+// away. The scans are those of ctl status, asked for every watchInterval.
+
+// watchInterval is how often the console asks for new scans.
+const watchInterval = 500 * time.Millisecond
+
+const consoleHelp = `Commands of ctl, e.g.:
+  beep [code], led on|off, trigger on|off, enable, disable, sleep, wake
+  param <name> [value], symbology <name> on|off, menu <commands>, image [send]
+  pause, resume, status, reload, loglevel <level>
+and of the console:
+  watch on|off   print the scans as they come in (on at the start)
+  debug on|off   have the daemon log at debug level, or info again
+  profile [name] send the commands to this profile, or to all of them
+  quit
+`
+
+// console is the state of the prompt.
+type console struct {
+	socket string
+	out    io.Writer
+
+	mu      sync.Mutex // for profile, watch and writing to out
+	profile string
+	watch   bool
+	last    map[string]Scan // by profile, the newest scan printed
+}
+
+// runConsole implements `usbscanner console`.
+func runConsole(args []string) {
+	fs := flag.NewFlagSet("console", flag.ExitOnError)
+	socket := fs.String("socket", defaultControlSocket, "path of the control socket")
+	profile := fs.String("profile", "", "send the commands to this profile")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: usbscanner console [-socket path] [-profile name]\n\n%s\n", consoleHelp)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if env := os.Getenv("USBSCANNER_CONTROL_SOCKET"); env != "" && !flagWasSet(fs, "socket") {
+		*socket = env
+	}
+	c := &console{socket: *socket, out: os.Stdout, profile: *profile, watch: true, last: map[string]Scan{}}
+	if _, err := c.newScans(); err != nil {
+		fmt.Fprintf(os.Stderr, "Not running? %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(c.out, "Connected to %s, help lists the commands.\n", c.socket)
+	go c.watchScans()
+	c.run(os.Stdin)
+}
+
+// run reads commands from in until quit or the end of it.
+func (c *console) run(in io.Reader) {
+	lines := bufio.NewScanner(in)
+	for {
+		c.printf("usbscanner> ")
+		if !lines.Scan() {
+			c.printf("\n")
+			return
+		}
+		if !c.command(strings.Fields(lines.Text())) {
+			return
+		}
+	}
+}
+
+// command carries out a command, false if it was quit.
+func (c *console) command(args []string) bool {
+	if len(args) == 0 {
+		return true
+	}
+	c.mu.Lock()
+	profile := c.profile
+	c.mu.Unlock()
+	switch args[0] {
+	case "quit", "exit":
+		return false
+	case "help", "?":
+		c.printf("%s", consoleHelp)
+		return true
+	case "watch":
+		if len(args) != 2 || args[1] != "on" && args[1] != "off" {
+			c.printf("watch on|off\n")
+			return true
+		}
+		c.mu.Lock()
+		c.watch = args[1] == "on"
+		c.mu.Unlock()
+		return true
+	case "profile":
+		if len(args) > 2 {
+			c.printf("profile [name]\n")
+			return true
+		}
+		c.mu.Lock()
+		c.profile = strings.Join(args[1:], "")
+		c.mu.Unlock()
+		return true
+	case "debug":
+		level := map[string]string{"on": "debug", "off": "info"}[strings.Join(args[1:], " ")]
+		if level == "" {
+			c.printf("debug on|off\n")
+			return true
+		}
+		args = []string{"loglevel", level}
+	}
+	req, ok := ctlRequest(args, profile)
+	if !ok {
+		c.printf("Unknown command, help lists them\n")
+		return true
+	}
+	resp, err := controlCall(c.socket, req)
+	switch {
+	case err != nil:
+		c.printf("error: %v\n", err)
+	case !resp.OK:
+		c.printf("error: %s\n", resp.Error)
+	default:
+		out, _ := json.MarshalIndent(resp, "", "  ")
+		if string(out) == "{\n  \"ok\": true\n}" {
+			c.printf("ok\n")
+		} else {
+			c.printf("%s\n", out)
+		}
+	}
+	return true
+}
+
+// watchScans prints the scans that came in since it last looked, while watch is on.
+func (c *console) watchScans() {
+	for range time.Tick(watchInterval) {
+		scans, err := c.newScans()
+		if err != nil {
+			continue // the daemon restarting, say; the next command says so
+		}
+		c.mu.Lock()
+		if c.watch && len(scans) > 0 {
+			fmt.Fprint(c.out, "\r")
+			for _, scan := range scans {
+				fmt.Fprintf(c.out, "scan %s %s", scan.Device, scan.Code)
+				if scan.Symbology != "" {
+					fmt.Fprintf(c.out, " (%s)", scan.Symbology)
+				}
+				fmt.Fprintln(c.out)
+			}
+			fmt.Fprint(c.out, "usbscanner> ")
+		}
+		c.mu.Unlock()
+	}
+}
+
+// newScans are the scans of the status that are newer than those seen before, oldest
+// first. The first time, those are only taken as seen.
+func (c *console) newScans() ([]Scan, error) {
+	resp, err := controlCall(c.socket, controlRequest{Command: "status"})
+	if err != nil {
+		return nil, err
+	}
+	if !resp.OK {
+		return nil, fmt.Errorf("%s", resp.Error)
+	}
+	statuses := resp.Profiles
+	if resp.Status != nil {
+		statuses = []*controlStatus{resp.Status}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var scans []Scan
+	for _, st := range statuses {
+		last, seen := c.last[st.Profile]
+		if len(st.Recent) > 0 {
+			c.last[st.Profile] = st.Recent[0]
+		} else if !seen {
+			c.last[st.Profile] = Scan{}
+		}
+		if !seen {
+			continue
+		}
+		n := 0
+		for n < len(st.Recent) && !sameScan(st.Recent[n], last) {
+			n++
+		}
+		for i := n - 1; i >= 0; i-- {
+			scans = append(scans, st.Recent[i])
+		}
+	}
+	return scans, nil
+}
+
+func (c *console) printf(format string, args ...any) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(c.out, format, args...)
+}
@@ -0,0 +1,534 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// defaultControlSocket is where `usbscanner ctl` looks for the control socket unless told
+// otherwise. The daemon only listens if control_socket is set in the config.
+const defaultControlSocket = "/run/usbscanner/control.sock"
+
+// controlRequest is a single line sent to the control socket, e.g. {"command":"status"}.
+// Profile picks the station a command is for when there are several; without it pause and
+// resume go to all of them and status shows all of them.
+type controlRequest struct {
+	Command string `json:"command"`
+	Profile string `json:"profile,omitempty"`
+	Level   string `json:"level,omitempty"` // for loglevel
+	Value   string `json:"value,omitempty"` // for beep (the beep code), led, trigger and symbology (on or off), menu (the commands), image (send)
+
+	Symbology string `json:"symbology,omitempty"` // for symbology, the one to turn on or off
+	Param     string `json:"param,omitempty"`     // for param, the scanner's parameter to show or set to value
+}
+
+// controlResponse is the line sent back. Status is only filled in for the status command,
+// or Profiles instead when asking for the status of several profiles.
+type controlResponse struct {
+	OK       bool             `json:"ok"`
+	Error    string           `json:"error,omitempty"`
+	Status   *controlStatus   `json:"status,omitempty"`
+	Profiles []*controlStatus `json:"profiles,omitempty"`
+	Reply    string           `json:"reply,omitempty"` // the scanner's answer to menu, where image saved it
+}
+
+type controlStatus struct {
+	Profile  string       `json:"profile,omitempty"`
+	Paused   bool         `json:"paused"`
+	Outside  bool         `json:"outside_hours,omitempty"`
+	Held     int          `json:"held,omitempty"`
+	Device   deviceStatus `json:"device"`
+	Scans    int64        `json:"scans"`
+	LastScan *time.Time   `json:"last_scan,omitempty"`
+	Sinks    []sinkStatus `json:"sinks"`
+	Recent   []Scan       `json:"recent,omitempty"` // newest first
+
+	// ScanDuration is how long scans take from the first key event until complete.
+	ScanDuration *latencySummary   `json:"scan_duration,omitempty"`
+	Restarts     []componentStatus `json:"restarts,omitempty"`
+}
+
+type deviceStatus struct {
+	Name   string       `json:"name"`
+	Path   string       `json:"path"`
+	Errors deviceErrors `json:"errors"`
+
+	Identity *scannerIdentity `json:"identity,omitempty"` // see identity.go
+	Asleep   bool             `json:"asleep,omitempty"`   // see idle.go
+}
+
+// deviceErrors counts what went wrong with a device since we started. A flaky cable shows
+// up as read errors and reconnects, a keyboard layout that doesn't match as decode errors.
+type deviceErrors struct {
+	Read       int64        `json:"read"`
+	Decode     int64        `json:"decode"`
+	Reconnects int64        `json:"reconnects"`
+	Dropped    int64        `json:"dropped_events"`
+	Overflows  int64        `json:"overflows"` // the kernel lost events, see SYN_DROPPED
+	Last       *deviceError `json:"last,omitempty"`
+}
+
+type componentStatus struct {
+	Name     string `json:"name"`
+	Restarts int    `json:"restarts"`
+}
+
+type sinkStatus struct {
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Queued int    `json:"queued"`
+	Error  string `json:"error,omitempty"` // of the last delivery, if it failed
+	Down   bool   `json:"down,omitempty"`  // failed down_after times in a row
+
+	// Delivered counts acknowledged scans, Retries the attempts that had to be repeated.
+	Delivery  string `json:"delivery"` // best-effort or at-least-once
+	Delivered int64  `json:"delivered"`
+	Retries   int64  `json:"retries,omitempty"`
+	Dead      int    `json:"dead_letters,omitempty"` // scans it gave up on, see dead_letter_dir
+
+	// Checkpoint is the last scan delivered from the disk queue, with queue=disk.
+	Checkpoint *queueCheckpoint `json:"checkpoint,omitempty"`
+
+	// AckLatency is how long scans take from complete until the sink acknowledged them.
+	AckLatency *latencySummary `json:"ack_latency,omitempty"`
+}
+
+// controller answers requests on the control socket. It lets an operator pause and resume
+// scanning (the device stays grabbed, scans are dropped meanwhile), look at the status and
+// reload the configuration without restarting.
+type controller struct {
+	stations []*station
+	reload   func() error
+	imageDir string
+}
+
+// listen starts serving the control socket at path. A stale socket left behind by an earlier
+// run is removed, one that is still answering means another instance is running.
+func (c *controller) listen(path string) (net.Listener, error) {
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("%s is in use by another instance", path)
+	}
+	os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0660); err != nil {
+		l.Close()
+		return nil, err
+	}
+	c.serveListener(l)
+	return l, nil
+}
+
+// serveListener accepts control connections on l until it is closed.
+func (c *controller) serveListener(l net.Listener) {
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			} else if err != nil {
+				slog.Warn("Control socket", "error", err)
+				continue
+			}
+			go c.serve(conn)
+		}
+	}()
+}
+
+// serve handles requests on one connection, one JSON object per line each way, until the
+// client hangs up.
+func (c *controller) serve(conn net.Conn) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	enc := json.NewEncoder(conn)
+	for scanner.Scan() {
+		var req controlRequest
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			enc.Encode(controlResponse{Error: "bad request: " + err.Error()})
+			continue
+		}
+		enc.Encode(c.handle(req))
+	}
+}
+
+func (c *controller) handle(req controlRequest) controlResponse {
+	stations := c.stations
+	if req.Profile != "" {
+		stations = nil
+		for _, st := range c.stations {
+			if st.profile == req.Profile {
+				stations = append(stations, st)
+			}
+		}
+		if stations == nil {
+			return controlResponse{Error: fmt.Sprintf("unknown profile %q", req.Profile)}
+		}
+	}
+	switch req.Command {
+	case "pause":
+		for _, st := range stations {
+			st.d.paused.Store(true)
+		}
+		slog.Info("Scanning paused", "profile", req.Profile)
+	case "resume":
+		for _, st := range stations {
+			st.d.paused.Store(false)
+		}
+		slog.Info("Scanning resumed", "profile", req.Profile)
+	case "status":
+		if len(stations) == 1 {
+			return controlResponse{OK: true, Status: stationStatus(stations[0])}
+		}
+		resp := controlResponse{OK: true}
+		for _, st := range stations {
+			resp.Profiles = append(resp.Profiles, stationStatus(st))
+		}
+		return resp
+	case "loglevel":
+		if err := setLogLevel(req.Level); err != nil {
+			return controlResponse{Error: err.Error()}
+		}
+		slog.Info("Log level changed", "level", logLevel.Level().String())
+	case "reload":
+		if err := c.reload(); err != nil {
+			return controlResponse{Error: err.Error()}
+		}
+	case "beep", "led", "enable", "disable", "trigger":
+		if err := scannerCommand(stations, req); err != nil {
+			return controlResponse{Error: err.Error()}
+		}
+	case "sleep", "wake":
+		if err := idleCommand(stations, req); err != nil {
+			return controlResponse{Error: err.Error()}
+		}
+	case "symbology":
+		if err := symbologyCommand(stations, req); err != nil {
+			return controlResponse{Error: err.Error()}
+		}
+	case "param":
+		reply, err := paramCommand(stations, req)
+		if err != nil {
+			return controlResponse{Error: err.Error()}
+		}
+		return controlResponse{OK: true, Reply: reply}
+	case "image":
+		path, err := imageCommand(stations, c.imageDir, req)
+		if err != nil {
+			return controlResponse{Error: err.Error(), Reply: path}
+		}
+		return controlResponse{OK: true, Reply: path}
+	case "menu":
+		reply, err := menuCommand(stations, req)
+		if err != nil {
+			return controlResponse{Error: err.Error(), Reply: reply}
+		}
+		return controlResponse{OK: true, Reply: reply}
+	default:
+		return controlResponse{Error: fmt.Sprintf("unknown command %q", req.Command)}
+	}
+	return controlResponse{OK: true}
+}
+
+// scannerCommand sends a command to the scanners of stations, all of which have to take
+// commands.
+func scannerCommand(stations []*station, req controlRequest) error {
+	var send func(scannerControl) error
+	switch req.Command {
+	case "beep":
+		code := 0
+		if req.Value != "" {
+			var err error
+			if code, err = strconv.Atoi(req.Value); err != nil {
+				return fmt.Errorf("beep code should be a number, not %q", req.Value)
+			}
+		}
+		send = func(c scannerControl) error { return c.beep(code) }
+	case "led", "trigger":
+		if req.Value != "on" && req.Value != "off" {
+			return fmt.Errorf("%s should be on or off, not %q", req.Command, req.Value)
+		}
+		send = func(c scannerControl) error { return c.setLED(req.Value == "on") }
+		if req.Command == "trigger" {
+			send = func(c scannerControl) error { return c.setTrigger(req.Value == "on") }
+		}
+	case "enable", "disable":
+		send = func(c scannerControl) error { return c.setEnabled(req.Command == "enable") }
+	}
+	var controls []scannerControl
+	for _, st := range stations {
+		c, err := st.control()
+		if err != nil {
+			return err
+		}
+		controls = append(controls, c)
+	}
+	for i, c := range controls {
+		if err := send(c); err != nil {
+			return fmt.Errorf("%s: %v", stations[i].label(), err)
+		}
+	}
+	slog.Info("Scanner command", "command", req.Command, "value", req.Value, "profile", req.Profile)
+	return nil
+}
+
+// symbologyCommand turns a symbology on or off on the scanners of stations, all of which
+// have to take it.
+func symbologyCommand(stations []*station, req controlRequest) error {
+	if req.Value != "on" && req.Value != "off" {
+		return fmt.Errorf("symbology should be on or off, not %q", req.Value)
+	}
+	var controls []symbologyControl
+	for _, st := range stations {
+		c, err := st.control()
+		if err != nil {
+			return err
+		}
+		sc, ok := c.(symbologyControl)
+		if !ok {
+			return fmt.Errorf("symbologies can't be turned on and off on the %s, only on scanners over SSI or SNAPI and Honeywell ones on a serial port", st.label())
+		}
+		controls = append(controls, sc)
+	}
+	for i, c := range controls {
+		if err := c.setSymbology(req.Symbology, req.Value == "on"); err != nil {
+			return fmt.Errorf("%s: %v", stations[i].label(), err)
+		}
+	}
+	slog.Info("Symbology turned "+req.Value, "symbology", req.Symbology, "profile", req.Profile)
+	return nil
+}
+
+// paramCommand shows the value of a parameter of the scanner of the one station given, or
+// sets it on the scanners of stations to req's value.
+func paramCommand(stations []*station, req controlRequest) (string, error) {
+	if req.Value == "" && len(stations) != 1 {
+		return "", errors.New("parameters are shown for one scanner, pick its profile")
+	}
+	var controls []paramControl
+	for _, st := range stations {
+		c, err := st.control()
+		if err != nil {
+			return "", err
+		}
+		pc, ok := c.(paramControl)
+		if !ok {
+			return "", fmt.Errorf("the %s has no parameters to set, only scanners over SSI or SNAPI and Honeywell ones on a serial port do", st.label())
+		}
+		controls = append(controls, pc)
+	}
+	if req.Value == "" {
+		return controls[0].getParam(req.Param)
+	}
+	for i, c := range controls {
+		if err := c.setParam(req.Param, req.Value); err != nil {
+			return "", fmt.Errorf("%s: %v", stations[i].label(), err)
+		}
+	}
+	slog.Info("Scanner parameter set", "param", req.Param, "value", req.Value, "profile", req.Profile)
+	return "", nil
+}
+
+// menuCommand sends the menu commands of req to the scanner of the one station given,
+// which has to take them, and returns its answer.
+func menuCommand(stations []*station, req controlRequest) (string, error) {
+	if len(stations) != 1 {
+		return "", errors.New("menu commands go to one scanner, pick its profile")
+	}
+	c, err := stations[0].control()
+	if err != nil {
+		return "", err
+	}
+	m, ok := c.(menuControl)
+	if !ok {
+		return "", fmt.Errorf("the %s takes no menu commands, only Honeywell scanners on a serial port do", stations[0].label())
+	}
+	reply, err := m.menu(req.Value)
+	slog.Info("Menu command", "command", req.Value, "reply", reply, "profile", req.Profile, "error", err)
+	return reply, err
+}
+
+func stationStatus(st *station) *controlStatus {
+	d := st.d
+	status := &controlStatus{
+		Profile: st.profile,
+		Paused:  d.paused.Load(),
+		Device:  deviceStatus{Name: st.device.Name, Path: st.device.Fn, Errors: stationErrors(st), Identity: d.identity.Load(), Asleep: st.asleep.Load()},
+		Scans:   d.scans.Load(),
+		Recent:  d.recentScans(),
+
+		Outside:      d.outside.Load(),
+		ScanDuration: scanDuration.summary(st.device.Name),
+		Restarts:     components.componentRestarts(),
+	}
+	d.heldMu.Lock()
+	status.Held = len(d.held)
+	d.heldMu.Unlock()
+	if last := d.lastScan.Load(); last != 0 {
+		t := time.Unix(0, last)
+		status.LastScan = &t
+	}
+	d.mu.RLock()
+	for _, s := range d.current.sinks {
+		ss := sinkStatus{Name: s.name, Type: s.kind, Queued: s.queued(), AckLatency: ackLatency.summary(s.device, s.name),
+			Delivery: "best-effort", Delivered: s.delivered.Load(), Retries: s.retries.Load(), Dead: s.dead.len(),
+			Down: s.breaker.isDown()}
+		if s.atLeastOnce {
+			ss.Delivery = "at-least-once"
+		}
+		if s.spool != nil {
+			ss.Checkpoint = s.spool.checkpoint()
+		}
+		if err := s.lastErr.Load(); err != nil {
+			ss.Error = (*err).Error()
+		}
+		status.Sinks = append(status.Sinks, ss)
+	}
+	d.mu.RUnlock()
+	return status
+}
+
+func stationErrors(st *station) deviceErrors {
+	name := st.device.Name
+	return deviceErrors{
+		Read:       int64(readErrors.value(name)),
+		Decode:     int64(decodeErrors.value(name)),
+		Reconnects: int64(deviceReconnects.value(name)),
+		Dropped:    int64(droppedEvents.value(name)),
+		Overflows:  int64(eventOverflows.value(name)),
+		Last:       st.lastErr.Load(),
+	}
+}
+
+// ctlRequest is the request for the arguments of ctl, false if they aren't a command it
+// takes.
+func ctlRequest(args []string, profile string) (controlRequest, bool) {
+	arg := func(i int) string {
+		if i < len(args) {
+			return args[i]
+		}
+		return ""
+	}
+	switch cmd := arg(0); {
+	case len(args) == 1 && cmd != "led" && cmd != "trigger" && cmd != "menu" && cmd != "symbology" && cmd != "param":
+	case len(args) == 2 && (cmd == "loglevel" || cmd == "beep" || cmd == "led" || cmd == "trigger" || cmd == "menu" || cmd == "image" || cmd == "param"):
+	case len(args) == 3 && (cmd == "symbology" || cmd == "param"):
+	default:
+		return controlRequest{}, false
+	}
+	req := controlRequest{Command: arg(0), Profile: profile}
+	if req.Command == "loglevel" {
+		req.Level = arg(1)
+	} else if req.Command == "symbology" {
+		req.Symbology, req.Value = arg(1), arg(2)
+	} else if req.Command == "param" {
+		req.Param, req.Value = arg(1), arg(2)
+	} else {
+		req.Value = arg(1)
+	}
+	return req, true
+}
+
+// runCtl implements `usbscanner ctl <command>`, which sends a single command to a running
+// instance and prints the response as JSON. It exits non-zero if the command failed.
+func runCtl(args []string) {
+	fs := flag.NewFlagSet("ctl", flag.ExitOnError)
+	socket := fs.String("socket", defaultControlSocket, "path of the control socket")
+	profile := fs.String("profile", "", "only pause, resume, show or send commands to this profile")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: usbscanner ctl [-socket path] [-profile name] pause|resume|status|reload|loglevel <level>\n"+
+			"       usbscanner ctl [-socket path] [-profile name] beep [code]|led on|off|trigger on|off|enable|disable|sleep|wake\n"+
+			"       usbscanner ctl [-socket path] [-profile name] symbology <name> on|off|param <name> [value]\n"+
+			"       usbscanner ctl [-socket path] [-profile name] menu <commands>|image [send]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	req, ok := ctlRequest(fs.Args(), *profile)
+	if !ok {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if env := os.Getenv("USBSCANNER_CONTROL_SOCKET"); env != "" && !flagWasSet(fs, "socket") {
+		*socket = env
+	}
+
+	resp, err := controlCall(*socket, req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	out, _ := json.MarshalIndent(resp, "", "  ")
+	fmt.Println(string(out))
+	if !resp.OK {
+		os.Exit(1)
+	}
+}
+
+// controlCall sends one request to the control socket and waits for the response.
+func controlCall(socket string, req controlRequest) (*controlResponse, error) {
+	conn, err := net.DialTimeout("unix", socket, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, err
+	}
+	var resp controlResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// flagWasSet tells whether a flag was given explicitly rather than left at its default.
+func flagWasSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// startControl sets up the control socket if one is configured, or systemd passed us one
+// named "control" through socket activation. In lockdown there is none either way.
+func startControl(ctx context.Context, cfg *Config, stations []*station, configPath string, flags *cmdlineFlags) {
+	c := &controller{stations: stations, imageDir: cfg.ImageDir, reload: func() error {
+		return reloadStations(ctx, stations, configPath, flags)
+	}}
+	if cfg.Lockdown {
+		// Don't leave a socket systemd handed us half working, close it so clients are refused.
+		if l := activatedListener("control"); l != nil {
+			l.Close()
+		}
+		slog.Info("Locked down, no control socket")
+		return
+	}
+	if l := activatedListener("control"); l != nil {
+		c.serveListener(l)
+		slog.Info("Control socket (socket activated)", "path", l.Addr().String())
+		return
+	}
+	if cfg.ControlSocket == "" {
+		return
+	}
+	if _, err := c.listen(cfg.ControlSocket); err != nil {
+		slog.Error("Could not open control socket", "error", err)
+		return
+	}
+	slog.Info("Control socket", "path", cfg.ControlSocket)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// csvColumns are the scan fields that can be picked as CSV columns.
+var csvColumns = map[string]func(Scan) string{
+	"id":        func(s Scan) string { return s.ID },
+	"time":      func(s Scan) string { return s.Time.Format(time.RFC3339Nano) },
+	"code":      func(s Scan) string { return s.Code },
+	"device":    func(s Scan) string { return s.Device },
+	"symbology": func(s Scan) string { return s.Symbology },
+	"tags":      func(s Scan) string { return strings.Join(s.Tags, " ") },
+}
+
+// csvFormat turns scans into CSV records with a chosen set of columns.
+type csvFormat struct {
+	columns []string
+	header  bool
+}
+
+// newCSVFormat reads the columns option, a comma separated list out of csvColumns
+// (time,device,code by default), and header, whether streams start with a header row.
+func newCSVFormat(cfg *SinkConfig) (*csvFormat, error) {
+	columns := strings.Split(cfg.Option("columns", "time,device,code"), ",")
+	for i, c := range columns {
+		columns[i] = strings.TrimSpace(c)
+		if _, ok := csvColumns[columns[i]]; !ok {
+			return nil, fmt.Errorf("unknown csv column %q", c)
+		}
+	}
+	header, err := cfg.BoolOption("header", true)
+	if err != nil {
+		return nil, err
+	}
+	return &csvFormat{columns: columns, header: header}, nil
+}
+
+func (f *csvFormat) record(scan Scan) string {
+	fields := make([]string, len(f.columns))
+	for i, c := range f.columns {
+		fields[i] = csvColumns[c](scan)
+	}
+	return csvLine(fields)
+}
+
+func (f *csvFormat) headerRow() string {
+	return csvLine(f.columns)
+}
+
+// csvLine encodes a single record, without the line ending.
+func csvLine(fields []string) string {
+	var b bytes.Buffer
+	w := csv.NewWriter(&b)
+	w.Write(fields)
+	w.Flush()
+	return strings.TrimSuffix(b.String(), "\n")
+}
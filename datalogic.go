@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// Datalogic scanners, Gryphons and QuickScans, in USB-COM mode are a CDC-ACM serial port
+// like other scanners in serial mode and send their scans as they are, with the AIM
+// identifier in front when their label ID is set to AIM, which gives scans their symbology.
+// The host can drive them with single character host commands: B for a good read beep, E
+// and D to enable and disable scanning. That is what feedback and `usbscanner ctl` use.
+
+const (
+	datalogicBeep    = 'B'
+	datalogicEnable  = 'E'
+	datalogicDisable = 'D'
+)
+
+// datalogicScanner reads a Datalogic scanner in USB-COM mode and sends it host commands.
+type datalogicScanner struct {
+	*rawScanner
+}
+
+func openDatalogicScanner(sc SerialConfig, name string, timeout time.Duration) (*datalogicScanner, error) {
+	raw, err := openRawScanner(sc, name, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &datalogicScanner{raw}, nil
+}
+
+// beep sounds the good read beep, the only one there is.
+func (d *datalogicScanner) beep(code int) error {
+	if code != 0 {
+		return errors.New("a Datalogic scanner only has the good read beep, beep code 0")
+	}
+	return d.write([]byte{datalogicBeep})
+}
+
+func (d *datalogicScanner) setEnabled(on bool) error {
+	if on {
+		return d.write([]byte{datalogicEnable})
+	}
+	return d.write([]byte{datalogicDisable})
+}
+
+func (d *datalogicScanner) setLED(bool) error {
+	return errors.New("a Datalogic scanner's LED can't be set from the host, it shows good reads")
+}
+
+func (d *datalogicScanner) setTrigger(bool) error {
+	return errors.New("a Datalogic scanner can't be triggered with host commands")
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// permanentError is a failure that trying again won't fix, like a template that fails on a
+// scan. Such scans go to the dead letters right away.
+type permanentError struct{ err error }
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+func permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return permanentError{err}
+}
+
+func isPermanent(err error) bool {
+	var p permanentError
+	return errors.As(err, &p)
+}
+
+// deadLetter is what a sink couldn't deliver, with why: a file in dead_letter_dir, named
+// after the sink, with a JSON line per scan. Nothing reads it back, it is there so scans
+// aren't retried forever, holding up those behind them, yet not silently lost either.
+// Feed them back in by hand once the problem is fixed.
+type deadLetter struct {
+	Time     time.Time `json:"time"`
+	Sink     string    `json:"sink"`
+	Attempts int       `json:"attempts"`
+	Reason   string    `json:"reason"` // permanent, max_attempts or max_age
+	Error    string    `json:"error"`
+	Scan     Scan      `json:"scan"`
+}
+
+type deadLetters struct {
+	path string
+
+	mu    sync.Mutex
+	f     *os.File // opened on the first dead letter
+	count int      // lines in the file
+}
+
+// newDeadLetters counts what is in the file already. It is only created once there is
+// something to put in it.
+func newDeadLetters(path string) (*deadLetters, error) {
+	n, err := countLines(path, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &deadLetters{path: path, count: n}, nil
+}
+
+func (d *deadLetters) add(sink string, scan Scan, attempts int, reason string, err error) error {
+	data, merr := json.Marshal(deadLetter{Time: time.Now(), Sink: sink, Attempts: attempts, Reason: reason, Error: err.Error(), Scan: scan})
+	if merr != nil {
+		return merr
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.f == nil {
+		if err := os.MkdirAll(filepath.Dir(d.path), 0750); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(d.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			return err
+		}
+		d.f = f
+	}
+	if _, err := d.f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if err := d.f.Sync(); err != nil {
+		return err
+	}
+	d.count++
+	return nil
+}
+
+func (d *deadLetters) len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.count
+}
+
+func (d *deadLetters) close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.f == nil {
+		return nil
+	}
+	err := d.f.Close()
+	d.f = nil
+	return err
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/gvalkov/golang-evdev"
+)
+
+// debugEvents is set with -debug-events: every raw input event is logged along with what
+// the decoding made of it, for tracking down keyboard layout and timing problems. It is set
+// once at startup, before any device is read, and implies -vv as the events are logged at
+// debug.
+var debugEvents bool
+
+// keyStates names the values of EV_KEY events.
+var keyStates = map[int32]string{0: "up", 1: "down", 2: "repeat"}
+
+// formatEvent describes a raw input event: its kernel timestamp, type, code and value, the
+// type and code by name where evdev has one.
+func formatEvent(ev *evdev.InputEvent) string {
+	typ := fmt.Sprintf("%d", ev.Type)
+	if name, ok := evdev.EV[int(ev.Type)]; ok {
+		typ = fmt.Sprintf("%s(%d)", name, ev.Type)
+	}
+	code := fmt.Sprintf("%d", ev.Code)
+	if name, ok := evdev.ByEventType[int(ev.Type)][int(ev.Code)]; ok {
+		code = fmt.Sprintf("%s(%d)", name, ev.Code)
+	}
+	value := fmt.Sprintf("%d", ev.Value)
+	if state, ok := keyStates[ev.Value]; ok && ev.Type == evdev.EV_KEY {
+		value = fmt.Sprintf("%d(%s)", ev.Value, state)
+	}
+	return fmt.Sprintf("%d.%06d type %s code %s value %s", ev.Time.Sec, ev.Time.Usec, typ, code, value)
+}
+
+// eventTime is when the kernel saw the event.
+func eventTime(ev *evdev.InputEvent) time.Time {
+	return time.Unix(int64(ev.Time.Sec), int64(ev.Time.Usec)*1000)
+}
+
+// logEvent logs an event and the decision taken on it, with the delay between the kernel
+// seeing it and us getting to it. Extra attributes go at the end.
+func logEvent(device string, ev *evdev.InputEvent, decision string, attrs ...any) {
+	attrs = append([]any{"device", device, "event", formatEvent(ev), "decision", decision,
+		"lag", time.Since(eventTime(ev))}, attrs...)
+	slog.Debug("Input event", attrs...)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gvalkov/golang-evdev"
+)
+
+// `usbscanner decode` runs key presses given as text through the decoder and shows what it
+// makes of each of them, to get to the bottom of a keymap problem from a log or a bug
+// report without the scanner. Keys are evdev names, with or without KEY_, or key codes
+// (but 0 to 9 are the digit keys):
+//
+//	usbscanner decode KEY_LEFTSHIFT KEY_A KEY_1 KEY_MINUS KEY_2
+//
+// Lines logged with -debug-events can be pasted as they are, only the key downs in them
+// count. A blank line ends a scan, like the inter-character timeout does.
+
+// debugEventKey finds the key and its state in a line logged with -debug-events.
+var debugEventKey = regexp.MustCompile(`code (KEY_[A-Z0-9_]+)\(\d+\) value (\d+)`)
+
+// keyNames looks up evdev key codes by name.
+var keyNames = func() map[string]uint16 {
+	names := map[string]uint16{}
+	for code, name := range evdev.KEY {
+		names[name] = uint16(code)
+	}
+	return names
+}()
+
+// parseKeys reads the key presses of a line: the key downs of a -debug-events line, or else
+// every key named in it.
+func parseKeys(line string) ([]uint16, error) {
+	if m := debugEventKey.FindStringSubmatch(line); m != nil {
+		if m[2] != "1" {
+			return nil, nil
+		}
+		return []uint16{keyNames[m[1]]}, nil
+	} else if strings.Contains(line, "Input event") {
+		return nil, nil // not a key, a SYN_REPORT say
+	}
+	var keys []uint16
+	for _, field := range strings.FieldsFunc(line, func(r rune) bool { return r == ' ' || r == '\t' || r == ',' }) {
+		name := strings.ToUpper(field)
+		if !strings.HasPrefix(name, "KEY_") {
+			name = "KEY_" + name
+		}
+		if code, ok := keyNames[name]; ok {
+			keys = append(keys, code)
+		} else if code, err := strconv.ParseUint(field, 10, 16); err == nil {
+			keys = append(keys, uint16(code)) // 0 to 9 are keys, other numbers key codes
+		} else {
+			return nil, fmt.Errorf("no key %s", field)
+		}
+	}
+	return keys, nil
+}
+
+// decodeSteps decodes one scan, printing a line for each key on w.
+func decodeSteps(w io.Writer, keys []uint16, keymap map[string]string) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "#\tKEY\tOUTPUT\tSHIFT\tBARCODE")
+	d := decoder{device: "decode"}
+	now := time.Now()
+	var notes []string
+	for i, code := range keys {
+		before := d.barcode.Len()
+		d.event(&evdev.InputEvent{Type: evdev.EV_KEY, Code: code, Value: 1}, now, keymap)
+		name, ok := evdev.KEY[int(code)]
+		if !ok {
+			name = strconv.Itoa(int(code))
+			notes = append(notes, fmt.Sprintf("key code %d isn't known to evdev, it decodes to ?", code))
+		}
+		output := d.barcode.String()[before:]
+		shift := ""
+		if d.capNext {
+			shift = "on"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%q\t%s\t%s\n", i+1, name, output, shift, d.barcode.String())
+		// Keys the decoder has no character for come out as their name.
+		if len([]rune(output)) > 1 {
+			notes = append(notes, fmt.Sprintf("%s comes out as %q, map %q to the character in [keymap]", name, output, output))
+		}
+	}
+	tw.Flush()
+	scan, ok := d.complete(now)
+	if !ok {
+		fmt.Fprintln(w, "Nothing decoded")
+		return
+	}
+	if scan.Symbology != "" {
+		fmt.Fprintf(w, "Decoded %q, symbology %s\n", scan.Code, scan.Symbology)
+	} else {
+		fmt.Fprintf(w, "Decoded %q\n", scan.Code)
+	}
+	seen := map[string]bool{}
+	for _, note := range notes {
+		if !seen[note] {
+			fmt.Fprintln(w, "Note: "+note)
+			seen[note] = true
+		}
+	}
+}
+
+// runDecode implements `usbscanner decode`, reading the keys from the arguments or, without
+// any, from stdin.
+func runDecode(args []string) {
+	fs := flag.NewFlagSet("decode", flag.ExitOnError)
+	configPath := fs.String("config", os.Getenv("USBSCANNER_CONFIG"), "decode with the keymap of this TOML file")
+	profile := fs.String("profile", "", "use the keymap of this profile")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: usbscanner decode [flags] [key]...\n\nWithout keys, they are read from stdin, a blank line ends a scan. Lines logged with\n-debug-events can be pasted as they are.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	cfg := defaultConfig()
+	if *configPath != "" {
+		var err error
+		cfg, err = loadConfig(*configPath)
+		if err == nil && len(cfg.Profiles) > 0 && *profile == "" {
+			err = fmt.Errorf("pick the profile whose keymap to use with -profile: %s", strings.Join(cfg.profileNames(), ", "))
+		}
+		if err == nil {
+			cfg, err = cfg.profile(*profile)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	var r io.Reader = os.Stdin
+	if fs.NArg() > 0 {
+		r = strings.NewReader(strings.Join(fs.Args(), " "))
+	}
+	sc := bufio.NewScanner(r)
+	var keys []uint16
+	scans := 0
+	flush := func() {
+		if len(keys) > 0 {
+			if scans > 0 {
+				fmt.Println()
+			}
+			decodeSteps(os.Stdout, keys, cfg.Keymap)
+			keys = nil
+			scans++
+		}
+	}
+	for line := 1; sc.Scan(); line++ {
+		if strings.TrimSpace(sc.Text()) == "" {
+			flush()
+			continue
+		}
+		k, err := parseKeys(sc.Text())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "line %d: %v\n", line, err)
+			os.Exit(2)
+		}
+		keys = append(keys, k...)
+	}
+	flush()
+	if scans == 0 {
+		fmt.Fprintln(os.Stderr, "No keys to decode")
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// dedup spots repeats of a scan, from an operator pulling the trigger twice or a scanner
+// reading the same label again. A scan is a repeat if the same code was scanned within the
+// window, among the last scans, or both if both are set. Every scan counts, repeats too, so
+// holding the same label under the scanner keeps being a repeat.
+type dedup struct {
+	window    time.Duration
+	last      int
+	perDevice bool // only the same code from the same device is a repeat
+	tag       bool // tag repeats instead of dropping them
+	store     *dedupStore
+}
+
+// duplicateTag is what repeats are tagged with when they're kept.
+const duplicateTag = "duplicate"
+
+// newDedup sets up duplicate detection, nil if it's off.
+func newDedup(cfg DedupConfig) (*dedup, error) {
+	if cfg.Window.Duration < 0 || cfg.Last < 0 {
+		return nil, fmt.Errorf("dedup window and last can't be negative")
+	}
+	if cfg.Window.Duration == 0 && cfg.Last == 0 {
+		if cfg.File != "" {
+			return nil, fmt.Errorf("dedup file needs a window or last")
+		}
+		return nil, nil
+	}
+	d := &dedup{window: cfg.Window.Duration, last: cfg.Last, perDevice: cfg.PerDevice}
+	switch cfg.Action {
+	case "", "drop":
+	case "tag":
+		d.tag = true
+	default:
+		return nil, fmt.Errorf("dedup action should be drop or tag, not %q", cfg.Action)
+	}
+	if cfg.File == "" {
+		d.store = &dedupStore{count: map[string]int{}}
+		return d, nil
+	}
+	store, err := openDedupStore(cfg.File, d.expired)
+	if err != nil {
+		return nil, fmt.Errorf("dedup file: %v", err)
+	}
+	d.store = store
+	return d, nil
+}
+
+// repeat reports whether the scan is a repeat, and remembers it for the scans to come.
+func (d *dedup) repeat(scan Scan) bool {
+	if d == nil {
+		return false
+	}
+	key := scan.Code
+	if d.perDevice {
+		key = scan.Device + "\x00" + scan.Code
+	}
+	return d.store.add(seenScan{Key: key, Time: scan.Time}, d.expired)
+}
+
+// expired says whether the oldest of n remembered scans no longer counts at now.
+func (d *dedup) expired(oldest seenScan, n int, now time.Time) bool {
+	return (d.window > 0 && now.Sub(oldest.Time) > d.window) || (d.last > 0 && n > d.last)
+}
+
+func (d *dedup) close() {
+	if d == nil {
+		return
+	}
+	if err := d.store.release(); err != nil {
+		slog.Warn("Could not close dedup file", "path", d.store.path, "error", err)
+	}
+}
+
+type seenScan struct {
+	Key  string    `json:"key"`
+	Time time.Time `json:"time"`
+}
+
+// dedupStore is the scans dedup remembers. With a file they are appended to it as JSON
+// lines, so a restart doesn't forget them and lets a ticket in twice, and read back on
+// start, dropping the ones that expired. The file is rewritten once it holds mostly expired
+// scans. A reload opens the file again while the old pipeline is still running, so both
+// share one store.
+type dedupStore struct {
+	path string
+
+	mu      sync.Mutex
+	seen    []seenScan     // oldest first
+	count   map[string]int // of every key in seen
+	f       *os.File
+	written int // lines in f
+	refs    int
+}
+
+var (
+	dedupStoresMu sync.Mutex
+	dedupStores   = map[string]*dedupStore{}
+)
+
+func openDedupStore(path string, expired func(seenScan, int, time.Time) bool) (*dedupStore, error) {
+	dedupStoresMu.Lock()
+	defer dedupStoresMu.Unlock()
+	if s, ok := dedupStores[path]; ok {
+		// A reload may have changed the window or the count, which holds for the scans
+		// remembered already from now on.
+		s.mu.Lock()
+		s.expire(time.Now(), expired)
+		s.mu.Unlock()
+		s.refs++
+		return s, nil
+	}
+	s := &dedupStore{path: path, count: map[string]int{}, refs: 1}
+	if f, err := os.Open(path); err == nil {
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			var seen seenScan
+			// A line cut short by a crash is the only one that won't parse, skip it.
+			if json.Unmarshal(sc.Bytes(), &seen) == nil {
+				s.push(seen)
+			}
+		}
+		err := sc.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	s.expire(time.Now(), expired)
+	if err := s.rewrite(); err != nil {
+		return nil, err
+	}
+	dedupStores[path] = s
+	return s, nil
+}
+
+func (s *dedupStore) push(seen seenScan) {
+	s.seen = append(s.seen, seen)
+	s.count[seen.Key]++
+}
+
+// expire forgets the oldest scans for as long as they no longer count.
+func (s *dedupStore) expire(now time.Time, expired func(seenScan, int, time.Time) bool) {
+	i := 0
+	for i < len(s.seen) && expired(s.seen[i], len(s.seen)-i, now) {
+		if s.count[s.seen[i].Key]--; s.count[s.seen[i].Key] == 0 {
+			delete(s.count, s.seen[i].Key)
+		}
+		i++
+	}
+	s.seen = s.seen[i:]
+}
+
+// add reports whether a scan with the key is remembered already, then remembers this one.
+func (s *dedupStore) add(seen seenScan, expired func(seenScan, int, time.Time) bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire(seen.Time, expired)
+	repeat := s.count[seen.Key] > 0
+	s.push(seen)
+	if s.f == nil {
+		return repeat
+	}
+	if s.written > 2*len(s.seen)+1000 {
+		if err := s.rewrite(); err != nil {
+			slog.Error("Could not rewrite dedup file", "path", s.path, "error", err)
+		}
+		return repeat
+	}
+	if err := s.append(seen); err != nil {
+		slog.Error("Could not write to dedup file, the scan will be forgotten on restart", "path", s.path, "error", err)
+	}
+	return repeat
+}
+
+func (s *dedupStore) append(seen seenScan) error {
+	data, err := json.Marshal(seen)
+	if err != nil {
+		return err
+	}
+	if _, err := s.f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	s.written++
+	return s.f.Sync()
+}
+
+// rewrite replaces the file with one holding just the scans remembered now.
+func (s *dedupStore) rewrite() error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0750); err != nil {
+		return err
+	}
+	tmp := s.path + ".new"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, seen := range s.seen {
+		data, err := json.Marshal(seen)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		w.Write(append(data, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		f.Close()
+		return err
+	}
+	if s.f != nil {
+		s.f.Close()
+	}
+	s.f, s.written = f, len(s.seen)
+	return nil
+}
+
+func (s *dedupStore) release() error {
+	if s.path == "" {
+		return nil
+	}
+	dedupStoresMu.Lock()
+	defer dedupStoresMu.Unlock()
+	s.refs--
+	if s.refs > 0 {
+		return nil
+	}
+	delete(dedupStores, s.path)
+	return s.f.Close()
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gvalkov/golang-evdev"
+)
+
+// The emulator is a scanner made up in software: a keyboard created through uinput that
+// types barcodes the way a scanner in keyboard mode does, so the whole pipeline can be run
+// on a machine without one, in development or CI.
+
+// uinput ioctls, from linux/uinput.h.
+const (
+	uiDevCreate  = 0x5501
+	uiDevDestroy = 0x5502
+	uiSetEvBit   = 0x40045564
+	uiSetKeyBit  = 0x40045565
+)
+
+// uinputUserDev is struct uinput_user_dev, written to /dev/uinput to describe the device.
+type uinputUserDev struct {
+	Name         [80]byte
+	Bustype      uint16
+	Vendor       uint16
+	Product      uint16
+	Version      uint16
+	FFEffectsMax uint32
+	Absmax       [64]int32
+	Absmin       [64]int32
+	Absfuzz      [64]int32
+	Absflat      [64]int32
+}
+
+// virtualScanner is a uinput keyboard.
+type virtualScanner struct {
+	f      *os.File
+	keys   map[rune]keyStroke
+	delay  time.Duration // between key presses, give or take half of it
+	suffix []keyStroke   // typed after every barcode
+}
+
+// keyStroke is a key to press for a character, with shift or without.
+type keyStroke struct {
+	code  uint16
+	shift bool
+}
+
+// typingKeys works out which key to press for each character the decoder knows, by asking
+// processCharacter about every key, without shift first so digits and punctuation don't
+// come out shifted.
+func typingKeys() map[rune]keyStroke {
+	keys := map[rune]keyStroke{}
+	for _, shift := range []bool{false, true} {
+		for code, name := range evdev.KEY {
+			if !strings.HasPrefix(name, "KEY_") || strings.Contains(name, "SHIFT") {
+				continue
+			}
+			char, _ := processCharacter(name, shift, nil)
+			r := []rune(char)
+			if len(r) != 1 {
+				continue
+			}
+			if _, ok := keys[r[0]]; !ok {
+				keys[r[0]] = keyStroke{uint16(code), shift}
+			}
+		}
+	}
+	return keys
+}
+
+// newVirtualScanner creates the uinput device. It takes udev a moment to set it up, and
+// the daemon only looks for scanners when it starts.
+func newVirtualScanner(name string, vendor, product uint16) (*virtualScanner, error) {
+	f, err := os.OpenFile("/dev/uinput", os.O_WRONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	v := &virtualScanner{f: f, keys: typingKeys()}
+	if err := v.ioctl(uiSetEvBit, evdev.EV_KEY); err != nil {
+		f.Close()
+		return nil, err
+	}
+	for code := range evdev.KEY {
+		if code > 0 && code < 0x100 {
+			if err := v.ioctl(uiSetKeyBit, uintptr(code)); err != nil {
+				f.Close()
+				return nil, err
+			}
+		}
+	}
+	dev := uinputUserDev{Bustype: 0x03, Vendor: vendor, Product: product, Version: 1} // BUS_USB
+	copy(dev.Name[:len(dev.Name)-1], name)
+	if err := binary.Write(f, binary.NativeEndian, &dev); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := v.ioctl(uiDevCreate, 0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return v, nil
+}
+
+func (v *virtualScanner) ioctl(req, arg uintptr) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, v.f.Fd(), req, arg); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func (v *virtualScanner) emit(typ, code uint16, value int32) error {
+	ev := evdev.InputEvent{Type: typ, Code: code, Value: value} // the kernel fills in the time
+	return binary.Write(v.f, binary.NativeEndian, &ev)
+}
+
+func (v *virtualScanner) press(k keyStroke) error {
+	var seq [][3]int32
+	if k.shift {
+		seq = append(seq, [3]int32{evdev.EV_KEY, evdev.KEY_LEFTSHIFT, 1})
+	}
+	seq = append(seq, [3]int32{evdev.EV_KEY, int32(k.code), 1}, [3]int32{evdev.EV_KEY, int32(k.code), 0})
+	if k.shift {
+		seq = append(seq, [3]int32{evdev.EV_KEY, evdev.KEY_LEFTSHIFT, 0})
+	}
+	for _, e := range seq {
+		if err := v.emit(uint16(e[0]), uint16(e[1]), e[2]); err != nil {
+			return err
+		}
+		if err := v.emit(evdev.EV_SYN, evdev.SYN_REPORT, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// strokes are the keys for a barcode, or an error naming a character the decoder couldn't
+// make out of any key.
+func (v *virtualScanner) strokes(code string) ([]keyStroke, error) {
+	var strokes []keyStroke
+	for _, r := range code {
+		k, ok := v.keys[r]
+		if !ok {
+			return nil, fmt.Errorf("no key types %q", r)
+		}
+		strokes = append(strokes, k)
+	}
+	return append(strokes, v.suffix...), nil
+}
+
+// typeCode types a barcode a key at a time, as fast as a scanner does.
+func (v *virtualScanner) typeCode(code string) error {
+	strokes, err := v.strokes(code)
+	if err != nil {
+		return err
+	}
+	for _, k := range strokes {
+		if err := v.press(k); err != nil {
+			return err
+		}
+		time.Sleep(v.delay/2 + time.Duration(rand.Int63n(int64(v.delay)+1)))
+	}
+	return nil
+}
+
+func (v *virtualScanner) close() error {
+	v.ioctl(uiDevDestroy, 0)
+	return v.f.Close()
+}
+
+// runEmulate implements `usbscanner emulate`: it creates a virtual scanner and types the
+// barcodes given with -text or made up with -generate, or else every line read from stdin.
+func runEmulate(args []string) {
+	fs := flag.NewFlagSet("emulate", flag.ExitOnError)
+	var texts listFlag
+	fs.Var(&texts, "text", "barcode to type, can be given several times")
+	name := fs.String("name", "Symbol Technologies virtual scanner", "device name, the default is found by the default device matcher")
+	vendor := fs.Uint("vendor", 0x05e0, "USB vendor ID of the device")
+	product := fs.Uint("product", 0x1200, "USB product ID of the device")
+	wait := fs.Duration("wait", 2*time.Second, "how long to wait after creating the device before typing")
+	delay := fs.Duration("key-delay", 2*time.Millisecond, "time between key presses, give or take half of it")
+	gap := fs.Duration("gap", 500*time.Millisecond, "time between barcodes")
+	enter := fs.Bool("enter", false, "press enter after every barcode, like many scanners do")
+	generate := fs.String("generate", "", "type made up barcodes of this kind, see usbscanner generate")
+	count := fs.Int("count", 10, "how many barcodes -generate types")
+	seed := fs.Int64("seed", 0, "seed for -generate, 0 for a random one")
+	aim := fs.Bool("aim", false, "start generated barcodes with their AIM symbology identifier")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: usbscanner emulate [-text barcode]... [flags]\n\nWithout -text or -generate, every line read from stdin is typed as a barcode.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *generate != "" {
+		g, err := newGenerator(*generate, *seed, *aim)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		for i := 0; i < *count; i++ {
+			texts = append(texts, g.next())
+		}
+	}
+
+	v, err := newVirtualScanner(*name, uint16(*vendor), uint16(*product))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not create the virtual scanner: %v\n", err)
+		os.Exit(1)
+	}
+	defer v.close()
+	v.delay = *delay
+	if *enter {
+		v.suffix = []keyStroke{{code: evdev.KEY_ENTER}}
+	}
+	fmt.Fprintf(os.Stderr, "Created %q\n", *name)
+	time.Sleep(*wait)
+
+	typeCode := func(code string) bool {
+		if err := v.typeCode(code); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not type %q: %v\n", code, err)
+			return false
+		}
+		return true
+	}
+	ok := true
+	if len(texts) > 0 {
+		for i, code := range texts {
+			if i > 0 {
+				time.Sleep(*gap)
+			}
+			ok = typeCode(code) && ok
+		}
+	} else {
+		sc := bufio.NewScanner(os.Stdin)
+		for sc.Scan() {
+			if code := strings.TrimRight(sc.Text(), "\r"); code != "" {
+				ok = typeCode(code) && ok
+				time.Sleep(*gap)
+			}
+		}
+	}
+	// Give the events time to be read before the device goes away.
+	time.Sleep(*gap)
+	if !ok {
+		v.close()
+		os.Exit(1)
+	}
+}
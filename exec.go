@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterSink("exec", func(cfg *SinkConfig) (Sink, error) { return newExecSink(cfg) })
+}
+
+// execSink runs an external command for every scan, as the escape hatch for whatever glue a
+// site needs. The command is run through /bin/sh with the barcode appended as its last
+// argument. Scan details are also passed in the environment (SCAN_ID, SCAN_CODE, SCAN_DEVICE,
+// SCAN_SYMBOLOGY, SCAN_TAGS and SCAN_TIME) and the rendered payload, the code by default,
+// is written to its stdin as a single line.
+type execSink struct {
+	payload
+	command     string
+	timeout     time.Duration
+	slots       chan struct{} // limits how many commands run at the same time
+	wg          sync.WaitGroup
+	atLeastOnce bool // wait for the command, whose failure fails the delivery
+}
+
+// newExecSink reads the options for an exec sink: timeout (default 10s), after which the
+// command is killed, and concurrency (default 1), the number of commands allowed to run at
+// once. Once that many are running further scans wait in the sink's queue. Delivering at
+// least once, Send waits for the command instead and a non-zero exit is a failed delivery,
+// retried like any other.
+func newExecSink(cfg *SinkConfig) (*execSink, error) {
+	if cfg.Arg == "" {
+		return nil, fmt.Errorf("exec sink needs a command")
+	}
+	timeout, err := cfg.DurationOption("timeout", 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	concurrency, err := cfg.IntOption("concurrency", 1)
+	if err != nil {
+		return nil, err
+	}
+	if concurrency < 1 {
+		return nil, fmt.Errorf("concurrency has to be at least 1")
+	}
+	return &execSink{command: cfg.Arg, timeout: timeout, slots: make(chan struct{}, concurrency), atLeastOnce: cfg.AtLeastOnce}, nil
+}
+
+func (s *execSink) Send(ctx context.Context, scan Scan) error {
+	input, err := s.render(scan, scan.Code)
+	if err != nil {
+		return err
+	}
+	select {
+	case s.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if s.atLeastOnce {
+		defer func() { <-s.slots }()
+		if out, err := s.run(scan, input); err != nil {
+			return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+		}
+		return nil
+	}
+	s.wg.Add(1)
+	go func() {
+		defer func() {
+			<-s.slots
+			s.wg.Done()
+		}()
+		if out, err := s.run(scan, input); err != nil {
+			slog.Warn("Command failed", "code", scan.Code, "error", err, "output", string(out))
+		}
+	}()
+	return nil
+}
+
+func (s *execSink) run(scan Scan, input string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", s.command+` "$@"`, "usbscanner", scan.Code)
+	cmd.Env = append(os.Environ(),
+		"SCAN_ID="+scan.ID,
+		"SCAN_CODE="+scan.Code,
+		"SCAN_DEVICE="+scan.Device,
+		"SCAN_SYMBOLOGY="+scan.Symbology,
+		"SCAN_TAGS="+strings.Join(scan.Tags, ","),
+		"SCAN_TIME="+scan.Time.Format(time.RFC3339Nano),
+	)
+	cmd.Stdin = strings.NewReader(input + "\n")
+	// Don't hang around for stray children of the command still holding on to its output.
+	cmd.WaitDelay = time.Second
+	return cmd.CombinedOutput()
+}
+
+// Close waits for commands that are still running.
+func (s *execSink) Close() error {
+	s.wg.Wait()
+	return nil
+}
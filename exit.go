@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"syscall"
+)
+
+// The exit codes of the daemon, so a provisioning script can tell why it didn't start
+// without reading the message.
+const (
+	exitFailure    = 1 // anything not below
+	exitUsage      = 2 // bad flags or arguments
+	exitConfig     = 3 // the config file, environment or flags have an error
+	exitNoDevice   = 4 // none of the devices the config picks is there
+	exitPermission = 5 // a device or file we need can't be opened by this user
+	exitSink       = 6 // a sink couldn't be set up, or lost scans on shutdown
+)
+
+// exitKinds name the exit codes for -error-format json.
+var exitKinds = map[int]string{
+	exitFailure:    "failure",
+	exitUsage:      "usage",
+	exitConfig:     "config",
+	exitNoDevice:   "no_device",
+	exitPermission: "permission",
+	exitSink:       "sink",
+}
+
+// errorFormat is how fatal reports an error: text, logged as any other error, or json, a
+// single object on a line of stderr, whatever the log settings.
+var errorFormat = "text"
+
+// exitError is an error with the exit code it is to end in.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+func (e *exitError) Unwrap() error { return e.err }
+
+// withExit gives err the exit code, unless it has one already from closer to the cause.
+func withExit(code int, err error) error {
+	var e *exitError
+	if err == nil || errors.As(err, &e) {
+		return err
+	}
+	return &exitError{code: code, err: err}
+}
+
+// noDevice gives err exitNoDevice if it is that the device isn't there, as opening a node
+// that doesn't exist or whose device is gone says.
+func noDevice(err error) error {
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, syscall.ENODEV) {
+		return withExit(exitNoDevice, err)
+	}
+	return err
+}
+
+// exitCode is the exit code for err: the one it was given, or exitPermission for a
+// permission error, or exitFailure.
+func exitCode(err error) int {
+	var e *exitError
+	switch {
+	case errors.As(err, &e):
+		return e.code
+	case errors.Is(err, fs.ErrPermission):
+		return exitPermission
+	}
+	return exitFailure
+}
+
+// errorJSON is an error that ends the program as -error-format json writes it: what couldn't
+// be done, why, and the kind and code of the exit.
+func errorJSON(msg string, err error) string {
+	code := exitCode(err)
+	b, _ := json.Marshal(struct {
+		Error string `json:"error"`
+		Cause string `json:"cause"`
+		Kind  string `json:"kind"`
+		Code  int    `json:"code"`
+	}{msg, err.Error(), exitKinds[code], code})
+	return string(b)
+}
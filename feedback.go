@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/gvalkov/golang-evdev"
+)
+
+// The scanner beeps when it has decoded a barcode, but it can't know whether the barcode is
+// one we take. With [feedback] the host has the last word and signals that on the scanner
+// too: a good read is a scan that passed the validation rules, a bad read one that didn't,
+// each with a beep code, or the LED lit for a moment, or both. This needs a scanner that
+// takes commands, over SSI or SNAPI, or in keyboard mode one of its keyboard LEDs, which
+// the host sets with a HID output report, with hid_led.
+
+// feedbackSignal is what to do on the scanner after a scan.
+type feedbackSignal struct {
+	beep *int
+	led  time.Duration
+}
+
+// signal returns what to do for a scan that passed validation if good, or didn't.
+func (c FeedbackConfig) signal(good bool) (feedbackSignal, bool) {
+	s := feedbackSignal{beep: c.BadBeep, led: c.BadLED.Duration}
+	if good {
+		s = feedbackSignal{beep: c.GoodBeep, led: c.GoodLED.Duration}
+	}
+	return s, s.beep != nil || s.led > 0
+}
+
+// signal queues the feedback for a scan whose validation returned err. When the scanner
+// is too slow to keep up, feedback is dropped rather than holding up the scans.
+func (d *dispatcher) signal(cfg FeedbackConfig, err error) {
+	s, ok := cfg.signal(err == nil)
+	if !ok || d.feedback == nil {
+		return
+	}
+	select {
+	case d.feedback <- s:
+	default:
+		slog.Warn("Dropping feedback, the scanner isn't keeping up")
+	}
+}
+
+// giveFeedback sends the queued feedback to the scanner, for as long as the station runs.
+func giveFeedback(device string, c scannerControl, feedback chan feedbackSignal) {
+	for s := range feedback {
+		var errs []error
+		if s.beep != nil {
+			errs = append(errs, c.beep(*s.beep))
+		}
+		if s.led > 0 {
+			if err := c.setLED(true); err != nil {
+				errs = append(errs, err)
+			} else {
+				time.Sleep(s.led)
+				errs = append(errs, c.setLED(false))
+			}
+		}
+		if err := errors.Join(errs...); err != nil {
+			slog.Warn("Could not give feedback on the scanner", "device", device, "error", err)
+		}
+	}
+}
+
+// hidLEDs are the keyboard LEDs hid_led can name.
+var hidLEDs = map[string]uint16{
+	"numlock":    evdev.LED_NUML,
+	"capslock":   evdev.LED_CAPSL,
+	"scrolllock": evdev.LED_SCROLLL,
+}
+
+// inputControl is what a scanner in keyboard mode takes from the host: one of its keyboard
+// LEDs, for scanners that can be set up to show it. It has no beeper and can't be disabled.
+type inputControl struct {
+	dev *evdev.InputDevice
+	led uint16
+}
+
+// newInputControl is the control of dev with the LED named led, if dev has that LED.
+func newInputControl(dev *evdev.InputDevice, led string) (*inputControl, error) {
+	code, ok := hidLEDs[led]
+	if !ok {
+		return nil, fmt.Errorf("feedback hid_led should be numlock, capslock or scrolllock, not %q", led)
+	}
+	if !slices.Contains(dev.CapabilitiesFlat[evdev.EV_LED], int(code)) {
+		return nil, fmt.Errorf("%s has no %s LED", dev.Name, led)
+	}
+	return &inputControl{dev: dev, led: code}, nil
+}
+
+func (c *inputControl) beep(int) error {
+	return errors.New("a scanner in keyboard mode can't be told to beep")
+}
+
+func (c *inputControl) setLED(on bool) error {
+	ev := evdev.InputEvent{Type: evdev.EV_LED, Code: c.led}
+	if on {
+		ev.Value = 1
+	}
+	return binary.Write(c.dev.File, binary.NativeEndian, &ev)
+}
+
+func (c *inputControl) setEnabled(bool) error {
+	return errors.New("a scanner in keyboard mode can't be disabled, pause it instead")
+}
+
+func (c *inputControl) setTrigger(bool) error {
+	return errors.New("a scanner in keyboard mode can't be triggered from the host")
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// errNoReader is returned when a scan is written to the FIFO while nobody has it open for
+// reading. We'd rather drop the scan than block the whole pipeline on a missing reader.
+var errNoReader = errors.New("no reader on fifo")
+
+func init() {
+	RegisterSink("fifo", func(cfg *SinkConfig) (Sink, error) {
+		if cfg.Arg == "" {
+			return nil, fmt.Errorf("fifo sink needs a path")
+		}
+		s, err := newFifoSink(cfg.Arg)
+		if err != nil {
+			return nil, err
+		}
+		return s, s.configureFormat(cfg)
+	})
+}
+
+// fifoSink writes scanned barcodes to a named pipe, one per line, so that shell scripts and
+// older programs can pick them up with a plain `read` and no other dependencies. With a
+// template, the template output makes up the line. With a CSV header every new reader
+// gets the header row first.
+type fifoSink struct {
+	payload
+	path string
+	file *os.File
+}
+
+// newFifoSink makes sure there is a named pipe at path, creating it if needed. The pipe
+// itself is only opened once the first barcode comes along.
+func newFifoSink(path string) (*fifoSink, error) {
+	fi, err := os.Stat(path)
+	switch {
+	case os.IsNotExist(err):
+		if err = syscall.Mkfifo(path, 0644); err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, err
+	case fi.Mode()&os.ModeNamedPipe == 0:
+		return nil, fmt.Errorf("%s exists and is not a named pipe", path)
+	}
+	return &fifoSink{path: path}, nil
+}
+
+// open opens the write end of the pipe. Opening a FIFO for writing normally blocks until
+// a reader shows up, so it is opened non-blocking, which fails with ENXIO instead.
+func (s *fifoSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+	if errors.Is(err, syscall.ENXIO) {
+		return errNoReader
+	} else if err != nil {
+		return err
+	}
+	if header, ok := s.header(); ok {
+		if _, err := f.WriteString(header + "\n"); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	s.file = f
+	return nil
+}
+
+// Send writes a single barcode down the pipe. A reader like `while read` in a shell loop
+// may have gone away since the last scan (EPIPE), in which case we reopen once to check
+// whether somebody new is listening.
+func (s *fifoSink) Send(ctx context.Context, scan Scan) error {
+	line, err := s.render(scan, scan.Code)
+	if err != nil {
+		return err
+	}
+	line += "\n"
+	for attempt := 0; attempt < 2; attempt++ {
+		if s.file == nil {
+			if err := s.open(); err != nil {
+				return err
+			}
+		}
+		_, err := s.file.WriteString(line)
+		if err == nil {
+			return nil
+		}
+		s.file.Close()
+		s.file = nil
+		if !errors.Is(err, syscall.EPIPE) {
+			return err
+		}
+	}
+	return errNoReader
+}
+
+// Close closes the write end of the pipe if it is open. The pipe itself is left in place
+// so readers can keep waiting on it across restarts.
+func (s *fifoSink) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+func init() {
+	RegisterSink("file", func(cfg *SinkConfig) (Sink, error) {
+		if cfg.Arg == "" {
+			return nil, fmt.Errorf("file sink needs a path")
+		}
+		s := &fileSink{path: cfg.Arg}
+		if err := s.configureFormat(cfg); err != nil {
+			return nil, err
+		}
+		return s, s.open()
+	})
+}
+
+// fileSink appends scans to a file, one per line: the code, or whatever the template or
+// format makes of it. With a CSV header, the header row is written when the file is new or
+// empty, so a file can be appended to across restarts and still open in a spreadsheet.
+type fileSink struct {
+	payload
+	path  string
+	file  *os.File
+	empty bool // nothing written to the file yet, so it still needs a header
+}
+
+func (s *fileSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.file = f
+	s.empty = fi.Size() == 0
+	return nil
+}
+
+func (s *fileSink) Send(ctx context.Context, scan Scan) error {
+	line, err := s.render(scan, scan.Code)
+	if err != nil {
+		return err
+	}
+	if header, ok := s.header(); ok && s.empty {
+		line = header + "\n" + line
+	}
+	if _, err = s.file.WriteString(line + "\n"); err != nil {
+		return err
+	}
+	s.empty = false
+	return nil
+}
+
+func (s *fileSink) Close() error {
+	return s.file.Close()
+}
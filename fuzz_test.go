@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"image"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gvalkov/golang-evdev"
+)
+
+// Fuzz targets for everything that takes input from outside: the events a device sends, the
+// packets of SSI scanners, the report descriptors of HID devices, the captures replay reads,
+// the keys decode reads, the tracks of badges, the IDs proximity readers type, the frames
+// of cameras and the specs of the config. Run one with e.g.
+//
+//	go test -run '^$' -fuzz FuzzDecoder -fuzztime 1m
+
+// fuzzEvents makes events out of arbitrary bytes, five to an event: what kind of event, the
+// code, the value and the milliseconds since the event before, so the timeout is hit too.
+func fuzzEvents(data []byte) []evdev.InputEvent {
+	var events []evdev.InputEvent
+	t := time.Unix(1700000000, 0)
+	for ; len(data) >= 5; data = data[5:] {
+		t = t.Add(time.Duration(data[4]) * time.Millisecond / 8)
+		ev := evdev.InputEvent{Code: uint16(data[1]) | uint16(data[2])<<8, Value: int32(data[3] % 3)}
+		switch data[0] % 4 {
+		case 0:
+			ev.Type, ev.Code = evdev.EV_SYN, evdev.SYN_REPORT
+		case 1:
+			ev.Type = evdev.EV_KEY
+		case 2:
+			ev.Type, ev.Code = evdev.EV_SYN, evdev.SYN_DROPPED
+		case 3:
+			ev.Type = evdev.EV_MSC
+		}
+		ev.Time = syscall.NsecToTimeval(t.UnixNano())
+		events = append(events, ev)
+	}
+	return events
+}
+
+// typedEvents are the events a scanner typing code sends, the way the emulator v types it,
+// nil if it can't.
+func typedEvents(v *virtualScanner, code string) []evdev.InputEvent {
+	strokes, err := v.strokes(code)
+	if err != nil {
+		return nil
+	}
+	var events []evdev.InputEvent
+	at := time.Unix(1700000000, 0)
+	emit := func(typ, code uint16, value int32) {
+		at = at.Add(time.Millisecond)
+		ev := evdev.InputEvent{Time: syscall.NsecToTimeval(at.UnixNano()), Type: typ, Code: code, Value: value}
+		events = append(events, ev, evdev.InputEvent{Time: ev.Time, Type: evdev.EV_SYN, Code: evdev.SYN_REPORT})
+	}
+	for _, k := range strokes {
+		if k.shift {
+			emit(evdev.EV_KEY, evdev.KEY_LEFTSHIFT, 1)
+		}
+		emit(evdev.EV_KEY, k.code, 1)
+		emit(evdev.EV_KEY, k.code, 0)
+		if k.shift {
+			emit(evdev.EV_KEY, evdev.KEY_LEFTSHIFT, 0)
+		}
+	}
+	return events
+}
+
+func FuzzDecoder(f *testing.F) {
+	f.Add([]byte{1, 42, 0, 1, 8, 1, 30, 0, 1, 8, 1, 42, 0, 0, 8, 1, 2, 0, 1, 8, 0, 0, 0, 0, 200, 1, 3, 0, 1, 8})
+	f.Add([]byte{1, 30, 0, 1, 8, 2, 0, 0, 0, 8, 1, 31, 0, 1, 8, 0, 0, 0, 0, 8, 1, 32, 0, 1, 8})
+	f.Add([]byte{1, 0xff, 0xff, 1, 0, 1, 58, 0, 1, 0, 1, 28, 0, 1, 0})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		td := newTimedDecoder(timerDuration, nil)
+		var scans []Scan
+		for _, ev := range fuzzEvents(data) {
+			if scan, ok := td.event("fuzz", &ev); ok {
+				scans = append(scans, scan)
+			}
+		}
+		scans = append(scans, td.flush()...)
+		for _, scan := range scans {
+			if len(scan.ID) != 26 {
+				t.Fatalf("scan %q has ID %q", scan.Code, scan.ID)
+			}
+			if scan.Time.Before(scan.Started) {
+				t.Fatalf("scan %q completed at %v, before it started at %v", scan.Code, scan.Time, scan.Started)
+			}
+		}
+		if d := td.decoders["fuzz"]; d != nil && d.barcode.Len() > 0 {
+			t.Fatalf("%q left over after the flush", d.barcode.String())
+		}
+	})
+}
+
+// FuzzTyping checks that whatever the emulator can type decodes back to what it typed.
+func FuzzTyping(f *testing.F) {
+	f.Add("4006381333931")
+	f.Add("ABC-123")
+	f.Add("https://example.com/p?id=42&x=Y_z")
+	f.Add("]C1Mixed Case !@#$%^&*()")
+	v := &virtualScanner{keys: typingKeys()}
+	f.Fuzz(func(t *testing.T, code string) {
+		events := typedEvents(v, code)
+		if events == nil || code == "" {
+			return
+		}
+		td := newTimedDecoder(timerDuration, nil)
+		for _, ev := range events {
+			if scan, ok := td.event("fuzz", &ev); ok {
+				t.Fatalf("%q split, %q came out first", code, scan.Code)
+			}
+		}
+		scans := td.flush()
+		if len(scans) != 1 {
+			t.Fatalf("%q decoded to %d scans", code, len(scans))
+		}
+		if got := scans[0].Code; scans[0].Symbology != "" {
+			got = code[:3] + got
+			if got != code {
+				t.Fatalf("typed %q, decoded %q with symbology %s", code, scans[0].Code, scans[0].Symbology)
+			}
+		} else if got != code {
+			t.Fatalf("typed %q, decoded %q", code, got)
+		}
+	})
+}
+
+func FuzzNewScan(f *testing.F) {
+	f.Add("]C1ABC")
+	f.Add("]Q3")
+	f.Add("]")
+	f.Add("]x0abc")
+	f.Fuzz(func(t *testing.T, code string) {
+		scan := newScan(code, "fuzz", time.Unix(1700000000, 0))
+		if scan.Symbology == "" && scan.Code != code {
+			t.Fatalf("%q became %q without a symbology", code, scan.Code)
+		}
+		if scan.Symbology != "" && code[:3]+scan.Code != code {
+			t.Fatalf("%q became %q with symbology %s", code, scan.Code, scan.Symbology)
+		}
+	})
+}
+
+// FuzzReplayCapture feeds arbitrary files to replay, which has to turn down what isn't a
+// capture rather than fall over.
+func FuzzReplayCapture(f *testing.F) {
+	f.Add([]byte(`{"kind":"start","time":"2024-01-01T00:00:00Z","version":1}
+{"kind":"event","time":"2024-01-01T00:00:00Z","device":"d","event":{"sec":1,"usec":0,"type":1,"code":30,"value":1}}
+{"kind":"scan","time":"2024-01-01T00:00:00Z","device":"d","scan":{"code":"a","device":"d"}}
+`))
+	f.Add([]byte(`{"kind":"start"}` + "\n" + `{"kind":"event","device":"d"}`))
+	f.Add([]byte(`{"kind":"event","event":{"sec":-9223372036854775808,"usec":-1,"type":1,"code":65535,"value":1}}`))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var decoded []Scan
+		recorded, err := replayCapture(bytes.NewReader(data), newTimedDecoder(timerDuration, nil), "", func(scan Scan) {
+			decoded = append(decoded, scan)
+		})
+		if err == nil {
+			compareScans(&bytes.Buffer{}, decoded, recorded)
+		}
+	})
+}
+
+// FuzzSSIPacket reads packets from arbitrary bytes, as from a serial line with noise on it.
+// A packet that is read without error has to encode back to the same packet.
+func FuzzSSIPacket(f *testing.F) {
+	f.Add(ssiPacket{opcode: ssiDecodeData, data: []byte{0x0B, '4', '0', '0', '6'}}.encode())
+	f.Add(append([]byte{0x00, 0x02, 0xFF}, ssiPacket{opcode: ssiAck}.encode()...))
+	f.Add([]byte{0x04, 0xD0, 0x04, 0x00, 0xFF, 0x27})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bufio.NewReader(bytes.NewReader(data))
+		for {
+			p, err := readSSIPacket(r)
+			if err == errSSIChecksum {
+				continue
+			} else if err != nil {
+				return
+			}
+			again, err := readSSIPacket(bufio.NewReader(bytes.NewReader(p.encode())))
+			if err != nil || again.opcode != p.opcode || again.source != p.source || again.status != p.status || !bytes.Equal(again.data, p.data) {
+				t.Fatalf("%+v encoded reads back as %+v, %v", p, again, err)
+			}
+		}
+	})
+}
+
+// FuzzReportDescriptor parses arbitrary report descriptors and reads the fields they
+// describe from a report that may well be too short for them.
+func FuzzReportDescriptor(f *testing.F) {
+	f.Add(hidposDescriptor, []byte{2, ']', 'E', '0', '4', '0', '0', '6'})
+	f.Add(bootKeyboardDescriptor, []byte{0x02, 0, 0x04})
+	f.Add([]byte{0xFE, 0x02, 0x00, 0xAA, 0xBB, 0xB4, 0x27, 0xFF, 0xFF, 0xFF, 0xFF}, []byte{})
+	f.Fuzz(func(t *testing.T, desc, report []byte) {
+		fields, err := parseReportDescriptor(desc)
+		if err != nil {
+			return
+		}
+		for _, field := range fields {
+			if field.offset < 0 || field.size < 0 || field.size > 32 || field.count < 0 {
+				t.Fatalf("field %+v", field)
+			}
+			if field.report != 0 && len(report) == 0 {
+				continue
+			}
+			if field.size == 8 {
+				field.bytes(report)
+			} else if field.count > 0 {
+				field.value(report, field.count-1)
+			}
+		}
+	})
+}
+
+// FuzzCamera draws the Code 128 of a text two pixels to a module and reads it back, and
+// decodes the text's bytes as a line of pixels of their own.
+func FuzzCamera(f *testing.F) {
+	f.Add("4006381333931")
+	f.Add("Hello, world")
+	f.Add("\xff\x00\x00\xff\xff\x00\xff\x00")
+	f.Fuzz(func(t *testing.T, text string) {
+		decodeFrame(&image.Gray{Pix: []byte(text), Stride: len(text), Rect: image.Rect(0, 0, len(text), 1)})
+		values, err := code128B(text)
+		if err != nil || text == "" {
+			return
+		}
+		line := bytes.Repeat([]byte{0xFF}, 2*programQuiet)
+		for i, w := range code128(values) {
+			line = append(line, bytes.Repeat([]byte{byte(i%2) * 0xFF}, 2*w)...)
+		}
+		line = append(line, bytes.Repeat([]byte{0xFF}, 2*programQuiet)...)
+		if got, ok := decodeCode128(lineRuns(line)); !ok || got != text {
+			t.Fatalf("the Code 128 of %q read as %q", text, got)
+		}
+	})
+}
+
+func FuzzParseProx(f *testing.F) {
+	f.Add("0004567890enter", "decimal", false, true)
+	f.Add("04A224E2", "hex", true, false)
+	f.Add("123,45678", "wiegand", false, false)
+	f.Fuzz(func(t *testing.T, code, format string, reverse, facility bool) {
+		p, err := parseProx(code, ProxConfig{Format: format, Reverse: reverse, Facility: facility})
+		if err != nil {
+			return
+		}
+		if _, err := hex.DecodeString(p.UID); err != nil || ((facility || format == "wiegand") && (p.Facility > 0xFF || p.Card > 0xFFFF)) {
+			t.Fatalf("%q read as %+v", code, p)
+		}
+	})
+}
+
+func FuzzParseBadge(f *testing.F) {
+	f.Add("%B4111111111111111^DOE/JOHN^25011011234?;4111111111111111=25011011234?")
+	f.Add(";00012345?")
+	f.Add("%E?;E?+12345?")
+	f.Fuzz(func(t *testing.T, s string) {
+		b, err := parseBadge(s)
+		if err != nil {
+			return
+		}
+		for _, track := range []*BadgeTrack{b.Track1, b.Track2, b.Track3} {
+			if track != nil && (strings.Contains(track.Data, "?") || !strings.Contains(track.Data, track.Number)) {
+				t.Fatalf("%q has a track %+v", s, track)
+			}
+		}
+	})
+}
+
+func FuzzParseWindow(f *testing.F) {
+	f.Add("06:00-22:00")
+	f.Add("mon-fri 06:00-22:00")
+	f.Add("sat,sun 22:00-02:00")
+	f.Add("sun-sat 00:00-24:00")
+	f.Fuzz(func(t *testing.T, spec string) {
+		w, err := parseWindow(spec)
+		if err != nil {
+			return
+		}
+		if w.from < 0 || w.from > 24*60 || w.to < 0 || w.to > 24*60 {
+			t.Fatalf("%q parsed to %d-%d", spec, w.from, w.to)
+		}
+		w.contains(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	})
+}
+
+// FuzzParseKeys checks that the keys of `usbscanner decode` named the way it prints them
+// parse back to the same keys.
+func FuzzParseKeys(f *testing.F) {
+	f.Add("KEY_LEFTSHIFT KEY_A KEY_1 KEY_MINUS KEY_2")
+	f.Add("leftshift a, 1 30 999")
+	f.Add(`level=INFO msg="Input event" device=x event="1.000000 type EV_KEY(1) code KEY_4(5) value 1(down)"`)
+	f.Fuzz(func(t *testing.T, line string) {
+		keys, err := parseKeys(line)
+		if err != nil {
+			return
+		}
+		var names []string
+		for _, code := range keys {
+			if name, ok := evdev.KEY[int(code)]; ok {
+				names = append(names, name)
+			} else {
+				names = append(names, strconv.Itoa(int(code)))
+			}
+		}
+		again, err := parseKeys(strings.Join(names, " "))
+		if err != nil || !slices.Equal(again, keys) {
+			t.Fatalf("%q parsed to %v, printed as %q that parses to %v, %v", line, keys, names, again, err)
+		}
+		decodeSteps(io.Discard, keys, nil)
+	})
+}
+
+func FuzzParseRoute(f *testing.F) {
+	f.Add("http:device=Symbol,tag=vip")
+	f.Add("mqtt:symbology=qr,match=^[0-9]{3,}$")
+	f.Add("auth:class=badge,device=door")
+	f.Add("file:")
+	f.Fuzz(func(t *testing.T, spec string) {
+		name, _, err := parseRoute(spec)
+		if err == nil && (name == "" || !strings.HasPrefix(spec, name+":")) {
+			t.Fatalf("%q parsed to sink %q", spec, name)
+		}
+	})
+}
+
+func FuzzFixWidth(f *testing.F) {
+	f.Add("4006381333931", 8, false)
+	f.Add("ü", 3, true)
+	f.Add("abc", -1, false)
+	f.Fuzz(func(t *testing.T, s string, width int, right bool) {
+		if width > 1000 {
+			return
+		}
+		got := fixWidth(s, width, right)
+		if want := max(width, 0); utf8.RuneCountInString(got) != want && utf8.ValidString(s) {
+			t.Fatalf("fixWidth(%q, %d) = %q, not %d characters", s, width, got, want)
+		}
+	})
+}
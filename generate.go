@@ -0,0 +1,176 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
+)
+
+// generator makes up barcodes that look like the real thing, for the emulator and for load
+// tests of sinks: GTIN-13s (EAN-13) with valid check digits, GS1-128 element strings and
+// QR codes with GS1 Digital Link URLs. Only characters the decoder can make out of key
+// presses are used, so everything generated can be typed by the emulator: GS1-128 ends with
+// its one variable length element, which needs no FNC1 separator, and the URLs have no query.
+type generator struct {
+	rng   *rand.Rand
+	kinds []string
+	aim   bool      // start with the AIM symbology identifier, as scanners set up to send them do
+	now   time.Time // dates are around this
+}
+
+// generatorKinds are what the generator makes, in the order of -kind's help.
+var generatorKinds = []string{"gtin13", "gs1-128", "qr-url"}
+
+// gs1Prefixes are common GS1 company prefixes by country, for GTINs that look like they
+// come off a shelf: US and Canada, France, Germany, the UK, Switzerland, the Netherlands,
+// Poland and China.
+var gs1Prefixes = []string{"0", "30", "40", "41", "42", "50", "76", "87", "590", "690", "692"}
+
+// newGenerator makes a generator of kind, one of generatorKinds or mixed for all of them.
+// The same seed makes the same barcodes, on the same day, 0 picks one at random.
+func newGenerator(kind string, seed int64, aim bool) (*generator, error) {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	g := &generator{rng: rand.New(rand.NewSource(seed)), aim: aim, now: time.Now()}
+	switch {
+	case kind == "mixed":
+		g.kinds = generatorKinds
+	case isGeneratorKind(kind):
+		g.kinds = []string{kind}
+	default:
+		return nil, fmt.Errorf("kind should be %s or mixed, not %q", strings.Join(generatorKinds, ", "), kind)
+	}
+	return g, nil
+}
+
+func isGeneratorKind(kind string) bool {
+	for _, k := range generatorKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// next makes a barcode.
+func (g *generator) next() string {
+	switch g.kinds[g.rng.Intn(len(g.kinds))] {
+	case "gs1-128":
+		return g.prefix("]C1") + g.gs1128()
+	case "qr-url":
+		return g.prefix("]Q1") + g.qrURL()
+	}
+	return g.prefix("]E0") + g.gtin13()
+}
+
+func (g *generator) prefix(aim string) string {
+	if g.aim {
+		return aim
+	}
+	return ""
+}
+
+func (g *generator) digits(n int) string {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte('0' + g.rng.Intn(10))
+	}
+	return string(b)
+}
+
+// alphanumeric is upper case letters and digits, as lot and serial numbers mostly are,
+// without the I and O that are easily taken for a 1 and a 0.
+func (g *generator) alphanumeric(min, max int) string {
+	const chars = "0123456789ABCDEFGHJKLMNPQRSTUVWXYZ"
+	b := make([]byte, min+g.rng.Intn(max-min+1))
+	for i := range b {
+		b[i] = chars[g.rng.Intn(len(chars))]
+	}
+	return string(b)
+}
+
+func (g *generator) gtin13() string {
+	prefix := gs1Prefixes[g.rng.Intn(len(gs1Prefixes))]
+	code := prefix + g.digits(12-len(prefix))
+	return code + string(gs1CheckDigit(code))
+}
+
+// gtin14 is a GTIN-13 with a packaging indicator in front, as on cases and pallets.
+func (g *generator) gtin14() string {
+	code := g.digits(1) + g.gtin13()[:12]
+	return code + string(gs1CheckDigit(code))
+}
+
+// gs1128 is a GTIN-14 (AI 01), often an expiry (17) or production date (11), and a batch
+// (10) or serial number (21), the way logistics labels have them.
+func (g *generator) gs1128() string {
+	s := "01" + g.gtin14()
+	switch g.rng.Intn(3) {
+	case 0:
+		s += "17" + g.now.AddDate(0, 0, g.rng.Intn(730)).Format("060102")
+	case 1:
+		s += "11" + g.now.AddDate(0, 0, -g.rng.Intn(365)).Format("060102")
+	}
+	if g.rng.Intn(2) == 0 {
+		return s + "10" + g.alphanumeric(1, 10)
+	}
+	return s + "21" + g.alphanumeric(6, 12)
+}
+
+// qrURL is a GS1 Digital Link, what QR codes on packaging encode these days: the GTIN and
+// possibly the batch and serial number as a path.
+func (g *generator) qrURL() string {
+	hosts := []string{"https://id.gs1.org", "https://example.com", "https://qr.example.net/dl"}
+	s := hosts[g.rng.Intn(len(hosts))] + "/01/" + g.gtin14()
+	if g.rng.Intn(2) == 0 {
+		s += "/10/" + g.alphanumeric(1, 10)
+	}
+	if g.rng.Intn(3) == 0 {
+		s += "/21/" + g.alphanumeric(6, 12)
+	}
+	return s
+}
+
+// gs1CheckDigit is the check digit for the digits of a GTIN or SSCC without it: from the
+// right, the digits are weighted 3, 1, 3, 1... and the check digit makes the sum a multiple
+// of ten.
+func gs1CheckDigit(digits string) byte {
+	sum := 0
+	for i := len(digits) - 1; i >= 0; i -= 2 {
+		sum += 3 * int(digits[i]-'0')
+		if i > 0 {
+			sum += int(digits[i-1] - '0')
+		}
+	}
+	return byte('0' + (10-sum%10)%10)
+}
+
+// runGenerate implements `usbscanner generate`, printing made up barcodes a line each.
+func runGenerate(args []string) {
+	fs := flag.NewFlagSet("generate", flag.ExitOnError)
+	kind := fs.String("kind", "mixed", "what to generate: "+strings.Join(generatorKinds, ", ")+" or mixed")
+	count := fs.Int("count", 10, "how many barcodes")
+	seed := fs.Int64("seed", 0, "the same seed generates the same barcodes, 0 for a random one")
+	aim := fs.Bool("aim", false, "start barcodes with their AIM symbology identifier")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: usbscanner generate [flags]\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	g, err := newGenerator(*kind, *seed, *aim)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	for i := 0; i < *count; i++ {
+		fmt.Println(g.next())
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the scans of the golden captures with what they decode to now")
+
+// TestGolden replays every capture in testdata/golden and checks that it decodes to the scans
+// it has. A capture can have a config of the same name next to it, with the keymap and
+// timeout of the station it comes from. After a change that is meant to decode differently,
+// -update rewrites the scans; check the diff.
+func TestGolden(t *testing.T) {
+	captures, err := filepath.Glob(filepath.Join("testdata", "golden", "*.ndjson"))
+	if err != nil || len(captures) == 0 {
+		t.Fatalf("no golden captures: %v", err)
+	}
+	for _, path := range captures {
+		t.Run(strings.TrimSuffix(filepath.Base(path), ".ndjson"), func(t *testing.T) {
+			config := strings.TrimSuffix(path, ".ndjson") + ".toml"
+			if _, err := os.Stat(config); err != nil {
+				config = ""
+			}
+			timeout, keymap, err := replayConfig(config, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var decoded []Scan
+			recorded, err := replayCapture(bytes.NewReader(data), newTimedDecoder(timeout, keymap), "", func(scan Scan) {
+				decoded = append(decoded, scan)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *update {
+				if err := updateGolden(path, data, decoded); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if len(recorded) == 0 {
+				t.Fatal("the capture has no scans to compare with, run with -update")
+			}
+			var diff strings.Builder
+			if !compareScans(&diff, decoded, recorded) {
+				t.Errorf("decodes differently:\n%s", diff.String())
+			}
+		})
+	}
+}
+
+// updateGolden replaces the scans of a capture with the ones decoded, after its events.
+func updateGolden(path string, data []byte, decoded []Scan) error {
+	var out bytes.Buffer
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		var rec captureRecord
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			return err
+		}
+		if rec.Kind != "scan" {
+			out.Write(sc.Bytes())
+			out.WriteByte('\n')
+		}
+	}
+	enc := json.NewEncoder(&out)
+	for _, scan := range decoded {
+		scan.ID = "" // made up by the replay, it would change every time
+		if err := enc.Encode(captureRecord{Kind: "scan", Time: scan.Time, Device: scan.Device, Scan: &scan}); err != nil {
+			return err
+		}
+	}
+	return os.WriteFile(path, out.Bytes(), 0644)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// healthCheck is one thing /healthz or /readyz looked at.
+type healthCheck struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type healthReport struct {
+	OK     bool          `json:"ok"`
+	Checks []healthCheck `json:"checks"`
+}
+
+func (r *healthReport) add(name string, err error) {
+	c := healthCheck{Name: name, OK: err == nil}
+	if err != nil {
+		c.Error = err.Error()
+		r.OK = false
+	}
+	r.Checks = append(r.Checks, c)
+}
+
+// liveChecks is what /healthz reports: whether the read loop and event processing of every
+// station still respond. If this fails restarting is the only thing that helps.
+func liveChecks(stations []*station) *healthReport {
+	r := &healthReport{OK: true}
+	for _, st := range stations {
+		var err error
+		if !st.live.check(time.Second) {
+			err = fmt.Errorf("event processing not responding")
+		}
+		r.add(st.component("events"), err)
+	}
+	return r
+}
+
+// readyChecks is what /readyz reports: on top of liveness, that every device is grabbed and
+// readable and that the last delivery of every sink went through. A sink that hasn't had
+// anything to deliver yet counts as ready.
+func readyChecks(stations []*station) *healthReport {
+	r := liveChecks(stations)
+	for _, st := range stations {
+		var err error
+		switch {
+		case st.d == nil:
+			err = fmt.Errorf("not started yet")
+		case st.stopping.Load():
+			err = fmt.Errorf("shutting down")
+		case st.readFailed.Load():
+			err = fmt.Errorf("reading %s fails", st.device.Fn)
+		}
+		r.add(st.component("device"), err)
+		if st.d == nil {
+			continue
+		}
+		st.d.mu.RLock()
+		sinks := st.d.current.sinks
+		st.d.mu.RUnlock()
+		for _, s := range sinks {
+			var err error
+			if last := s.lastErr.Load(); last != nil {
+				err = *last
+			}
+			r.add(st.component("sink "+s.name), err)
+		}
+	}
+	return r
+}
+
+// healthHandler serves a report as JSON, with 503 if anything failed so probes only need
+// the status code.
+func healthHandler(report func() *healthReport) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		r := report()
+		w.Header().Set("Content-Type", "application/json")
+		if !r.OK {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(r)
+	}
+}
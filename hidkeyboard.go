@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gvalkov/golang-evdev"
+)
+
+// A scanner in keyboard mode can also be read through its hidraw node rather than the input
+// device the kernel makes of it, where grabbing input devices isn't possible, in a container
+// say, or not wanted. The keyboard reports, found with the report descriptor, say which keys
+// are down; hidKeyboard turns the changes into the key events the input device would have
+// sent and the decoder works on them as always. Nothing is grabbed this way, so the scanner
+// keeps typing into whatever has the focus too unless the input device is kept from the
+// desktop, e.g. with a udev rule setting LIBINPUT_IGNORE_DEVICE.
+
+// hidKeyCodes are the evdev codes of the usages of the keyboard page, as the kernel has
+// them: letters from 0x04, digits from 0x1E, Enter 0x28 and so on.
+var hidKeyCodes = [...]uint16{
+	0, 0, 0, 0, 30, 48, 46, 32, 18, 33, 34, 35, 23, 36, 37, 38,
+	50, 49, 24, 25, 16, 19, 31, 20, 22, 47, 17, 45, 21, 44, 2, 3,
+	4, 5, 6, 7, 8, 9, 10, 11, 28, 1, 14, 15, 57, 12, 13, 26,
+	27, 43, 43, 39, 40, 41, 51, 52, 53, 58, 59, 60, 61, 62, 63, 64,
+	65, 66, 67, 68, 87, 88, 99, 70, 119, 110, 102, 104, 111, 107, 109, 106,
+	105, 108, 103, 69, 98, 55, 74, 78, 96, 79, 80, 81, 75, 76, 77, 71,
+	72, 73, 82, 83, 86, 127,
+}
+
+// hidModifierCodes are the evdev codes of the modifier usages 0xE0 to 0xE7.
+var hidModifierCodes = [...]uint16{
+	evdev.KEY_LEFTCTRL, evdev.KEY_LEFTSHIFT, evdev.KEY_LEFTALT, evdev.KEY_LEFTMETA,
+	evdev.KEY_RIGHTCTRL, evdev.KEY_RIGHTSHIFT, evdev.KEY_RIGHTALT, evdev.KEY_RIGHTMETA,
+}
+
+const hidKeyboardPage = 0x07
+
+// hidKeyCode is the evdev code of a usage of the keyboard page, 0 if there is none.
+func hidKeyCode(usage uint32) uint16 {
+	switch id := usage & 0xFFFF; {
+	case id < uint32(len(hidKeyCodes)):
+		return hidKeyCodes[id]
+	case id >= 0xE0 && id <= 0xE7:
+		return hidModifierCodes[id-0xE0]
+	}
+	return 0
+}
+
+// hidKeyboard reads a keyboard's reports from its hidraw node as key events.
+type hidKeyboard struct {
+	cfg HIDConfig
+
+	mu     sync.Mutex
+	f      *os.File
+	fields []hidField // of the keyboard report: modifier bits and the array of keys down
+	down   []uint16   // evdev codes of the keys down as of the last report
+}
+
+// keyboardFields finds the fields of the keyboard report of dev.
+func keyboardFields(dev hidrawDevice) ([]hidField, error) {
+	desc, err := dev.reportDescriptor()
+	if err != nil {
+		return nil, err
+	}
+	fields, err := parseReportDescriptor(desc)
+	if err != nil {
+		return nil, err
+	}
+	keys := keyFields(fields)
+	if keys == nil {
+		return nil, fmt.Errorf("%s is not a keyboard, its reports have no keys", dev.path)
+	}
+	return keys, nil
+}
+
+// keyFields picks the fields of the first report with keys out of fields, nil if none has.
+func keyFields(fields []hidField) []hidField {
+	var keys []hidField
+	for _, f := range fields {
+		if f.usage>>16 == hidKeyboardPage && (f.array || f.size == 1) && (len(keys) == 0 || f.report == keys[0].report) {
+			keys = append(keys, f)
+		}
+	}
+	if !slices.ContainsFunc(keys, func(f hidField) bool { return f.array }) {
+		return nil
+	}
+	return keys
+}
+
+func openHIDKeyboard(cfg HIDConfig, dev hidrawDevice) (*hidKeyboard, error) {
+	k := &hidKeyboard{cfg: cfg}
+	if err := k.open(dev); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func (k *hidKeyboard) open(dev hidrawDevice) error {
+	fields, err := keyboardFields(dev)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(dev.path, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return err
+	}
+	k.mu.Lock()
+	k.f, k.fields, k.down = f, fields, nil
+	k.mu.Unlock()
+	return nil
+}
+
+// read waits for the next keyboard report and returns the key events for the keys that
+// went up or down since the one before: releases first, then presses, modifiers pressed
+// before other keys and released after them, each followed by a SYN_REPORT.
+func (k *hidKeyboard) read() ([]evdev.InputEvent, error) {
+	k.mu.Lock()
+	f, fields := k.f, k.fields
+	k.mu.Unlock()
+	report := make([]byte, 512)
+reports:
+	for {
+		n, err := f.Read(report)
+		if err != nil {
+			return nil, err
+		}
+		r := report[:n]
+		if fields[0].report != 0 && (n == 0 || r[0] != fields[0].report) {
+			continue
+		}
+		var down []uint16
+		for _, field := range fields {
+			if !field.array {
+				if field.value(r, 0) != 0 {
+					down = append(down, hidKeyCode(field.usage))
+				}
+				continue
+			}
+			for i := 0; i < field.count; i++ {
+				switch v := field.value(r, i); {
+				case v == 1:
+					continue reports // too many keys at once to tell which, they stay as they were
+				case v > 3:
+					if code := hidKeyCode(field.usage + v); code != 0 {
+						down = append(down, code)
+					}
+				}
+			}
+		}
+		events := k.changes(down, syscall.NsecToTimeval(time.Now().UnixNano()))
+		if len(events) > 0 {
+			return events, nil
+		}
+	}
+}
+
+// changes are the events to get from the keys down before to those down now.
+func (k *hidKeyboard) changes(down []uint16, t syscall.Timeval) []evdev.InputEvent {
+	var events []evdev.InputEvent
+	key := func(code uint16, value int32) {
+		events = append(events, evdev.InputEvent{Time: t, Type: evdev.EV_KEY, Code: code, Value: value},
+			evdev.InputEvent{Time: t, Type: evdev.EV_SYN, Code: evdev.SYN_REPORT})
+	}
+	isModifier := func(code uint16) bool { return slices.Contains(hidModifierCodes[:], code) }
+	for _, modifiers := range []bool{false, true} {
+		for _, code := range k.down {
+			if isModifier(code) == modifiers && !slices.Contains(down, code) {
+				key(code, 0)
+			}
+		}
+	}
+	for _, modifiers := range []bool{true, false} {
+		for _, code := range down {
+			if isModifier(code) == modifiers && !slices.Contains(k.down, code) {
+				key(code, 1)
+			}
+		}
+	}
+	k.down = down
+	return events
+}
+
+// reopen looks for the keyboard again, it gets a new hidraw node when plugged in again.
+func (k *hidKeyboard) reopen() error {
+	k.close()
+	dev, err := findHidraw(k.cfg, keyboardFits)
+	if err != nil {
+		return err
+	}
+	return k.open(dev)
+}
+
+func (k *hidKeyboard) close() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.f.Close()
+}
+
+func keyboardFits(dev hidrawDevice) error {
+	_, err := keyboardFields(dev)
+	return err
+}
+
+// openHIDKeyboardStation opens the station for a scanner in keyboard mode read through its
+// hidraw node.
+func openHIDKeyboardStation(profile string, cfg *Config) (*station, error) {
+	dev, err := findHidraw(cfg.Hidraw, keyboardFits)
+	if err != nil {
+		return nil, err
+	}
+	name := cfg.Hidraw.Name
+	if name == "" {
+		name = dev.name
+	}
+	if name == "" {
+		name = dev.path
+	}
+	lock, err := lockDevice(cfg.LockDir, dev.path)
+	if err != nil {
+		return nil, err
+	}
+	k, err := openHIDKeyboard(cfg.Hidraw, dev)
+	if err != nil {
+		lock.Close()
+		if os.IsPermission(err) {
+			return nil, fmt.Errorf("%v; %s", err, permissionHint(dev.path))
+		}
+		return nil, err
+	}
+	s := &station{profile: profile, hid: k, lock: lock, live: newLiveness(), stopEvents: make(chan struct{}), scansDone: make(chan struct{}),
+		device: &evdev.InputDevice{Fn: dev.path, Name: name}}
+	slog.Info("Opened "+s.label(), "path", dev.path, "device", name, "protocol", "hidraw")
+	return s, nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Scanners in the USB HID Point of Sale mode, Honeywell's "HID POS" or Zebra's "HID POS
+// scanner", aren't keyboards but bar code scanners as the HID usage tables have them, usage
+// page 0x8C. Their scanned data reports carry the decoded data as it is, with the AIM
+// symbology identifier in fields of their own, so there is no keymap to get wrong. Where the
+// fields are comes from the report descriptor, barcodes longer than a report continue in
+// the next ones.
+
+// Usages of the bar code scanner page.
+const (
+	hidposPage                = 0x8C
+	hidposSymbologyID1        = 0xFB
+	hidposDecodedData         = 0xFE
+	hidposDecodeDataContinued = 0xFF
+)
+
+// hidposScanner reads the scanned data reports of a HID POS scanner.
+type hidposScanner struct {
+	cfg  HIDConfig
+	name string
+	path string
+
+	mu      sync.Mutex
+	f       *os.File
+	data    *hidField
+	aim     []*hidField // symbology identifiers 1 to 3, if any
+	more    *hidField   // set while the data continues in the next report
+	pending []byte
+}
+
+// hidposFields finds the fields of the scanned data report in the report descriptor
+// of dev.
+func hidposFields(dev hidrawDevice) (data *hidField, aim []*hidField, more *hidField, err error) {
+	desc, err := dev.reportDescriptor()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	fields, err := parseReportDescriptor(desc)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if data = findField(fields, hidUsage(hidposPage, hidposDecodedData)); data == nil || data.size != 8 {
+		return nil, nil, nil, fmt.Errorf("%s is not a HID POS scanner, its reports have no decoded data", dev.path)
+	}
+	for id := uint16(hidposSymbologyID1); id < hidposSymbologyID1+3; id++ {
+		if f := findField(fields, hidUsage(hidposPage, id)); f != nil && f.report == data.report {
+			aim = append(aim, f)
+		}
+	}
+	if f := findField(fields, hidUsage(hidposPage, hidposDecodeDataContinued)); f != nil && f.report == data.report {
+		more = f
+	}
+	return data, aim, more, nil
+}
+
+func hidposFits(dev hidrawDevice) error {
+	_, _, _, err := hidposFields(dev)
+	return err
+}
+
+func openHIDPOSScanner(cfg HIDConfig, dev hidrawDevice, name string) (*hidposScanner, error) {
+	s := &hidposScanner{cfg: cfg, name: name, path: dev.path}
+	if err := s.open(dev); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *hidposScanner) open(dev hidrawDevice) error {
+	data, aim, more, err := hidposFields(dev)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(dev.path, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.f, s.path, s.data, s.aim, s.more, s.pending = f, dev.path, data, aim, more, nil
+	s.mu.Unlock()
+	return nil
+}
+
+// readScan waits for the next scanned data report that completes a barcode.
+func (s *hidposScanner) readScan() (Scan, error) {
+	s.mu.Lock()
+	f, data, aim, more := s.f, s.data, s.aim, s.more
+	s.mu.Unlock()
+	report := make([]byte, 4096)
+	for {
+		n, err := f.Read(report)
+		if err != nil {
+			return Scan{}, err
+		}
+		r := report[:n]
+		if data.report != 0 && (n == 0 || r[0] != data.report) {
+			continue // another report, a status say
+		}
+		s.pending = append(s.pending, bytes.TrimRight(data.bytes(r), "\x00")...)
+		if more != nil && more.value(r, 0) != 0 {
+			continue
+		}
+		code := string(s.pending)
+		s.pending = nil
+		var id []byte
+		for _, f := range aim {
+			if c := byte(f.value(r, 0)); c != 0 {
+				id = append(id, c)
+			}
+		}
+		// The identifiers are those of AIM, with or without the ].
+		if len(id) == 2 {
+			code = "]" + string(id) + code
+		} else if len(id) == 3 && id[0] == ']' {
+			code = string(id) + code
+		}
+		return newScan(code, s.name, time.Now()), nil
+	}
+}
+
+// reopen looks for the scanner again, it gets a new hidraw node when plugged in again.
+func (s *hidposScanner) reopen() error {
+	s.close()
+	dev, err := findHidraw(s.cfg, hidposFits)
+	if err != nil {
+		return err
+	}
+	return s.open(dev)
+}
+
+func (s *hidposScanner) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.f.Close()
+}
+
+// openHIDPOSStation opens the station for a scanner in HID POS mode.
+func openHIDPOSStation(profile string, cfg *Config) (*station, error) {
+	dev, err := findHidraw(cfg.HIDPOS, hidposFits)
+	if err != nil {
+		return nil, err
+	}
+	name := cfg.HIDPOS.Name
+	if name == "" {
+		name = dev.name
+	}
+	if name == "" {
+		name = dev.path
+	}
+	return openSourceStation(profile, cfg, dev.path, name, "hidpos", func() (scanSource, error) {
+		return openHIDPOSScanner(cfg.HIDPOS, dev, name)
+	})
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Scanners that aren't keyboards show up as hidraw nodes, which pass on the reports of the
+// HID device as they are. What is where in a report is in the device's report descriptor,
+// a list of items each a byte with its type, tag and size followed by the data: global
+// items like the usage page and the size and count of the fields to come, local items with
+// their usages, and main items, Input for one, that add the fields to a report.
+
+// hidrawDevice is a hidraw node with what sysfs says about the HID device behind it.
+type hidrawDevice struct {
+	path            string
+	name            string
+	vendor, product int
+}
+
+// listHidraw lists the hidraw nodes.
+func listHidraw() ([]hidrawDevice, error) {
+	uevents, err := filepath.Glob("/sys/class/hidraw/hidraw*/device/uevent")
+	if err != nil {
+		return nil, err
+	}
+	var devices []hidrawDevice
+	for _, uevent := range uevents {
+		f, err := os.Open(uevent)
+		if err != nil {
+			continue
+		}
+		node := filepath.Base(filepath.Dir(filepath.Dir(uevent)))
+		dev := hidrawDevice{path: "/dev/" + node}
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			key, value, _ := strings.Cut(sc.Text(), "=")
+			switch key {
+			case "HID_NAME":
+				dev.name = value
+			case "HID_ID": // bus:vendor:product in hex, e.g. 0003:000005E0:00001900
+				if parts := strings.Split(value, ":"); len(parts) == 3 {
+					vendor, _ := strconv.ParseInt(parts[1], 16, 32)
+					product, _ := strconv.ParseInt(parts[2], 16, 32)
+					dev.vendor, dev.product = int(vendor), int(product)
+				}
+			}
+		}
+		f.Close()
+		devices = append(devices, dev)
+	}
+	return devices, nil
+}
+
+// reportDescriptor reads the report descriptor of the device from sysfs.
+func (d hidrawDevice) reportDescriptor() ([]byte, error) {
+	path, err := filepath.EvalSymlinks(d.path)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(filepath.Join("/sys/class/hidraw", filepath.Base(path), "device/report_descriptor"))
+}
+
+// findHidraw finds the device of cfg: the hidraw node at its path, or the first one with
+// its vendor and product IDs, those that are set, that fits, which returns why not if not.
+func findHidraw(cfg HIDConfig, fits func(hidrawDevice) error) (hidrawDevice, error) {
+	devices, err := listHidraw()
+	if err != nil {
+		return hidrawDevice{}, err
+	}
+	path := cfg.Path
+	if p, err := filepath.EvalSymlinks(path); err == nil {
+		path = p // by-id or a udev symlink
+	}
+	for _, dev := range devices {
+		if (path != "" && dev.path != path) ||
+			(cfg.Vendor != 0 && dev.vendor != cfg.Vendor) ||
+			(cfg.Product != 0 && dev.product != cfg.Product) {
+			continue
+		}
+		if err := fits(dev); err == nil {
+			return dev, nil
+		} else if path != "" {
+			return hidrawDevice{}, err
+		}
+	}
+	if path != "" {
+		return hidrawDevice{}, withExit(exitNoDevice, fmt.Errorf("%s is not a hidraw node", cfg.Path))
+	}
+	return hidrawDevice{}, withExit(exitNoDevice, fmt.Errorf("Could not find a fitting hidraw device with vendor %#04x and product %#04x", cfg.Vendor, cfg.Product))
+}
+
+// hidField is a field of an input report: count values of size bits each, offset bits into
+// the report after its ID, for a usage with its page in the high 16 bits.
+type hidField struct {
+	report              byte // ID, 0 if the device doesn't number its reports
+	usage               uint32
+	offset, size, count int
+	array               bool // the values are usages, as with the keys of a keyboard
+}
+
+// hidUsage puts a usage together from its page and ID.
+func hidUsage(page, id uint16) uint32 { return uint32(page)<<16 | uint32(id) }
+
+// parseReportDescriptor returns the fields of the input reports a report descriptor
+// describes, leaving out constant ones, which are padding.
+func parseReportDescriptor(desc []byte) ([]hidField, error) {
+	type globals struct {
+		page        uint32
+		size, count int
+		report      byte
+	}
+	var g globals
+	var stack []globals
+	var usages []uint32
+	var usageMin uint32
+	offsets := map[byte]int{}
+	var fields []hidField
+
+	for i := 0; i < len(desc); {
+		prefix := desc[i]
+		if prefix == 0xFE { // a long item, none of which are defined
+			if i+1 >= len(desc) {
+				return nil, errors.New("hid: report descriptor ends in a long item")
+			}
+			i += 3 + int(desc[i+1])
+			continue
+		}
+		size := [4]int{0, 1, 2, 4}[prefix&3]
+		if i+1+size > len(desc) {
+			return nil, errors.New("hid: report descriptor ends in the middle of an item")
+		}
+		var data uint32
+		for j := size - 1; j >= 0; j-- {
+			data = data<<8 | uint32(desc[i+1+j])
+		}
+		kind, tag := prefix>>2&3, prefix>>4
+		i += 1 + size
+
+		switch kind {
+		case 0: // main
+			if tag == 8 { // Input
+				if g.size > 32 || g.count > 4096 {
+					return nil, fmt.Errorf("hid: input of %d fields of %d bits", g.count, g.size)
+				}
+				for n := range usages {
+					if usages[n]>>16 == 0 {
+						usages[n] |= g.page << 16
+					}
+				}
+				constant, variable, buffered := data&1 != 0, data&2 != 0, data&0x100 != 0
+				offset := offsets[g.report]
+				offsets[g.report] += g.size * g.count
+				switch {
+				case constant:
+				case variable && !buffered:
+					// A value for each usage, the last one repeated for the rest.
+					for n := 0; n < g.count; n++ {
+						usage := uint32(0)
+						if len(usages) > 0 {
+							usage = usages[min(n, len(usages)-1)]
+						}
+						if last := len(fields) - 1; last >= 0 && n > 0 && fields[last].usage == usage && fields[last].report == g.report {
+							fields[last].count++
+							continue
+						}
+						fields = append(fields, hidField{report: g.report, usage: usage, offset: offset + n*g.size, size: g.size, count: 1})
+					}
+				default:
+					f := hidField{report: g.report, offset: offset, size: g.size, count: g.count, array: !variable}
+					if len(usages) > 0 {
+						f.usage = usages[0]
+					}
+					fields = append(fields, f)
+				}
+			}
+			usages = nil
+		case 1: // global
+			switch tag {
+			case 0:
+				g.page = data
+			case 7:
+				g.size = int(data)
+			case 8:
+				g.report = byte(data)
+			case 9:
+				g.count = int(data)
+			case 10:
+				stack = append(stack, g)
+			case 11:
+				if len(stack) == 0 {
+					return nil, errors.New("hid: pop without a push in the report descriptor")
+				}
+				g, stack = stack[len(stack)-1], stack[:len(stack)-1]
+			}
+		case 2: // local, a usage of 4 bytes has its page in it
+			switch tag {
+			case 0:
+				usages = append(usages, data)
+			case 1:
+				usageMin = data
+			case 2:
+				if data >= usageMin && data-usageMin < 4096 {
+					for u := usageMin; u <= data; u++ {
+						usages = append(usages, u)
+					}
+				}
+			}
+		}
+	}
+	return fields, nil
+}
+
+// value is the nth value of the field in report, which starts with its ID if it has one.
+func (f hidField) value(report []byte, n int) uint32 {
+	if f.report != 0 {
+		report = report[1:]
+	}
+	var v uint32
+	for b := 0; b < f.size; b++ {
+		bit := f.offset + n*f.size + b
+		if bit/8 < len(report) && report[bit/8]>>(bit%8)&1 != 0 {
+			v |= 1 << b
+		}
+	}
+	return v
+}
+
+// bytes are the values of a field of bytes in report.
+func (f hidField) bytes(report []byte) []byte {
+	b := make([]byte, 0, f.count)
+	for n := 0; n < f.count; n++ {
+		b = append(b, byte(f.value(report, n)))
+	}
+	return b
+}
+
+// findField finds the field with usage among fields.
+func findField(fields []hidField, usage uint32) *hidField {
+	for i := range fields {
+		if fields[i].usage == usage {
+			return &fields[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/gvalkov/golang-evdev"
+)
+
+// hidposDescriptor is the report descriptor of a HID POS scanner like those in the wild: a
+// scanned data report with ID 2 and three symbology identifiers, 56 bytes of decoded data,
+// a vendor field in between and the continued flag in a byte of its own.
+var hidposDescriptor = []byte{
+	0x05, 0x8C, // Usage Page (Bar Code Scanner)
+	0x09, 0x02, // Usage (Bar Code Scanner)
+	0xA1, 0x01, // Collection (Application)
+	0x09, 0x12, //   Usage (Scanned Data Report)
+	0xA1, 0x02, //   Collection (Logical)
+	0x85, 0x02, //     Report ID (2)
+	0x15, 0x00, //     Logical Minimum (0)
+	0x26, 0xFF, 0x00, // Logical Maximum (255)
+	0x75, 0x08, //     Report Size (8)
+	0x95, 0x03, //     Report Count (3)
+	0x09, 0xFB, 0x09, 0xFC, 0x09, 0xFD, // Usages (Symbology Identifier 1 to 3)
+	0x81, 0x02, //     Input (Data, Variable)
+	0x95, 0x38, //     Report Count (56)
+	0x09, 0xFE, //     Usage (Decoded Data)
+	0x82, 0x02, 0x01, // Input (Data, Variable, Buffered Bytes)
+	0xA4,             //     Push
+	0x06, 0x66, 0xFF, //     Usage Page (vendor)
+	0x95, 0x02, //     Report Count (2)
+	0x09, 0x01, //     Usage (1)
+	0x81, 0x02, //     Input (Data, Variable)
+	0xB4,       //     Pop
+	0x75, 0x01, //     Report Size (1)
+	0x95, 0x01, //     Report Count (1)
+	0x25, 0x01, //     Logical Maximum (1)
+	0x09, 0xFF, //     Usage (Decode Data Continued)
+	0x81, 0x02, //     Input (Data, Variable)
+	0x75, 0x07, //     Report Size (7)
+	0x81, 0x03, //     Input (Constant)
+	0xC0, //   End Collection
+	0xC0, // End Collection
+}
+
+func TestHIDPOSScanner(t *testing.T) {
+	fields, err := parseReportDescriptor(hidposDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := findField(fields, hidUsage(hidposPage, hidposDecodedData))
+	more := findField(fields, hidUsage(hidposPage, hidposDecodeDataContinued))
+	if data == nil || data.report != 2 || data.offset != 24 || data.count != 56 || more == nil || more.offset != 24+56*8+16 {
+		t.Fatalf("fields %+v", fields)
+	}
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Skip(err)
+	}
+	syscall.SetNonblock(fds[0], true)
+	host, scanner := os.NewFile(uintptr(fds[0]), "host"), os.NewFile(uintptr(fds[1]), "scanner")
+	defer scanner.Close()
+	s := &hidposScanner{name: "hidpos", f: host, data: data, more: more}
+	for id := uint16(hidposSymbologyID1); id < hidposSymbologyID1+3; id++ {
+		s.aim = append(s.aim, findField(fields, hidUsage(hidposPage, id)))
+	}
+	defer s.close()
+
+	report := func(aim, data string, continued bool) []byte {
+		r := make([]byte, 1+3+56+2+1)
+		r[0] = 2
+		copy(r[1:], aim)
+		copy(r[4:], data)
+		r[60], r[61] = 0xAA, 0x55 // the vendor field
+		if continued {
+			r[62] = 1
+		}
+		return r
+	}
+	code := strings.Repeat("0123456789", 7)
+	scanner.Write([]byte{1, 0xFF})                 // a report of another kind
+	scanner.Write(report("]Q1", code[:56], true))  // the first 56 characters
+	scanner.Write(report("]Q1", code[56:], false)) // the rest
+	scanner.Write(report("E0", "4006381333931", false))
+	for _, want := range []struct{ code, symbology string }{{code, "qr"}, {"4006381333931", "ean"}} {
+		scan, err := s.readScan()
+		if err != nil || scan.Code != want.code || scan.Symbology != want.symbology {
+			t.Fatalf("scan %q %s, %v, not %q %s", scan.Code, scan.Symbology, err, want.code, want.symbology)
+		}
+	}
+}
+
+// bootKeyboardDescriptor is the report descriptor of the boot keyboard in the HID spec, which
+// scanners in keyboard mode use: a byte of modifier bits, a reserved byte and six keys.
+var bootKeyboardDescriptor = []byte{
+	0x05, 0x01, // Usage Page (Generic Desktop)
+	0x09, 0x06, // Usage (Keyboard)
+	0xA1, 0x01, // Collection (Application)
+	0x05, 0x07, //   Usage Page (Keyboard)
+	0x19, 0xE0, //   Usage Minimum (Left Control)
+	0x29, 0xE7, //   Usage Maximum (Right GUI)
+	0x15, 0x00, //   Logical Minimum (0)
+	0x25, 0x01, //   Logical Maximum (1)
+	0x75, 0x01, //   Report Size (1)
+	0x95, 0x08, //   Report Count (8)
+	0x81, 0x02, //   Input (Data, Variable)
+	0x95, 0x01, //   Report Count (1)
+	0x75, 0x08, //   Report Size (8)
+	0x81, 0x03, //   Input (Constant)
+	0x95, 0x05, //   Report Count (5)
+	0x75, 0x01, //   Report Size (1)
+	0x05, 0x08, //   Usage Page (LEDs)
+	0x19, 0x01, //   Usage Minimum (Num Lock)
+	0x29, 0x05, //   Usage Maximum (Kana)
+	0x91, 0x02, //   Output (Data, Variable)
+	0x95, 0x01, //   Report Count (1)
+	0x75, 0x03, //   Report Size (3)
+	0x91, 0x03, //   Output (Constant)
+	0x95, 0x06, //   Report Count (6)
+	0x75, 0x08, //   Report Size (8)
+	0x15, 0x00, //   Logical Minimum (0)
+	0x25, 0x65, //   Logical Maximum (101)
+	0x05, 0x07, //   Usage Page (Keyboard)
+	0x19, 0x00, //   Usage Minimum (0)
+	0x29, 0x65, //   Usage Maximum (101)
+	0x81, 0x00, //   Input (Data, Array)
+	0xC0, // End Collection
+}
+
+func TestHIDKeyboard(t *testing.T) {
+	fields, err := parseReportDescriptor(bootKeyboardDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := keyFields(fields)
+	if len(keys) != 9 || !keys[8].array || keys[8].offset != 16 || keys[8].count != 6 {
+		t.Fatalf("fields %+v", fields)
+	}
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Skip(err)
+	}
+	syscall.SetNonblock(fds[0], true)
+	host, scanner := os.NewFile(uintptr(fds[0]), "host"), os.NewFile(uintptr(fds[1]), "scanner")
+	defer scanner.Close()
+	k := &hidKeyboard{f: host, fields: keys}
+	defer k.close()
+
+	scanner.Write([]byte{0x02, 0, 0x04, 0, 0, 0, 0, 0})             // shift and A
+	scanner.Write([]byte{0x02, 0, 0x04, 0, 0, 0, 0, 0})             // the same again, nothing changed
+	scanner.Write([]byte{0, 0, 0x01, 0x01, 0x01, 0x01, 0x01, 0x01}) // rollover, keys as they were
+	scanner.Write([]byte{0, 0, 0x1E, 0, 0, 0, 0, 0})                // 1 down, A and shift up
+	var got []string
+	for len(got) < 5 {
+		events, err := k.read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, ev := range events {
+			if ev.Type == evdev.EV_KEY {
+				got = append(got, fmt.Sprintf("%s %d", evdev.KEY[int(ev.Code)], ev.Value))
+			}
+		}
+	}
+	want := "KEY_LEFTSHIFT 1,KEY_A 1,KEY_A 0,KEY_LEFTSHIFT 0,KEY_1 1"
+	if strings.Join(got, ",") != want {
+		t.Errorf("events %s, not %s", strings.Join(got, ","), want)
+	}
+}
+
+func TestHIDScale(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Skip(err)
+	}
+	syscall.SetNonblock(fds[0], true)
+	host, scale := os.NewFile(uintptr(fds[0]), "host"), os.NewFile(uintptr(fds[1]), "scale")
+	defer scale.Close()
+	s := &hidScale{name: "scale", f: host}
+	defer s.close()
+
+	scale.Write([]byte{3, scaleInMotion, 2, 0xFF, 0x10, 0x00})
+	scale.Write([]byte{3, scaleStable, 3, 0xFD, 0xE2, 0x04}) // 1250 * 10^-3 kg
+	scale.Write([]byte{3, scaleStable, 3, 0xFD, 0xE2, 0x04}) // still on the scale
+	scale.Write([]byte{3, scaleZero, 3, 0xFD, 0x00, 0x00})
+	scale.Write([]byte{3, scaleStable, 11, 0xFF, 0x2C, 0x01}) // 300 * 10^-1 oz
+	for _, want := range []Weight{{1.25, "kg"}, {30, "oz"}} {
+		scan, err := s.readScan()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if scan.Weight == nil || *scan.Weight != want || scan.Symbology != "weight" || scan.Code != strconv.FormatFloat(want.Value, 'f', -1, 64) {
+			t.Errorf("scan %q of symbology %q weighing %+v, not %+v", scan.Code, scan.Symbology, scan.Weight, want)
+		}
+	}
+}
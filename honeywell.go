@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Honeywell scanners, Voyagers and Xenons among them, send their scans over a serial port
+// as they are, like protocol raw, but also take the commands of their programming menus
+// there: SYN M CR and then the commands, each a tag, a subtag and data, separated by ; and
+// ended by . to store them or ! to only use them until the scanner is powered off. A ?
+// instead of the data asks for the setting, REVINF. for the firmware and so on. The scanner
+// answers with the commands, each followed by ACK, ENQ for a tag it doesn't know or NAK for
+// data out of range, and the terminator. SYN T CR and SYN U CR pull and release the trigger.
+
+const (
+	hwACK = 0x06
+	hwENQ = 0x05
+	hwNAK = 0x15
+)
+
+// menuControl is a scanner that takes menu commands, see honeywell.go.
+type menuControl interface {
+	menu(command string) (string, error)
+}
+
+// honeywellScanner reads a Honeywell scanner in serial mode and sends it menu commands.
+type honeywellScanner struct {
+	*rawScanner
+
+	cmd     sync.Mutex // one command at a time
+	mu      sync.Mutex
+	reply   chan []byte // set while a command waits for its answer
+	partial []byte
+}
+
+func openHoneywellScanner(sc SerialConfig, name string, timeout time.Duration) (*honeywellScanner, error) {
+	raw, err := openRawScanner(sc, name, timeout)
+	if err != nil {
+		return nil, err
+	}
+	h := &honeywellScanner{rawScanner: raw}
+	raw.replies = h.takeReply
+	return h, nil
+}
+
+// takeReply takes the answer to the command waiting for one out of data, as it comes in,
+// and returns the rest, scan data.
+func (h *honeywellScanner) takeReply(data []byte) []byte {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.reply == nil {
+		return data
+	}
+	h.partial = append(h.partial, data...)
+	for i := 0; i+1 < len(h.partial); i++ {
+		if c := h.partial[i]; (c == hwACK || c == hwENQ || c == hwNAK) && (h.partial[i+1] == '.' || h.partial[i+1] == '!') {
+			h.reply <- h.partial[:i+2]
+			rest := h.partial[i+2:]
+			h.reply, h.partial = nil, nil
+			return rest
+		}
+	}
+	return nil
+}
+
+// menu sends menu commands, e.g. "BEPLVL?" or "BEPLVL2." and returns the answer without
+// ACKs and terminator. The scanner stores them unless they end with !.
+func (h *honeywellScanner) menu(command string) (string, error) {
+	if !strings.HasSuffix(command, ".") && !strings.HasSuffix(command, "!") {
+		command += "."
+	}
+	h.cmd.Lock()
+	defer h.cmd.Unlock()
+	reply := make(chan []byte, 1)
+	h.mu.Lock()
+	h.reply, h.partial = reply, nil
+	h.mu.Unlock()
+	if err := h.write([]byte("\x16M\r" + command)); err != nil {
+		return "", err
+	}
+	select {
+	case r := <-reply:
+		return parseMenuReply(r)
+	case <-time.After(2 * time.Second):
+		h.mu.Lock()
+		h.reply, h.partial = nil, nil
+		h.mu.Unlock()
+		return "", fmt.Errorf("honeywell: no answer to %s", command)
+	}
+}
+
+// parseMenuReply checks the answer to menu commands, the status after each of them.
+func parseMenuReply(r []byte) (string, error) {
+	r = r[:len(r)-1] // the terminator
+	var answers []string
+	var errs []error
+	for _, part := range bytes.Split(r, []byte(";")) {
+		if len(part) == 0 {
+			continue
+		}
+		text := string(bytes.TrimSpace(part[:len(part)-1]))
+		switch part[len(part)-1] {
+		case hwACK:
+		case hwENQ:
+			errs = append(errs, fmt.Errorf("honeywell: %s: the scanner doesn't know this command", text))
+		case hwNAK:
+			errs = append(errs, fmt.Errorf("honeywell: %s: the value is out of range", text))
+		default:
+			errs = append(errs, fmt.Errorf("honeywell: %q isn't an answer", part))
+		}
+		answers = append(answers, text)
+	}
+	return strings.Join(answers, ";"), errors.Join(errs...)
+}
+
+// identity asks the scanner for its revision information, REVINF, which has a line for each
+// of the product name, the serial number, the software revision and more, e.g. "Product
+// Name: Xenon 1900".
+func (h *honeywellScanner) identity() (scannerIdentity, error) {
+	r, err := h.menu("REVINF")
+	if err != nil {
+		return scannerIdentity{}, err
+	}
+	var id scannerIdentity
+	for _, line := range strings.Split(strings.TrimPrefix(r, "REVINF"), "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		value = strings.TrimSpace(value)
+		if !ok || value == "" {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "Product Name":
+			id.Model = value
+		case "Serial Number":
+			id.Serial = value
+		case "Software Revision":
+			id.Firmware = value
+		case "Software Part Number":
+			if id.Firmware == "" {
+				id.Firmware = value
+			}
+		}
+	}
+	return id, nil
+}
+
+func (h *honeywellScanner) setTrigger(pulled bool) error {
+	if pulled {
+		return h.write([]byte("\x16T\r"))
+	}
+	return h.write([]byte("\x16U\r"))
+}
+
+func (h *honeywellScanner) beep(int) error {
+	return errors.New("a Honeywell scanner can't be told to beep, set its beeper with menu commands")
+}
+
+func (h *honeywellScanner) setLED(bool) error {
+	return errors.New("a Honeywell scanner's LED can't be set over the serial port")
+}
+
+func (h *honeywellScanner) setEnabled(bool) error {
+	return errors.New("a Honeywell scanner can't be disabled over the serial port, pause it instead")
+}
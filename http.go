@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"time"
+)
+
+// startHTTP serves the metrics and health checks at http_listen, or on a socket systemd
+// passed us named "http". It is off without either.
+func startHTTP(cfg *Config, stations []*station) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w, stations)
+	})
+	mux.Handle("/healthz", healthHandler(func() *healthReport { return liveChecks(stations) }))
+	mux.Handle("/readyz", healthHandler(func() *healthReport { return readyChecks(stations) }))
+	if cfg.Pprof {
+		servePprof(mux, cfg.PprofToken)
+	}
+
+	l := activatedListener("http")
+	if l == nil {
+		if cfg.HTTPListen == "" {
+			if cfg.Pprof {
+				slog.Warn("pprof needs http_listen, not serving it")
+			}
+			return
+		}
+		var err error
+		if l, err = net.Listen("tcp", cfg.HTTPListen); err != nil {
+			slog.Error("Could not listen for HTTP", "error", err)
+			return
+		}
+	}
+	slog.Info("Serving metrics and health checks", "url", "http://"+l.Addr().String(), "pprof", cfg.Pprof)
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("HTTP server", "error", err)
+		}
+	}()
+}
+
+// servePprof adds the Go profiler at /debug/pprof/, for looking into CPU or memory use
+// without a special build. Profiles show a lot about the process, so with a token set they
+// need an "Authorization: Bearer <token>" header.
+func servePprof(mux *http.ServeMux, token string) {
+	guard := func(h http.HandlerFunc) http.HandlerFunc {
+		if token == "" {
+			return h
+		}
+		want := []byte("Bearer " + token)
+		return func(w http.ResponseWriter, r *http.Request) {
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			h(w, r)
+		}
+	}
+	mux.HandleFunc("/debug/pprof/", guard(pprof.Index))
+	mux.HandleFunc("/debug/pprof/cmdline", guard(pprof.Cmdline))
+	mux.HandleFunc("/debug/pprof/profile", guard(pprof.Profile))
+	mux.HandleFunc("/debug/pprof/symbol", guard(pprof.Symbol))
+	mux.HandleFunc("/debug/pprof/trace", guard(pprof.Trace))
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Who a scanner is, its model, serial number and firmware, is for fleet inventory: in the
+// status, as a metric and with every scan. USB tells the model and the serial number of
+// most scanners, whichever way they are read, and the release number of the device, which
+// is what firmware revision it reports. Scanners that take commands are asked as well when
+// they are attached, SSI for the software revision and Honeywell's REVINF for all of it,
+// which take precedence.
+
+// scannerIdentity is what is known about who a scanner is.
+type scannerIdentity struct {
+	Vendor   string `json:"vendor,omitempty"`
+	Model    string `json:"model,omitempty"`
+	Serial   string `json:"serial,omitempty"`
+	Firmware string `json:"firmware,omitempty"`
+}
+
+// identifier is a scanner that can be asked who it is.
+type identifier interface {
+	identity() (scannerIdentity, error)
+}
+
+// sysfsClasses are the sysfs classes of the nodes scanners are read from, by node name.
+var sysfsClasses = map[string]string{"event": "input", "hidraw": "hidraw", "tty": "tty"}
+
+// usbIdentity is what USB says about the device behind the node at path, by way of sysfs.
+func usbIdentity(path string) scannerIdentity {
+	if p, err := filepath.EvalSymlinks(path); err == nil {
+		path = p
+	}
+	node := filepath.Base(path)
+	var class string
+	for prefix, c := range sysfsClasses {
+		if strings.HasPrefix(node, prefix) {
+			class = c
+		}
+	}
+	if class == "" {
+		return scannerIdentity{}
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Join("/sys/class", class, node, "device"))
+	if err != nil {
+		return scannerIdentity{}
+	}
+	// Up to the USB device, the one with the IDs, from the interface or the input device.
+	for ; dir != "/" && dir != "."; dir = filepath.Dir(dir) {
+		if _, err := os.Stat(filepath.Join(dir, "idVendor")); err == nil {
+			break
+		}
+	}
+	attr := func(name string) string {
+		b, _ := os.ReadFile(filepath.Join(dir, name))
+		return strings.TrimSpace(string(b))
+	}
+	id := scannerIdentity{Vendor: attr("manufacturer"), Model: attr("product"), Serial: attr("serial")}
+	if bcd := attr("bcdDevice"); len(bcd) == 4 {
+		id.Firmware = strings.TrimLeft(bcd[:2], "0") + "." + bcd[2:]
+		if id.Firmware[0] == '.' {
+			id.Firmware = "0" + id.Firmware
+		}
+	}
+	return id
+}
+
+// merge fills in what id doesn't know from other.
+func (id scannerIdentity) merge(other scannerIdentity) scannerIdentity {
+	for _, f := range []struct {
+		to   *string
+		from string
+	}{
+		{&id.Vendor, other.Vendor}, {&id.Model, other.Model}, {&id.Serial, other.Serial}, {&id.Firmware, other.Firmware},
+	} {
+		if *f.to == "" {
+			*f.to = f.from
+		}
+	}
+	return id
+}
+
+// identify finds out who the station's scanner is, from the scanner if it can be asked and
+// from USB, and keeps it for the status and the scans.
+func (s *station) identify() {
+	var id scannerIdentity
+	if i, ok := s.source.(identifier); ok {
+		var err error
+		if id, err = i.identity(); err != nil {
+			slog.Warn("Could not ask the scanner who it is", "device", s.device.Name, "error", err)
+		}
+	}
+	id = id.merge(usbIdentity(s.device.Fn))
+	if id == (scannerIdentity{}) {
+		return
+	}
+	s.d.identity.Store(&id)
+	slog.Info("Scanner identified", "device", s.device.Name, "vendor", id.Vendor, "model", id.Model, "serial", id.Serial, "firmware", id.Firmware)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// A hands-free scanner on a presentation stand keeps its illumination on all day, even at a
+// kiosk nobody uses at night. With idle_after it is put to sleep once nothing was scanned
+// for that long, with its LEDs off, and wakes on its own when something is held in front
+// of it, if it is set up to, or when `usbscanner ctl wake` wakes it. `ctl sleep` puts it to
+// sleep right away. Over SSI the scanner only sleeps with its low power mode turned on,
+// parameter 0x80.
+
+const ssiSleep = 0xEB
+
+// ssiWakeDelay is how long to give the scanner after the WAKEUP character before sending
+// it anything, the manual says at least 10ms.
+const ssiWakeDelay = 50 * time.Millisecond
+
+// idler is a scanner that can be put to sleep and woken up.
+type idler interface {
+	sleep() error
+	wake() error
+}
+
+func (s *ssiScanner) sleep() error {
+	_, err := s.command(ssiPacket{opcode: ssiSleep}, false)
+	return err
+}
+
+// wake sends WAKEUP, which isn't a packet but a single 0 byte.
+func (s *ssiScanner) wake() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errors.New("ssi: scanner closed")
+	}
+	s.wmu.Lock()
+	_, err := s.port.Write([]byte{0})
+	s.wmu.Unlock()
+	time.Sleep(ssiWakeDelay)
+	return err
+}
+
+// setAsleep puts the station's scanner to sleep or wakes it up.
+func (s *station) setAsleep(asleep bool) error {
+	c, err := s.control()
+	if err != nil {
+		return err
+	}
+	i, ok := c.(idler)
+	if !ok {
+		return fmt.Errorf("the %s can't be put to sleep, only scanners over SSI or SNAPI can", s.label())
+	}
+	if asleep {
+		err = i.sleep()
+	} else {
+		err = i.wake()
+	}
+	if err == nil {
+		s.asleep.Store(asleep)
+	}
+	return err
+}
+
+// watchIdle puts the scanner to sleep once nothing was scanned for after. A scan while it
+// sleeps means it woke up on its own.
+func (s *station) watchIdle(after time.Duration) {
+	ticker := time.NewTicker(max(after/4, time.Second))
+	defer ticker.Stop()
+	since := time.Now().UnixNano()
+	for range ticker.C {
+		if s.stopping.Load() {
+			return
+		}
+		if last := s.d.lastScan.Load(); last > since {
+			since = last
+			s.asleep.Store(false)
+		}
+		if s.asleep.Load() || time.Since(time.Unix(0, since)) < after {
+			continue
+		}
+		if err := s.setAsleep(true); err != nil {
+			slog.Warn("Could not put the idle scanner to sleep", "device", s.device.Name, "error", err)
+			since = time.Now().UnixNano() // try again after another while
+			continue
+		}
+		slog.Info("Nothing scanned for a while, the scanner sleeps", "device", s.device.Name, "idle", after)
+	}
+}
+
+// idleCommand puts the scanners of stations to sleep or wakes them up.
+func idleCommand(stations []*station, req controlRequest) error {
+	for _, st := range stations {
+		if err := st.setAsleep(req.Command == "sleep"); err != nil {
+			return err
+		}
+	}
+	slog.Info("Scanner command", "command", req.Command, "profile", req.Profile)
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Imagers, the 2D scanners that decode from a camera, can also just take a picture, of a
+// damaged label say, over SSI or SNAPI: in image capture mode a pull of the trigger snaps
+// one and the scanner sends it as IMAGE_DATA, many packets long, as a JPEG unless set to
+// BMP or TIFF. `usbscanner ctl image` saves it in image_dir, and with send also passes it
+// on to the sinks as a scan of symbology image, the file name as its code and the picture
+// itself in image.
+
+// SSI opcodes for images.
+const (
+	ssiImagerMode = 0xF7 // data 1 for image capture mode, 0 to decode again
+	ssiImageData  = 0xB1
+)
+
+// ssiImageTimeout is how long an image can take to come, at 9600 baud a JPEG takes most of
+// a minute.
+const ssiImageTimeout = 90 * time.Second
+
+// imager is a scanner that can take pictures.
+type imager interface {
+	captureImage() ([]byte, error)
+}
+
+func (s *ssiScanner) captureImage() ([]byte, error) {
+	if _, err := s.command(ssiPacket{opcode: ssiImagerMode, data: []byte{1}}, false); err != nil {
+		return nil, err
+	}
+	defer s.command(ssiPacket{opcode: ssiImagerMode, data: []byte{0}}, false)
+	if _, err := s.command(ssiPacket{opcode: ssiStartDecode}, false); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	deadline := time.After(ssiImageTimeout)
+	for {
+		select {
+		case r := <-s.replies:
+			if r.opcode == ssiImageData {
+				return r.data, nil
+			}
+		case <-deadline:
+			return nil, errors.New("ssi: the scanner sent no image")
+		}
+	}
+}
+
+// imageExt is the file name extension for an image, by what it starts with.
+func imageExt(image []byte) string {
+	switch {
+	case bytes.HasPrefix(image, []byte("BM")):
+		return ".bmp"
+	case bytes.HasPrefix(image, []byte("II*\x00")), bytes.HasPrefix(image, []byte("MM\x00*")):
+		return ".tiff"
+	}
+	return ".jpg"
+}
+
+// imageCommand takes a picture with the scanner of the one station given, saves it in dir
+// if set and passes it on to the sinks if req says send. It returns where it saved it.
+func imageCommand(stations []*station, dir string, req controlRequest) (string, error) {
+	if len(stations) != 1 {
+		return "", errors.New("images come from one scanner, pick its profile")
+	}
+	send := req.Value == "send"
+	if req.Value != "" && !send {
+		return "", fmt.Errorf("image takes send or nothing, not %q", req.Value)
+	} else if dir == "" && !send {
+		return "", errors.New("set image_dir to save images, or pass them on to the sinks with image send")
+	}
+	st := stations[0]
+	c, err := st.control()
+	if err != nil {
+		return "", err
+	}
+	im, ok := c.(imager)
+	if !ok {
+		return "", fmt.Errorf("the %s takes no pictures, only imagers over SSI or SNAPI do", st.label())
+	}
+	image, err := im.captureImage()
+	if err != nil {
+		return "", err
+	}
+	scan := newScan("", st.device.Name, time.Now())
+	scan.Code, scan.Symbology, scan.Image = scan.ID+imageExt(image), "image", image
+	var path string
+	if dir != "" {
+		path = filepath.Join(dir, scan.Code)
+		if err := os.WriteFile(path, image, 0o640); err != nil {
+			return "", err
+		}
+	}
+	if send {
+		d := st.d
+		d.mu.RLock()
+		err = d.current.handle(scan)
+		d.mu.RUnlock()
+	}
+	slog.Info("Image taken", "device", st.device.Name, "bytes", len(image), "path", path, "sent", send, "error", err)
+	return path, err
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterSink("influx", func(cfg *SinkConfig) (Sink, error) { return newInfluxSink(cfg) })
+}
+
+// influxSink writes scans and scan rates in InfluxDB line protocol, which VictoriaMetrics and
+// friends accept as well. The argument is the full write URL, e.g.
+// influx:http://influx:8086/api/v2/write?org=ops&bucket=scans or
+// influx:http://victoria:8428/write. Every scan becomes a point
+//
+//	scan,device=<device>,symbology=<symbology> code="<code>",tags="<tags>",id="<id>" <time>
+//
+// and every interval (option, default 10s) a point per device with the number of scans and
+// scans per second in that interval is added:
+//
+//	scan_rate,device=<device> count=<n>i,rate=<n/s>
+//
+// Points are collected and sent every flush interval (option, default 1s) so a busy station
+// doesn't turn into a request per scan. While influx can't be reached they are kept for the
+// next flush, up to buffer points (option, default 100000), beyond which the oldest go. A
+// batch influx rejects with a 4xx is dropped, as sending it again won't change that.
+// Delivering at least once, scans are written one by one instead, as that's the only way to
+// know the write of a scan went through, and a rejected one is a dead letter.
+// Authentication is with the token option (InfluxDB 2) or username and password (InfluxDB 1,
+// basic auth).
+type influxSink struct {
+	url      string
+	token    string
+	username string
+	password string
+	interval time.Duration
+	client   *http.Client
+	sync     bool // write every scan right away
+	buffer   int  // points kept at most
+
+	mu     sync.Mutex
+	lines  bytes.Buffer
+	points int            // lines in lines
+	counts map[string]int // scans per device in the current interval
+
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+func newInfluxSink(cfg *SinkConfig) (*influxSink, error) {
+	if !strings.HasPrefix(cfg.Arg, "http://") && !strings.HasPrefix(cfg.Arg, "https://") {
+		return nil, fmt.Errorf("influx sink needs a write URL")
+	}
+	interval, err := cfg.DurationOption("interval", 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	flush, err := cfg.DurationOption("flush", time.Second)
+	if err != nil {
+		return nil, err
+	}
+	timeout, err := cfg.DurationOption("timeout", 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	buffer, err := cfg.IntOption("buffer", 100000)
+	if err != nil {
+		return nil, err
+	}
+	if interval <= 0 || flush <= 0 || buffer <= 0 {
+		return nil, fmt.Errorf("interval, flush and buffer have to be positive")
+	}
+	s := &influxSink{
+		url:      cfg.Arg,
+		token:    cfg.Option("token", ""),
+		username: cfg.Option("username", ""),
+		password: cfg.Option("password", ""),
+		interval: interval,
+		client:   &http.Client{Timeout: timeout, Transport: sinkTransport},
+		sync:     cfg.AtLeastOnce,
+		buffer:   buffer,
+		counts:   map[string]int{},
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go s.loop(flush)
+	return s, nil
+}
+
+func (s *influxSink) Send(ctx context.Context, scan Scan) error {
+	var line strings.Builder
+	line.WriteString("scan")
+	if scan.Device != "" {
+		line.WriteString(",device=" + influxEscape(scan.Device, ",= "))
+	}
+	if scan.Symbology != "" {
+		line.WriteString(",symbology=" + influxEscape(scan.Symbology, ",= "))
+	}
+	line.WriteString(` code="` + influxEscape(scan.Code, `"\`) + `"`)
+	if len(scan.Tags) > 0 {
+		line.WriteString(`,tags="` + influxEscape(strings.Join(scan.Tags, ","), `"\`) + `"`)
+	}
+	if scan.ID != "" {
+		line.WriteString(`,id="` + scan.ID + `"`)
+	}
+	line.WriteString(" " + strconv.FormatInt(scan.Time.UnixNano(), 10) + "\n")
+	if s.sync {
+		if err := s.send(ctx, []byte(line.String())); err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.sync {
+		s.lines.WriteString(line.String())
+		s.points++
+		s.trim()
+	}
+	s.counts[scan.Device]++
+	return nil
+}
+
+func (s *influxSink) loop(flush time.Duration) {
+	defer close(s.stopped)
+	flushTicker := time.NewTicker(flush)
+	defer flushTicker.Stop()
+	rateTicker := time.NewTicker(s.interval)
+	defer rateTicker.Stop()
+	for {
+		select {
+		case <-flushTicker.C:
+			s.flush()
+		case now := <-rateTicker.C:
+			s.addRates(now)
+		case <-s.done:
+			s.flush()
+			return
+		}
+	}
+}
+
+// addRates adds the scan_rate points for the interval that just ended. Devices seen before
+// but quiet in this interval get a zero, so graphs don't just stop.
+func (s *influxSink) addRates(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	devices := make([]string, 0, len(s.counts))
+	for dev := range s.counts {
+		devices = append(devices, dev)
+	}
+	sort.Strings(devices)
+	ts := strconv.FormatInt(now.UnixNano(), 10)
+	for _, dev := range devices {
+		n := s.counts[dev]
+		rate := float64(n) / s.interval.Seconds()
+		tags := ""
+		if dev != "" {
+			tags = ",device=" + influxEscape(dev, ",= ")
+		}
+		fmt.Fprintf(&s.lines, "scan_rate%s count=%di,rate=%g %s\n", tags, n, rate, ts)
+		s.counts[dev] = 0
+		s.points++
+	}
+	s.trim()
+}
+
+// trim drops the oldest points beyond the buffer.
+func (s *influxSink) trim() {
+	dropped := 0
+	for ; s.points > s.buffer; s.points-- {
+		line, _ := s.lines.ReadBytes('\n')
+		if len(line) == 0 {
+			break
+		}
+		dropped++
+	}
+	if dropped > 0 {
+		slog.Warn("Influx buffer is full, dropping the oldest points", "dropped", dropped, "buffer", s.buffer)
+	}
+}
+
+// flush sends the collected points. If that fails they are kept for the next attempt,
+// unless influx rejected them.
+func (s *influxSink) flush() {
+	s.mu.Lock()
+	if s.lines.Len() == 0 {
+		s.mu.Unlock()
+		return
+	}
+	body, points := append([]byte(nil), s.lines.Bytes()...), s.points
+	s.lines.Reset()
+	s.points = 0
+	s.mu.Unlock()
+
+	err := s.send(context.Background(), body)
+	switch {
+	case err == nil:
+	case isPermanent(err):
+		slog.Error("Influx rejected the points, dropping them", "points", points, "error", err)
+	default:
+		slog.Warn("Could not write to influx", "error", err)
+		s.mu.Lock()
+		rest := append(body, s.lines.Bytes()...)
+		s.lines.Reset()
+		s.lines.Write(rest)
+		s.points += points
+		s.trim()
+		s.mu.Unlock()
+	}
+}
+
+func (s *influxSink) send(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Token "+s.token)
+	} else if s.username != "" {
+		req.SetBasicAuth(s.username, s.password)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(resp.Body)
+		err := fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+		// Bad points, or a token that can't write to the bucket. But a timeout or rate limit
+		// is worth waiting out.
+		if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+			return permanent(err)
+		}
+		return err
+	}
+	return nil
+}
+
+// Close sends whatever is still collected.
+func (s *influxSink) Close() error {
+	close(s.done)
+	<-s.stopped
+	return nil
+}
+
+// influxEscape backslash-escapes the given special characters, which differ between tags
+// and string fields in line protocol. Newlines can't be escaped at all, so they go.
+func influxEscape(s string, special string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if r == '\n' || r == '\r' {
+			continue
+		}
+		if strings.ContainsRune(special, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"syscall"
+	"time"
+
+	"github.com/gvalkov/golang-evdev"
+)
+
+// captureInput feeds a station from a capture instead of a device, with -input=stdin, for
+// running the whole pipeline where there is no /dev/input, like in a container. The events
+// of the first device in the capture are passed on at the pace they were recorded, as the
+// timeout that completes scans goes by the clock, but a gap of more than maxInputGap, the
+// time between two scans, is cut short.
+type captureInput struct {
+	sc     *bufio.Scanner
+	line   int
+	device string            // whose events are passed on
+	next   *evdev.InputEvent // read while looking for the device
+	last   syscall.Timeval   // timestamp of the event before
+}
+
+const maxInputGap = time.Second
+
+// openCaptureInput reads r up to the first event, to know the device the scans come from.
+func openCaptureInput(r io.Reader) (*captureInput, error) {
+	in := &captureInput{sc: bufio.NewScanner(r)}
+	in.sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	ev, device, err := in.event()
+	if err == io.EOF {
+		return nil, errors.New("no events in the capture on stdin")
+	} else if err != nil {
+		return nil, err
+	}
+	in.device, in.next, in.last = device, ev, ev.Time
+	return in, nil
+}
+
+// event reads up to the next event record of any device.
+func (in *captureInput) event() (*evdev.InputEvent, string, error) {
+	for in.sc.Scan() {
+		in.line++
+		var rec captureRecord
+		if err := json.Unmarshal(in.sc.Bytes(), &rec); err != nil {
+			return nil, "", fmt.Errorf("stdin line %d: %v", in.line, err)
+		}
+		if rec.Kind == "start" && rec.Version > captureVersion {
+			return nil, "", fmt.Errorf("capture version %d is newer than this usbscanner knows (%d)", rec.Version, captureVersion)
+		}
+		if rec.Kind == "event" && rec.Event != nil {
+			ev := rec.Event.inputEvent()
+			return &ev, rec.Device, nil
+		}
+	}
+	if err := in.sc.Err(); err != nil {
+		return nil, "", err
+	}
+	return nil, "", io.EOF
+}
+
+// read returns the next event of the device once it is due, io.EOF at the end of the
+// capture.
+func (in *captureInput) read() ([]evdev.InputEvent, error) {
+	ev := in.next
+	in.next = nil
+	for ev == nil {
+		var device string
+		var err error
+		if ev, device, err = in.event(); err != nil {
+			return nil, err
+		}
+		if device != in.device {
+			ev = nil
+		}
+	}
+	gap := time.Duration(syscall.TimevalToNsec(ev.Time) - syscall.TimevalToNsec(in.last))
+	in.last = ev.Time
+	if gap > 0 {
+		time.Sleep(min(gap, maxInputGap))
+	}
+	return []evdev.InputEvent{*ev}, nil
+}
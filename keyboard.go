@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/gvalkov/golang-evdev"
+)
+
+// Cheap unbranded scanners often call themselves nothing more than a keyboard, "USB Keyboard"
+// or "HID 1a86:e026", the same as the keyboard on the desk. Grabbing that one by mistake
+// would leave the machine without a keyboard, so a device by such a name is only taken as
+// the scanner when its matcher says keyboard = true, which in turn needs the device picked
+// by its path or by both vendor and product ID rather than a name any keyboard has.
+
+// genericName matches the names of devices that don't say what they are beyond the USB IDs.
+var genericName = regexp.MustCompile(`(?i)^(hid )?[0-9a-f]{4}:[0-9a-f]{4}$`)
+
+// looksLikeKeyboard tells a device whose name makes it a keyboard, or nothing at all.
+func looksLikeKeyboard(dev *evdev.InputDevice) bool {
+	name := strings.ToLower(dev.Name)
+	return strings.Contains(name, "keyboard") || strings.Contains(name, "kbd") || genericName.MatchString(strings.TrimSpace(name))
+}
+
+// checkKeyboard checks that a matcher that takes keyboards picks one device.
+func (m DeviceMatcher) checkKeyboard() error {
+	if m.Keyboard && m.Path == "" && (m.Vendor == 0 || m.Product == 0) {
+		return fmt.Errorf("a device with keyboard = true needs its path, or its vendor and product, not only a name")
+	}
+	return nil
+}
+
+// keyboardHint explains why none of devices was taken, if one of them would have been but
+// for looking like a keyboard.
+func (cfg *Config) keyboardHint(devices []*evdev.InputDevice) string {
+	for _, dev := range devices {
+		for _, m := range cfg.Devices {
+			m.Keyboard = true
+			if m.matches(dev) {
+				return fmt.Sprintf(" %s (%s) looks like a keyboard, set keyboard = true and its path or vendor and product in its [[device]] if it is the scanner", dev.Fn, dev.Name)
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,42 @@
+package main
+
+import "time"
+
+// A USB keypad is a keyboard too, but typed by a person: a quantity or a PIN, taking its
+// time between keys and ending with Enter rather than a pause. With reader = "keypad" the
+// decoder takes the keys of a numeric keypad, lets Backspace take back a key and Esc the
+// whole entry, and completes the entry on Enter. Its symbology is keypad, so it doesn't pass
+// for a barcode.
+
+// keypadTimeout is how long an entry without Enter is kept before it is thrown away.
+const keypadTimeout = time.Minute
+
+// keypadKeys are the characters of the keys of a numeric keypad.
+var keypadKeys = map[string]string{
+	"KEY_KP0": "0", "KEY_KP1": "1", "KEY_KP2": "2", "KEY_KP3": "3", "KEY_KP4": "4",
+	"KEY_KP5": "5", "KEY_KP6": "6", "KEY_KP7": "7", "KEY_KP8": "8", "KEY_KP9": "9",
+	"KEY_KPDOT": ".", "KEY_KPCOMMA": ",", "KEY_KPPLUS": "+", "KEY_KPMINUS": "-",
+	"KEY_KPASTERISK": "*", "KEY_KPSLASH": "/", "KEY_KPEQUAL": "=",
+}
+
+// keypadKey handles the key name of a keypad, reporting whether it is one of the keys
+// taken care of here rather than typed like any other.
+func (d *decoder) keypadKey(name string) bool {
+	switch name {
+	case "KEY_ENTER", "KEY_KPENTER":
+		d.entered = true
+	case "KEY_BACKSPACE":
+		if n := d.barcode.Len(); n > 0 {
+			d.barcode.Truncate(n - 1)
+		}
+	case "KEY_ESC":
+		d.barcode.Reset()
+	default:
+		char, ok := keypadKeys[name]
+		if ok {
+			d.barcode.WriteString(char)
+		}
+		return ok
+	}
+	return true
+}
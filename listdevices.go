@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/gvalkov/golang-evdev"
+)
+
+// listedDevice is an input device as list-devices shows it.
+type listedDevice struct {
+	Path     string `json:"path"`
+	Name     string `json:"name"`
+	Vendor   uint16 `json:"vendor"`
+	Product  uint16 `json:"product"`
+	Keyboard bool   `json:"keyboard,omitempty"` // looks like a keyboard, see keyboard.go
+	Taken    string `json:"taken,omitempty"`    // by which profile, "scanner" without profiles
+}
+
+// listDevices is every input device and the profile that takes it, the way openStations
+// would pick them.
+func listDevices(cfg *Config, devices []*evdev.InputDevice) []listedDevice {
+	taken := map[string]string{}
+	remaining := devices
+	for _, name := range cfg.profileNames() {
+		pcfg, err := cfg.profile(name)
+		if err != nil {
+			continue
+		}
+		if dev := pcfg.findDevice(remaining); dev != nil {
+			taken[dev.Fn] = name
+			if name == "" {
+				taken[dev.Fn] = "scanner"
+			}
+			remaining = withoutDevice(remaining, dev.Fn)
+		}
+	}
+	var list []listedDevice
+	for _, dev := range devices {
+		list = append(list, listedDevice{Path: dev.Fn, Name: dev.Name, Vendor: dev.Vendor, Product: dev.Product, Keyboard: looksLikeKeyboard(dev), Taken: taken[dev.Fn]})
+	}
+	return list
+}
+
+// runListDevices implements `usbscanner list-devices`, which shows what to put in a
+// [[device]] matcher and checks that the config picks the right one.
+func runListDevices(args []string) {
+	fs := flag.NewFlagSet("list-devices", flag.ExitOnError)
+	configPath := fs.String("config", os.Getenv("USBSCANNER_CONFIG"), "show which devices the matchers of this TOML file take")
+	asJSON := fs.Bool("json", false, "print the devices as JSON")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: usbscanner list-devices [flags]\n\nDevices the user can't open, without root or the input group, aren't listed.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	cfg := defaultConfig()
+	if *configPath != "" {
+		var err error
+		if cfg, err = loadConfig(*configPath); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	devices, err := evdev.ListInputDevices()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	list := listDevices(cfg, devices)
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(list)
+		return
+	}
+	if len(list) == 0 {
+		fmt.Fprintln(os.Stderr, "No input devices, is this user allowed to read /dev/input?")
+		os.Exit(1)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "PATH\tVENDOR:PRODUCT\tNAME\tTAKEN BY")
+	for _, d := range list {
+		taken := d.Taken
+		if taken == "" && d.Keyboard {
+			taken = "(keyboard)"
+		}
+		fmt.Fprintf(tw, "%s\t%04x:%04x\t%s\t%s\n", d.Path, d.Vendor, d.Product, d.Name, taken)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// A load test sends scans at a steady rate through the pipeline of a configuration to its
+// sinks, the real ones, to see before go-live whether the network and whatever is at the
+// other end keep up, and what the queues do when they don't. The scans are made up by the
+// generator, or decoded from a capture and sent again and again, each time as a new scan.
+// They go through validation, tagging and routing like scans from the scanner, but not
+// through dedup, which would drop the repeats of a capture, nor the schedule. Disk queues
+// and dead letters go to a directory of their own that is removed afterwards, so the
+// daemon never delivers a test scan later on.
+
+// loadSource is where the scans of a load test come from.
+type loadSource struct {
+	gen    *generator
+	device string // of generated scans
+	scans  []Scan // from a capture, used in turn
+	n      int
+}
+
+// next makes the next scan, completed at now.
+func (s *loadSource) next(now time.Time) Scan {
+	if s.gen != nil {
+		return newScan(s.gen.next(), s.device, now)
+	}
+	scan := s.scans[s.n%len(s.scans)]
+	s.n++
+	scan.ID, scan.Time, scan.Started, scan.Tags = newScanID(now), now, time.Time{}, nil
+	return scan
+}
+
+// captureSource decodes the scans of a capture, with the timeout and keymap of cfg.
+func captureSource(path string, cfg *Config) (*loadSource, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s := &loadSource{}
+	if _, err := replayCapture(f, newTimedDecoder(cfg.Timeout.Duration, cfg.Keymap), "", func(scan Scan) {
+		s.scans = append(s.scans, scan)
+	}); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if len(s.scans) == 0 {
+		return nil, fmt.Errorf("%s: no scans in the capture", path)
+	}
+	return s, nil
+}
+
+// loadStats counts what the load test offered the pipeline.
+type loadStats struct {
+	sent    int
+	invalid int
+	routed  map[string]int // by sink
+}
+
+// feed offers scans from src to p at rate a second until done is closed or count scans
+// were sent (if count isn't 0), printing progress on w every interval. A scan is due at
+// its place in the schedule, if the pipeline held up the ones before it, it is sent right
+// away to catch up, so the rate that was reached shows how far behind the sinks are.
+func feed(w io.Writer, p *pipeline, src *loadSource, rate float64, count int, interval time.Duration, done <-chan struct{}) *loadStats {
+	stats := &loadStats{routed: map[string]int{}}
+	every := time.Duration(float64(time.Second) / rate)
+	start := time.Now()
+	nextProgress := start.Add(interval)
+	for i := 0; count == 0 || i < count; i++ {
+		if wait := time.Until(start.Add(time.Duration(i) * every)); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-done:
+				return stats
+			}
+		} else {
+			select {
+			case <-done:
+				return stats
+			default:
+			}
+		}
+		scan := src.next(time.Now())
+		if p.validator.check(p.validator.strip(scan)) != nil {
+			stats.invalid++
+		} else {
+			stats.sent++
+			tagged := p.tag(p.validator.strip(scan))
+			for _, r := range p.sinks {
+				if r.accepts(tagged) {
+					stats.routed[r.name]++
+				}
+			}
+		}
+		p.handle(scan)
+		if now := time.Now(); interval > 0 && now.After(nextProgress) {
+			nextProgress = now.Add(interval)
+			elapsed := now.Sub(start)
+			var queued []string
+			for _, r := range p.sinks {
+				queued = append(queued, fmt.Sprintf("%s %d", r.name, r.queued()))
+			}
+			fmt.Fprintf(w, "%s: %d scans, %.0f/s, queued: %s\n", elapsed.Round(time.Second), i+1,
+				float64(i+1)/elapsed.Seconds(), strings.Join(queued, ", "))
+		}
+	}
+	return stats
+}
+
+// loadReport prints how each sink did. It reports whether every sink delivered every scan
+// routed to it.
+func loadReport(w io.Writer, p *pipeline, stats *loadStats, elapsed time.Duration) bool {
+	fmt.Fprintf(w, "Sent %d scans in %s, %.1f/s", stats.sent, elapsed.Round(time.Millisecond), float64(stats.sent)/elapsed.Seconds())
+	if stats.invalid > 0 {
+		fmt.Fprintf(w, ", %d more rejected by the validation rules", stats.invalid)
+	}
+	fmt.Fprintln(w)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "SINK\tROUTED\tDELIVERED\tFAILURES\tRETRIES\tDEAD\tQUEUED\tSEND P50\tP90\tP99\tACK P50\tP90\tP99")
+	ok := true
+	for _, r := range p.sinks {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.0f\t%d\t%d\t%d\t%s\t%s\n", r.name, stats.routed[r.name], r.delivered.Load(),
+			sinkFailures.value(r.device, r.name), r.retries.Load(), r.dead.len(), r.queued(),
+			latencyColumns(sinkLatency.summary(r.device, r.name)), latencyColumns(ackLatency.summary(r.device, r.name)))
+		if r.delivered.Load() < int64(stats.routed[r.name]) {
+			ok = false
+		}
+	}
+	tw.Flush()
+	return ok
+}
+
+// latencyColumns are the quantiles of a latency summary as table columns.
+func latencyColumns(s *latencySummary) string {
+	if s == nil {
+		return "-\t-\t-"
+	}
+	var cols []string
+	for _, v := range []float64{s.P50, s.P90, s.P99} {
+		cols = append(cols, time.Duration(v*float64(time.Second)).Round(100*time.Microsecond).String())
+	}
+	return strings.Join(cols, "\t")
+}
+
+// loadtest runs a load test of the sinks of cfg with scans from src, reporting on w, and
+// returns whether every sink delivered everything routed to it. It sends for length, or
+// count scans if that isn't 0, or until interrupted.
+func loadtest(w io.Writer, cfg *Config, src *loadSource, rate float64, count int, length, progress time.Duration) (bool, error) {
+	dir, err := os.MkdirTemp("", "usbscanner-loadtest")
+	if err != nil {
+		return false, err
+	}
+	defer os.RemoveAll(dir)
+	c := *cfg
+	c.Dedup, c.Schedule = DedupConfig{}, ScheduleConfig{}
+	c.QueueDir, c.DeadLetterDir = filepath.Join(dir, "queue"), filepath.Join(dir, "dead-letter")
+	p, err := newPipeline(&c)
+	if err != nil {
+		return false, fmt.Errorf("could not set up the sinks: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p.start(ctx)
+
+	// Sending stops when the time is up or on Ctrl-C, then the sinks get the shutdown
+	// timeout to deliver what is queued, a second Ctrl-C reports right away.
+	done := make(chan struct{})
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	var timeUp <-chan time.Time
+	if count == 0 {
+		timeUp = time.After(length)
+	}
+	go func() {
+		select {
+		case <-sig:
+		case <-timeUp:
+		}
+		close(done)
+	}()
+	fmt.Fprintf(os.Stderr, "Sending %g scans a second to %d sinks\n", rate, len(p.sinks))
+	start := time.Now()
+	stats := feed(os.Stderr, p, src, rate, count, progress, done)
+	elapsed := time.Since(start)
+
+	stopped := make(chan struct{})
+	go func() {
+		p.stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(c.ShutdownTimeout.Duration):
+		fmt.Fprintf(os.Stderr, "The sinks didn't deliver everything within the shutdown timeout (%s)\n", c.ShutdownTimeout.Duration)
+	case <-sig:
+	}
+	return loadReport(w, p, stats, elapsed), nil
+}
+
+// runLoadtest implements `usbscanner loadtest`. It exits 1 if a sink didn't deliver
+// everything routed to it.
+func runLoadtest(args []string) {
+	fs := flag.NewFlagSet("loadtest", flag.ExitOnError)
+	configPath := fs.String("config", os.Getenv("USBSCANNER_CONFIG"), "send to the sinks of this TOML file")
+	profile := fs.String("profile", "", "the profile whose sinks to send to, with profiles")
+	rate := fs.Float64("rate", 200, "scans a second")
+	length := fs.Duration("duration", time.Minute, "how long to send scans for")
+	count := fs.Int("count", 0, "stop after this many scans instead, 0 goes by -duration")
+	kind := fs.String("generate", "mixed", "kind of barcodes to make up without a capture, see usbscanner generate")
+	seed := fs.Int64("seed", 0, "seed for -generate, 0 for a random one")
+	aim := fs.Bool("aim", false, "start generated barcodes with their AIM symbology identifier, for routes by symbology")
+	device := fs.String("device", "usbscanner loadtest", "device name of made up scans, for routes by device")
+	progress := fs.Duration("progress", 5*time.Second, "print progress this often, 0 for never")
+	verbose := fs.Bool("v", false, "log what the pipeline does, as the daemon would")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: usbscanner loadtest [flags] [capture]\n\nWith a capture, its scans are sent over and over, otherwise made up ones.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 1 || *rate <= 0 || *count < 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	level := slog.LevelWarn
+	if *verbose {
+		level = slog.LevelInfo
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+
+	cfg, err := setupConfig(*configPath, &cmdlineFlags{})
+	if err == nil && len(cfg.Profiles) > 0 && *profile == "" {
+		err = fmt.Errorf("pick the profile to test with -profile: %s", strings.Join(cfg.profileNames(), ", "))
+	}
+	if err == nil {
+		cfg, err = cfg.profile(*profile)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not load the config: %v\n", err)
+		os.Exit(1)
+	}
+	var src *loadSource
+	if fs.NArg() == 1 {
+		src, err = captureSource(fs.Arg(0), cfg)
+	} else {
+		src = &loadSource{device: *device}
+		src.gen, err = newGenerator(*kind, *seed, *aim)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	ok, err := loadtest(os.Stdout, cfg, src, *rate, *count, *length, *progress)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
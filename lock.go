@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// defaultLockDir is where device lock files go unless lock_dir says otherwise.
+const defaultLockDir = "/run/lock"
+
+// lockDevice makes sure we are the only instance using a device, by taking an flock on a
+// file in dir named after the device path, e.g. usbscanner-dev-input-event3.lock. The lock
+// is held for as long as the returned file stays open, so it goes away by itself when the
+// process exits, however that happens. The file holds our PID so that a second instance
+// can tell who has the device.
+func lockDevice(dir string, device string) (*os.File, error) {
+	name := "usbscanner-" + strings.ReplaceAll(strings.Trim(device, "/"), "/", "-") + ".lock"
+	path := filepath.Join(dir, name)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not create lock file: %v", err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		defer f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			owner, _ := os.ReadFile(path)
+			if pid := strings.TrimSpace(string(owner)); pid != "" {
+				return nil, fmt.Errorf("%s is already in use by another usbscanner (pid %s, see %s)", device, pid, path)
+			}
+			return nil, fmt.Errorf("%s is already in use by another usbscanner (see %s)", device, path)
+		}
+		return nil, fmt.Errorf("could not lock %s: %v", path, err)
+	}
+	f.Truncate(0)
+	f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	return f, nil
+}
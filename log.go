@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// logLevel is shared by all handlers so it can be changed while running, by a reload or
+// with `usbscanner ctl loglevel <level>`.
+var logLevel = new(slog.LevelVar)
+
+// fatal logs an error that keeps us from running and exits, with the exit code of the error.
+func fatal(msg string, err error) {
+	viewer.close()
+	if errorFormat == "json" {
+		fmt.Fprintln(os.Stderr, errorJSON(msg, err))
+	} else {
+		slog.Error(msg, "error", err)
+	}
+	os.Exit(exitCode(err))
+}
+
+// setupLogging sets up the default logger from the [log] settings. The level can change
+// later on, the format and output are set once at startup.
+func setupLogging(cfg LogConfig) error {
+	if err := setLogLevel(cfg.Level); err != nil {
+		return err
+	}
+	var h slog.Handler
+	opts := &slog.HandlerOptions{Level: logLevel}
+	var w io.Writer = os.Stderr
+	switch cfg.Output {
+	case "", "stderr":
+		if viewer != nil {
+			w = viewer // below the scans, rather than over them
+		}
+	case "journal":
+		if cfg.Format != "" {
+			return fmt.Errorf("log: the journal has its own format, leave out format")
+		}
+		j, err := newJournalHandler()
+		if err != nil {
+			return fmt.Errorf("log: %v", err)
+		}
+		slog.SetDefault(slog.New(j))
+		return nil
+	default:
+		f, err := os.OpenFile(cfg.Output, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			return fmt.Errorf("log: %v", err)
+		}
+		w = f
+	}
+	switch cfg.Format {
+	case "", "text":
+		h = slog.NewTextHandler(w, opts)
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("log: unknown format %q, use text or json", cfg.Format)
+	}
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+// setLogLevel changes the level of the running logger: debug, info, warn or error. Empty
+// means info.
+func setLogLevel(level string) error {
+	if level == "" {
+		level = "info"
+	}
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("log: unknown level %q, use debug, info, warn or error", level)
+	}
+	logLevel.Set(l)
+	return nil
+}
+
+// journalHandler logs straight to journald with the native protocol, so the attributes end
+// up as journal fields (DEVICE=..., SINK=...) that journalctl can filter on.
+type journalHandler struct {
+	conn   *net.UnixConn
+	mu     *sync.Mutex
+	attrs  []slog.Attr
+	prefix string // from WithGroup
+}
+
+func newJournalHandler() (*journalHandler, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: "/run/systemd/journal/socket", Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &journalHandler{conn: conn, mu: &sync.Mutex{}}, nil
+}
+
+func (h *journalHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= logLevel.Level()
+}
+
+// journalPriority maps levels to syslog priorities.
+func journalPriority(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return 3
+	case level >= slog.LevelWarn:
+		return 4
+	case level >= slog.LevelInfo:
+		return 6
+	}
+	return 7
+}
+
+func (h *journalHandler) Handle(_ context.Context, r slog.Record) error {
+	var b bytes.Buffer
+	journalField(&b, "MESSAGE", r.Message)
+	journalField(&b, "PRIORITY", fmt.Sprint(journalPriority(r.Level)))
+	journalField(&b, "SYSLOG_IDENTIFIER", "usbscanner")
+	for _, a := range h.attrs {
+		journalAttr(&b, "", a)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		journalAttr(&b, h.prefix, a)
+		return true
+	})
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := h.conn.Write(b.Bytes())
+	return err
+}
+
+func (h *journalHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	n := *h
+	n.attrs = append([]slog.Attr{}, h.attrs...)
+	for _, a := range attrs {
+		a.Key = h.prefix + a.Key
+		n.attrs = append(n.attrs, a)
+	}
+	return &n
+}
+
+func (h *journalHandler) WithGroup(name string) slog.Handler {
+	n := *h
+	n.prefix = h.prefix + name + "_"
+	return &n
+}
+
+func journalAttr(b *bytes.Buffer, prefix string, a slog.Attr) {
+	v := a.Value.Resolve()
+	if v.Kind() == slog.KindGroup {
+		for _, g := range v.Group() {
+			journalAttr(b, prefix+a.Key+"_", g)
+		}
+		return
+	}
+	journalField(b, journalKey(prefix+a.Key), v.String())
+}
+
+// journalKey turns an attribute key into a valid journal field name: upper case letters,
+// digits and underscores, not starting with an underscore.
+func journalKey(key string) string {
+	key = strings.ToUpper(key)
+	key = strings.Map(func(r rune) rune {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' {
+			return r
+		}
+		return '_'
+	}, key)
+	return strings.TrimLeft(key, "_")
+}
+
+// journalField writes one field. Values with newlines need the length prefixed form.
+func journalField(b *bytes.Buffer, key, value string) {
+	if !strings.Contains(value, "\n") {
+		b.WriteString(key + "=" + value + "\n")
+		return
+	}
+	b.WriteString(key + "\n")
+	binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value + "\n")
+}
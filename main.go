@@ -2,10 +2,14 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"flag"
 	"fmt"
+	"log/slog"
 	"os"
 	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/gvalkov/golang-evdev"
@@ -13,25 +17,16 @@ import (
 
 // Need to set a duration of no activity after which we assume that the scan completed. The
 // way the input from the scanner is set up we don't really know when a scan finishes, so we
-// assume a timeout. 10ms seemed about right in testing.
+// assume a timeout. 10ms seemed about right in testing. This is the default, the timeout
+// setting in the config file overrides it.
 const (
 	timerDuration = 10 * time.Millisecond
 )
 
-// processBarcodes is just a base for a process that waits for a barcode to be broadcast on
-// the channel and prints it to the terminal. Not particular useful in most use cases, but helps
-// with testing.
-func processBarcodes(barcode chan string) {
-	var code string
-	for {
-		code = <-barcode
-		fmt.Println("Scanned: " + code)
-	}
-}
-
 // processCharacter handles translating of keycodes to characters and determines state of
-// shift keys and other modifiers.
-func processCharacter(key string, capNext bool) (string, bool) {
+// shift keys and other modifiers. The keymap from the config can add or override characters,
+// keyed by the name we'd otherwise output: lower case, or upper case when shifted.
+func processCharacter(key string, capNext bool, keymap map[string]string) (string, bool) {
 	if strings.Contains(key, "LEFTSHIFT") || strings.Contains(key, "RIGHTSHIFT") {
 		capNext = true
 		key = ""
@@ -42,6 +37,9 @@ func processCharacter(key string, capNext bool) (string, bool) {
 		} else {
 			capNext = false
 		}
+		if char, ok := keymap[key]; ok {
+			return char, capNext
+		}
 		switch key {
 		case "space":
 			key = " "
@@ -57,113 +55,338 @@ func processCharacter(key string, capNext bool) (string, bool) {
 			key = ":"
 		case "semicolon":
 			key = ";"
+		case "leftbrace":
+			key = "["
+		case "rightbrace":
+			key = "]"
+		case "LEFTBRACE":
+			key = "{"
+		case "RIGHTBRACE":
+			key = "}"
 			// TODO: Add more if we need to decode additional characters
 		}
 	}
 	return key, capNext
 }
 
-// processEvents is run as a process waiting for events to be broadcast. Once an event appears
-// the keycode map is consulted for the character and processCharacter is called to handle whatever
-// character the keycode corresponds to. processEvents also handles the timeout of when a scan
-// is completed; when this happens the buffer that accumulates the processed characters from a
-// given event is sent through a channel elsewhere
-func processEvents(event chan evdev.InputEvent, scannedBarcode chan string, timeout *time.Timer) {
-	var barcode bytes.Buffer
-	var capNext bool
-	var key string
+// decoder turns input events into barcodes. It holds the characters of the scan coming in
+// and the state of the shift keys; when the scan is complete is up to the caller.
+type decoder struct {
+	device           string
+	barcode          bytes.Buffer
+	capNext          bool
+	started, lastKey time.Time
+	resync           bool // events were lost, skipping the rest up to the next SYN_REPORT
+	badge            bool // a badge reader, whose sentinels need characters of their own
+	keypad           bool // a keypad, whose entries end with Enter, see keypad.go
+	entered          bool // Enter was pressed on the keypad
+}
+
+// event handles an input event that came in at now. It reports whether it was a key press,
+// which starts the inter-character timeout over.
+func (d *decoder) event(ev *evdev.InputEvent, now time.Time, keymap map[string]string) bool {
+	// The kernel's buffer for the device overflowed and it threw events away. Whatever scan
+	// was coming in has holes in it now, so drop it rather than pass on a wrong code, and
+	// start over once the kernel has caught up.
+	if ev.Type == evdev.EV_SYN && ev.Code == evdev.SYN_DROPPED {
+		eventOverflows.inc(d.device)
+		slog.Warn("Events were lost, the device's buffer overflowed", "device", d.device, "discarded", d.barcode.String())
+		if debugEvents {
+			logEvent(d.device, ev, "events lost, resyncing")
+		}
+		d.barcode.Reset()
+		d.capNext = false
+		d.resync = true
+		return false
+	}
+	if d.resync {
+		if ev.Type == evdev.EV_SYN && ev.Code == evdev.SYN_REPORT {
+			d.resync = false
+		}
+		if debugEvents {
+			logEvent(d.device, ev, "skipped while resyncing")
+		}
+		return false
+	}
+	// Ignore key-ups and statuses. Also ignore anything that isn't a key
+	if ev.Value != 1 || ev.Type != evdev.EV_KEY {
+		if debugEvents {
+			logEvent(d.device, ev, "ignored")
+		}
+		return false
+	}
+	key, haskey := evdev.KEY[int(ev.Code)]
+	if !haskey { // can't find the key in our map
+		key = "?"
+		decodeErrors.inc(d.device)
+	}
+	gap := now.Sub(d.lastKey)
+	if d.barcode.Len() == 0 {
+		d.started = now
+		gap = 0
+	}
+	d.lastKey = now
+	name, shifted := key, d.capNext
+	if d.keypad && d.keypadKey(name) {
+		if debugEvents {
+			logEvent(d.device, ev, "keypad", "key", name, "entry", d.barcode.String())
+		}
+		return true
+	}
+	key, d.capNext = processCharacter(key, d.capNext, keymap)
+	if d.badge {
+		key = badgeCharacter(name, shifted, key, keymap)
+	}
+	d.barcode.WriteString(key)
+	if debugEvents {
+		decision := "decoded"
+		if !haskey {
+			decision = "unknown key code"
+		} else if key == "" {
+			decision = "modifier"
+		}
+		logEvent(d.device, ev, decision, "key", name, "output", key, "shift", d.capNext, "gap", gap)
+	}
+	return true
+}
+
+// complete ends the scan coming in, as the timeout ran out at now. It reports false if
+// there wasn't one.
+func (d *decoder) complete(now time.Time) (Scan, bool) {
+	if d.barcode.Len() == 0 {
+		return Scan{}, false
+	}
+	d.capNext = false
+	if debugEvents {
+		slog.Debug("Scan complete", "device", d.device, "code", d.barcode.String(),
+			"took", d.lastKey.Sub(d.started), "idle", now.Sub(d.lastKey))
+	}
+	scan := newScan(d.barcode.String(), d.device, now)
+	scan.Started = d.started
+	if d.keypad {
+		scan.Symbology = "keypad"
+	}
+	d.barcode.Reset() // reset for next round
+	return scan, true
+}
+
+// processEvents is run as a process waiting for events to be broadcast. Every event goes to
+// the decoder, which consults the keycode map for the character. processEvents also handles
+// the timeout of when a scan is completed; when this happens the barcode the decoder
+// accumulated is sent through a channel elsewhere. Once stop is closed whatever is in the
+// buffer is sent as well and the channel is closed. If scannedBarcode is full, overflow says
+// what happens to the scan. The time, and the timer for the timeout, come from clk.
+func processEvents(device string, d *dispatcher, live *liveness, event chan evdev.InputEvent, scannedBarcode chan Scan, overflow overflowPolicy, clk clock, stop chan struct{}) {
+	dec := decoder{device: device}
+	timeout := clk.newTimer(d.config().Timeout.Duration)
+	timeout.stop()
+	send := func(scan Scan) { // pass it along elsewhere
+		offer(scannedBarcode, scan, overflow, device, "scans", func(scan Scan) {
+			slog.Warn("Dropping scan, the pipeline isn't keeping up", "code", scan.Code, "device", device)
+		})
+	}
 	for {
 		select {
 		case ev := <-event:
-			// Ignore key-ups and statuses. Also ignore anything that isn't a key
-			if ev.Value == 1 && ev.Type == evdev.EV_KEY {
-				val, haskey := evdev.KEY[int(ev.Code)]
-				if haskey {
-					key = val
-				} else { // can't find the key in our map
-					key = "?"
+			cfg := d.config()
+			dec.badge = cfg.Reader == "badge"
+			dec.keypad = cfg.Reader == "keypad"
+			if !dec.event(&ev, clk.now(), cfg.Keymap) {
+				break
+			}
+			switch {
+			case !dec.keypad:
+				timeout.reset(cfg.Timeout.Duration)
+			case dec.entered:
+				dec.entered = false
+				timeout.stop()
+				if scan, ok := dec.complete(clk.now()); ok {
+					send(scan)
 				}
-				key, capNext = processCharacter(key, capNext)
-				barcode.WriteString(key)
-				timeout.Reset(timerDuration)
+			default:
+				timeout.reset(keypadTimeout)
 			}
-		case <-timeout.C: // assuming no more characters coming in this barcode
-			if barcode.Len() > 0 {
-				capNext = false
-				scannedBarcode <- barcode.String() // pass it along elsewhere
-				barcode.Reset()                    // reset for next round
+		case reply := <-live.heartbeat: // the watchdog checking that we're still here
+			close(reply)
+		case <-timeout.c(): // assuming no more characters coming in this barcode
+			if dec.keypad { // nobody pressed Enter
+				if scan, ok := dec.complete(clk.now()); ok {
+					slog.Info("Dropping keypad entry without Enter", "device", device, "entry", scan.Code)
+				}
+			} else if scan, ok := dec.complete(clk.now()); ok {
+				send(scan)
+			}
+		case <-stop: // shutting down, don't lose a scan that was still coming in
+			timeout.stop()
+			if scan, ok := dec.complete(clk.now()); ok && !dec.keypad { // an entry without Enter isn't one
+				scannedBarcode <- scan
 			}
+			close(scannedBarcode)
+			return
 		}
 	}
 }
 
 func main() {
-	devices, _ := evdev.ListInputDevices()
+	name, args := "listen", os.Args[1:]
+	if len(args) > 0 && (args[0] == "-h" || args[0] == "-help" || args[0] == "--help") {
+		name, args = "help", nil
+	} else if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	c := findCommand(name)
+	if c == nil {
+		fmt.Fprintf(os.Stderr, "usbscanner: unknown command %q\n\n", name)
+		usage()
+		os.Exit(2)
+	}
+	c.run(args)
+}
 
-	// TODO: This currently assumes a single barcode scanner from Zebra (aka Symbol Technologies)
-	// We may need to expand this, as some stations might have multiple wireless scanners.
-	// TODO: Add support for badge reader
-	scannerLoc := ""
-	for _, dev := range devices {
-		if strings.Contains(dev.Name, "Symbol Technologies") {
-			scannerLoc = dev.Fn
-			break
-		}
+// runListen implements `usbscanner listen`, the daemon: it grabs the scanners the config
+// picks and passes their scans on to the sinks until it is stopped.
+func runListen(args []string) {
+	fs := flag.NewFlagSet("listen", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: usbscanner [listen] [flags]\n\n")
+		fs.PrintDefaults()
 	}
-	if scannerLoc == "" {
-		fmt.Println("Cound not find a scanner, error.")
-		os.Exit(1)
-	} else {
-		fmt.Printf("Found scanner at %s\n", scannerLoc)
+	var flags cmdlineFlags
+	configPath := fs.String("config", os.Getenv("USBSCANNER_CONFIG"), "read settings from this TOML file")
+	flags.register(fs)
+	var remoteFlags remoteFlags
+	remoteFlags.register(fs)
+	fs.BoolVar(&debugEvents, "debug-events", false, "log every raw input event and what was decoded from it")
+	fs.StringVar(&errorFormat, "error-format", "text", "how an error we can't start with is reported: text, or json for scripts")
+	fs.Parse(args)
+	if fs.NArg() > 0 || errorFormat != "text" && errorFormat != "json" {
+		fs.Usage()
+		os.Exit(exitUsage)
 	}
 
-	device, err := evdev.Open(scannerLoc)
+	var remote *remoteConfig
+	if remoteFlags.url != "" {
+		var err error
+		if remote, *configPath, err = setupRemoteConfig(&remoteFlags); err != nil {
+			fatal("Could not set up the config", withExit(exitConfig, err))
+		}
+	}
+	cfg, err := setupConfig(*configPath, &flags)
 	if err != nil {
-		panic(err)
+		fatal("Could not set up the config", withExit(exitConfig, err))
 	}
-
-	// Need to grab the device so that we don't get additional input from the HID
-	// portion of the scanner connection
-	err = device.Grab()
+	if err := setupLogging(cfg.Log); err != nil {
+		fatal("Could not set up logging", withExit(exitConfig, err))
+	}
+	if err := setupRecording(cfg.Record); err != nil {
+		fatal("Could not set up recording", err)
+	}
+	stations, err := openStations(cfg)
 	if err != nil {
-		panic(err)
+		fatal("Could not open the scanner", err)
+	}
+	release := func() {
+		for _, st := range stations {
+			st.release()
+		}
 	}
-	defer device.Release()
 
-	// Ran into some trouble during testing when closing out through ctrl+c with the input not being
-	// released. The code below cleans up on a terminate signal.
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	// Now that we have the devices there is no need for root anymore. Sinks are only set up
+	// after this, so nothing talks to the network with more privileges than it needs.
+	if cfg.User != "" {
+		if err := dropPrivileges(cfg.User, cfg.Group); err != nil {
+			release()
+			fatal("Could not drop privileges", err)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := startStations(ctx, cfg, stations); err != nil {
+		release()
+		fatal("Could not start", withExit(exitConfig, err)) // but a sink's error has its own code
+	}
+
+	if flags.tui {
+		if viewer, err = startViewer(); err != nil {
+			release()
+			fatal("Could not start the viewer", err)
+		}
+		if cfg.Log.Output == "" || cfg.Log.Output == "stderr" {
+			setupLogging(cfg.Log) // now to the viewer
+		}
+	}
+	startControl(ctx, cfg, stations, *configPath, &flags)
+	startHTTP(cfg, stations)
+	setupTracing(ctx, cfg.Tracing)
+
+	if remote != nil && remoteFlags.interval > 0 {
+		go remote.watch(ctx, remoteFlags.interval, func() error {
+			return reloadStations(ctx, stations, *configPath, &flags)
+		})
+	}
+
+	// Reload the configuration on SIGHUP. The devices stay grabbed, so a change to the device
+	// matchers only takes effect on restart.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 	go func() {
-		for range c {
-			err = device.Release()
-			if err != nil {
-				panic(err)
+		for range hup {
+			if cfg.Lockdown {
+				slog.Info("Locked down, ignoring SIGHUP")
+				continue
+			}
+			if err := reloadStations(ctx, stations, *configPath, &flags); err != nil {
+				slog.Error("Could not reload configuration, keeping the old one", "error", err)
 			}
-			os.Exit(1)
 		}
 	}()
 
-	event := make(chan evdev.InputEvent, 256)
-	timeout := time.NewTimer(timerDuration)
-	scannedBarcode := make(chan string, 8)
-
-	// processBarcodes is only dumping received barcodes to the terminal. For other usage this should probably
-	// be something else
-	go processBarcodes(scannedBarcode)
-	go processEvents(event, scannedBarcode, timeout)
+	// Ran into some trouble during testing when closing out through ctrl+c with the input not being
+	// released. The code below cleans up on a terminate signal, after giving the sinks a chance to
+	// deliver what they still have. SIGTERM is how systemd stops us, so that counts as a clean exit.
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-c
+		sdNotify("STOPPING=1")
+		slog.Info("Shutting down, delivering queued scans")
+		delivered := shutdownStations(stations, cfg.ShutdownTimeout.Duration)
+		if !delivered {
+			slog.Warn("Sinks didn't finish in time, giving up", "timeout", cfg.ShutdownTimeout.Duration)
+		}
+		recording.close()
+		viewer.close()
+		cancel()
+		switch {
+		case !delivered:
+			os.Exit(exitSink)
+		case sig == syscall.SIGTERM:
+			os.Exit(0)
+		}
+		os.Exit(exitFailure)
+	}()
 
-	var events []evdev.InputEvent
-	fmt.Printf("Listening for events ...\n")
+	slog.Info("Listening for events")
 
-	for {
-		events, err = device.Read()
-		for i := range events {
-			/*str := format_event(&events[i])
-			if str != "" {
-				fmt.Println(str)
-			}*/
-			event <- events[i]
+	// Tell systemd we're up now that the devices are grabbed, and keep its watchdog happy if it
+	// has one for us.
+	if err := sdNotify("READY=1"); err != nil {
+		slog.Warn("Could not notify systemd", "error", err)
+	}
+	if interval := watchdogInterval(); interval > 0 {
+		var lives []*liveness
+		for _, st := range stations {
+			lives = append(lives, st.live)
 		}
+		go runWatchdog(interval, lives...)
+	}
+
+	for _, st := range stations[1:] {
+		go st.read()
 	}
+	stations[0].read()
+	// Only a capture or lines on stdin come to an end. Once it has been read, shut down as for
+	// SIGTERM, delivering what was scanned.
+	slog.Info("End of input, shutting down")
+	c <- syscall.SIGTERM
+	select {}
 }
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The metrics are written in the Prometheus text format by hand, there are few enough of
+// them that pulling in the client library isn't worth it.
+
+// latencyBuckets are the upper bounds in seconds for the latency histograms, from a fast
+// local sink up to a cloud API having a bad day.
+var latencyBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// scanBuckets are the upper bounds in seconds for how long reading a scan takes. Scans end
+// on the inter-character timeout, so there is at least that much to each of them.
+var scanBuckets = []float64{.01, .025, .05, .075, .1, .15, .2, .3, .5, .75, 1, 2, 5}
+
+// metricFamily is a metric with all its label combinations.
+type metricFamily interface {
+	write(w io.Writer)
+}
+
+// counterVec is a counter with labels.
+type counterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]float64
+	series map[string][]string
+}
+
+func newCounter(name, help string, labels ...string) *counterVec {
+	c := &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}, series: map[string][]string{}}
+	metricFamilies = append(metricFamilies, c)
+	return c
+}
+
+// inc counts one for the label values, given in the order the labels were declared.
+func (c *counterVec) inc(labelValues ...string) {
+	c.add(1, labelValues...)
+}
+
+func (c *counterVec) add(n float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[key] += n
+	c.series[key] = labelValues
+}
+
+// value is the count so far for the label values.
+func (c *counterVec) value(labelValues ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[strings.Join(labelValues, "\xff")]
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, labelPairs(c.labels, c.series[key], ""), formatValue(c.values[key]))
+	}
+}
+
+// histogramVec is a histogram with labels.
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+type histogram struct {
+	labelValues []string
+	counts      []uint64 // per bucket, not cumulative
+	count       uint64
+	sum         float64
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: map[string]*histogram{}}
+	metricFamilies = append(metricFamilies, h)
+	return h
+}
+
+// observe records a duration for the label values.
+func (h *histogramVec) observe(d time.Duration, labelValues ...string) {
+	v := d.Seconds()
+	key := strings.Join(labelValues, "\xff")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{labelValues: labelValues, counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, upper := range h.buckets {
+		if v <= upper {
+			s.counts[i]++
+			break
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+// latencySummary is what the status shows of a histogram: the count and estimated
+// quantiles, in seconds.
+type latencySummary struct {
+	Count uint64  `json:"count"`
+	P50   float64 `json:"p50"`
+	P90   float64 `json:"p90"`
+	P99   float64 `json:"p99"`
+}
+
+// summary estimates the quantiles for the label values from the buckets, nil if nothing
+// was observed yet.
+func (h *histogramVec) summary(labelValues ...string) *latencySummary {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[strings.Join(labelValues, "\xff")]
+	if !ok || s.count == 0 {
+		return nil
+	}
+	return &latencySummary{
+		Count: s.count,
+		P50:   h.quantile(s, .5),
+		P90:   h.quantile(s, .9),
+		P99:   h.quantile(s, .99),
+	}
+}
+
+// quantile interpolates linearly within the bucket the quantile falls in, like
+// histogram_quantile does. Past the last bucket it is the last upper bound.
+func (h *histogramVec) quantile(s *histogram, q float64) float64 {
+	rank := q * float64(s.count)
+	var cumulative uint64
+	lower := 0.0
+	for i, upper := range h.buckets {
+		if n := s.counts[i]; float64(cumulative+n) >= rank && n > 0 {
+			return lower + (upper-lower)*(rank-float64(cumulative))/float64(n)
+		}
+		cumulative += s.counts[i]
+		lower = upper
+	}
+	return h.buckets[len(h.buckets)-1]
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += s.counts[i]
+			le := `le="` + formatValue(upper) + `"`
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelPairs(h.labels, s.labelValues, le), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelPairs(h.labels, s.labelValues, `le="+Inf"`), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labelPairs(h.labels, s.labelValues, ""), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labelPairs(h.labels, s.labelValues, ""), s.count)
+	}
+}
+
+// gaugeSample is one value of a gauge that is computed when scraped.
+type gaugeSample struct {
+	labelValues []string
+	value       float64
+}
+
+// gaugeFunc is a gauge whose values are read at scrape time, for things like queue lengths
+// that are already there and just need looking at.
+type gaugeFunc struct {
+	name, help string
+	labels     []string
+	read       func() []gaugeSample
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	for _, s := range g.read() {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, labelPairs(g.labels, s.labelValues, ""), formatValue(s.value))
+	}
+}
+
+var metricFamilies []metricFamily
+
+var (
+	scansTotal = newCounter("usbscanner_scans_total",
+		"Completed scans by what happened to them: accepted, invalid, duplicate, paused, held or outside_hours. Held scans count again once they are let through.",
+		"device", "symbology", "result")
+	decodeErrors = newCounter("usbscanner_decode_errors_total",
+		"Key events with a key code we have no character for.", "device")
+	readErrors = newCounter("usbscanner_device_read_errors_total",
+		"Failed reads from an input device.", "device")
+	deviceReconnects = newCounter("usbscanner_device_reconnects_total",
+		"Times an input device was opened again after it went away.", "device")
+	watchdogReopens = newCounter("usbscanner_device_watchdog_reopens_total",
+		"Times an input device was opened again after nothing was read from it for read_timeout.", "device")
+	droppedEvents = newCounter("usbscanner_dropped_events_total",
+		"Input events that were read from a device but never decoded.", "device")
+	eventOverflows = newCounter("usbscanner_event_overflows_total",
+		"Times the kernel's event buffer for a device overflowed and events were lost (SYN_DROPPED).", "device")
+	backpressure = newCounter("usbscanner_backpressure_total",
+		"Times something came in while its queue was full, by what was done: blocked, dropped_oldest, dropped_newest or spilled.",
+		"device", "queue", "decision")
+	sinkLatency = newHistogram("usbscanner_sink_delivery_seconds",
+		"Time it took a sink to deliver a scan, failed deliveries included.", latencyBuckets, "device", "sink")
+	sinkFailures = newCounter("usbscanner_sink_failures_total",
+		"Scans a sink failed to deliver.", "device", "sink")
+	deadLetterTotal = newCounter("usbscanner_dead_letters_total",
+		"Scans a sink gave up on, by why: permanent (the scan can't be sent), max_attempts or max_age.", "device", "sink", "reason")
+	sinkStateChanges = newCounter("usbscanner_sink_state_changes_total",
+		"Times a sink went down after failing down_after times in a row, or came back up.", "device", "sink", "state")
+	scanDuration = newHistogram("usbscanner_scan_duration_seconds",
+		"Time from the first key event of a scan until it was complete, the inter-character timeout included.", scanBuckets, "device")
+	ackLatency = newHistogram("usbscanner_scan_ack_seconds",
+		"Time from the completion of a scan until a sink acknowledged it, time spent queued or held included.", latencyBuckets, "device", "sink")
+)
+
+// writeMetrics writes all metrics in the Prometheus text format, along with the gauges for
+// the stations: queue lengths and component restarts.
+func writeMetrics(w io.Writer, stations []*station) {
+	for _, m := range metricFamilies {
+		m.write(w)
+	}
+	queues := &gaugeFunc{
+		name:   "usbscanner_queue_depth",
+		help:   "Items waiting in a queue: key events, completed scans or scans for a sink.",
+		labels: []string{"device", "queue"},
+		read: func() []gaugeSample {
+			var samples []gaugeSample
+			for _, st := range stations {
+				if st.d == nil {
+					continue
+				}
+				samples = append(samples,
+					gaugeSample{[]string{st.device.Name, "events"}, float64(len(st.event))},
+					gaugeSample{[]string{st.device.Name, "scans"}, float64(len(st.scans))})
+				st.d.mu.RLock()
+				for _, s := range st.d.current.sinks {
+					samples = append(samples, gaugeSample{[]string{st.device.Name, "sink:" + s.name}, float64(s.queued())})
+				}
+				st.d.mu.RUnlock()
+			}
+			return samples
+		},
+	}
+	queues.write(w)
+	restarts := &gaugeFunc{
+		name:   "usbscanner_component_restarts",
+		help:   "How often a component was restarted after it failed.",
+		labels: []string{"component"},
+		read: func() []gaugeSample {
+			var samples []gaugeSample
+			for _, c := range components.componentRestarts() {
+				samples = append(samples, gaugeSample{[]string{c.Name}, float64(c.Restarts)})
+			}
+			return samples
+		},
+	}
+	restarts.write(w)
+	dead := &gaugeFunc{
+		name:   "usbscanner_dead_letters",
+		help:   "Scans a sink gave up on, waiting in its dead letter file.",
+		labels: []string{"device", "sink"},
+		read: func() []gaugeSample {
+			var samples []gaugeSample
+			for _, st := range stations {
+				if st.d == nil {
+					continue
+				}
+				st.d.mu.RLock()
+				for _, s := range st.d.current.sinks {
+					samples = append(samples, gaugeSample{[]string{st.device.Name, s.name}, float64(s.dead.len())})
+				}
+				st.d.mu.RUnlock()
+			}
+			return samples
+		},
+	}
+	dead.write(w)
+	up := &gaugeFunc{
+		name:   "usbscanner_sink_up",
+		help:   "1 while a sink is up, 0 once it failed down_after times in a row until a delivery goes through again.",
+		labels: []string{"device", "sink"},
+		read: func() []gaugeSample {
+			var samples []gaugeSample
+			for _, st := range stations {
+				if st.d == nil {
+					continue
+				}
+				st.d.mu.RLock()
+				for _, s := range st.d.current.sinks {
+					v := 1.0
+					if s.breaker.isDown() {
+						v = 0
+					}
+					samples = append(samples, gaugeSample{[]string{st.device.Name, s.name}, v})
+				}
+				st.d.mu.RUnlock()
+			}
+			return samples
+		},
+	}
+	up.write(w)
+	info := &gaugeFunc{
+		name:   "usbscanner_scanner_info",
+		help:   "1 for every scanner that was identified, with its model, serial number and firmware revision.",
+		labels: []string{"device", "vendor", "model", "serial", "firmware"},
+		read: func() []gaugeSample {
+			var samples []gaugeSample
+			for _, st := range stations {
+				if st.d == nil {
+					continue
+				}
+				if id := st.d.identity.Load(); id != nil {
+					samples = append(samples, gaugeSample{[]string{st.device.Name, id.Vendor, id.Model, id.Serial, id.Firmware}, 1})
+				}
+			}
+			return samples
+		},
+	}
+	info.write(w)
+}
+
+// labelPairs formats the labels of a sample, with extra (e.g. the bucket) added at the end.
+func labelPairs(names, values []string, extra string) string {
+	var pairs []string
+	for i, name := range names {
+		pairs = append(pairs, name+`="`+escapeLabel(values[i])+`"`)
+	}
+	if extra != "" {
+		pairs = append(pairs, extra)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Every vendor numbers or names the parameters of its scanners its own way, SSI by number
+// and Honeywell by the tags of its menu commands. Those work as they are, the number of a
+// parameter with a value of a byte over SSI and a tag with its data on Honeywell scanners,
+// and a few that are worth setting everywhere have a name of their own, which works with
+// either: beeper_volume, off, low, medium or high, and same_symbol_timeout, how long the
+// same barcode isn't read again, e.g. 500ms. The parameters of [params] are set whenever
+// the scanner is attached, so a scanner that was swapped or reset is set up like the rest.
+// Like symbologies, they last until the scanner is reset or powered off.
+
+// scannerParams are parameters of the scanner, by name, see params.go.
+type scannerParams map[string]string
+
+// paramControl is a scanner whose parameters can be read and set.
+type paramControl interface {
+	getParam(name string) (string, error)
+	setParam(name, value string) error
+}
+
+// beeperVolumes are the values of beeper_volume, from quiet to loud.
+var beeperVolumes = []string{"off", "low", "medium", "high"}
+
+// parseSameSymbolTimeout parses a value of same_symbol_timeout, up to max.
+func parseSameSymbolTimeout(value string, max time.Duration) (time.Duration, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 || d > max {
+		return 0, fmt.Errorf("same_symbol_timeout should be a duration of up to %s, not %q", max, value)
+	}
+	return d, nil
+}
+
+// Zebra's parameters for the named ones.
+const (
+	ssiParamBeeperVolume      = 0x8C // 0 high, 1 medium, 2 low
+	ssiParamSameSymbolTimeout = 0x89 // in tenths of a second
+)
+
+// ssiBeeperVolumes are the values of beeper_volume over SSI, which can't turn it off.
+var ssiBeeperVolumes = map[string]int{"high": 0, "medium": 1, "low": 2}
+
+// ssiParam is the number and value of a parameter for SSI.
+func ssiParam(name, value string) (int, int, error) {
+	switch name {
+	case "beeper_volume":
+		v, ok := ssiBeeperVolumes[value]
+		if !ok {
+			return 0, 0, fmt.Errorf("beeper_volume should be low, medium or high for a Zebra scanner, not %q", value)
+		}
+		return ssiParamBeeperVolume, v, nil
+	case "same_symbol_timeout":
+		d, err := parseSameSymbolTimeout(value, 9900*time.Millisecond)
+		return ssiParamSameSymbolTimeout, int(d / (100 * time.Millisecond)), err
+	}
+	num, err := ssiParamNumber(name)
+	if err != nil {
+		return 0, 0, err
+	}
+	v, err := strconv.ParseUint(value, 0, 8)
+	if err != nil {
+		return 0, 0, fmt.Errorf("the value of parameter %s should be a number from 0 to 255, not %q", name, value)
+	}
+	return num, int(v), nil
+}
+
+// ssiParamNumber is the number of the parameter name for SSI.
+func ssiParamNumber(name string) (int, error) {
+	switch name {
+	case "beeper_volume":
+		return ssiParamBeeperVolume, nil
+	case "same_symbol_timeout":
+		return ssiParamSameSymbolTimeout, nil
+	}
+	num, err := strconv.ParseUint(name, 0, 16)
+	if err != nil {
+		return 0, fmt.Errorf("a Zebra scanner's parameter should be beeper_volume, same_symbol_timeout or a number, not %q", name)
+	}
+	return int(num), nil
+}
+
+func (s *ssiScanner) setParam(name, value string) error {
+	num, v, err := ssiParam(name, value)
+	if err != nil {
+		return err
+	}
+	return s.setParams(false, map[int]int{num: v})
+}
+
+func (s *ssiScanner) getParam(name string) (string, error) {
+	num, err := ssiParamNumber(name)
+	if err != nil {
+		return "", err
+	}
+	values, err := s.params(num)
+	if err != nil {
+		return "", err
+	}
+	v, ok := values[num]
+	if !ok {
+		return "", fmt.Errorf("ssi: the scanner didn't say parameter %s", name)
+	}
+	switch name {
+	case "beeper_volume":
+		for volume, value := range ssiBeeperVolumes {
+			if value == v {
+				return volume, nil
+			}
+		}
+	case "same_symbol_timeout":
+		return (time.Duration(v) * 100 * time.Millisecond).String(), nil
+	}
+	return strconv.Itoa(v), nil
+}
+
+// honeywellParamTags are the menu commands of the named parameters on Honeywell scanners.
+var honeywellParamTags = map[string]string{
+	"beeper_volume":       "BEPLVL", // 0 off to 3 high
+	"same_symbol_timeout": "DLYRRD", // in milliseconds
+}
+
+// honeywellTag is the tag of the parameter name, and its data for value.
+func honeywellTag(name, value string) (tag, data string, err error) {
+	tag, named := honeywellParamTags[name]
+	switch {
+	case !named:
+		if len(name) != 6 || strings.ContainsAny(name, ".!;?") {
+			return "", "", fmt.Errorf("a Honeywell scanner's parameter should be beeper_volume, same_symbol_timeout or a tag of 6 characters, not %q", name)
+		}
+		return strings.ToUpper(name), value, nil
+	case value == "":
+	case name == "beeper_volume":
+		v := slices.Index(beeperVolumes, value)
+		if v < 0 {
+			return "", "", fmt.Errorf("beeper_volume should be off, low, medium or high, not %q", value)
+		}
+		data = strconv.Itoa(v)
+	case name == "same_symbol_timeout":
+		d, err := parseSameSymbolTimeout(value, 30*time.Second)
+		if err != nil {
+			return "", "", err
+		}
+		data = strconv.FormatInt(d.Milliseconds(), 10)
+	}
+	return tag, data, nil
+}
+
+func (h *honeywellScanner) setParam(name, value string) error {
+	tag, data, err := honeywellTag(name, value)
+	if err != nil {
+		return err
+	}
+	_, err = h.menu(tag + data + "!")
+	return err
+}
+
+func (h *honeywellScanner) getParam(name string) (string, error) {
+	tag, _, err := honeywellTag(name, "")
+	if err != nil {
+		return "", err
+	}
+	reply, err := h.menu(tag + "?")
+	if err != nil {
+		return "", err
+	}
+	data := strings.TrimPrefix(reply, tag)
+	switch name {
+	case "beeper_volume":
+		if v, err := strconv.Atoi(data); err == nil && v >= 0 && v < len(beeperVolumes) {
+			return beeperVolumes[v], nil
+		}
+	case "same_symbol_timeout":
+		if ms, err := strconv.Atoi(data); err == nil {
+			return (time.Duration(ms) * time.Millisecond).String(), nil
+		}
+	}
+	return data, nil
+}
+
+// setUp sets the parameters of the scanner as params has them, in the order of their names.
+func setUp(c paramControl, params scannerParams) error {
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var errs []error
+	for _, name := range names {
+		if err := c.setParam(name, params[name]); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// attached sets the scanner up whenever it is there, when the station starts and when it
+// came back: its [params] and who it is.
+func (s *station) attached() {
+	if len(s.params) > 0 {
+		if c, ok := s.ctl.(paramControl); !ok {
+			slog.Warn("The scanner's parameters can't be set, only those of scanners over SSI or SNAPI and Honeywell ones on a serial port", "device", s.device.Name)
+		} else if err := setUp(c, s.params); err != nil {
+			slog.Warn("Could not set the scanner's parameters", "device", s.device.Name, "error", err)
+		} else {
+			slog.Info("Scanner parameters set", "device", s.device.Name, "params", len(s.params))
+		}
+	}
+	s.identify()
+}
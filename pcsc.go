@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Contactless readers for RFID badges, MIFARE and DESFire cards and the like, are smart card
+// readers as far as Linux is concerned, run by pcscd of pcsc-lite. Rather than linking to
+// libpcsclite we speak its protocol on pcscd's socket ourselves: every message a header of
+// its size and the command, then the struct of the command as libpcsclite has it in native
+// byte order, answered by the same struct with the result in rv. The reader is polled for a
+// new card, whose UID is read with the GET DATA command of the PC/SC part 3 spec and passed
+// on as a scan of symbology nfc, in hex.
+
+const pcscdSocket = "/run/pcscd/pcscd.comm"
+
+// pcscPoll is how often the readers are looked at for a new card.
+const pcscPoll = 200 * time.Millisecond
+
+// Commands of the pcscd protocol.
+const (
+	pcscEstablishContext = 0x01
+	pcscConnect          = 0x04
+	pcscDisconnect       = 0x06
+	pcscTransmit         = 0x09
+	pcscVersion          = 0x11
+	pcscGetReadersState  = 0x12
+)
+
+const (
+	pcscProtocolMajor = 4
+	pcscProtocolMinor = 4
+
+	pcscMaxReaders    = 16
+	pcscMaxReaderName = 128
+
+	pcscScopeSystem  = 2
+	pcscShareShared  = 2
+	pcscProtocolAny  = 3 // T=0 or T=1
+	pcscLeaveCard    = 0
+	pcscStatePresent = 0x0004
+)
+
+// pcscGetUID is the APDU that asks a contactless card for its UID, answered by the UID and
+// 90 00.
+var pcscGetUID = []byte{0xFF, 0xCA, 0x00, 0x00, 0x00}
+
+type pcscHeader struct {
+	Size, Command uint32
+}
+
+type pcscVersionMsg struct {
+	Major, Minor int32
+	RV           uint32
+}
+
+type pcscEstablishMsg struct {
+	Scope, Context, RV uint32
+}
+
+type pcscConnectMsg struct {
+	Context            uint32
+	Reader             [pcscMaxReaderName]byte
+	ShareMode          uint32
+	PreferredProtocols uint32
+	Card               int32
+	ActiveProtocol     uint32
+	RV                 uint32
+}
+
+type pcscDisconnectMsg struct {
+	Card        int32
+	Disposition uint32
+	RV          uint32
+}
+
+type pcscTransmitMsg struct {
+	Card                  int32
+	SendProtocol, SendLen uint32 // of the protocol control information
+	SendLength            uint32
+	RecvProtocol, RecvLen uint32
+	RecvLength            uint32
+	RV                    uint32
+}
+
+// pcscReaderState is a reader as pcscd shares it with its clients.
+type pcscReaderState struct {
+	Name      [pcscMaxReaderName]byte
+	Events    uint32 // counts cards put on and taken off
+	State     uint32
+	Sharing   int32
+	ATR       [33]byte
+	_         [3]byte
+	ATRLength uint32
+	Protocol  uint32
+}
+
+func (r pcscReaderState) name() string {
+	name, _, _ := bytes.Cut(r.Name[:], []byte{0})
+	return string(name)
+}
+
+// pcscError is a result of pcscd other than success.
+type pcscError uint32
+
+func (e pcscError) Error() string {
+	switch e {
+	case 0x8010000C:
+		return "pcsc: no card on the reader"
+	case 0x80100069:
+		return "pcsc: the card was taken off"
+	case 0x80100066:
+		return "pcsc: the card doesn't answer"
+	}
+	return fmt.Sprintf("pcsc: error %#08x", uint32(e))
+}
+
+func pcscResult(rv uint32) error {
+	if rv != 0 {
+		return pcscError(rv)
+	}
+	return nil
+}
+
+// pcscClient is a connection to pcscd with its context.
+type pcscClient struct {
+	conn    net.Conn
+	context uint32
+}
+
+func dialPCSC(socket string) (*pcscClient, error) {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, noDevice(fmt.Errorf("pcsc: is pcscd running? %w", err))
+	}
+	c := &pcscClient{conn: conn}
+	v := pcscVersionMsg{Major: pcscProtocolMajor, Minor: pcscProtocolMinor}
+	if err := c.call(pcscVersion, &v, nil, &v); err != nil {
+		conn.Close()
+		return nil, err
+	} else if v.RV != 0 {
+		conn.Close()
+		return nil, fmt.Errorf("pcsc: pcscd speaks protocol %d.%d, not %d.%d", v.Major, v.Minor, pcscProtocolMajor, pcscProtocolMinor)
+	}
+	e := pcscEstablishMsg{Scope: pcscScopeSystem}
+	if err := c.call(pcscEstablishContext, &e, nil, &e); err == nil {
+		err = pcscResult(e.RV)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c.context = e.Context
+	return c, nil
+}
+
+// call sends a command with its struct req, if any, and data after it, and reads the
+// answer into resp.
+func (c *pcscClient) call(command uint32, req any, data []byte, resp any) error {
+	var b bytes.Buffer
+	size := 0
+	if req != nil {
+		size = binary.Size(req)
+	}
+	binary.Write(&b, binary.NativeEndian, pcscHeader{Size: uint32(size), Command: command})
+	if req != nil {
+		binary.Write(&b, binary.NativeEndian, req)
+	}
+	b.Write(data)
+	c.conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := c.conn.Write(b.Bytes()); err != nil {
+		return err
+	}
+	return binary.Read(c.conn, binary.NativeEndian, resp)
+}
+
+func (c *pcscClient) readersState() ([]pcscReaderState, error) {
+	var states [pcscMaxReaders]pcscReaderState
+	if err := c.call(pcscGetReadersState, nil, nil, &states); err != nil {
+		return nil, err
+	}
+	var readers []pcscReaderState
+	for _, r := range states {
+		if r.Name[0] != 0 {
+			readers = append(readers, r)
+		}
+	}
+	return readers, nil
+}
+
+// readUID connects to the card on reader and asks it for its UID.
+func (c *pcscClient) readUID(reader string) ([]byte, error) {
+	conn := pcscConnectMsg{Context: c.context, ShareMode: pcscShareShared, PreferredProtocols: pcscProtocolAny}
+	copy(conn.Reader[:pcscMaxReaderName-1], reader)
+	if err := c.call(pcscConnect, &conn, nil, &conn); err != nil {
+		return nil, err
+	} else if err := pcscResult(conn.RV); err != nil {
+		return nil, err
+	}
+	defer func() {
+		d := pcscDisconnectMsg{Card: conn.Card, Disposition: pcscLeaveCard}
+		c.call(pcscDisconnect, &d, nil, &d)
+	}()
+	t := pcscTransmitMsg{Card: conn.Card, SendProtocol: conn.ActiveProtocol, SendLen: 8, SendLength: uint32(len(pcscGetUID)),
+		RecvProtocol: conn.ActiveProtocol, RecvLen: 8, RecvLength: 258}
+	if err := c.call(pcscTransmit, &t, pcscGetUID, &t); err != nil {
+		return nil, err
+	} else if err := pcscResult(t.RV); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, t.RecvLength)
+	if _, err := io.ReadFull(c.conn, resp); err != nil {
+		return nil, err
+	}
+	if len(resp) < 2 || resp[len(resp)-2] != 0x90 || resp[len(resp)-1] != 0x00 {
+		return nil, fmt.Errorf("pcsc: the card answered % X to GET DATA", resp)
+	}
+	return resp[:len(resp)-2], nil
+}
+
+// pcscReader reads the UIDs of the cards put on the first reader of pcscd whose name has
+// cfg's reader in it.
+type pcscReader struct {
+	cfg  PCSCConfig
+	name string
+
+	mu     sync.Mutex
+	c      *pcscClient
+	closed bool
+	seen   map[string]uint32 // the event count of the card read last, by reader
+}
+
+func (c PCSCConfig) socket() string {
+	if c.Socket != "" {
+		return c.Socket
+	}
+	return pcscdSocket
+}
+
+// findReader is the first reader whose name has cfg's reader in it.
+func (c *pcscClient) findReader(cfg PCSCConfig) (pcscReaderState, error) {
+	readers, err := c.readersState()
+	if err != nil {
+		return pcscReaderState{}, err
+	}
+	for _, r := range readers {
+		if strings.Contains(r.name(), cfg.Reader) {
+			return r, nil
+		}
+	}
+	return pcscReaderState{}, withExit(exitNoDevice, fmt.Errorf("pcsc: no reader with %q in its name", cfg.Reader))
+}
+
+func openPCSCReader(cfg PCSCConfig, name string) (*pcscReader, error) {
+	r := &pcscReader{cfg: cfg, name: name, seen: map[string]uint32{}}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *pcscReader) open() error {
+	c, err := dialPCSC(r.cfg.socket())
+	if err != nil {
+		return err
+	}
+	if _, err := c.findReader(r.cfg); err != nil {
+		c.conn.Close()
+		return err
+	}
+	r.mu.Lock()
+	r.c, r.closed = c, false
+	r.mu.Unlock()
+	return nil
+}
+
+// readScan waits for a card to be put on the reader and reads its UID. A card that can't
+// be read, taken off too soon say, is logged and skipped.
+func (r *pcscReader) readScan() (Scan, error) {
+	for {
+		r.mu.Lock()
+		c, closed := r.c, r.closed
+		r.mu.Unlock()
+		if closed {
+			return Scan{}, errors.New("pcsc: reader closed")
+		}
+		reader, err := c.findReader(r.cfg)
+		if err != nil {
+			return Scan{}, err
+		}
+		name := reader.name()
+		if reader.State&pcscStatePresent == 0 || r.seen[name] == reader.Events {
+			time.Sleep(pcscPoll)
+			continue
+		}
+		r.seen[name] = reader.Events
+		uid, err := c.readUID(name)
+		if err != nil {
+			slog.Warn("Could not read the card", "device", r.name, "reader", name, "error", err)
+			continue
+		}
+		scan := newScan(strings.ToUpper(hex.EncodeToString(uid)), r.name, time.Now())
+		scan.Symbology = "nfc"
+		return scan, nil
+	}
+}
+
+// reopen connects to pcscd again, after it was restarted say.
+func (r *pcscReader) reopen() error {
+	r.close()
+	return r.open()
+}
+
+func (r *pcscReader) close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	return r.c.conn.Close()
+}
+
+// openPCSCStation opens the station for a contactless reader through pcscd.
+func openPCSCStation(profile string, cfg *Config) (*station, error) {
+	c, err := dialPCSC(cfg.PCSC.socket())
+	if err != nil {
+		return nil, err
+	}
+	reader, err := c.findReader(cfg.PCSC)
+	c.conn.Close()
+	if err != nil {
+		return nil, err
+	}
+	name := cfg.PCSC.Name
+	if name == "" {
+		name = reader.name()
+	}
+	return openSourceStation(profile, cfg, "pcsc/"+reader.name(), name, "pcsc", func() (scanSource, error) {
+		return openPCSCReader(cfg.PCSC, name)
+	})
+}
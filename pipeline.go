@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// pipeline is everything between a completed scan and the sinks: validation, tagging and
+// routing. On reload a new pipeline is built and swapped in as a whole, so every scan is
+// handled by one consistent set of rules and sinks.
+type pipeline struct {
+	cfg       *Config
+	validator *validator
+	dedup     *dedup
+	session   *session
+	tags      []tagRule
+	schedule  *schedule
+	sinks     []*sinkRunner
+}
+
+// newPipeline sets up a pipeline for a configuration. Its sinks aren't running until start
+// is called.
+func newPipeline(cfg *Config) (*pipeline, error) {
+	if err := cfg.checkReader(); err != nil {
+		return nil, err
+	}
+	v, err := newValidator(cfg.Validate)
+	if err != nil {
+		return nil, err
+	}
+	tags, err := cfg.tagRules()
+	if err != nil {
+		return nil, err
+	}
+	sched, err := newSchedule(cfg.Schedule)
+	if err != nil {
+		return nil, err
+	}
+	sess, err := newSession(cfg.Session)
+	if err != nil {
+		return nil, err
+	}
+	dc := cfg.Dedup
+	if cfg.DryRun {
+		dc.File = "" // or the real run would take what was scanned in the dry run for repeats
+	}
+	dd, err := newDedup(dc)
+	if err != nil {
+		return nil, err
+	}
+	sinks, err := setupSinks(cfg)
+	if err != nil {
+		dd.close()
+		return nil, withExit(exitSink, err)
+	}
+	return &pipeline{cfg: cfg, validator: v, dedup: dd, session: sess, tags: tags, schedule: sched, sinks: sinks}, nil
+}
+
+// checkReader checks the reader setting, and its [prox] table for prox.
+func (cfg *Config) checkReader() error {
+	switch cfg.Reader {
+	case "", "scanner", "badge", "keypad":
+	case "prox":
+		if f := cfg.Prox.Format; f != "" && f != "decimal" && f != "hex" && f != "wiegand" {
+			return fmt.Errorf("prox: format should be decimal, hex or wiegand, not %q", f)
+		}
+	default:
+		return fmt.Errorf("reader should be scanner, badge, prox or keypad, not %q", cfg.Reader)
+	}
+	return nil
+}
+
+// setDevice names the device of the station the pipeline is for, in the metrics of its sinks.
+func (p *pipeline) setDevice(name string) {
+	for _, s := range p.sinks {
+		s.device = name
+		s.breaker.device = name
+	}
+}
+
+func (p *pipeline) start(ctx context.Context) {
+	for _, s := range p.sinks {
+		go s.run(ctx)
+	}
+}
+
+// stop lets every sink deliver what it has queued and closes them.
+func (p *pipeline) stop() {
+	for _, s := range p.sinks {
+		s.stop()
+	}
+	p.dedup.close()
+}
+
+// handle strips the scan and checks it against the validation rules, drops or tags
+// repeats, tags it, pairs it with the operator of the session and queues it on every sink
+// whose routes match. It returns why the scan isn't valid, if it isn't.
+func (p *pipeline) handle(scan Scan) error {
+	root := tracing.startScan(scan)
+	defer root.release()
+	parse := root.child("parse")
+	scan = p.validator.strip(scan)
+	if err := p.validator.check(scan); err != nil {
+		parse.finish(err)
+		slog.Warn("Ignoring scan", "code", scan.Code, "device", scan.Device, "error", err)
+		scansTotal.inc(scan.Device, scan.Symbology, "invalid")
+		viewer.scan(scan, "invalid: "+err.Error())
+		return err
+	}
+	if p.dedup.repeat(scan) {
+		if !p.dedup.tag {
+			parse.finish(nil)
+			slog.Info("Ignoring repeated scan", "code", scan.Code, "device", scan.Device)
+			scansTotal.inc(scan.Device, scan.Symbology, "duplicate")
+			viewer.scan(scan, "duplicate")
+			return nil
+		}
+		scan.Tags = append(scan.Tags, duplicateTag)
+	}
+	scansTotal.inc(scan.Device, scan.Symbology, "accepted")
+	slog.Debug("Scan", "code", scan.Code, "device", scan.Device, "symbology", scan.Symbology, "tags", scan.Tags)
+	scan = p.tag(scan)
+	if !p.session.pair(&scan) {
+		parse.finish(nil)
+		slog.Info("Ignoring scan made without a session", "code", scan.Code, "device", scan.Device)
+		viewer.scan(scan, "no session")
+		return nil
+	}
+	parse.finish(nil)
+	viewer.scan(scan, viewerStatus(scan))
+	scan.trace = root
+	for _, s := range p.sinks {
+		if s.accepts(scan) {
+			root.hold()
+			s.enqueue(scan)
+		}
+	}
+	return nil
+}
+
+// tag adds the tags of the rules the scan matches.
+func (p *pipeline) tag(scan Scan) Scan {
+	for _, t := range p.tags {
+		if t.re.MatchString(scan.Code) {
+			scan.Tags = append(scan.Tags, t.tag)
+		}
+	}
+	return scan
+}
+
+// dispatcher holds the current pipeline and feeds completed scans to it. While paused,
+// completed scans are dropped instead.
+type dispatcher struct {
+	mu      sync.RWMutex
+	current *pipeline
+	stopped bool // shutting down, no more reloads
+
+	paused   atomic.Bool
+	outside  atomic.Bool  // outside the active hours of the schedule
+	scans    atomic.Int64 // scans completed so far, paused or not
+	lastScan atomic.Int64 // unix nanoseconds of the last one
+
+	heldMu sync.Mutex
+	held   []Scan // scans made outside the active hours, see schedule
+
+	feedback chan feedbackSignal // to the scanner, nil if it takes none
+
+	identity atomic.Pointer[scannerIdentity] // of the scanner, nil until known
+
+	recentMu sync.Mutex
+	recent   []Scan // the last few scans, newest first, for the status
+}
+
+// recentScans is how many scans the status shows.
+const recentScans = 10
+
+func (d *dispatcher) remember(scan Scan) {
+	d.recentMu.Lock()
+	defer d.recentMu.Unlock()
+	d.recent = append([]Scan{scan}, d.recent...)
+	if len(d.recent) > recentScans {
+		d.recent = d.recent[:recentScans]
+	}
+}
+
+func (d *dispatcher) recentScans() []Scan {
+	d.recentMu.Lock()
+	defer d.recentMu.Unlock()
+	return append([]Scan(nil), d.recent...)
+}
+
+// config returns the configuration currently in effect.
+func (d *dispatcher) config() *Config {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.current.cfg
+}
+
+// processScans waits for completed scans and hands them to the current pipeline until the
+// channel is closed. The read lock is held while a scan is queued, so a pipeline that was
+// swapped out by a reload won't get any more scans after that.
+func (d *dispatcher) processScans(scans chan Scan) {
+	for scan := range scans {
+		d.scans.Add(1)
+		if scan.Scanner == nil {
+			scan.Scanner = d.identity.Load()
+		}
+		d.lastScan.Store(scan.Time.UnixNano())
+		recording.scan(scan)
+		switch cfg := d.config(); cfg.Reader {
+		case "badge":
+			scan = badgeScan(scan)
+		case "prox":
+			scan = proxScan(scan, cfg.Prox)
+		}
+		d.remember(scan)
+		if !scan.Started.IsZero() {
+			scanDuration.observe(scan.Time.Sub(scan.Started), scan.Device)
+		}
+		if d.paused.Load() {
+			slog.Info("Paused, dropping scan", "code", scan.Code, "device", scan.Device)
+			scansTotal.inc(scan.Device, scan.Symbology, "paused")
+			viewer.scan(scan, "paused")
+			scan.acknowledge(false)
+			continue
+		}
+		d.mu.RLock()
+		sched := d.current.schedule
+		d.mu.RUnlock()
+		if !sched.active(scan.Time) {
+			scan.acknowledge(true)
+			d.hold(sched, scan)
+			continue
+		}
+		d.flushHeld()
+		d.mu.RLock()
+		err := d.current.handle(scan)
+		scan.acknowledge(err == nil)
+		d.signal(d.current.cfg.Feedback, err)
+		d.mu.RUnlock()
+	}
+}
+
+// replace swaps in a new pipeline, which has to be started already. Scans already queued
+// on the old sinks are delivered before those are closed. Once shutting down p is stopped
+// right away instead.
+func (d *dispatcher) replace(p *pipeline) error {
+	d.mu.Lock()
+	if d.stopped {
+		d.mu.Unlock()
+		p.stop()
+		return errors.New("shutting down")
+	}
+	old := d.current
+	d.current = p
+	d.mu.Unlock()
+	old.stop()
+	return nil
+}
+
+// stop drains and closes the sinks of the current pipeline for shutdown. Scans still held
+// for the active hours go to the sinks first, they were acknowledged already and would
+// otherwise be lost. It waits at most timeout and reports whether the sinks finished in
+// time.
+func (d *dispatcher) stop(timeout time.Duration) bool {
+	d.mu.Lock()
+	d.stopped = true
+	p := d.current
+	d.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		d.heldMu.Lock()
+		if len(d.held) > 0 {
+			slog.Info("Shutting down, delivering the scans held for the active hours", "held", len(d.held))
+			for _, scan := range d.held {
+				p.handle(scan)
+			}
+			d.held = nil
+		}
+		d.heldMu.Unlock()
+		p.stop()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// dropPrivileges switches to an unprivileged user (and group, if given, otherwise the user's
+// primary group) once the scanner is open and grabbed. The device stays usable through the
+// open file, while everything after, sinks talking to the network in particular, runs
+// without root. Names or numeric IDs work for both.
+func dropPrivileges(username string, groupname string) error {
+	u, err := user.Lookup(username)
+	if err != nil {
+		if u, err = user.LookupId(username); err != nil {
+			return fmt.Errorf("unknown user %s", username)
+		}
+	}
+	uid, _ := strconv.Atoi(u.Uid)
+	gid, _ := strconv.Atoi(u.Gid)
+	if groupname != "" {
+		g, err := user.LookupGroup(groupname)
+		if err != nil {
+			if g, err = user.LookupGroupId(groupname); err != nil {
+				return fmt.Errorf("unknown group %s", groupname)
+			}
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+
+	if os.Geteuid() != 0 {
+		if os.Geteuid() == uid {
+			return nil
+		}
+		return fmt.Errorf("need to run as root to switch to user %s", username)
+	}
+
+	// Supplementary groups first while we still may, then group, then user.
+	var groups []int
+	if ids, err := u.GroupIds(); err == nil {
+		for _, id := range ids {
+			if n, err := strconv.Atoi(id); err == nil {
+				groups = append(groups, n)
+			}
+		}
+	}
+	if err := syscall.Setgroups(groups); err != nil {
+		return fmt.Errorf("setgroups: %v", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("setgid: %v", err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("setuid: %v", err)
+	}
+	// Make sure there is no way back.
+	if err := syscall.Setuid(0); err == nil {
+		return fmt.Errorf("could still regain root after dropping privileges")
+	}
+	// Things like the AWS credentials file are looked up in the home directory.
+	os.Setenv("HOME", u.HomeDir)
+	os.Setenv("USER", u.Username)
+	return nil
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// `usbscanner program` makes the programming barcodes that set a scanner up the way
+// usbscanner reads it best, to scan off the screen or a printout rather than hunting for
+// them in the scanner's manual: an Enter after every barcode, AIM symbology identifiers in
+// front, the packet format for SSI. Settings are the vendor's parameter numbers, 123Scan's
+// for Zebra, so anything else can be given by number too. The barcodes are Code 128, drawn
+// here, as a PNG or a PDF with the setting under each of them.
+
+// code128Patterns are the widths of the bars and spaces of the Code 128 symbols, the start
+// and stop symbols last.
+var code128Patterns = [107]string{
+	"212222", "222122", "222221", "121223", "121322", "131222", "122213", "122312", "132212", "221213",
+	"221312", "231212", "112232", "122132", "122231", "113222", "123122", "123221", "223211", "221132",
+	"221231", "213212", "223112", "312131", "311222", "321122", "321221", "312212", "322112", "322211",
+	"212123", "212321", "232121", "111323", "131123", "131321", "112313", "132113", "132311", "211313",
+	"231113", "231311", "112133", "112331", "132131", "113123", "113321", "133121", "313121", "211331",
+	"231131", "213113", "213311", "213131", "311123", "311321", "331121", "312113", "312311", "332111",
+	"314111", "221411", "431111", "111224", "111422", "121124", "121421", "141122", "141221", "112214",
+	"112412", "122114", "122411", "142112", "142211", "241211", "221114", "413111", "241112", "134111",
+	"111242", "121142", "121241", "114212", "124112", "124211", "411212", "421112", "421211", "212141",
+	"214121", "412121", "111143", "111341", "131141", "114113", "114311", "411113", "411311", "113141",
+	"114131", "311141", "411131", "211412", "211214", "211232", "2331112",
+}
+
+const (
+	code128FNC3   = 96 // in code set B, marks a barcode as programming the scanner
+	code128StartB = 104
+	code128Stop   = 106
+)
+
+// code128B is text in code set B, which has all of printable ASCII.
+func code128B(text string) ([]int, error) {
+	values := make([]int, 0, len(text))
+	for _, c := range []byte(text) {
+		if c < 32 || c > 127 {
+			return nil, fmt.Errorf("code 128: %q has no symbol in code set B", c)
+		}
+		values = append(values, int(c)-32)
+	}
+	return values, nil
+}
+
+// code128 is the widths of the bars and spaces of the barcode of values in code set B,
+// starting with a bar: the start symbol, the values, the check symbol and the stop symbol.
+func code128(values []int) []int {
+	symbols := append([]int{code128StartB}, values...)
+	check := code128StartB
+	for i, v := range values {
+		check += (i + 1) * v
+	}
+	symbols = append(symbols, check%103, code128Stop)
+	var widths []int
+	for _, s := range symbols {
+		for _, w := range code128Patterns[s] {
+			widths = append(widths, int(w-'0'))
+		}
+	}
+	return widths
+}
+
+// programSetting is something a programming barcode sets, as the vendor's parameters.
+type programSetting struct {
+	name, about string
+	params      [][2]int // parameter number and value
+}
+
+// programVendor is how a vendor's scanners are programmed: the settings usbscanner wants
+// and the data of a barcode setting parameters.
+type programVendor struct {
+	settings []programSetting
+	barcode  func(params [][2]int) []int
+}
+
+var programVendors = map[string]programVendor{
+	"zebra": {
+		settings: []programSetting{
+			{"enter", "send an Enter after every barcode", [][2]int{{235, 1}, {98, 0x0D}}},
+			{"aim", "send the AIM symbology identifier in front", [][2]int{{45, 1}}},
+			{"no-aim", "send no symbology identifier", [][2]int{{45, 0}}},
+			{"ssi", "send decode data in SSI packets, for protocol = \"ssi\"", [][2]int{{0xEE, 1}}},
+		},
+		barcode: zebraParamBarcode,
+	},
+}
+
+// zebraParamBarcode is a Zebra parameter barcode: FNC3 and then the number and value of
+// every parameter, in hex of 4 and 2 digits, the parameter numbers 123Scan and the
+// programming guides give.
+func zebraParamBarcode(params [][2]int) []int {
+	var b strings.Builder
+	for _, p := range params {
+		fmt.Fprintf(&b, "%04X%02X", p[0], p[1])
+	}
+	values, _ := code128B(b.String()) // hex digits are all in code set B
+	return append([]int{code128FNC3}, values...)
+}
+
+// parseParam parses number=value, both decimal or hex with 0x.
+func parseParam(s string) ([2]int, error) {
+	n, v, ok := strings.Cut(s, "=")
+	number, err1 := strconv.ParseUint(n, 0, 16)
+	value, err2 := strconv.ParseUint(v, 0, 8)
+	if !ok || err1 != nil || err2 != nil {
+		return [2]int{}, fmt.Errorf("-param should be number=value, e.g. 45=1, not %q", s)
+	}
+	return [2]int{int(number), int(value)}, nil
+}
+
+// programBarcode is a barcode to draw, with what it does under it.
+type programBarcode struct {
+	caption string
+	widths  []int
+}
+
+// programQuiet is the space left of and right of a barcode, in modules.
+const programQuiet = 10
+
+func (b programBarcode) modules() int {
+	n := 2 * programQuiet
+	for _, w := range b.widths {
+		n += w
+	}
+	return n
+}
+
+// writeProgramPNG draws the barcodes one under the other, 3 pixels to a module.
+func writeProgramPNG(w io.Writer, codes []programBarcode) error {
+	const module, height, gap = 3, 120, 60
+	width := 0
+	for _, c := range codes {
+		width = max(width, c.modules()*module)
+	}
+	img := image.NewGray(image.Rect(0, 0, width, len(codes)*(height+gap)+gap))
+	for i := range img.Pix {
+		img.Pix[i] = 0xFF
+	}
+	for i, c := range codes {
+		x, y := programQuiet*module, gap+i*(height+gap)
+		for j, wd := range c.widths {
+			if j%2 == 0 {
+				for px := x; px < x+wd*module; px++ {
+					for py := y; py < y+height; py++ {
+						img.SetGray(px, py, color.Gray{})
+					}
+				}
+			}
+			x += wd * module
+		}
+	}
+	return png.Encode(w, img)
+}
+
+// pdfString quotes s for a PDF content stream.
+func pdfString(s string) string {
+	return "(" + strings.NewReplacer(`\`, `\\`, "(", `\(`, ")", `\)`).Replace(s) + ")"
+}
+
+// writeProgramPDF lays the barcodes out on A4 pages, six to a page with their captions, at a
+// module of 1pt, less if a barcode wouldn't fit the width of the page otherwise.
+func writeProgramPDF(w io.Writer, codes []programBarcode) error {
+	const pageWidth, pageHeight, margin, perPage = 595, 842, 50, 6
+	var pages []string
+	for first := 0; first < len(codes); first += perPage {
+		var content strings.Builder
+		for i, c := range codes[first:min(first+perPage, len(codes))] {
+			module := min(1, float64(pageWidth-2*margin)/float64(c.modules()))
+			x, y := margin+programQuiet*module, float64(pageHeight-margin-60-i*125)
+			for j, wd := range c.widths {
+				if j%2 == 0 {
+					fmt.Fprintf(&content, "%.2f %.2f %.2f 50 re f\n", x, y, float64(wd)*module)
+				}
+				x += float64(wd) * module
+			}
+			fmt.Fprintf(&content, "BT /F1 11 Tf %d %.2f Td %s Tj ET\n", margin, y-18, pdfString(c.caption))
+		}
+		pages = append(pages, content.String())
+	}
+
+	// Objects: 1 catalog, 2 pages, 3 font, then a page and its content for every page.
+	objects := []string{"<< /Type /Catalog /Pages 2 0 R >>", "", "<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica >>"}
+	var kids []string
+	for _, content := range pages {
+		n := len(objects) + 1
+		kids = append(kids, fmt.Sprintf("%d 0 R", n))
+		objects = append(objects,
+			fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>", pageWidth, pageHeight, n+1),
+			fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", len(content), content))
+	}
+	objects[1] = fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(kids))
+
+	var b bytes.Buffer
+	b.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, o := range objects {
+		offsets[i] = b.Len()
+		fmt.Fprintf(&b, "%d 0 obj\n%s\nendobj\n", i+1, o)
+	}
+	xref := b.Len()
+	fmt.Fprintf(&b, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&b, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&b, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// runProgram implements `usbscanner program`.
+func runProgram(args []string) {
+	fs := flag.NewFlagSet("program", flag.ExitOnError)
+	vendor := fs.String("vendor", "zebra", "whose scanner it is: zebra")
+	output := fs.String("o", "program.pdf", "write the barcodes to this .pdf or .png file")
+	var params listFlag
+	fs.Var(&params, "param", "also set a parameter by number, as number=value (repeatable)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: usbscanner program [flags] [setting]...\n\nSettings for Zebra scanners:\n")
+		for _, s := range programVendors["zebra"].settings {
+			fmt.Fprintf(fs.Output(), "  %-8s %s\n", s.name, s.about)
+		}
+		fmt.Fprintf(fs.Output(), "\nWithout settings or -param, enter and aim.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	v, ok := programVendors[*vendor]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "vendor should be zebra, not %q\n", *vendor)
+		os.Exit(2)
+	}
+	names := fs.Args()
+	if len(names) == 0 && len(params) == 0 {
+		names = []string{"enter", "aim"}
+	}
+	var codes []programBarcode
+	for _, name := range names {
+		i := 0
+		for i < len(v.settings) && v.settings[i].name != name {
+			i++
+		}
+		if i == len(v.settings) {
+			fmt.Fprintf(os.Stderr, "%s scanners have no setting %q, see -h\n", *vendor, name)
+			os.Exit(2)
+		}
+		s := v.settings[i]
+		codes = append(codes, programBarcode{caption: fmt.Sprintf("%d. %s: %s", len(codes)+1, s.name, s.about), widths: code128(v.barcode(s.params))})
+	}
+	for _, p := range params {
+		param, err := parseParam(p)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		codes = append(codes, programBarcode{caption: fmt.Sprintf("%d. parameter %d = %d", len(codes)+1, param[0], param[1]), widths: code128(v.barcode([][2]int{param}))})
+	}
+
+	var write func(io.Writer, []programBarcode) error
+	switch strings.ToLower(filepath.Ext(*output)) {
+	case ".pdf":
+		write = writeProgramPDF
+	case ".png":
+		write = writeProgramPNG
+	default:
+		fmt.Fprintf(os.Stderr, "-o should name a .pdf or .png file, not %s\n", *output)
+		os.Exit(2)
+	}
+	f, err := os.Create(*output)
+	if err == nil {
+		err = write(f, codes)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not write the barcodes: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Wrote %d barcodes to %s, scan them in order:\n", len(codes), *output)
+	for _, c := range codes {
+		fmt.Println("  " + c.caption)
+	}
+}
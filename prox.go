@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"math/bits"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Proximity card readers in keyboard mode, the cheap ones for 125 kHz EM4100 fobs and
+// MIFARE cards, type the card's ID and Enter, each in its own way: the ID as decimal,
+// usually ten digits of 32 bits, or in hex, sometimes with its bytes least significant
+// first, or as the facility code and card number of 26 bit Wiegand, three digits and five.
+// With reader = "prox" the scan is read the way [prox] says and passed on as a badge whose
+// code is the card number.
+
+// ProxCard is the ID of a card a proximity reader typed.
+type ProxCard struct {
+	UID      string `json:"uid"` // in hex, most significant byte first
+	Facility int    `json:"facility,omitempty"`
+	Card     uint64 `json:"card"`
+}
+
+// parseProx reads what a proximity reader typed, Enter and all.
+func parseProx(code string, cfg ProxConfig) (ProxCard, error) {
+	code = strings.TrimSuffix(strings.TrimRight(code, "\r\n"), "enter")
+	var uid []byte
+	switch cfg.Format {
+	case "", "decimal":
+		v, err := strconv.ParseUint(code, 10, 64)
+		if err != nil {
+			return ProxCard{}, fmt.Errorf("prox: %q is not a decimal ID", code)
+		}
+		uid = make([]byte, max(4, (bits.Len64(v)+7)/8))
+		for i := range uid {
+			uid[len(uid)-1-i] = byte(v >> (8 * i))
+		}
+	case "hex":
+		if len(code)%2 == 1 {
+			code = "0" + code
+		}
+		var err error
+		if uid, err = hex.DecodeString(code); err != nil || len(uid) == 0 || len(uid) > 8 {
+			return ProxCard{}, fmt.Errorf("prox: %q is not an ID in hex", code)
+		}
+	case "wiegand":
+		facility, card, ok := strings.Cut(code, ",")
+		if !ok && len(code) == 8 {
+			facility, card = code[:3], code[3:]
+		}
+		f, err1 := strconv.ParseUint(facility, 10, 8)
+		c, err2 := strconv.ParseUint(card, 10, 16)
+		if err1 != nil || err2 != nil {
+			return ProxCard{}, fmt.Errorf("prox: %q is not a facility code and card number", code)
+		}
+		uid = []byte{byte(f), byte(c >> 8), byte(c)}
+	default:
+		return ProxCard{}, fmt.Errorf("prox: format should be decimal, hex or wiegand, not %q", cfg.Format)
+	}
+	if cfg.Reverse {
+		slices.Reverse(uid)
+	}
+	p := ProxCard{UID: strings.ToUpper(hex.EncodeToString(uid))}
+	if cfg.Facility || cfg.Format == "wiegand" {
+		// What 26 bit Wiegand would carry: the last three bytes.
+		last := append(make([]byte, 3), uid...)[len(uid):]
+		p.Facility, p.Card = int(last[0]), uint64(last[1])<<8|uint64(last[2])
+		return p, nil
+	}
+	for _, b := range uid {
+		p.Card = p.Card<<8 | uint64(b)
+	}
+	return p, nil
+}
+
+// proxScan reads the card of a scan of a proximity reader.
+func proxScan(scan Scan, cfg ProxConfig) Scan {
+	scan.Symbology = "badge"
+	p, err := parseProx(scan.Code, cfg)
+	if err != nil {
+		slog.Warn("Could not read the card", "device", scan.Device, "error", err)
+		return scan
+	}
+	scan.Code = strconv.FormatUint(p.Card, 10)
+	scan.Badge = &BadgeScan{Prox: &p}
+	return scan
+}
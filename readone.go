@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// readScans collects valid scans from the stations, which are started, until there are
+// count of them, if count isn't 0, or until the deadline, if it isn't zero, or stop. Scans
+// the validation rules reject are skipped, as the daemon would.
+func readScans(stations []*station, count int, deadline time.Time, stop <-chan os.Signal) []Scan {
+	var scans []Scan
+	last := make([]Scan, len(stations)) // the newest scan of each station taken so far
+	for deadline.IsZero() || time.Now().Before(deadline) {
+		for i, s := range stations {
+			recent := s.d.recentScans() // newest first
+			n := 0
+			for n < len(recent) && !sameScan(recent[n], last[i]) {
+				n++
+			}
+			if n == 0 {
+				continue
+			}
+			last[i] = recent[0]
+			s.d.mu.RLock()
+			v := s.d.current.validator
+			s.d.mu.RUnlock()
+			for j := n - 1; j >= 0; j-- {
+				scan := v.strip(recent[j])
+				if err := v.check(scan); err != nil {
+					slog.Warn("Ignoring scan", "code", scan.Code, "device", scan.Device, "error", err)
+					continue
+				}
+				scans = append(scans, scan)
+				if len(scans) == count {
+					return scans
+				}
+			}
+		}
+		select {
+		case <-stop:
+			return scans
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	return scans
+}
+
+func sameScan(a, b Scan) bool {
+	return a.ID == b.ID && a.Code == b.Code && a.Time.Equal(b.Time)
+}
+
+// startReading opens and starts the stations of a config for reading scans off them, or
+// exits with the exit code of the daemon for the error. With profiles, profile picks the
+// one to read. The filter flags override its validation rules.
+func startReading(configPath, profile string, filters *filterFlags, verbose bool) []*station {
+	level := slog.LevelWarn
+	if verbose {
+		level = slog.LevelInfo
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+
+	cfg := defaultConfig()
+	if configPath != "" {
+		var err error
+		cfg, err = loadConfig(configPath)
+		if err == nil && len(cfg.Profiles) > 0 && profile == "" {
+			err = fmt.Errorf("pick the profile whose scanner to read with -profile: %s", strings.Join(cfg.profileNames(), ", "))
+		}
+		if err == nil {
+			cfg, err = cfg.profile(profile)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(exitConfig)
+		}
+	}
+	// Only the scanner and its decoding, none of the sinks or rules that hold scans back.
+	c := *cfg
+	c.Profiles = nil
+	c.Sinks = nil
+	c.Schedule = ScheduleConfig{}
+	c.Dedup = DedupConfig{}
+	c.Session = SessionConfig{}
+	c.Record = ""
+	c.Input = ""
+	filters.apply(&c.Validate)
+	stations, err := openStations(&c)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitCode(err))
+	}
+	if err := startStations(context.Background(), &c, stations); err != nil {
+		for _, s := range stations {
+			s.release()
+		}
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitCode(withExit(exitConfig, err)))
+	}
+	for _, s := range stations {
+		go s.read()
+	}
+	return stations
+}
+
+// runReadOne implements `usbscanner read-one`, for shell scripts: it grabs the scanner,
+// prints the first barcode scanned and exits 0, or exits 1 if nothing was scanned in time.
+// It takes the device the daemon would, so the daemon has to be stopped first.
+func runReadOne(args []string) {
+	fs := flag.NewFlagSet("read-one", flag.ExitOnError)
+	configPath := fs.String("config", os.Getenv("USBSCANNER_CONFIG"), "find the scanner, and decode, with the settings of this TOML file")
+	profile := fs.String("profile", "", "read the scanner of this profile")
+	timeout := fs.Duration("timeout", 30*time.Second, "how long to wait for the scan")
+	format := fs.String("format", "raw", "print the scan as raw, only the code, json, csv, or template")
+	text := fs.String("template", "", "the Go template to print the scan with, for -format template")
+	columns := fs.String("columns", "time,device,code", "the columns of csv, out of id, time, code, device, symbology and tags")
+	verbose := fs.Bool("v", false, "log what the scanner does, as the daemon would")
+	var filters filterFlags
+	filters.register(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: usbscanner read-one [flags]\n\nPrints the code of the first barcode scanned, e.g. code=$(usbscanner read-one -timeout 10s).\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	out, err := outputPayload(*format, *text, *columns)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	stations := startReading(*configPath, *profile, &filters, *verbose)
+	scans := readScans(stations, 1, time.Now().Add(*timeout), nil)
+	shutdownStations(stations, time.Second)
+	if len(scans) == 0 {
+		fmt.Fprintf(os.Stderr, "Nothing was scanned within %s\n", *timeout)
+		os.Exit(1)
+	}
+	line, err := out.render(scans[0], scans[0].Code)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Println(line)
+}
+
+// outputPayload is what a command prints for a scan with -format, -template and -columns:
+// the same as a sink's with that format or template, only csv has no header.
+func outputPayload(format, text, columns string) (*payload, error) {
+	p := &payload{}
+	if format == "template" {
+		if text == "" {
+			return nil, fmt.Errorf("-format template needs a -template")
+		}
+		t, err := parseTemplate("output", text)
+		if err != nil {
+			return nil, err
+		}
+		p.setTemplate(t)
+		return p, nil
+	}
+	if format != "raw" && format != "json" && format != "csv" {
+		return nil, fmt.Errorf("format should be raw, json, csv or template, not %q", format)
+	}
+	return p, p.configureFormat(&SinkConfig{Options: map[string]string{"format": format, "columns": columns, "header": "false"}})
+}
+
+// runRead implements `usbscanner read`, which reads a batch of scans, for a stock count
+// say, and prints them all at the end as a JSON array or CSV. It exits 1 if -count scans
+// weren't read within -duration.
+func runRead(args []string) {
+	fs := flag.NewFlagSet("read", flag.ExitOnError)
+	configPath := fs.String("config", os.Getenv("USBSCANNER_CONFIG"), "find the scanner, and decode, with the settings of this TOML file")
+	profile := fs.String("profile", "", "read the scanner of this profile")
+	count := fs.Int("count", 0, "stop after this many scans")
+	duration := fs.Duration("duration", 0, "stop after this long")
+	format := fs.String("format", "json", "print the scans as json or csv")
+	columns := fs.String("columns", "time,device,code", "the columns of csv, out of id, time, code, device, symbology and tags")
+	verbose := fs.Bool("v", false, "log what the scanner does, as the daemon would")
+	var filters filterFlags
+	filters.register(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: usbscanner read -count N|-duration D [flags]\n\nCtrl+c stops early, printing the scans read so far.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 0 || *count < 0 || *duration < 0 || *count == 0 && *duration == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	var csvf *csvFormat
+	switch *format {
+	case "json":
+	case "csv":
+		var err error
+		if csvf, err = newCSVFormat(&SinkConfig{Options: map[string]string{"columns": *columns}}); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "format should be json or csv, not %q\n", *format)
+		os.Exit(2)
+	}
+
+	stations := startReading(*configPath, *profile, &filters, *verbose)
+	var deadline time.Time
+	if *duration > 0 {
+		deadline = time.Now().Add(*duration)
+	}
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	scans := readScans(stations, *count, deadline, interrupt)
+	shutdownStations(stations, time.Second)
+
+	if csvf != nil {
+		fmt.Println(csvf.headerRow())
+		for _, scan := range scans {
+			fmt.Println(csvf.record(scan))
+		}
+	} else {
+		if scans == nil {
+			scans = []Scan{}
+		}
+		b, _ := json.MarshalIndent(scans, "", "  ")
+		fmt.Println(string(b))
+	}
+	if *count > 0 && len(scans) < *count {
+		fmt.Fprintf(os.Stderr, "Only %d of %d scans were read\n", len(scans), *count)
+		os.Exit(1)
+	}
+}
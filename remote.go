@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// remoteConfig keeps a local copy of a config file served over HTTP(S) up to date, so a
+// fleet of machines can be reconfigured from one place. The copy is what the rest of the
+// program loads as its config file, which also means the last good config keeps working
+// while the server can't be reached. The ETag of the copy is kept next to it, so unchanged
+// configs aren't downloaded again, not even after a restart.
+//
+// With a public key, the server has to provide a detached ed25519 signature of the file,
+// base64 encoded, at the same URL with .sig appended. Configs without a valid signature are
+// ignored.
+type remoteConfig struct {
+	url    string
+	cache  string
+	key    ed25519.PublicKey
+	client *http.Client
+}
+
+// remoteFlags are the flags for fetching the config from a server.
+type remoteFlags struct {
+	url      string
+	cache    string
+	keyFile  string
+	interval time.Duration
+}
+
+func (f *remoteFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.url, "config-url", os.Getenv("USBSCANNER_CONFIG_URL"), "fetch the config file from this http(s) URL instead of -config")
+	fs.StringVar(&f.cache, "config-cache", "/var/lib/usbscanner/config.toml", "where to keep the fetched config file")
+	fs.StringVar(&f.keyFile, "config-key", os.Getenv("USBSCANNER_CONFIG_KEY"), "file with the base64 ed25519 public key the fetched config has to be signed with")
+	fs.DurationVar(&f.interval, "config-interval", 5*time.Minute, "how often to check -config-url for changes, 0 to only fetch at startup")
+}
+
+func newRemoteConfig(f *remoteFlags) (*remoteConfig, error) {
+	r := &remoteConfig{url: f.url, cache: f.cache, client: &http.Client{Timeout: 30 * time.Second}}
+	if f.keyFile != "" {
+		data, err := os.ReadFile(f.keyFile)
+		if err != nil {
+			return nil, err
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("%s: not a base64 ed25519 public key", f.keyFile)
+		}
+		r.key = ed25519.PublicKey(key)
+	}
+	return r, nil
+}
+
+func (r *remoteConfig) etagPath() string { return r.cache + ".etag" }
+
+// fetch downloads the config if it changed and replaces the local copy with it. A config
+// that doesn't verify or doesn't load is an error and leaves the copy alone. It reports
+// whether the copy changed.
+func (r *remoteConfig) fetch(ctx context.Context) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.url, nil)
+	if err != nil {
+		return false, err
+	}
+	etag, _ := os.ReadFile(r.etagPath())
+	if _, err := os.Stat(r.cache); err == nil && len(etag) > 0 {
+		req.Header.Set("If-None-Match", strings.TrimSpace(string(etag)))
+	}
+	body, resp, err := r.get(req)
+	if err != nil {
+		return false, err
+	}
+	if resp.StatusCode == http.StatusNotModified {
+		return false, nil
+	}
+	if r.key != nil {
+		if err := r.verify(ctx, body); err != nil {
+			return false, err
+		}
+	}
+
+	// Check that it loads before it replaces what we have, then swap it in atomically so a
+	// reload never sees half a file.
+	if err := os.MkdirAll(filepath.Dir(r.cache), 0755); err != nil {
+		return false, err
+	}
+	tmp := r.cache + ".new"
+	if err := os.WriteFile(tmp, body, 0644); err != nil {
+		return false, err
+	}
+	if _, err := loadConfig(tmp); err != nil {
+		os.Remove(tmp)
+		return false, fmt.Errorf("%s: %v", r.url, err)
+	}
+	if err := os.Rename(tmp, r.cache); err != nil {
+		return false, err
+	}
+	// Without an ETag there is nothing to ask for next time, and an old one would be for
+	// another copy.
+	if etag := resp.Header.Get("ETag"); etag == "" {
+		os.Remove(r.etagPath())
+	} else if err := os.WriteFile(r.etagPath(), []byte(etag+"\n"), 0644); err != nil {
+		slog.Warn("Could not save the ETag of the remote config, it will be fetched in full again", "path", r.etagPath(), "error", err)
+	}
+	return true, nil
+}
+
+// verify checks the detached signature of a config.
+func (r *remoteConfig) verify(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.url+".sig", nil)
+	if err != nil {
+		return err
+	}
+	sig, resp, err := r.get(req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s.sig: %s", r.url, resp.Status)
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig)))
+	if err != nil || !ed25519.Verify(r.key, body, raw) {
+		return fmt.Errorf("%s: bad signature, ignoring it", r.url)
+	}
+	return nil
+}
+
+// maxRemoteConfig is the most of a remote config, or its signature, that is read.
+const maxRemoteConfig = 1 << 20
+
+// get does a request and reads the body. Anything other than 200 and 304 is an error, and
+// so is a body larger than maxRemoteConfig.
+func (r *remoteConfig) get(req *http.Request) ([]byte, *http.Response, error) {
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxRemoteConfig+1))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(body) > maxRemoteConfig {
+		return nil, nil, fmt.Errorf("%s: config too large, more than %d bytes", req.URL, maxRemoteConfig)
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotModified {
+		return nil, nil, fmt.Errorf("%s: %s", req.URL, resp.Status)
+	}
+	return body, resp, nil
+}
+
+// setupRemoteConfig fetches the config at startup and returns the path of the local copy to
+// load. If the server can't be reached we carry on with the copy from last time, if any.
+func setupRemoteConfig(f *remoteFlags) (*remoteConfig, string, error) {
+	r, err := newRemoteConfig(f)
+	if err != nil {
+		return nil, "", err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if _, err := r.fetch(ctx); err != nil {
+		if _, statErr := os.Stat(r.cache); statErr != nil {
+			return nil, "", fmt.Errorf("could not fetch config: %v", err)
+		}
+		slog.Warn("Could not fetch config, using the copy from last time", "url", r.url, "error", err)
+	}
+	return r, r.cache, nil
+}
+
+// watch checks for a new config every interval and calls reload when there is one.
+func (r *remoteConfig) watch(ctx context.Context, interval time.Duration, reload func() error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		changed, err := r.fetch(ctx)
+		if errors.Is(err, context.Canceled) {
+			return
+		} else if err != nil {
+			slog.Warn("Could not fetch config", "url", r.url, "error", err)
+			continue
+		}
+		if !changed {
+			continue
+		}
+		slog.Info("Got a new config", "url", r.url)
+		if err := reload(); err != nil {
+			slog.Error("Could not reload configuration, keeping the old one", "error", err)
+		}
+	}
+}
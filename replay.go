@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/gvalkov/golang-evdev"
+)
+
+// `usbscanner record` makes a capture of a scanner without running the daemon, and
+// `usbscanner replay` feeds a capture back through the decoder. The replay goes by the
+// kernel's timestamps of the events rather than the clock, so a capture decodes the same
+// every time, on any machine.
+
+// timedDecoder decodes events going by their timestamps: a key that comes more than the
+// timeout after the one before completes the scan that was coming in first, as the timer in
+// processEvents would have. Each device gets a decoder of its own.
+type timedDecoder struct {
+	timeout  time.Duration
+	keymap   map[string]string
+	decoders map[string]*decoder
+	order    []string // devices in the order they first came up, for flush
+}
+
+func newTimedDecoder(timeout time.Duration, keymap map[string]string) *timedDecoder {
+	return &timedDecoder{timeout: timeout, keymap: keymap, decoders: map[string]*decoder{}}
+}
+
+// event decodes an event from device, returning the scan it completed if any.
+func (t *timedDecoder) event(device string, ev *evdev.InputEvent) (Scan, bool) {
+	d, ok := t.decoders[device]
+	if !ok {
+		d = &decoder{device: device}
+		t.decoders[device] = d
+		t.order = append(t.order, device)
+	}
+	now := time.Unix(int64(ev.Time.Sec), int64(ev.Time.Usec)*1000)
+	var scan Scan
+	var done bool
+	if d.barcode.Len() > 0 && ev.Type == evdev.EV_KEY && ev.Value == 1 && now.Sub(d.lastKey) > t.timeout {
+		scan, done = t.complete(d)
+	}
+	d.event(ev, now, t.keymap)
+	return scan, done
+}
+
+// complete ends the scan of a decoder at the moment its timeout ran out.
+func (t *timedDecoder) complete(d *decoder) (Scan, bool) {
+	return d.complete(d.lastKey.Add(t.timeout))
+}
+
+// flush completes whatever scans are still coming in, at the end of the events.
+func (t *timedDecoder) flush() []Scan {
+	var scans []Scan
+	for _, device := range t.order {
+		if scan, ok := t.complete(t.decoders[device]); ok {
+			scans = append(scans, scan)
+		}
+	}
+	return scans
+}
+
+// inputEvent turns a recorded event back into what the kernel gave us.
+func (e *captureEvent) inputEvent() evdev.InputEvent {
+	return evdev.InputEvent{
+		Time:  syscall.NsecToTimeval(e.Sec*int64(time.Second) + e.Usec*int64(time.Microsecond)),
+		Type:  e.Type,
+		Code:  e.Code,
+		Value: e.Value,
+	}
+}
+
+// replayCapture decodes the events of a capture, calling decoded with every scan in order.
+// It returns the scans the capture itself has, the ones decoded when it was recorded.
+func replayCapture(r io.Reader, t *timedDecoder, device string, decoded func(Scan)) ([]Scan, error) {
+	var recorded []Scan
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; sc.Scan(); line++ {
+		var rec captureRecord
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		if line == 1 && rec.Kind != "start" {
+			return nil, errors.New("not a capture, it doesn't start with a start record")
+		}
+		if device != "" && rec.Kind != "start" && rec.Device != device {
+			continue
+		}
+		switch rec.Kind {
+		case "start":
+			if rec.Version > captureVersion {
+				return nil, fmt.Errorf("capture version %d is newer than this usbscanner knows (%d)", rec.Version, captureVersion)
+			}
+		case "event":
+			if rec.Event == nil {
+				return nil, fmt.Errorf("line %d: event record without an event", line)
+			}
+			ev := rec.Event.inputEvent()
+			if scan, ok := t.event(rec.Device, &ev); ok {
+				decoded(scan)
+			}
+		case "scan":
+			if rec.Scan != nil {
+				recorded = append(recorded, *rec.Scan)
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	for _, scan := range t.flush() {
+		decoded(scan)
+	}
+	return recorded, nil
+}
+
+// replayConfig is the timeout and keymap a replay decodes with: those of the config file if
+// there is one, else the defaults, with -timeout over either.
+func replayConfig(path string, timeout time.Duration) (time.Duration, map[string]string, error) {
+	cfg := defaultConfig()
+	if path != "" {
+		var err error
+		if cfg, err = loadConfig(path); err != nil {
+			return 0, nil, err
+		}
+	}
+	if timeout > 0 {
+		cfg.Timeout.Duration = timeout
+	}
+	return cfg.Timeout.Duration, cfg.Keymap, nil
+}
+
+// runReplay implements `usbscanner replay`: it prints every scan decoded from a capture, a
+// code per line or the scans as JSON, and then checks them against the scans the capture
+// has. It exits 1 if they don't match.
+func runReplay(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	configPath := fs.String("config", os.Getenv("USBSCANNER_CONFIG"), "decode with the timeout and keymap of this TOML file")
+	timeout := fs.Duration("timeout", 0, "time between characters that ends a scan, overriding the config")
+	device := fs.String("device", "", "only replay the events of the device with this name")
+	asJSON := fs.Bool("json", false, "print the scans as JSON")
+	fs.BoolVar(&debugEvents, "debug-events", false, "log every event and what was decoded from it")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: usbscanner replay [flags] <capture>\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if debugEvents {
+		logLevel.Set(slog.LevelDebug)
+	}
+	d, keymap, err := replayConfig(*configPath, *timeout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(os.Stdout)
+	var decoded []Scan
+	recorded, err := replayCapture(f, newTimedDecoder(d, keymap), *device, func(scan Scan) {
+		decoded = append(decoded, scan)
+		if *asJSON {
+			enc.Encode(scan)
+		} else {
+			fmt.Println(scan.Code)
+		}
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", fs.Arg(0), err)
+		os.Exit(1)
+	}
+	if len(recorded) == 0 {
+		fmt.Fprintf(os.Stderr, "%d scans, the capture has none to compare with\n", len(decoded))
+		return
+	}
+	if !compareScans(os.Stderr, decoded, recorded) {
+		f.Close()
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "%d scans, the same as when recorded\n", len(decoded))
+}
+
+// compareScans reports to w where the scans decoded differ from the ones recorded, device by
+// device, as scans from different devices needn't complete in the same order when replayed.
+// It reports whether they're the same.
+func compareScans(w io.Writer, decoded, recorded []Scan) bool {
+	byDevice := func(scans []Scan) {
+		sort.SliceStable(scans, func(i, j int) bool { return scans[i].Device < scans[j].Device })
+	}
+	byDevice(decoded)
+	byDevice(recorded)
+	same := len(decoded) == len(recorded)
+	for i := 0; i < len(decoded) || i < len(recorded); i++ {
+		switch {
+		case i >= len(recorded):
+			fmt.Fprintf(w, "scan %d: decoded %q from %s, not recorded\n", i+1, decoded[i].Code, decoded[i].Device)
+		case i >= len(decoded):
+			fmt.Fprintf(w, "scan %d: recorded %q from %s, not decoded\n", i+1, recorded[i].Code, recorded[i].Device)
+		case decoded[i].Code != recorded[i].Code || decoded[i].Device != recorded[i].Device:
+			fmt.Fprintf(w, "scan %d: decoded %q from %s, recorded %q from %s\n", i+1,
+				decoded[i].Code, decoded[i].Device, recorded[i].Code, recorded[i].Device)
+			same = false
+		}
+	}
+	return same
+}
+
+// runRecord implements `usbscanner record`: it grabs a scanner and writes a capture of it,
+// printing what it decodes as it goes, until interrupted. It takes the device the daemon
+// would, so the daemon has to be stopped first.
+func runRecord(args []string) {
+	fs := flag.NewFlagSet("record", flag.ExitOnError)
+	configPath := fs.String("config", os.Getenv("USBSCANNER_CONFIG"), "find the scanner, and decode, with the settings of this TOML file")
+	path := fs.String("device", "", "record this device, e.g. /dev/input/event3, instead of the one the config matches")
+	out := fs.String("o", "", "write the capture to this file (default usbscanner-<date>-<time>.ndjson)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: usbscanner record [flags]\n\nScan the barcodes to capture, then press ctrl+c.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	cfg := defaultConfig()
+	if *configPath != "" {
+		var err error
+		if cfg, err = loadConfig(*configPath); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	if *path != "" {
+		cfg.Devices = []DeviceMatcher{{Path: *path, Keyboard: true}} // picked by hand
+	}
+	devices, _ := evdev.ListInputDevices()
+	s, err := openStation("", cfg, devices)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer s.release()
+	if *out == "" {
+		*out = "usbscanner-" + time.Now().Format("20060102-150405") + ".ndjson"
+	}
+	f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	rec := &recorder{path: *out, f: f, enc: json.NewEncoder(f)}
+	rec.write(captureRecord{Kind: "start", Time: time.Now(), Version: captureVersion})
+	fmt.Fprintf(os.Stderr, "Recording %s (%s) to %s, press ctrl+c to stop\n", s.device.Fn, s.device.Name, *out)
+
+	events := make(chan evdev.InputEvent, 256)
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			evs, err := s.device.Read()
+			if err != nil {
+				errs <- err
+				return
+			}
+			for i := range evs {
+				events <- evs[i]
+			}
+		}
+	}()
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+
+	td := newTimedDecoder(cfg.Timeout.Duration, cfg.Keymap)
+	found := func(scan Scan) {
+		rec.scan(scan)
+		fmt.Println(scan.Code)
+	}
+	timeout := time.NewTimer(time.Hour)
+	timeout.Stop()
+	for {
+		select {
+		case ev := <-events:
+			rec.event(s.device.Name, &ev)
+			if scan, ok := td.event(s.device.Name, &ev); ok {
+				found(scan)
+			}
+			timeout.Reset(cfg.Timeout.Duration)
+		case <-timeout.C:
+			for _, scan := range td.flush() {
+				found(scan)
+			}
+		case err := <-errs:
+			fmt.Fprintf(os.Stderr, "Could not read from %s: %v\n", s.device.Fn, err)
+			stopRecord(rec, td, found)
+			s.release()
+			os.Exit(1)
+		case <-interrupt:
+			stopRecord(rec, td, found)
+			return
+		}
+	}
+}
+
+// stopRecord completes the scan that was still coming in and closes the capture.
+func stopRecord(rec *recorder, td *timedDecoder, found func(Scan)) {
+	for _, scan := range td.flush() {
+		found(scan)
+	}
+	rec.close()
+	fmt.Fprintf(os.Stderr, "Wrote %s\n", rec.path)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// USB scales at the checkout are HID devices of the weighing devices page, 0x8D. However
+// their report descriptors put it, the scales send the scale data report of the HID POS
+// usage tables the same way: report 3 with the status, the unit, the exponent of the weight
+// as a signed byte and the weight in 16 bits, little endian. They send it over and over, so
+// a weight is passed on once it is stable, and again only once it changed or the scale went
+// back to zero, as a scan of symbology weight with the weight as its code.
+
+const (
+	scalePage       = 0x8D
+	scaleDataReport = 3
+)
+
+// Scale statuses of the scale data report.
+const (
+	scaleFault      = 1
+	scaleZero       = 2
+	scaleInMotion   = 3
+	scaleStable     = 4
+	scaleUnderZero  = 5
+	scaleOverWeight = 6
+	scaleCalibrate  = 7
+	scaleRezero     = 8
+)
+
+// scaleTrouble is what the statuses of a scale that can't weigh mean.
+var scaleTrouble = map[byte]string{
+	scaleFault: "fault", scaleOverWeight: "over weight", scaleCalibrate: "needs calibrating", scaleRezero: "needs zeroing",
+}
+
+// scaleUnits are the units of the scale data report by their number, short.
+var scaleUnits = map[byte]string{
+	1: "mg", 2: "g", 3: "kg", 4: "ct", 5: "tael", 6: "gr", 7: "dwt",
+	8: "t", 9: "ton", 10: "ozt", 11: "oz", 12: "lb",
+}
+
+// Weight is what a scale weighed.
+type Weight struct {
+	Value float64 `json:"value"`
+	Unit  string  `json:"unit"` // g, kg, oz, lb and so on
+}
+
+// parseScaleReport reads the status and the weight of a scale data report, ok false if
+// report isn't one.
+func parseScaleReport(report []byte) (status byte, w Weight, ok bool) {
+	if len(report) < 6 || report[0] != scaleDataReport {
+		return 0, Weight{}, false
+	}
+	raw := int(report[4]) | int(report[5])<<8
+	unit, known := scaleUnits[report[2]]
+	if !known {
+		unit = fmt.Sprintf("unit %d", report[2])
+	}
+	exp := int(int8(report[3]))
+	// Rounded to the digits the exponent gives, 10^-2 isn't exact in a float.
+	value, _ := strconv.ParseFloat(strconv.FormatFloat(float64(raw)*math.Pow10(exp), 'f', max(-exp, 0), 64), 64)
+	return report[1], Weight{Value: value, Unit: unit}, true
+}
+
+// hidScale reads the weights of a USB scale from its hidraw node.
+type hidScale struct {
+	cfg  HIDConfig
+	name string
+
+	mu     sync.Mutex
+	f      *os.File
+	last   *Weight // the weight passed on last, nil once the scale is back at zero
+	warned bool    // about the trouble the scale is in
+}
+
+func scaleFits(dev hidrawDevice) error {
+	desc, err := dev.reportDescriptor()
+	if err != nil {
+		return err
+	}
+	fields, err := parseReportDescriptor(desc)
+	if err != nil {
+		return err
+	}
+	for _, f := range fields {
+		if f.usage>>16 == scalePage {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not a scale, its reports have nothing of the weighing devices page", dev.path)
+}
+
+func openHIDScale(cfg HIDConfig, dev hidrawDevice, name string) (*hidScale, error) {
+	s := &hidScale{cfg: cfg, name: name}
+	if err := s.open(dev); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *hidScale) open(dev hidrawDevice) error {
+	f, err := os.OpenFile(dev.path, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.f, s.last, s.warned = f, nil, false
+	s.mu.Unlock()
+	return nil
+}
+
+// readScan waits for the scale to weigh something new.
+func (s *hidScale) readScan() (Scan, error) {
+	s.mu.Lock()
+	f := s.f
+	s.mu.Unlock()
+	report := make([]byte, 64)
+	for {
+		n, err := f.Read(report)
+		if err != nil {
+			return Scan{}, err
+		}
+		status, w, ok := parseScaleReport(report[:n])
+		if !ok {
+			continue
+		}
+		trouble, troubled := scaleTrouble[status]
+		if troubled && !s.warned {
+			slog.Warn("The scale can't weigh", "device", s.name, "status", trouble)
+		}
+		s.warned = troubled
+		switch status {
+		case scaleZero, scaleUnderZero:
+			s.last = nil
+		case scaleStable:
+			if s.last != nil && *s.last == w {
+				continue
+			}
+			s.last = &w
+			scan := newScan(strconv.FormatFloat(w.Value, 'f', -1, 64), s.name, time.Now())
+			scan.Symbology = "weight"
+			scan.Weight = &w
+			return scan, nil
+		}
+	}
+}
+
+// reopen looks for the scale again, it gets a new hidraw node when plugged in again.
+func (s *hidScale) reopen() error {
+	s.close()
+	dev, err := findHidraw(s.cfg, scaleFits)
+	if err != nil {
+		return err
+	}
+	return s.open(dev)
+}
+
+func (s *hidScale) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.f.Close()
+}
+
+// openScaleStation opens the station for a USB scale.
+func openScaleStation(profile string, cfg *Config) (*station, error) {
+	dev, err := findHidraw(cfg.Scale, scaleFits)
+	if err != nil {
+		return nil, err
+	}
+	name := cfg.Scale.Name
+	if name == "" {
+		name = dev.name
+	}
+	if name == "" {
+		name = dev.path
+	}
+	return openSourceStation(profile, cfg, dev.path, name, "scale", func() (scanSource, error) {
+		return openHIDScale(cfg.Scale, dev, name)
+	})
+}
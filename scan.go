@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/rand"
+	"time"
+)
+
+// Scan is a single barcode read off a scanner together with whatever we know about it. This
+// is what gets passed around between the event processing and the sinks.
+type Scan struct {
+	ID        string    `json:"id,omitempty"`        // ULID given to the scan when it was made, see newScanID
+	Code      string    `json:"code"`                // the barcode itself, without any AIM symbology identifier
+	Device    string    `json:"device"`              // name of the device the barcode was read from
+	Symbology string    `json:"symbology,omitempty"` // symbology if the scanner sends AIM identifiers, empty otherwise
+	Tags      []string  `json:"tags,omitempty"`      // tags assigned by the -tag rules
+	Time      time.Time `json:"time"`                // when the scan was completed
+
+	Scanner *scannerIdentity `json:"scanner,omitempty"` // who the scanner is, if known, see identity.go
+	Image   []byte           `json:"image,omitempty"`   // a picture the scanner took, see image.go
+	Badge   *BadgeScan       `json:"badge,omitempty"`   // the tracks of a card a badge reader read, see badge.go
+	Weight  *Weight          `json:"weight,omitempty"`  // what a scale weighed, see scale.go
+
+	Operator *Operator `json:"operator,omitempty"` // whose badge was scanned before, see session.go
+
+	Started time.Time `json:"-"` // when the first key event of the scan came in
+	trace   *span     // root span of the scan's trace, nil without tracing
+
+	ack func(taken bool) // tells a scanner in host ack mode whether the scan was taken, see ssi.go
+}
+
+// acknowledge tells the scanner whether the scan was taken, if it waits to be told.
+func (scan Scan) acknowledge(taken bool) {
+	if scan.ack != nil {
+		scan.ack(taken)
+	}
+}
+
+// aimSymbologies maps the code character of an AIM symbology identifier (the "C" in "]C1") to
+// a readable name. Scanners only send these if configured to, so they are optional. Only the
+// common ones are listed here.
+var aimSymbologies = map[byte]string{
+	'A': "code39",
+	'C': "code128",
+	'E': "ean",
+	'F': "codabar",
+	'G': "code93",
+	'I': "itf",
+	'L': "pdf417",
+	'Q': "qr",
+	'd': "datamatrix",
+	'e': "databar",
+	'z': "aztec",
+}
+
+// newScan builds a Scan from a barcode completed at t. If the barcode starts with an AIM
+// symbology identifier (a "]", the code character and a modifier) we note the symbology and
+// strip the identifier off the code.
+func newScan(code string, device string, t time.Time) Scan {
+	scan := Scan{ID: newScanID(t), Code: code, Device: device, Time: t}
+	if len(code) >= 3 && code[0] == ']' {
+		if name, ok := aimSymbologies[code[1]]; ok {
+			scan.Symbology = name
+			scan.Code = code[3:]
+		}
+	}
+	return scan
+}
+
+// crockford is the base32 alphabet of ULIDs, without I, L, O and U.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// newScanID makes a ULID for a scan: the milliseconds since the epoch in 48 bits and 80
+// random bits, as 26 characters of base32. It stays with the scan through queues, retries
+// and restarts, so whatever is at the other end of a sink can tell a scan it got twice
+// from a second scan of the same code.
+func newScanID(t time.Time) string {
+	var b [16]byte
+	ms := uint64(t.UnixMilli())
+	for i := 0; i < 6; i++ {
+		b[i] = byte(ms >> (40 - 8*i))
+	}
+	rand.Read(b[6:])
+	// 26 characters of 5 bits are 130 bits, the first character only has 3 of the 128.
+	var id [26]byte
+	for i := range id {
+		v := 0
+		for j := 0; j < 5; j++ {
+			v <<= 1
+			if bit := 5*i + j - 2; bit >= 0 && b[bit/8]&(0x80>>(bit%8)) != 0 {
+				v |= 1
+			}
+		}
+		id[i] = crockford[v]
+	}
+	return string(id[:])
+}
+
+// class is the kind of device the scan came from: a badge reader (magstripe, contactless or
+// Wiegand), a keypad, a scale, an imager for a picture or else a barcode scanner.
+func (s Scan) class() string {
+	switch {
+	case s.Badge != nil || s.Symbology == "badge" || s.Symbology == "nfc":
+		return "badge"
+	case s.Symbology == "keypad":
+		return "keypad"
+	case s.Weight != nil:
+		return "scale"
+	case s.Image != nil:
+		return "image"
+	}
+	return "barcode"
+}
+
+// hasTag checks whether the scan was given a tag.
+func (s Scan) hasTag(tag string) bool {
+	for _, t := range s.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
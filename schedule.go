@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// defaultMaxHeld is how many scans are kept for later outside the active hours with
+// outside = "queue" before the oldest are dropped.
+const defaultMaxHeld = 1000
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// window is a daily stretch of time, in minutes since midnight, on some days of the week. A
+// window that ends before it starts runs past midnight into the next day.
+type window struct {
+	days     [7]bool
+	from, to int
+}
+
+// parseWindow parses a window like "06:00-22:00", "mon-fri 06:00-22:00" or
+// "sat,sun 08:00-12:00". Without days the window applies to every day.
+func parseWindow(spec string) (window, error) {
+	var w window
+	fields := strings.Fields(strings.ToLower(spec))
+	if len(fields) == 1 {
+		fields = []string{"sun-sat", fields[0]}
+	}
+	if len(fields) != 2 {
+		return w, fmt.Errorf("window %q should look like [days] hh:mm-hh:mm", spec)
+	}
+	for _, part := range strings.Split(fields[0], ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		if !isRange {
+			last = first
+		}
+		a, ok1 := weekdays[first]
+		b, ok2 := weekdays[last]
+		if !ok1 || !ok2 {
+			return w, fmt.Errorf("window %q: unknown days %q", spec, part)
+		}
+		for d := a; ; d = (d + 1) % 7 {
+			w.days[d] = true
+			if d == b {
+				break
+			}
+		}
+	}
+	from, to, ok := strings.Cut(fields[1], "-")
+	if !ok {
+		return w, fmt.Errorf("window %q should look like [days] hh:mm-hh:mm", spec)
+	}
+	var err error
+	if w.from, err = parseClock(from); err != nil {
+		return w, fmt.Errorf("window %q: %v", spec, err)
+	}
+	if w.to, err = parseClock(to); err != nil {
+		return w, fmt.Errorf("window %q: %v", spec, err)
+	}
+	return w, nil
+}
+
+// parseClock turns "hh:mm" into minutes since midnight. "24:00" is allowed for the end of
+// the day.
+func parseClock(s string) (int, error) {
+	var h, m int
+	if n, err := fmt.Sscanf(s, "%d:%d", &h, &m); err != nil || n != 2 || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("bad time %q", s)
+	}
+	return h*60 + m, nil
+}
+
+func (w window) contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	if w.from <= w.to {
+		return w.days[day] && minute >= w.from && minute < w.to
+	}
+	// Past midnight: the early hours belong to the window that started the day before.
+	if minute >= w.from {
+		return w.days[day]
+	}
+	return minute < w.to && w.days[(day+6)%7]
+}
+
+// schedule limits scanning to the active hours. Outside of them the scanner stays grabbed
+// but scans are either dropped or held back until the next window opens.
+type schedule struct {
+	windows []window
+	queue   bool
+	maxHeld int
+}
+
+// newSchedule sets up the active hours. It returns nil if no windows are configured, in
+// which case scanning is always active.
+func newSchedule(cfg ScheduleConfig) (*schedule, error) {
+	if len(cfg.Windows) == 0 {
+		return nil, nil
+	}
+	s := &schedule{maxHeld: cfg.MaxQueued}
+	switch cfg.Outside {
+	case "", "drop":
+	case "queue":
+		s.queue = true
+	default:
+		return nil, fmt.Errorf("schedule: outside should be drop or queue, not %q", cfg.Outside)
+	}
+	if s.maxHeld <= 0 {
+		s.maxHeld = defaultMaxHeld
+	}
+	for _, spec := range cfg.Windows {
+		w, err := parseWindow(spec)
+		if err != nil {
+			return nil, fmt.Errorf("schedule: %v", err)
+		}
+		s.windows = append(s.windows, w)
+	}
+	return s, nil
+}
+
+// active checks whether t falls into one of the windows. A nil schedule is always active.
+func (s *schedule) active(t time.Time) bool {
+	if s == nil {
+		return true
+	}
+	for _, w := range s.windows {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// hold keeps a scan made outside the active hours for when the next window opens, or drops
+// it, depending on the schedule.
+func (d *dispatcher) hold(s *schedule, scan Scan) {
+	if !s.queue {
+		slog.Info("Outside active hours, dropping scan", "code", scan.Code, "device", scan.Device)
+		scansTotal.inc(scan.Device, scan.Symbology, "outside_hours")
+		viewer.scan(scan, "outside hours")
+		return
+	}
+	scansTotal.inc(scan.Device, scan.Symbology, "held")
+	viewer.scan(scan, "held")
+	d.heldMu.Lock()
+	defer d.heldMu.Unlock()
+	if len(d.held) >= s.maxHeld {
+		slog.Warn("Outside active hours and too many scans held, dropping the oldest", "held", len(d.held), "code", d.held[0].Code)
+		d.held = d.held[1:]
+	}
+	d.held = append(d.held, scan)
+}
+
+// flushHeld delivers the scans held back outside the active hours, oldest first. The held
+// lock is kept while they are handed over so a fresh scan can't overtake them. Once
+// shutting down the sinks may be closed already, and stop is left to deliver them.
+func (d *dispatcher) flushHeld() {
+	d.heldMu.Lock()
+	defer d.heldMu.Unlock()
+	if len(d.held) == 0 {
+		return
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.stopped {
+		return
+	}
+	slog.Info("Active hours started, delivering held scans", "held", len(d.held))
+	for _, scan := range d.held {
+		d.current.handle(scan)
+	}
+	d.held = nil
+}
+
+// watchSchedule reports when the active hours start and end, and delivers held scans once
+// they start. It checks at the start of every minute, which is as fine as windows go.
+func (d *dispatcher) watchSchedule(ctx context.Context) {
+	first := true
+	var wasActive bool
+	for {
+		d.mu.RLock()
+		s := d.current.schedule
+		d.mu.RUnlock()
+		active := s.active(time.Now())
+		d.outside.Store(!active)
+		if first || active != wasActive {
+			switch {
+			case active && s != nil:
+				slog.Info("Inside active hours, scanning")
+			case !active && s.queue:
+				slog.Info("Outside active hours, holding scans until the next window")
+			case !active:
+				slog.Info("Outside active hours, dropping scans until the next window")
+			}
+		}
+		if active {
+			d.flushHeld()
+		}
+		first, wasActive = false, active
+
+		next := time.Now().Truncate(time.Minute).Add(time.Minute)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(next)):
+		}
+	}
+}
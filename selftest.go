@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gvalkov/golang-evdev"
+)
+
+// The self test scans a barcode on a virtual scanner and follows it through the pipeline of
+// the configuration, with every sink in dry run: it checks that the barcode is decoded as
+// typed, gets through validation and reaches every sink whose routes take it. That covers
+// the config, the keymap, /dev/uinput and reading from /dev/input, which is what breaks
+// after an install, but not the sinks' endpoints, nothing is sent. The devices matched are
+// the virtual one instead of the configured ones, the schedule is left out so the test
+// works at any hour, and queues, dead letters and the dedup file go to a directory of their
+// own that is removed afterwards.
+
+// selftestDevice creates the virtual scanner and waits for its device node to show up.
+func selftestDevice(name string, timeout time.Duration) (*virtualScanner, *evdev.InputDevice, error) {
+	v, err := newVirtualScanner(name, 0x05e0, 0x1200)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not create the virtual scanner: %v", err)
+	}
+	v.delay = 2 * time.Millisecond
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		devices, _ := evdev.ListInputDevices()
+		for _, dev := range devices {
+			if dev.Name == name {
+				return v, dev, nil
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	v.close()
+	return nil, nil, fmt.Errorf("the virtual scanner didn't show up in /dev/input within %s, is udev running?", timeout)
+}
+
+// selftestConfig is the configuration of a profile as the self test runs it.
+func selftestConfig(cfg *Config, dev *evdev.InputDevice, dir string) *Config {
+	c := *cfg
+	c.Devices = []DeviceMatcher{{Path: dev.Fn}}
+	c.DryRun = true
+	c.Schedule = ScheduleConfig{}
+	c.Record = ""
+	c.ReadTimeout = duration{}
+	c.LockDir = dir
+	c.QueueDir = filepath.Join(dir, "queue")
+	c.DeadLetterDir = filepath.Join(dir, "dead-letter")
+	if c.Dedup.File != "" {
+		c.Dedup.File = filepath.Join(dir, "dedup")
+	}
+	return &c
+}
+
+// checkStation types code with scan and reports on w how far it got through the started
+// station s, within timeout. It returns whether everything went as it should.
+func checkStation(w io.Writer, s *station, code string, scan func() error, timeout time.Duration) bool {
+	started := time.Now()
+	if err := scan(); err != nil {
+		fmt.Fprintf(w, "  FAIL  could not type %s: %v\n", code, err)
+		return false
+	}
+	deadline := started.Add(timeout)
+	for s.d.scans.Load() == 0 {
+		if time.Now().After(deadline) {
+			fmt.Fprintf(w, "  FAIL  no scan within %s\n", timeout)
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	decoded := s.d.recentScans()[0]
+	if decoded.Code != code {
+		fmt.Fprintf(w, "  FAIL  decoded %q instead of %q, check the keymap\n", decoded.Code, code)
+		return false
+	}
+	fmt.Fprintf(w, "  ok    decoded %s in %s\n", code, decoded.Time.Sub(started).Round(time.Millisecond))
+
+	s.d.mu.RLock()
+	p := s.d.current
+	s.d.mu.RUnlock()
+	decoded = p.validator.strip(decoded)
+	if err := p.validator.check(decoded); err != nil {
+		fmt.Fprintf(w, "  FAIL  rejected by the validation rules: %v, try another -code\n", err)
+		return false
+	}
+	tagged := p.tag(decoded) // what the routes see
+	ok, routed := true, 0
+	for _, r := range p.sinks {
+		if !r.accepts(tagged) {
+			fmt.Fprintf(w, "  -     sink %s: its routes don't take the scan\n", r.name)
+			continue
+		}
+		routed++
+		dry := r.sink.(*dryRunSink)
+		for {
+			if last, sent := dry.lastSent(); sent && last.Code == decoded.Code {
+				fmt.Fprintf(w, "  ok    sink %s would have sent it\n", r.name)
+				break
+			}
+			if time.Now().After(deadline) {
+				fmt.Fprintf(w, "  FAIL  sink %s: not sent within %s\n", r.name, timeout)
+				ok = false
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if routed == 0 {
+		fmt.Fprintln(w, "  FAIL  no sink takes the scan")
+		return false
+	}
+	return ok
+}
+
+// selftest runs the self test for every profile of cfg, or the top level configuration
+// without profiles, reporting on w. It returns whether all of them passed, an error if the
+// test couldn't be run at all.
+func selftest(w io.Writer, cfg *Config, code string, timeout time.Duration) (bool, error) {
+	dir, err := os.MkdirTemp("", "usbscanner-selftest")
+	if err != nil {
+		return false, err
+	}
+	defer os.RemoveAll(dir)
+	name := fmt.Sprintf("usbscanner selftest %d", os.Getpid())
+	v, dev, err := selftestDevice(name, timeout)
+	if err != nil {
+		return false, err
+	}
+	defer v.close()
+
+	passed := true
+	for _, profile := range cfg.profileNames() {
+		pcfg, err := cfg.profile(profile)
+		if err != nil {
+			return false, err
+		}
+		c := selftestConfig(pcfg, dev, dir)
+		if profile == "" {
+			fmt.Fprintf(w, "Scanning %s on %s\n", code, dev.Fn)
+		} else {
+			fmt.Fprintf(w, "Scanning %s on %s for %s\n", code, dev.Fn, profile)
+		}
+		s, err := openStation(profile, c, []*evdev.InputDevice{dev})
+		if err != nil {
+			return false, err
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		if err := s.start(ctx, c); err != nil {
+			cancel()
+			s.release()
+			fmt.Fprintf(w, "  FAIL  %v\n", err)
+			passed = false
+			continue
+		}
+		go s.read()
+		if !checkStation(w, s, code, func() error { return v.typeCode(code) }, timeout) {
+			passed = false
+		}
+		if !s.shutdown(c.ShutdownTimeout.Duration) {
+			fmt.Fprintln(w, "  FAIL  the sinks didn't close in time")
+			passed = false
+		}
+		s.lock.Close()
+		cancel()
+	}
+	return passed, nil
+}
+
+// runSelftest implements `usbscanner selftest`, a smoke test after installing: it exits 0
+// if the test passed and 1 if it didn't.
+func runSelftest(args []string) {
+	fs := flag.NewFlagSet("selftest", flag.ExitOnError)
+	configPath := fs.String("config", os.Getenv("USBSCANNER_CONFIG"), "test the pipeline of this TOML file")
+	code := fs.String("code", "4006381333931", "barcode to scan, it has to pass the validation rules")
+	timeout := fs.Duration("timeout", 10*time.Second, "how long to wait for the virtual scanner, and then for the scan")
+	verbose := fs.Bool("v", false, "log what the pipeline does, as the daemon would")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: usbscanner selftest [flags]\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	level := slog.LevelWarn
+	if *verbose {
+		level = slog.LevelInfo
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+
+	cfg, err := setupConfig(*configPath, &cmdlineFlags{})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not load the config: %v\n", err)
+		os.Exit(1)
+	}
+	if cfg.Input != "" && cfg.Input != "device" {
+		fmt.Fprintf(os.Stderr, "The self test scans on a device, it can't run with input = %s\n", cfg.Input)
+		os.Exit(1)
+	}
+	passed, err := selftest(os.Stdout, cfg, *code, *timeout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not run the self test: %v\n", err)
+		os.Exit(1)
+	}
+	if !passed {
+		fmt.Println("FAIL")
+		os.Exit(1)
+	}
+	fmt.Println("PASS")
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Scanners switched to serial mode, over RS-232 or as a USB CDC-ACM device (/dev/ttyACM0),
+// send whole scans instead of key presses, over a protocol of their own or as the plain
+// characters of the barcode with a suffix after them, CR usually. The port is opened in raw
+// mode at the configured baud rate and framing, 8N1 unless set otherwise, by hand with the
+// termios ioctls, there is not much more to it.
+
+// Linux termios bits the syscall package leaves out.
+const (
+	termiosCBAUD   = 0x100f
+	termiosCRTSCTS = 0x80000000
+)
+
+// baudRates are the speeds scanners are set to.
+var baudRates = map[int]uint32{
+	1200:   syscall.B1200,
+	2400:   syscall.B2400,
+	4800:   syscall.B4800,
+	9600:   syscall.B9600,
+	19200:  syscall.B19200,
+	38400:  syscall.B38400,
+	57600:  syscall.B57600,
+	115200: syscall.B115200,
+	230400: syscall.B230400,
+}
+
+// serialFraming is the termios control flags for the framing of sc.
+func serialFraming(sc SerialConfig) (uint32, error) {
+	var cflag uint32
+	switch sc.DataBits {
+	case 0, 8:
+		cflag |= syscall.CS8
+	case 7:
+		cflag |= syscall.CS7
+	default:
+		return 0, fmt.Errorf("serial: data_bits should be 7 or 8, not %d", sc.DataBits)
+	}
+	switch sc.Parity {
+	case "", "none":
+	case "even":
+		cflag |= syscall.PARENB
+	case "odd":
+		cflag |= syscall.PARENB | syscall.PARODD
+	default:
+		return 0, fmt.Errorf("serial: parity should be none, even or odd, not %q", sc.Parity)
+	}
+	switch sc.StopBits {
+	case 0, 1:
+	case 2:
+		cflag |= syscall.CSTOPB
+	default:
+		return 0, fmt.Errorf("serial: stop_bits should be 1 or 2, not %d", sc.StopBits)
+	}
+	if sc.RTSCTS {
+		cflag |= termiosCRTSCTS
+	}
+	return cflag, nil
+}
+
+// openSerial opens the serial port of sc in raw mode. The file is non-blocking underneath,
+// so reads can be interrupted by closing it, or time out.
+func openSerial(sc SerialConfig) (*os.File, error) {
+	speed, ok := baudRates[sc.Baud]
+	if !ok {
+		return nil, fmt.Errorf("serial: unsupported baud rate %d", sc.Baud)
+	}
+	framing, err := serialFraming(sc)
+	if err != nil {
+		return nil, err
+	}
+	path := sc.Port
+	f, err := os.OpenFile(path, os.O_RDWR|syscall.O_NOCTTY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := f.SyscallConn()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	var ioctlErr error
+	rc.Control(func(fd uintptr) {
+		var t syscall.Termios
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TCGETS, uintptr(unsafe.Pointer(&t))); errno != 0 {
+			ioctlErr = errno
+			return
+		}
+		t.Iflag = 0
+		t.Oflag = 0
+		t.Lflag = 0
+		t.Cflag &^= termiosCBAUD | syscall.CSIZE | syscall.PARENB | syscall.PARODD | syscall.CSTOPB | termiosCRTSCTS
+		t.Cflag |= speed | framing | syscall.CREAD | syscall.CLOCAL
+		t.Ispeed, t.Ospeed = speed, speed
+		t.Cc[syscall.VMIN], t.Cc[syscall.VTIME] = 1, 0
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TCSETS, uintptr(unsafe.Pointer(&t))); errno != 0 {
+			ioctlErr = errno
+		}
+	})
+	if ioctlErr != nil {
+		f.Close()
+		if errors.Is(ioctlErr, syscall.ENOTTY) {
+			return nil, fmt.Errorf("%s is not a serial port", path)
+		}
+		return nil, fmt.Errorf("%s: %v", path, ioctlErr)
+	}
+	return f, nil
+}
+
+// rawScanner reads a scanner that sends the characters of its barcodes as they are. A scan
+// ends with the suffix, or when nothing more came for the timeout, like with key presses.
+type rawScanner struct {
+	sc      SerialConfig
+	name    string
+	suffix  []byte // nil for CR or LF
+	timeout time.Duration
+	replies func([]byte) []byte // takes what answers a command out of what was read, if set
+
+	mu      sync.Mutex
+	f       *os.File
+	pending []byte
+	started time.Time
+}
+
+func openRawScanner(sc SerialConfig, name string, timeout time.Duration) (*rawScanner, error) {
+	s := &rawScanner{sc: sc, name: name, timeout: timeout}
+	if sc.Suffix != nil {
+		s.suffix = []byte(*sc.Suffix)
+	}
+	// At slow baud rates the characters of a scan are further apart than the timeout for
+	// key presses, so give it at least the time of ten of them at 10 bits each.
+	s.timeout = max(s.timeout, time.Duration(100*time.Second/time.Duration(sc.Baud)))
+	if err := s.reopen(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// end finds the end of the first scan in data: where the suffix starts and how long it is.
+func (s *rawScanner) end(data []byte) (int, int) {
+	if s.suffix == nil {
+		return bytes.IndexAny(data, "\r\n"), 1
+	} else if len(s.suffix) == 0 {
+		return -1, 0
+	}
+	return bytes.Index(data, s.suffix), len(s.suffix)
+}
+
+// readScan waits for the next scan. Empty ones, from a CR LF say, are skipped.
+func (s *rawScanner) readScan() (Scan, error) {
+	s.mu.Lock()
+	f := s.f
+	s.mu.Unlock()
+	buf := make([]byte, 512)
+	for {
+		if i, n := s.end(s.pending); i >= 0 {
+			code := s.pending[:i]
+			s.pending = s.pending[i+n:]
+			if len(code) == 0 {
+				continue
+			}
+			return s.scan(code), nil
+		}
+		var deadline time.Time
+		if len(s.pending) > 0 {
+			deadline = time.Now().Add(s.timeout)
+		}
+		f.SetReadDeadline(deadline)
+		n, err := f.Read(buf)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			code := s.pending
+			s.pending = nil
+			return s.scan(code), nil
+		} else if err != nil {
+			return Scan{}, err
+		}
+		data := buf[:n]
+		if s.replies != nil {
+			data = s.replies(data)
+		}
+		if len(s.pending) == 0 && len(data) > 0 {
+			s.started = time.Now()
+		}
+		s.pending = append(s.pending, data...)
+	}
+}
+
+func (s *rawScanner) scan(code []byte) Scan {
+	scan := newScan(string(bytes.TrimPrefix(code, []byte(s.sc.Prefix))), s.name, time.Now())
+	scan.Started = s.started
+	return scan
+}
+
+func (s *rawScanner) reopen() error {
+	s.mu.Lock()
+	if s.f != nil {
+		s.f.Close()
+	}
+	s.mu.Unlock()
+	f, err := s.sc.open()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.f, s.pending = f, nil
+	s.mu.Unlock()
+	return nil
+}
+
+// write sends b to the scanner.
+func (s *rawScanner) write(b []byte) error {
+	s.mu.Lock()
+	f := s.f
+	s.mu.Unlock()
+	_, err := f.Write(b)
+	return err
+}
+
+func (s *rawScanner) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.f.Close()
+}
+
+// openSerialStation opens the station for a scanner on a serial port. Its scans are named
+// after the port unless the config gives it a name.
+func openSerialStation(profile string, cfg *Config) (*station, error) {
+	sc := cfg.Serial
+	if sc.Baud == 0 {
+		sc.Baud = 9600
+	}
+	port := sc.Port
+	if sc.Bluetooth != "" {
+		port = "bluetooth/" + sc.Bluetooth
+	}
+	name := sc.Name
+	if name == "" {
+		name = port
+	}
+	var open func() (scanSource, error)
+	switch sc.Protocol {
+	case "ssi":
+		open = func() (scanSource, error) { return openSSIScanner(sc, name) }
+	case "raw":
+		open = func() (scanSource, error) { return openRawScanner(sc, name, cfg.Timeout.Duration) }
+	case "honeywell":
+		open = func() (scanSource, error) { return openHoneywellScanner(sc, name, cfg.Timeout.Duration) }
+	case "datalogic":
+		open = func() (scanSource, error) { return openDatalogicScanner(sc, name, cfg.Timeout.Duration) }
+	default:
+		return nil, fmt.Errorf("serial protocol should be ssi, raw, honeywell or datalogic, not %q", sc.Protocol)
+	}
+	return openSourceStation(profile, cfg, port, name, sc.Protocol, open)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestHoneywellScanner has a Honeywell scanner answer menu commands in between scans, one
+// of them in the same write as the answer.
+func TestHoneywellScanner(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Skip(err)
+	}
+	syscall.SetNonblock(fds[0], true)
+	host, scanner := os.NewFile(uintptr(fds[0]), "host"), os.NewFile(uintptr(fds[1]), "scanner")
+	defer scanner.Close()
+	h := &honeywellScanner{rawScanner: &rawScanner{name: "honeywell", timeout: 50 * time.Millisecond, f: host}}
+	h.replies = h.takeReply
+	defer h.close()
+
+	got := make(chan string, 4)
+	go func() {
+		buf := make([]byte, 256)
+		for {
+			n, err := scanner.Read(buf)
+			if err != nil {
+				return
+			}
+			cmd := string(buf[:n])
+			got <- cmd
+			switch cmd {
+			case "\x16M\rBEPLVL?.":
+				scanner.Write([]byte("BEPLVL3\x06.DEF\r"))
+			case "\x16M\rBEPLVL2;NOSUCH1!":
+				scanner.Write([]byte("BEPLVL2\x06;NOSUCH1\x05!"))
+			}
+		}
+	}()
+	scans := make(chan Scan, 4)
+	go func() {
+		for {
+			scan, err := h.readScan()
+			if err != nil {
+				close(scans)
+				return
+			}
+			scans <- scan
+		}
+	}()
+
+	scanner.Write([]byte("]E04006381333931\r\n"))
+	if scan := <-scans; scan.Code != "4006381333931" || scan.Symbology != "ean" {
+		t.Fatalf("scan %q %s", scan.Code, scan.Symbology)
+	}
+	if reply, err := h.menu("BEPLVL?"); reply != "BEPLVL3" || err != nil {
+		t.Errorf("reply %q, %v", reply, err)
+	}
+	if scan := <-scans; scan.Code != "DEF" {
+		t.Errorf("scan %q after the reply", scan.Code)
+	}
+	if reply, err := h.menu("BEPLVL2;NOSUCH1!"); reply != "BEPLVL2;NOSUCH1" || err == nil || !strings.Contains(err.Error(), "doesn't know") {
+		t.Errorf("reply %q, %v", reply, err)
+	}
+	h.setTrigger(true)
+	for _, want := range []string{"\x16M\rBEPLVL?.", "\x16M\rBEPLVL2;NOSUCH1!", "\x16T\r"} {
+		if cmd := <-got; cmd != want {
+			t.Errorf("scanner got %q, not %q", cmd, want)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// serviceUnit is the unit written by `usbscanner service install`, the same as the example
+// usbscanner.service but pointing at the actual binary and config.
+const serviceUnit = `# Written by usbscanner service install, changes are lost on the next install.
+[Unit]
+Description=USB barcode scanner bridge
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+Type=notify
+ExecStart=%s listen -config %s
+ExecReload=/bin/kill -HUP $MAINPID
+WatchdogSec=30
+Restart=on-failure
+RestartSec=2
+
+[Install]
+WantedBy=multi-user.target
+`
+
+// serviceOptions are the flags of `usbscanner service`.
+type serviceOptions struct {
+	name    string
+	config  string
+	binary  string
+	unitDir string
+	udevDir string
+	now     bool
+}
+
+func (o *serviceOptions) unitPath() string {
+	return filepath.Join(o.unitDir, o.name+".service")
+}
+
+func (o *serviceOptions) rulePath() string {
+	return filepath.Join(o.udevDir, "70-"+o.name+".rules")
+}
+
+// runService implements `usbscanner service install|uninstall|status`, which manages a
+// systemd unit and a udev rule for a config file, so a machine can be set up without writing
+// units by hand.
+func runService(args []string) {
+	var o serviceOptions
+	fs := flag.NewFlagSet("service", flag.ExitOnError)
+	fs.StringVar(&o.name, "name", "usbscanner", "name of the systemd unit, without .service")
+	fs.StringVar(&o.config, "config", os.Getenv("USBSCANNER_CONFIG"), "config file the service runs with")
+	fs.StringVar(&o.binary, "binary", "", "path of the usbscanner binary (default this one)")
+	fs.StringVar(&o.unitDir, "unit-dir", "/etc/systemd/system", "where to put the unit")
+	fs.StringVar(&o.udevDir, "udev-dir", "/etc/udev/rules.d", "where to put the udev rule")
+	fs.BoolVar(&o.now, "now", false, "start the service right away on install")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: usbscanner service [options] install|uninstall|status\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch fs.Arg(0) {
+	case "install":
+		err = o.install()
+	case "uninstall":
+		err = o.uninstall()
+	case "status":
+		err = o.status()
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// install writes the unit and, if the config identifies the scanner by vendor and product,
+// a udev rule giving the configured group access to it. Then systemd and udev are told and
+// the unit is enabled.
+func (o *serviceOptions) install() error {
+	if o.config == "" {
+		return fmt.Errorf("need -config, the service can't run without one")
+	}
+	config, err := filepath.Abs(o.config)
+	if err != nil {
+		return err
+	}
+	cfg, err := loadConfig(config)
+	if err != nil {
+		return err
+	}
+	binary := o.binary
+	if binary == "" {
+		if binary, err = os.Executable(); err != nil {
+			return err
+		}
+	}
+
+	unit := fmt.Sprintf(serviceUnit, binary, config)
+	if err := os.WriteFile(o.unitPath(), []byte(unit), 0644); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s\n", o.unitPath())
+	if rule := udevRule(cfg); rule != "" {
+		if err := os.WriteFile(o.rulePath(), []byte(rule), 0644); err != nil {
+			return err
+		}
+		fmt.Printf("Wrote %s\n", o.rulePath())
+		if err := runCommand("udevadm", "control", "--reload"); err != nil {
+			return err
+		}
+		if err := runCommand("udevadm", "trigger", "--subsystem-match=input"); err != nil {
+			return err
+		}
+	}
+	if err := runCommand("systemctl", "daemon-reload"); err != nil {
+		return err
+	}
+	enable := []string{"enable", o.name + ".service"}
+	if o.now {
+		enable = append(enable, "--now")
+	}
+	return runCommand("systemctl", enable...)
+}
+
+// uninstall stops and disables the unit and removes what install wrote.
+func (o *serviceOptions) uninstall() error {
+	if err := runCommand("systemctl", "disable", "--now", o.name+".service"); err != nil {
+		fmt.Printf("Could not disable %s: %v\n", o.name, err)
+	}
+	if err := os.Remove(o.unitPath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := runCommand("systemctl", "daemon-reload"); err != nil {
+		return err
+	}
+	err := os.Remove(o.rulePath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return runCommand("udevadm", "control", "--reload")
+}
+
+// status shows which of the files are there and what systemd thinks of the unit.
+func (o *serviceOptions) status() error {
+	for _, path := range []string{o.unitPath(), o.rulePath()} {
+		if _, err := os.Stat(path); err == nil {
+			fmt.Printf("%s: installed\n", path)
+		} else {
+			fmt.Printf("%s: missing\n", path)
+		}
+	}
+	// systemctl exits non-zero for a stopped unit, that's still a valid answer.
+	out, _ := exec.Command("systemctl", "is-enabled", o.name+".service").Output()
+	fmt.Printf("enabled: %s\n", strings.TrimSpace(string(out)))
+	out, _ = exec.Command("systemctl", "is-active", o.name+".service").Output()
+	fmt.Printf("active: %s\n", strings.TrimSpace(string(out)))
+	return nil
+}
+
+// udevRule gives the group the service runs as (or input if none is set) access to the
+// scanners matched by vendor and product, so it can also be run without root. Matchers by
+// name or path are left alone, udev can't tell those apart reliably.
+func udevRule(cfg *Config) string {
+	group := cfg.Group
+	if group == "" {
+		group = "input"
+	}
+	matchers := cfg.Devices
+	for _, p := range cfg.Profiles {
+		matchers = append(matchers, p.Devices...)
+	}
+	var b strings.Builder
+	for _, m := range matchers {
+		if m.Vendor == 0 || m.Product == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "SUBSYSTEM==\"input\", KERNEL==\"event*\", ATTRS{idVendor}==\"%04x\", ATTRS{idProduct}==\"%04x\", GROUP=\"%s\", MODE=\"0660\"\n",
+			m.Vendor, m.Product, group)
+	}
+	if b.Len() == 0 {
+		return ""
+	}
+	return "# Written by usbscanner service install, changes are lost on the next install.\n" + b.String()
+}
+
+// runCommand runs a command with its output going to ours.
+func runCommand(name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s %s: %v", name, strings.Join(args, " "), err)
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+func init() {
+	RegisterSink("servicebus", func(cfg *SinkConfig) (Sink, error) { return newAzureSink(cfg, false) })
+	RegisterSink("eventhubs", func(cfg *SinkConfig) (Sink, error) { return newAzureSink(cfg, true) })
+}
+
+// azureSink sends scans to an Azure Service Bus queue or topic (servicebus:...) or an Event
+// Hub (eventhubs:...) through their REST interfaces. See parseAzureTarget for what the
+// argument looks like. The scan goes out as JSON, or template output, with the device and
+// symbology as custom properties. Service Bus messages get the device as session ID when
+// the session option is set, which keeps them in order on session enabled queues; Event Hubs
+// messages always use the device as partition key for the same reason.
+type azureSink struct {
+	payload
+	url      string
+	auth     azureAuth
+	eventHub bool
+	session  bool
+	client   *http.Client
+}
+
+func newAzureSink(cfg *SinkConfig, eventHub bool) (*azureSink, error) {
+	scope := "https://servicebus.azure.net"
+	if eventHub {
+		scope = "https://eventhubs.azure.net"
+	}
+	target, auth, err := parseAzureTarget(cfg.Arg, cfg.Option("entity", ""), scope)
+	if err != nil {
+		return nil, err
+	}
+	session, err := cfg.BoolOption("session", false)
+	if err != nil {
+		return nil, err
+	}
+	timeout, err := cfg.DurationOption("timeout", 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return &azureSink{
+		url:      target,
+		auth:     auth,
+		eventHub: eventHub,
+		session:  session,
+		client:   &http.Client{Timeout: timeout, Transport: sinkTransport},
+	}, nil
+}
+
+func (s *azureSink) Send(ctx context.Context, scan Scan) error {
+	data, err := json.Marshal(scan)
+	if err != nil {
+		return err
+	}
+	body, err := s.render(scan, string(data))
+	if err != nil {
+		return err
+	}
+	auth, err := s.auth.header(s.url)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url+"/messages?timeout=60", strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", auth)
+	props := map[string]string{}
+	if s.eventHub {
+		req.Header.Set("Content-Type", "application/atom+xml;type=entry;charset=utf-8")
+		props["PartitionKey"] = scan.Device
+	} else {
+		req.Header.Set("Content-Type", "application/json")
+		if s.session {
+			props["SessionId"] = scan.Device
+		}
+	}
+	if scan.ID != "" {
+		// Lets Service Bus drop a scan sent twice, with duplicate detection on the queue.
+		props["MessageId"] = scan.ID
+	}
+	broker, _ := json.Marshal(props)
+	req.Header.Set("BrokerProperties", string(broker))
+	// Custom properties are plain headers, string values have to be quoted.
+	req.Header.Set("device", `"`+scan.Device+`"`)
+	if scan.Symbology != "" {
+		req.Header.Set("symbology", `"`+scan.Symbology+`"`)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+func (s *azureSink) Close() error { return nil }
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+)
+
+// At a pack station the operator scans their badge and then the items they pack, and what
+// is wanted downstream is who packed what. With a [session] window, a badge scan starts the
+// operator's session and every scan after it, until nothing was scanned for the window or
+// the next badge, carries the operator along. Profiles with the same group share a session,
+// so a badge reader and a scanner of one station can be profiles of their own. Sessions
+// outlive reloads of the configuration, not restarts.
+
+// Operator is who was signed in at the station when an item was scanned.
+type Operator struct {
+	Code    string    `json:"code"`    // of the badge
+	Device  string    `json:"device"`  // the badge was read from
+	Session string    `json:"session"` // ID of the badge scan, the same for all items of the session
+	Since   time.Time `json:"since"`   // when the badge was scanned
+}
+
+// unpairedTag is what scans without an operator are tagged with when they're kept.
+const unpairedTag = "unpaired"
+
+// session pairs scans with the badge scanned before them. The state is that of its group.
+type session struct {
+	window      time.Duration
+	operatorTag string // scans with this tag are badges, not only those of badge readers
+	unpaired    string // pass, drop or tag scans without an operator
+	state       *sessionState
+}
+
+type sessionState struct {
+	mu       sync.Mutex
+	operator *Operator
+	last     time.Time // of the last scan of the session
+}
+
+var (
+	sessionsMu sync.Mutex
+	sessions   = map[string]*sessionState{}
+)
+
+// newSession sets up pairing scans with badges, nil if it's off.
+func newSession(cfg SessionConfig) (*session, error) {
+	if cfg.Window.Duration < 0 {
+		return nil, fmt.Errorf("session window can't be negative")
+	}
+	if cfg.Window.Duration == 0 {
+		return nil, nil
+	}
+	switch cfg.Unpaired {
+	case "":
+		cfg.Unpaired = "pass"
+	case "pass", "drop", "tag":
+	default:
+		return nil, fmt.Errorf("session unpaired should be pass, drop or tag, not %q", cfg.Unpaired)
+	}
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	state := sessions[cfg.Group]
+	if state == nil {
+		state = &sessionState{}
+		sessions[cfg.Group] = state
+	}
+	return &session{window: cfg.Window.Duration, operatorTag: cfg.Operator, unpaired: cfg.Unpaired, state: state}, nil
+}
+
+// pair starts a session with a badge scan, or adds the operator to any other scan. It
+// reports false for a scan without an operator that is to be dropped.
+func (s *session) pair(scan *Scan) bool {
+	if s == nil {
+		return true
+	}
+	st := s.state
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.operator != nil && scan.Time.Sub(st.last) > s.window {
+		slog.Info("Session ended", "operator", st.operator.Code, "since", st.operator.Since)
+		st.operator = nil
+	}
+	if s.isOperator(*scan) {
+		if st.operator == nil || st.operator.Code != scan.Code {
+			slog.Info("Session started", "operator", scan.Code, "device", scan.Device)
+		}
+		st.operator = &Operator{Code: scan.Code, Device: scan.Device, Session: scan.ID, Since: scan.Time}
+		st.last = scan.Time
+		return true
+	}
+	if st.operator == nil {
+		switch s.unpaired {
+		case "drop":
+			return false
+		case "tag":
+			scan.Tags = append(scan.Tags, unpairedTag)
+		}
+		return true
+	}
+	op := *st.operator
+	scan.Operator = &op
+	st.last = scan.Time
+	return true
+}
+
+func (s *session) isOperator(scan Scan) bool {
+	if s.operatorTag != "" {
+		return slices.Contains(scan.Tags, s.operatorTag)
+	}
+	return scan.class() == "badge"
+}
@@ -0,0 +1,742 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Sink is anything a scan can be delivered to. Send is called for one scan at a time from
+// the sink's own goroutine, so implementations don't need to be safe for concurrent use. An
+// error from Send is reported, it doesn't stop the sink.
+type Sink interface {
+	Send(ctx context.Context, scan Scan) error
+	Close() error
+}
+
+// SinkFactory creates a sink from its configuration. It should read all options it knows
+// with the SinkConfig methods; any left over are reported as unknown.
+type SinkFactory func(cfg *SinkConfig) (Sink, error)
+
+var sinkFactories = map[string]SinkFactory{}
+
+// RegisterSink makes a sink type available to -sink. It is meant to be called from init, so
+// a new sink only needs its own file (behind a build tag if it pulls in heavy dependencies)
+// and nothing in the dispatching has to change. Registering a type twice panics.
+func RegisterSink(kind string, factory SinkFactory) {
+	if _, dup := sinkFactories[kind]; dup {
+		panic("sink type " + kind + " registered twice")
+	}
+	sinkFactories[kind] = factory
+}
+
+// sinkTypes lists the registered sink types for help output.
+func sinkTypes() []string {
+	var kinds []string
+	for k := range sinkFactories {
+		kinds = append(kinds, k)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+func init() {
+	RegisterSink("stdout", func(cfg *SinkConfig) (Sink, error) {
+		s := &stdoutSink{}
+		return s, s.configureFormat(cfg)
+	})
+}
+
+// stdoutSink prints scans to the terminal. This is what the tool did before sinks were
+// configurable and is still the default if nothing else is set up.
+type stdoutSink struct {
+	payload
+	started bool
+}
+
+func (s *stdoutSink) Send(ctx context.Context, scan Scan) error {
+	if viewer != nil {
+		return nil // the terminal is the viewer's, which shows the scan
+	}
+	if header, ok := s.header(); ok && !s.started {
+		fmt.Println(header)
+	}
+	s.started = true
+	line, err := s.render(scan, "Scanned: "+scan.Code)
+	if err != nil {
+		return err
+	}
+	fmt.Println(line)
+	return nil
+}
+
+func (s *stdoutSink) Close() error { return nil }
+
+// dryRunSink stands in for a sink with dry_run: it logs the scans instead of sending them.
+// The sink it stands in for is set up all the same, so its configuration is checked, but
+// nothing is sent to it.
+type dryRunSink struct {
+	name string
+	sink Sink
+
+	mu   sync.Mutex
+	sent int  // scans that would have been sent
+	last Scan // the last of them
+}
+
+func (s *dryRunSink) Send(ctx context.Context, scan Scan) error {
+	attrs := []any{"sink", s.name, "code", scan.Code, "device", scan.Device, "tags", scan.Tags}
+	if p, ok := s.sink.(interface {
+		render(Scan, string) (string, error)
+	}); ok {
+		// What a template or format makes of it; without one the sink sends its own.
+		if text, err := p.render(scan, ""); err != nil {
+			attrs = append(attrs, "error", err)
+		} else if text != "" {
+			attrs = append(attrs, "payload", text)
+		}
+	}
+	slog.Info("Dry run, not sending scan", attrs...)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent++
+	s.last = scan
+	return nil
+}
+
+// lastSent returns the last scan that would have been sent, false if there was none yet.
+func (s *dryRunSink) lastSent() (Scan, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.last, s.sent > 0
+}
+
+func (s *dryRunSink) Close() error { return s.sink.Close() }
+
+// SinkConfig is everything needed to set up a sink: the type and main argument from -sink,
+// e.g. "fifo" and "/tmp/scans", and any further options from -sink-opt.
+type SinkConfig struct {
+	Name    string
+	Type    string
+	Arg     string
+	Options map[string]string
+
+	// AtLeastOnce means failed scans are sent again until Send returns nil, so Send must
+	// only do that once the other end acknowledged the scan, not when it was buffered.
+	AtLeastOnce bool
+
+	used map[string]bool
+}
+
+// Option returns an option, or def if it isn't set. Options that are never asked for are
+// reported as unknown once the sink is set up.
+func (c *SinkConfig) Option(key string, def string) string {
+	if c.used == nil {
+		c.used = map[string]bool{}
+	}
+	c.used[key] = true
+	if v, ok := c.Options[key]; ok {
+		return v
+	}
+	return def
+}
+
+// DurationOption returns an option parsed with time.ParseDuration, or def if it isn't set.
+func (c *SinkConfig) DurationOption(key string, def time.Duration) (time.Duration, error) {
+	v := c.Option(key, "")
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("option %s: %v", key, err)
+	}
+	return d, nil
+}
+
+// IntOption returns an option as a number, or def if it isn't set.
+func (c *SinkConfig) IntOption(key string, def int) (int, error) {
+	v := c.Option(key, "")
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("option %s: %v", key, err)
+	}
+	return n, nil
+}
+
+// BoolOption returns an option parsed with strconv.ParseBool, or def if it isn't set.
+func (c *SinkConfig) BoolOption(key string, def bool) (bool, error) {
+	v := c.Option(key, "")
+	if v == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("option %s: %v", key, err)
+	}
+	return b, nil
+}
+
+// unused lists the options that were given but never looked at by the sink.
+func (c *SinkConfig) unused() []string {
+	var keys []string
+	for k := range c.Options {
+		if !c.used[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// newSink creates a sink from its configuration using the factory registered for its type.
+func newSink(cfg *SinkConfig) (Sink, error) {
+	factory, ok := sinkFactories[cfg.Type]
+	if !ok {
+		return nil, fmt.Errorf("unknown sink type %q (known are %s)", cfg.Type, strings.Join(sinkTypes(), ", "))
+	}
+	return factory(cfg)
+}
+
+// tagRule tags scans whose code matches a regular expression, e.g. to tell badges from items.
+type tagRule struct {
+	tag string
+	re  *regexp.Regexp
+}
+
+// route decides whether a scan goes to a particular sink. All criteria that are set have to
+// match for the route to match.
+type route struct {
+	device    string         // substring of the device name
+	class     string         // kind of device, see Scan.class
+	symbology string         // symbology name as found in aimSymbologies
+	tag       string         // tag given by a tagRule
+	match     *regexp.Regexp // regular expression on the code
+}
+
+func newRoute(e RouteEntry) (route, error) {
+	r := route{device: e.Device, class: e.Class, symbology: e.Symbology, tag: e.Tag}
+	switch e.Class {
+	case "", "barcode", "badge", "keypad", "scale", "image":
+	default:
+		return route{}, fmt.Errorf("class should be barcode, badge, keypad, scale or image, not %q", e.Class)
+	}
+	if e.Match != "" {
+		re, err := regexp.Compile(e.Match)
+		if err != nil {
+			return route{}, err
+		}
+		r.match = re
+	}
+	return r, nil
+}
+
+// parseRoute parses a -route flag of the form "sink:key=value,key=value". Valid keys are
+// device, class, symbology, tag and match. Since a regular expression may well contain commas,
+// match takes the whole rest of the spec and so has to come last.
+func parseRoute(spec string) (string, RouteEntry, error) {
+	name, rules, ok := strings.Cut(spec, ":")
+	if !ok || name == "" {
+		return "", RouteEntry{}, fmt.Errorf("route %q should look like sink:key=value,...", spec)
+	}
+	var r RouteEntry
+	for rules != "" {
+		var rule string
+		if strings.HasPrefix(rules, "match=") {
+			rule, rules = rules, ""
+		} else {
+			rule, rules, _ = strings.Cut(rules, ",")
+		}
+		key, value, _ := strings.Cut(rule, "=")
+		switch key {
+		case "device":
+			r.Device = value
+		case "class":
+			r.Class = value
+		case "symbology":
+			r.Symbology = value
+		case "tag":
+			r.Tag = value
+		case "match":
+			r.Match = value
+		default:
+			return "", RouteEntry{}, fmt.Errorf("route for %s: unknown rule %q", name, rule)
+		}
+	}
+	return name, r, nil
+}
+
+func (r route) matches(scan Scan) bool {
+	if r.device != "" && !strings.Contains(scan.Device, r.device) {
+		return false
+	}
+	if r.class != "" && r.class != scan.class() {
+		return false
+	}
+	if r.symbology != "" && r.symbology != scan.Symbology {
+		return false
+	}
+	if r.tag != "" && !scan.hasTag(r.tag) {
+		return false
+	}
+	if r.match != nil && !r.match.MatchString(scan.Code) {
+		return false
+	}
+	return true
+}
+
+// localSinks are the types of sinks that write on this machine. Failing, they fail right
+// away rather than after a timeout, and come back the moment a reader does, so a best-effort
+// one is tried with every scan even while it is down.
+var localSinks = map[string]bool{"stdout": true, "file": true, "fifo": true, "exec": true, "audit": true}
+
+// sinkRunner runs a single sink in its own goroutine with its own queue, so a slow sink
+// doesn't hold up delivery to the others.
+type sinkRunner struct {
+	name   string
+	kind   string
+	device string // of the station, so the metrics of profiles with sinks of the same name don't mix
+	sink   Sink
+	routes []route
+	queue  chan Scan
+	done   chan struct{}
+
+	// atLeastOnce retries every scan until the sink acknowledges it, instead of trying once,
+	// or until it runs out of retry budget: maxAttempts, or maxAge since it was scanned (if
+	// not 0). Then it becomes a dead letter.
+	atLeastOnce bool
+	maxAttempts int
+	maxAge      time.Duration
+	dead        *deadLetters
+	breaker     *breaker
+	stopping    chan struct{} // closed by stop, no more retries
+
+	// With a disk queue, scans go from queue to spool and are delivered from there.
+	spool   *diskQueue
+	spooled chan struct{} // everything from queue is on disk
+
+	// overflow is what happens when queue is full. With spill-to-disk what doesn't fit goes
+	// to spill, and from then on every scan until spill is empty again.
+	overflow overflowPolicy
+	spill    *diskQueue
+
+	lastErr   atomic.Pointer[error] // outcome of the last delivery, nil if it went through
+	delivered atomic.Int64
+	retries   atomic.Int64
+}
+
+func newSinkRunner(name string, s Sink) *sinkRunner {
+	return &sinkRunner{name: name, sink: s, queue: make(chan Scan, 8), done: make(chan struct{}), stopping: make(chan struct{})}
+}
+
+// accepts checks the routes of the sink. A sink without any routes gets every scan.
+func (r *sinkRunner) accepts(scan Scan) bool {
+	if len(r.routes) == 0 {
+		return true
+	}
+	for _, rt := range r.routes {
+		if rt.matches(scan) {
+			return true
+		}
+	}
+	return false
+}
+
+// run delivers scans until the queue is closed by stop. A sink that panics is restarted by
+// the supervisor; the scan it was sending is lost, unless it has a disk queue.
+func (r *sinkRunner) run(ctx context.Context) {
+	defer close(r.done)
+	if r.spool != nil {
+		go r.toSpool()
+		components.run("sink "+r.name, func() { r.deliverSpooled(ctx) })
+		return
+	}
+	components.run("sink "+r.name, func() { r.deliver(ctx) })
+}
+
+// queued is the number of scans waiting for the sink.
+func (r *sinkRunner) queued() int {
+	n := len(r.queue)
+	if r.spool != nil {
+		n += r.spool.len()
+	}
+	if r.spill != nil {
+		n += r.spill.len()
+	}
+	return n
+}
+
+// enqueue queues a scan for the sink, following the overflow policy if the queue is full.
+// Scans only go on the queue while nothing is spilled, so the queue always holds the older
+// scans and next can keep them in order.
+func (r *sinkRunner) enqueue(scan Scan) {
+	switch {
+	case r.spill != nil && r.spill.len() > 0: // older scans are on disk, this one goes behind them
+		backpressure.inc(scan.Device, "sink:"+r.name, "spilled")
+	case offer(r.queue, scan, r.overflow, scan.Device, "sink:"+r.name, r.dropped) || r.spill == nil:
+		return // queued, or dropped
+	}
+	if err := r.spill.push(scan); err != nil {
+		slog.Error("Could not spill scan to disk, it is lost", "sink", r.name, "code", scan.Code, "error", err)
+		sinkFailures.inc(r.device, r.name)
+	}
+	scan.trace.release()
+}
+
+// dropped is called for scans thrown away because the queue was full.
+func (r *sinkRunner) dropped(scan Scan) {
+	slog.Warn("Dropping scan, the sink isn't keeping up", "sink", r.name, "code", scan.Code, "queued", r.queued())
+	scan.trace.release()
+}
+
+// next waits for the next scan to deliver, taking it from the queue first and from spill
+// once the queue is empty. It returns false once the queue is closed and empty, whatever
+// is spilled stays on disk for the next time the sink starts.
+func (r *sinkRunner) next() (scan Scan, spilled, ok bool) {
+	if r.spill == nil {
+		scan, ok = <-r.queue
+		return scan, false, ok
+	}
+	for {
+		select {
+		case scan, ok = <-r.queue:
+			return scan, false, ok
+		default:
+		}
+		if r.spill.len() > 0 {
+			if scan, ok = r.spill.take(r.stopping); ok {
+				return scan, true, true
+			}
+		}
+		select {
+		case scan, ok = <-r.queue:
+			return scan, false, ok
+		case <-r.spill.notify:
+		}
+	}
+}
+
+// toSpool moves scans from the queue to the disk queue as they come in.
+func (r *sinkRunner) toSpool() {
+	defer close(r.spooled)
+	for scan := range r.queue {
+		if err := r.spool.push(scan); err != nil {
+			slog.Error("Could not queue scan on disk, it is lost", "sink", r.name, "code", scan.Code, "error", err)
+			sinkFailures.inc(r.device, r.name)
+		}
+		scan.trace.release()
+	}
+}
+
+// attempt sends a scan once and keeps track of how that went.
+func (r *sinkRunner) attempt(ctx context.Context, scan Scan) error {
+	start := time.Now()
+	sp := scan.trace.child("sink " + r.name)
+	err := r.sink.Send(withSpan(ctx, sp), scan)
+	sinkLatency.observe(time.Since(start), r.device, r.name)
+	sp.finish(err)
+	if err != nil {
+		sinkFailures.inc(r.device, r.name)
+		r.lastErr.Store(&err)
+		if !isPermanent(err) { // the scan's fault, not the sink's
+			r.breaker.failure(err)
+		}
+		return err
+	}
+	r.breaker.success()
+	r.lastErr.Store(nil)
+	r.delivered.Add(1)
+	ackLatency.observe(time.Since(scan.Time), r.device, r.name)
+	return nil
+}
+
+// sendAcked sends a scan until the sink acknowledges it, waiting for the backoff of the
+// breaker between attempts. A scan that fails for good, too often or for too long goes to
+// the dead letters. It reports whether it is done with the scan either way, false means it gave
+// up because the runner is stopping.
+func (r *sinkRunner) sendAcked(ctx context.Context, scan Scan) bool {
+	for attempts := 1; ; attempts++ {
+		err := r.attempt(ctx, scan)
+		if err == nil {
+			return true
+		}
+		if reason := r.exhausted(scan, attempts, err); reason != "" {
+			r.deadLetter(scan, attempts, reason, err)
+			return true
+		}
+		r.retries.Add(1)
+		delay := r.breaker.wait()
+		slog.Warn("Could not write to sink, will retry", "sink", r.name, "code", scan.Code, "error", err, "delay", delay.Round(time.Millisecond), "queued", r.queued())
+		select {
+		case <-time.After(delay):
+		case <-r.stopping:
+			return false
+		}
+	}
+}
+
+// deliverSpooled delivers scans from the disk queue in order. A scan is only removed from
+// the queue once the sink acknowledged it, and nothing behind it goes out before then.
+func (r *sinkRunner) deliverSpooled(ctx context.Context) {
+	for {
+		scan, ok := r.spool.take(r.stopping)
+		if !ok {
+			return
+		}
+		if !r.sendAcked(ctx, scan) {
+			r.spool.retry() // stays on disk for next time
+			return
+		}
+		r.spool.done()
+	}
+}
+
+// exhausted says why a scan that failed to go out isn't tried again, empty if it is.
+func (r *sinkRunner) exhausted(scan Scan, attempts int, err error) string {
+	switch {
+	case isPermanent(err):
+		return "permanent"
+	case r.maxAttempts > 0 && attempts >= r.maxAttempts:
+		return "max_attempts"
+	case r.maxAge > 0 && time.Since(scan.Time) > r.maxAge:
+		return "max_age"
+	}
+	return ""
+}
+
+// deadLetter sets a scan aside that the sink couldn't deliver.
+func (r *sinkRunner) deadLetter(scan Scan, attempts int, reason string, err error) {
+	slog.Error("Could not write to sink, giving up on the scan", "sink", r.name, "code", scan.Code,
+		"error", err, "attempts", attempts, "reason", reason, "path", r.dead.path)
+	deadLetterTotal.inc(r.device, r.name, reason)
+	if derr := r.dead.add(r.name, scan, attempts, reason, err); derr != nil {
+		slog.Error("Could not write dead letter, the scan is lost", "sink", r.name, "code", scan.Code, "error", derr)
+	}
+}
+
+func (r *sinkRunner) deliver(ctx context.Context) {
+	for {
+		scan, spilled, ok := r.next()
+		if !ok {
+			return
+		}
+		if !r.atLeastOnce {
+			if !localSinks[r.kind] && r.breaker.open() {
+				// Down, and each attempt would likely only hold up the scans behind this one
+				// until it times out. One gets through once the backoff is over.
+				slog.Warn("Sink is down, dropping scan", "sink", r.name, "code", scan.Code)
+				sinkFailures.inc(r.device, r.name)
+			} else if err := r.attempt(ctx, scan); isPermanent(err) {
+				r.deadLetter(scan, 1, "permanent", err)
+			} else if err != nil {
+				slog.Warn("Could not write to sink", "sink", r.name, "code", scan.Code, "error", err)
+			}
+		} else if !r.sendAcked(ctx, scan) {
+			if spilled {
+				r.spill.retry() // stays on disk for next time
+				return
+			}
+			slog.Error("Stopping, giving up on a scan the sink didn't acknowledge", "sink", r.name, "code", scan.Code)
+		}
+		if spilled {
+			r.spill.done()
+		}
+		scan.trace.release()
+	}
+}
+
+// stop delivers whatever is still queued, then closes the sink. Scans that aren't
+// acknowledged get one more try. With a disk queue, what is queued stays on disk for next
+// time instead. Nothing may be queued once stop has been called.
+func (r *sinkRunner) stop() {
+	close(r.queue)
+	if r.spool != nil {
+		<-r.spooled
+	}
+	close(r.stopping)
+	<-r.done
+	r.close()
+}
+
+// close closes the sink and lets go of its files, for stop, and for a runner that was never
+// started.
+func (r *sinkRunner) close() {
+	if err := r.sink.Close(); err != nil {
+		slog.Warn("Could not close sink", "sink", r.name, "error", err)
+	}
+	if err := r.dead.close(); err != nil {
+		slog.Warn("Could not close dead letters", "sink", r.name, "error", err)
+	}
+	if r.spill != nil {
+		if err := r.spill.release(); err != nil {
+			slog.Warn("Could not close spill queue", "sink", r.name, "error", err)
+		}
+	}
+	if r.spool != nil {
+		if err := r.spool.release(); err != nil {
+			slog.Warn("Could not close queue", "sink", r.name, "error", err)
+		}
+	}
+}
+
+// setupSinks creates the configured sinks along with their templates and routes. Sinks with
+// the queue=disk option get a disk queue of their own in queue_dir, and every sink a file in
+// dead_letter_dir for the scans it can't deliver.
+func setupSinks(c *Config) ([]*sinkRunner, error) {
+	var runners []*sinkRunner
+	ok := false
+	defer func() {
+		// A sink with an error leaves none of those set up before it open, nor itself.
+		if !ok {
+			for _, r := range runners {
+				r.close()
+			}
+		}
+	}()
+	seen := map[string]bool{}
+	for _, e := range c.Sinks {
+		e.Name = e.sinkName()
+		if seen[e.Name] {
+			return nil, fmt.Errorf("sink %s defined twice", e.Name)
+		}
+		seen[e.Name] = true
+
+		cfg := &SinkConfig{Name: e.Name, Type: e.Type, Arg: e.Arg, Options: map[string]string{}}
+		for k, v := range e.Options {
+			cfg.Options[k] = fmt.Sprint(v)
+		}
+		queue := cfg.Option("queue", "memory")
+		if queue != "memory" && queue != "disk" {
+			return nil, fmt.Errorf("sink %s: queue is memory or disk, not %q", e.Name, queue)
+		}
+		queueSync, err := cfg.BoolOption("queue_sync", true)
+		if err != nil {
+			return nil, fmt.Errorf("sink %s: %v", e.Name, err)
+		}
+		// A disk queue has room for everything, spilling to disk is for memory queues.
+		overflow, err := parseOverflow("overflow", cfg.Option("overflow", "block"), queue == "memory")
+		if err != nil {
+			return nil, fmt.Errorf("sink %s: %v", e.Name, err)
+		}
+		delivery := "best-effort"
+		if queue == "disk" {
+			delivery = "at-least-once"
+		}
+		// Unlimited by default: with a disk queue what is behind the head waits for it, and an
+		// outage of a few minutes shouldn't turn the head into a dead letter.
+		maxAttempts, err := cfg.IntOption("max_attempts", 0)
+		if err != nil {
+			return nil, fmt.Errorf("sink %s: %v", e.Name, err)
+		}
+		maxAge, err := cfg.DurationOption("max_age", 0)
+		if err != nil {
+			return nil, fmt.Errorf("sink %s: %v", e.Name, err)
+		}
+		backoffMin, err := cfg.DurationOption("backoff_min", time.Second)
+		if err != nil {
+			return nil, fmt.Errorf("sink %s: %v", e.Name, err)
+		}
+		backoffMax, err := cfg.DurationOption("backoff_max", time.Minute)
+		if err != nil {
+			return nil, fmt.Errorf("sink %s: %v", e.Name, err)
+		}
+		downAfter, err := cfg.IntOption("down_after", 3)
+		if err != nil {
+			return nil, fmt.Errorf("sink %s: %v", e.Name, err)
+		}
+		if backoffMin <= 0 || backoffMax < backoffMin {
+			return nil, fmt.Errorf("sink %s: backoff_min has to be more than 0 and at most backoff_max", e.Name)
+		}
+		switch delivery = cfg.Option("delivery", delivery); {
+		case delivery == "at-least-once":
+			cfg.AtLeastOnce = true
+		case delivery != "best-effort":
+			return nil, fmt.Errorf("sink %s: delivery is best-effort or at-least-once, not %q", e.Name, delivery)
+		case queue == "disk":
+			return nil, fmt.Errorf("sink %s: a disk queue always delivers at least once", e.Name)
+		}
+		dead, err := newDeadLetters(filepath.Join(c.DeadLetterDir, e.Name+".ndjson"))
+		if err != nil {
+			return nil, fmt.Errorf("sink %s: %v", e.Name, err)
+		}
+		s, err := newSink(cfg)
+		if err != nil {
+			dead.close()
+			return nil, fmt.Errorf("sink %s: %v", e.Name, err)
+		}
+		r := newSinkRunner(e.Name, s)
+		r.dead = dead
+		runners = append(runners, r)
+		if unknown := cfg.unused(); len(unknown) > 0 {
+			return nil, fmt.Errorf("sink %s: unknown options %s", e.Name, strings.Join(unknown, ", "))
+		}
+		if e.Template != "" {
+			t, ok := s.(templater)
+			if !ok {
+				return nil, fmt.Errorf("sink %s does not support templates", e.Name)
+			}
+			tmpl, err := parseTemplate(e.Name, e.Template)
+			if err != nil {
+				return nil, err
+			}
+			t.setTemplate(tmpl)
+		}
+		if c.DryRun {
+			// Nothing of a dry run goes to disk, and what the real sinks left queued there
+			// stays for them.
+			s = &dryRunSink{name: e.Name, sink: s}
+			queue = "memory"
+			if overflow == overflowSpill {
+				overflow = overflowBlock
+			}
+			r.sink = s
+		}
+		r.kind = e.Type
+		r.atLeastOnce = cfg.AtLeastOnce
+		r.maxAttempts = maxAttempts
+		r.maxAge = maxAge
+		r.breaker = newBreaker(e.Name, backoffMin, backoffMax, downAfter)
+		r.overflow = overflow
+		if overflow == overflowSpill {
+			if r.spill, err = openDiskQueue(filepath.Join(c.QueueDir, e.Name), queueSync); err != nil {
+				return nil, fmt.Errorf("sink %s: %v", e.Name, err)
+			}
+		}
+		if queue == "disk" {
+			if r.spool, err = openDiskQueue(filepath.Join(c.QueueDir, e.Name), queueSync); err != nil {
+				return nil, fmt.Errorf("sink %s: %v", e.Name, err)
+			}
+			r.spooled = make(chan struct{})
+		}
+		for _, re := range e.Routes {
+			rt, err := newRoute(re)
+			if err != nil {
+				return nil, fmt.Errorf("route for %s: %v", e.Name, err)
+			}
+			r.routes = append(r.routes, rt)
+		}
+	}
+	ok = true
+	return runners, nil
+}
+
+// listFlag collects the values of a flag that may be given several times.
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, ", ") }
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
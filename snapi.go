@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// SNAPI is the USB mode of Zebra scanners for Zebra's own software, a vendor defined HID
+// device rather than a keyboard, so on Linux it shows up as a hidraw node and not an input
+// device. Decode data comes in reports of its own, each ACKed with a report, carrying the
+// barcode type like SSI does; commands and their answers are SSI packets, one to a report.
+// snapiPort turns the reports into a stream of SSI packets, decode data included, so the
+// scanner is driven by the same ssiScanner as one on a serial port.
+
+const (
+	snapiReportAck    = 0x01 // host to scanner: [id, report ACKed, packet]
+	snapiReportSSI    = 0x0D // both ways: [id, length, SSI packet]
+	snapiReportDecode = 0x22 // scanner to host: [id, packets, packet, length, data]
+
+	// snapiReportSize is the size of SNAPI's reports, shorter ones are padded with zeros.
+	snapiReportSize = 32
+
+	zebraVendor = 0x05e0
+)
+
+// snapiPort is a SNAPI scanner's hidraw node as an SSI connection. The first report of
+// decode data starts with the barcode type, once all of them are in they are read as
+// DECODE_DATA, with the scanner's packets already ACKed.
+type snapiPort struct {
+	f       *os.File
+	pending []byte // to be read
+	decode  []byte // decode data so far
+
+	// ours are the packets read that weren't ACK or NAK, in order and whether the ACK for
+	// them is ours to drop because they were made from decode data.
+	mu   sync.Mutex
+	ours []bool
+}
+
+func openSNAPIPort(path string) (*snapiPort, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &snapiPort{f: f}, nil
+}
+
+func (p *snapiPort) Read(b []byte) (int, error) {
+	for len(p.pending) == 0 {
+		if err := p.readReport(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, p.pending)
+	p.pending = p.pending[n:]
+	return n, nil
+}
+
+// readReport reads the next report and queues the SSI packets it makes up.
+func (p *snapiPort) readReport() error {
+	report := make([]byte, 256)
+	n, err := p.f.Read(report)
+	if err != nil {
+		return err
+	}
+	report = report[:n]
+	switch {
+	case n >= 4 && report[0] == snapiReportDecode:
+		packets, packet, length := report[1], report[2], int(report[3])
+		data := report[4:min(4+length, n)]
+		if err := p.writeReport([]byte{snapiReportAck, snapiReportDecode, packet}); err != nil {
+			return err
+		}
+		if packet == 0 {
+			p.decode = p.decode[:0]
+		}
+		p.decode = append(p.decode, data...)
+		if packet+1 < packets {
+			return nil
+		}
+		// Split up the way the scanner does on a serial port, for readPackets to join.
+		for rest := p.decode; ; {
+			chunk := ssiPacket{opcode: ssiDecodeData, source: ssiFromDecoder, data: rest[:min(len(rest), ssiMaxData)]}
+			rest = rest[len(chunk.data):]
+			if len(rest) > 0 {
+				chunk.status = ssiContinuation
+			}
+			p.queue(chunk.encode(), true)
+			if len(rest) == 0 {
+				return nil
+			}
+		}
+	case n >= 2 && report[0] == snapiReportSSI:
+		length := min(int(report[1]), n-2)
+		p.queue(report[2:2+length], false)
+	}
+	return nil
+}
+
+// queue adds a packet to be read, ours if made from decode data.
+func (p *snapiPort) queue(packet []byte, ours bool) {
+	p.pending = append(p.pending, packet...)
+	if len(packet) > 1 && (packet[1] == ssiAck || packet[1] == ssiNak) {
+		return
+	}
+	p.mu.Lock()
+	p.ours = append(p.ours, ours)
+	p.mu.Unlock()
+}
+
+// Write sends an SSI packet, which has to come in one piece. The ACK for decode data was
+// sent when it came in, so it is dropped.
+func (p *snapiPort) Write(b []byte) (int, error) {
+	if len(b) > 1 && (b[1] == ssiAck || b[1] == ssiNak) {
+		p.mu.Lock()
+		ours := len(p.ours) > 0 && p.ours[0]
+		if len(p.ours) > 0 {
+			p.ours = p.ours[1:]
+		}
+		p.mu.Unlock()
+		if ours {
+			return len(b), nil
+		}
+	}
+	if len(b) > snapiReportSize-2 {
+		return 0, fmt.Errorf("snapi: packet of %d bytes doesn't fit in a report", len(b))
+	}
+	if err := p.writeReport(append([]byte{snapiReportSSI, byte(len(b))}, b...)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (p *snapiPort) writeReport(b []byte) error {
+	report := make([]byte, snapiReportSize)
+	copy(report, b)
+	_, err := p.f.Write(report)
+	return err
+}
+
+func (p *snapiPort) Close() error {
+	return p.f.Close()
+}
+
+// findSNAPI finds the scanner of sc, the first Zebra hidraw device with its product ID
+// unless it gives a path.
+func findSNAPI(sc SNAPIConfig) (hidrawDevice, error) {
+	devices, err := listHidraw()
+	if err != nil {
+		return hidrawDevice{}, err
+	}
+	for _, dev := range devices {
+		if (sc.Path != "" && dev.path == sc.Path) || (sc.Path == "" && dev.vendor == zebraVendor && dev.product == sc.Product) {
+			return dev, nil
+		}
+	}
+	if sc.Path != "" {
+		return hidrawDevice{path: sc.Path}, nil // not in sysfs, a symlink say
+	}
+	return hidrawDevice{}, fmt.Errorf("Could not find a SNAPI scanner with product ID %#04x", sc.Product)
+}
+
+// openSNAPIStation opens the station for a Zebra scanner in SNAPI mode.
+func openSNAPIStation(profile string, cfg *Config) (*station, error) {
+	dev, err := findSNAPI(cfg.SNAPI)
+	if err != nil {
+		return nil, err
+	}
+	name := cfg.SNAPI.Name
+	if name == "" {
+		name = dev.name
+	}
+	if name == "" {
+		name = dev.path
+	}
+	return openSourceStation(profile, cfg, dev.path, name, "snapi", func() (scanSource, error) {
+		return startSSIScanner(name, nil, false, func() (io.ReadWriteCloser, error) {
+			port, err := openSNAPIPort(dev.path)
+			if err != nil {
+				return nil, err
+			}
+			return port, nil
+		})
+	})
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// diskQueue is a sink's queue kept on disk, so scans made while the network is down wait
+// there, in order, until the sink can deliver them again, and a restart or power cut in
+// between doesn't lose them.
+//
+// Scans are appended as JSON lines to segment files (1.log, 2.log, ...) and a cursor file
+// says how far delivery got: the position of the next scan and, as a checkpoint, the last
+// scan delivered. Segments that were delivered in full are deleted. A scan is taken off the
+// head of the queue one at a time and only removed once done is called, so a failed
+// delivery is tried again with the same scan. After a crash delivery resumes at the
+// cursor; a scan the sink acknowledged just before can go out once more, which sinks with
+// idempotency keys leave out.
+type diskQueue struct {
+	dir   string
+	fsync bool
+
+	mu      sync.Mutex
+	refs    int
+	segs    []uint64 // segment numbers on disk, oldest first
+	w       *os.File // the last segment, appended to
+	wSize   int64
+	rOff    int64 // where the next scan starts in segs[0]
+	pending int   // scans on disk past the cursor
+	taken   bool  // the head was handed out and is neither done nor retried yet
+	head    Scan
+	headLen int64
+	last    *queueCheckpoint
+	notify  chan struct{}
+}
+
+// queueCheckpoint is the last scan delivered from a disk queue.
+type queueCheckpoint struct {
+	Delivered time.Time `json:"delivered"` // when the sink acknowledged it
+	Scan      Scan      `json:"scan"`
+}
+
+// maxSegmentSize is when the queue starts a new segment file.
+const maxSegmentSize = 4 << 20
+
+var (
+	diskQueuesMu sync.Mutex
+	diskQueues   = map[string]*diskQueue{}
+)
+
+// openDiskQueue opens the queue in dir, creating it if needed. A reload opens the queue of
+// a sink again while the old sink is still delivering, so both share one diskQueue, which
+// takes the queue_sync of the new config.
+func openDiskQueue(dir string, fsync bool) (*diskQueue, error) {
+	diskQueuesMu.Lock()
+	defer diskQueuesMu.Unlock()
+	if q, ok := diskQueues[dir]; ok {
+		q.mu.Lock()
+		if q.fsync != fsync {
+			slog.Warn("Queue sync changed, the queue takes it from now on", "dir", dir, "sync", fsync)
+			q.fsync = fsync
+		}
+		q.mu.Unlock()
+		q.refs++
+		return q, nil
+	}
+	q := &diskQueue{dir: dir, fsync: fsync, refs: 1, notify: make(chan struct{}, 1)}
+	if err := q.load(); err != nil {
+		return nil, fmt.Errorf("queue %s: %v", dir, err)
+	}
+	diskQueues[dir] = q
+	return q, nil
+}
+
+func (q *diskQueue) segPath(n uint64) string {
+	return filepath.Join(q.dir, strconv.FormatUint(n, 10)+".log")
+}
+
+func (q *diskQueue) cursorPath() string { return filepath.Join(q.dir, "cursor") }
+
+// load finds the segments and the cursor and counts what is left to deliver.
+func (q *diskQueue) load() error {
+	if err := os.MkdirAll(q.dir, 0750); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if n, err := strconv.ParseUint(strings.TrimSuffix(e.Name(), ".log"), 10, 64); err == nil && strings.HasSuffix(e.Name(), ".log") {
+			q.segs = append(q.segs, n)
+		}
+	}
+	sort.Slice(q.segs, func(i, j int) bool { return q.segs[i] < q.segs[j] })
+	if len(q.segs) == 0 {
+		q.segs = []uint64{1}
+	}
+
+	// The cursor is "<segment> <offset>", followed by the checkpoint as JSON on a line of its
+	// own. Without one, or if it points at a segment that's gone, delivery starts at the
+	// oldest segment there is.
+	if data, err := os.ReadFile(q.cursorPath()); err == nil {
+		var seg uint64
+		var off int64
+		pos, checkpoint, _ := strings.Cut(string(data), "\n")
+		var last queueCheckpoint
+		if json.Unmarshal([]byte(checkpoint), &last) == nil {
+			q.last = &last
+		}
+		if _, err := fmt.Sscan(pos, &seg, &off); err == nil {
+			for len(q.segs) > 1 && q.segs[0] < seg {
+				os.Remove(q.segPath(q.segs[0]))
+				q.segs = q.segs[1:]
+			}
+			if q.segs[0] == seg {
+				q.rOff = off
+			}
+		}
+	}
+
+	last := q.segs[len(q.segs)-1]
+	w, err := os.OpenFile(q.segPath(last), os.O_RDWR|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	// A crash in the middle of a write leaves half a line at the end, which would run into
+	// the next scan. Cut it off.
+	size, err := completeLines(w)
+	if err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Truncate(size); err != nil {
+		w.Close()
+		return err
+	}
+	if _, err := w.Seek(size, io.SeekStart); err != nil {
+		w.Close()
+		return err
+	}
+	q.w, q.wSize = w, size
+
+	for i, seg := range q.segs {
+		off := int64(0)
+		if i == 0 {
+			off = q.rOff
+		}
+		n, err := countLines(q.segPath(seg), off)
+		if err != nil {
+			return err
+		}
+		q.pending += n
+	}
+	if q.pending > 0 {
+		args := []any{"path", q.dir, "queued", q.pending}
+		if q.last != nil {
+			args = append(args, "last_delivered", q.last.Scan.Code, "delivered_at", q.last.Delivered)
+		}
+		slog.Info("Resuming delivery from disk queue", args...)
+	}
+	return nil
+}
+
+// completeLines is the size of f up to and including its last newline.
+func completeLines(f *os.File) (int64, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := fi.Size()
+	buf := make([]byte, 1)
+	for size > 0 {
+		if _, err := f.ReadAt(buf, size-1); err != nil {
+			return 0, err
+		}
+		if buf[0] == '\n' {
+			break
+		}
+		size--
+	}
+	return size, nil
+}
+
+func countLines(path string, from int64) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(io.NewSectionReader(f, from, 1<<62))
+	n := 0
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			n++
+		}
+		if err != nil {
+			return n, nil
+		}
+	}
+}
+
+// push appends a scan to the queue.
+func (q *diskQueue) push(scan Scan) error {
+	data, err := json.Marshal(scan)
+	if err != nil {
+		return err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.wSize >= maxSegmentSize {
+		if err := q.roll(); err != nil {
+			return err
+		}
+	}
+	n, err := q.w.Write(append(data, '\n'))
+	q.wSize += int64(n)
+	if err != nil {
+		return err
+	}
+	if q.fsync {
+		if err := q.w.Sync(); err != nil {
+			return err
+		}
+	}
+	q.pending++
+	q.wake()
+	return nil
+}
+
+// roll starts a new segment.
+func (q *diskQueue) roll() error {
+	next := q.segs[len(q.segs)-1] + 1
+	w, err := os.OpenFile(q.segPath(next), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	q.w.Close()
+	q.w, q.wSize = w, 0
+	q.segs = append(q.segs, next)
+	return nil
+}
+
+func (q *diskQueue) wake() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// take waits for the scan at the head of the queue and hands it out. Once delivered it has
+// to be passed to done, otherwise to retry. It returns false once stop is closed.
+func (q *diskQueue) take(stop <-chan struct{}) (Scan, bool) {
+	for {
+		q.mu.Lock()
+		if !q.taken && q.pending > 0 {
+			scan, err := q.readHead()
+			if err == nil {
+				q.taken = true
+				q.mu.Unlock()
+				return scan, true
+			}
+			// A line that doesn't parse would block the queue for good, skip it.
+			slog.Error("Skipping a damaged entry in the queue", "path", q.dir, "error", err)
+			q.advance()
+			q.mu.Unlock()
+			continue
+		}
+		q.mu.Unlock()
+		select {
+		case <-q.notify:
+		case <-stop:
+			return Scan{}, false
+		}
+	}
+}
+
+// readHead reads the scan at the cursor, moving on to the next segment when the current
+// one is through.
+func (q *diskQueue) readHead() (Scan, error) {
+	for {
+		f, err := os.Open(q.segPath(q.segs[0]))
+		if err != nil {
+			return Scan{}, err
+		}
+		line, err := bufio.NewReader(io.NewSectionReader(f, q.rOff, 1<<62)).ReadBytes('\n')
+		f.Close()
+		if err == io.EOF && len(q.segs) > 1 {
+			os.Remove(q.segPath(q.segs[0]))
+			q.segs, q.rOff = q.segs[1:], 0
+			continue
+		} else if err != nil {
+			return Scan{}, err
+		}
+		q.headLen = int64(len(line))
+		q.head = Scan{}
+		return q.head, json.Unmarshal(line, &q.head)
+	}
+}
+
+// done removes the scan handed out by take from the queue, it was delivered.
+func (q *diskQueue) done() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.last = &queueCheckpoint{Delivered: time.Now(), Scan: q.head}
+	q.advance()
+}
+
+func (q *diskQueue) advance() {
+	q.rOff += q.headLen
+	q.headLen = 0
+	q.pending--
+	q.taken = false
+	if err := q.saveCursor(); err != nil {
+		slog.Error("Could not save the queue position, scans may be delivered twice", "path", q.dir, "error", err)
+	}
+	q.wake()
+}
+
+// retry puts the scan handed out by take back, to be taken again.
+func (q *diskQueue) retry() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.taken = false
+	q.wake()
+}
+
+// saveCursor replaces the cursor file. With fsync the new one is on disk before the next
+// scan goes out, so a crash can't take delivery back to before it.
+func (q *diskQueue) saveCursor() error {
+	data := fmt.Sprintf("%d %d\n", q.segs[0], q.rOff)
+	if q.last != nil {
+		checkpoint, err := json.Marshal(q.last)
+		if err != nil {
+			return err
+		}
+		data += string(checkpoint) + "\n"
+	}
+	tmp := q.cursorPath() + ".new"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(data); err != nil {
+		f.Close()
+		return err
+	}
+	if q.fsync {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, q.cursorPath()); err != nil {
+		return err
+	}
+	if !q.fsync {
+		return nil
+	}
+	dir, err := os.Open(q.dir)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// checkpoint returns the last scan delivered, nil if there wasn't one yet.
+func (q *diskQueue) checkpoint() *queueCheckpoint {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.last
+}
+
+// len is the number of scans waiting, the one being delivered included.
+func (q *diskQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.pending
+}
+
+func (q *diskQueue) release() error {
+	diskQueuesMu.Lock()
+	defer diskQueuesMu.Unlock()
+	q.refs--
+	if q.refs > 0 {
+		return nil
+	}
+	delete(diskQueues, q.dir)
+	return q.w.Close()
+}
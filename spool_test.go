@@ -0,0 +1,315 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openQueue opens the queue in dir and has it released at the end of the test, unless that
+// was done already.
+func openQueue(t *testing.T, dir string) *diskQueue {
+	t.Helper()
+	q, err := openDiskQueue(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if q.refs > 0 {
+			q.release()
+		}
+	})
+	return q
+}
+
+func pushCodes(t *testing.T, q *diskQueue, codes ...string) {
+	t.Helper()
+	for _, code := range codes {
+		if err := q.push(newScan(code, "test", time.Now())); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// drain delivers what is in the queue and returns the codes in the order they came.
+func drain(q *diskQueue) []string {
+	stop := make(chan struct{})
+	close(stop)
+	var codes []string
+	for q.len() > 0 {
+		scan, ok := q.take(stop)
+		if !ok {
+			break
+		}
+		codes = append(codes, scan.Code)
+		q.done()
+	}
+	return codes
+}
+
+func appendTo(t *testing.T, path, data string) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func segments(t *testing.T, dir string) []string {
+	t.Helper()
+	names, err := filepath.Glob(filepath.Join(dir, "*.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range names {
+		names[i] = filepath.Base(name)
+	}
+	return names
+}
+
+// TestDiskQueue has each case run the queue up to a crash or a restart, and then checks
+// what the queue opened again delivers.
+func TestDiskQueue(t *testing.T) {
+	half, _ := json.Marshal(newScan("lost", "test", time.Now()))
+	half = half[:len(half)/2]
+
+	for _, tc := range []struct {
+		name     string
+		before   func(t *testing.T, q *diskQueue)
+		after    []string // pushed once opened again
+		pending  int      // when opened again
+		want     []string
+		segments []string // left once delivered
+	}{{
+		name: "resumes at the cursor",
+		before: func(t *testing.T, q *diskQueue) {
+			pushCodes(t, q, "a", "b", "c")
+			if got := drain(q); len(got) != 3 {
+				t.Fatalf("drained %q", got)
+			}
+			pushCodes(t, q, "d", "e")
+			stop := make(chan struct{})
+			if scan, _ := q.take(stop); scan.Code != "d" {
+				t.Fatalf("took %q", scan.Code)
+			}
+			q.done()
+		},
+		pending:  1,
+		want:     []string{"e"},
+		segments: []string{"1.log"},
+	}, {
+		name: "crash before done delivers again",
+		before: func(t *testing.T, q *diskQueue) {
+			pushCodes(t, q, "a", "b")
+			q.take(make(chan struct{}))
+		},
+		pending:  2,
+		want:     []string{"a", "b"},
+		segments: []string{"1.log"},
+	}, {
+		name: "crash in the middle of a write",
+		before: func(t *testing.T, q *diskQueue) {
+			pushCodes(t, q, "a", "b")
+			appendTo(t, q.segPath(1), string(half))
+		},
+		after:    []string{"c"},
+		pending:  2,
+		want:     []string{"a", "b", "c"},
+		segments: []string{"1.log"},
+	}, {
+		name: "skips a damaged entry",
+		before: func(t *testing.T, q *diskQueue) {
+			pushCodes(t, q, "a")
+			appendTo(t, q.segPath(1), "{not json\n")
+		},
+		after:    []string{"b"},
+		pending:  2,
+		want:     []string{"a", "b"},
+		segments: []string{"1.log"},
+	}, {
+		name: "rolls and deletes segments",
+		before: func(t *testing.T, q *diskQueue) {
+			pushCodes(t, q, "a")
+			q.wSize = maxSegmentSize
+			pushCodes(t, q, "b")
+			q.wSize = maxSegmentSize
+			pushCodes(t, q, "c")
+			if got := segments(t, q.dir); !slices.Equal(got, []string{"1.log", "2.log", "3.log"}) {
+				t.Fatalf("segments %q", got)
+			}
+		},
+		pending:  3,
+		want:     []string{"a", "b", "c"},
+		segments: []string{"3.log"},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "queue")
+			q := openQueue(t, dir)
+			tc.before(t, q)
+			if err := q.release(); err != nil {
+				t.Fatal(err)
+			}
+
+			q = openQueue(t, dir)
+			if q.len() != tc.pending {
+				t.Errorf("%d pending, not %d", q.len(), tc.pending)
+			}
+			pushCodes(t, q, tc.after...)
+			if got := drain(q); !slices.Equal(got, tc.want) {
+				t.Errorf("delivered %q, not %q", got, tc.want)
+			}
+			if got := segments(t, dir); !slices.Equal(got, tc.segments) {
+				t.Errorf("segments %q, not %q", got, tc.segments)
+			}
+		})
+	}
+}
+
+// TestDiskQueueReload has a reload share the queue with the sink it replaces, and take
+// the sync setting of the new config.
+func TestDiskQueueReload(t *testing.T) {
+	dir := t.TempDir()
+	q := openQueue(t, dir)
+	pushCodes(t, q, "a")
+	again, err := openDiskQueue(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != q || q.refs != 2 || !q.fsync || q.len() != 1 {
+		t.Errorf("reopened %p of %p, refs %d, fsync %v, %d pending", again, q, q.refs, q.fsync, q.len())
+	}
+	again.release()
+}
+
+func TestDeadLetters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dead", "http.jsonl")
+	d, err := newDeadLetters(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("created before the first dead letter: %v", err)
+	}
+	d.add("http", newScan("a", "test", time.Now()), 1, "permanent", errors.New("400 Bad Request"))
+	d.add("http", newScan("b", "test", time.Now()), 10, "max_attempts", errors.New("connection refused"))
+	if err := d.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err = newDeadLetters(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.close()
+	if d.len() != 2 {
+		t.Errorf("%d dead letters after reopening", d.len())
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dl deadLetter
+	if err := json.Unmarshal([]byte(strings.Split(string(data), "\n")[1]), &dl); err != nil {
+		t.Fatal(err)
+	}
+	if dl.Sink != "http" || dl.Scan.Code != "b" || dl.Attempts != 10 || dl.Reason != "max_attempts" || dl.Error != "connection refused" {
+		t.Errorf("dead letter %+v", dl)
+	}
+}
+
+// TestDedupStore has repeats count across a restart, a line cut short by a crash in the
+// file included.
+func TestDedupStore(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		cfg    DedupConfig
+		before []string
+		repeat map[string]bool // after the restart
+	}{{
+		name:   "window",
+		cfg:    DedupConfig{Window: duration{time.Hour}},
+		before: []string{"a", "b"},
+		repeat: map[string]bool{"a": true, "b": true, "c": false},
+	}, {
+		name:   "last",
+		cfg:    DedupConfig{Last: 1},
+		before: []string{"a", "b"},
+		repeat: map[string]bool{"a": false, "b": true},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.cfg.File = filepath.Join(t.TempDir(), "dedup.jsonl")
+			d, err := newDedup(tc.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, code := range tc.before {
+				if d.repeat(newScan(code, "test", time.Now())) {
+					t.Errorf("%s a repeat before the restart", code)
+				}
+			}
+			d.close()
+			appendTo(t, tc.cfg.File, `{"key":"c","ti`)
+
+			d, err = newDedup(tc.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d.close()
+			for code, want := range tc.repeat {
+				// Asked of the store without remembering the scan, which would change the
+				// answer for the other codes with last.
+				d.store.mu.Lock()
+				got := d.store.count[code] > 0
+				d.store.mu.Unlock()
+				if got != want {
+					t.Errorf("%s a repeat %v after the restart", code, got)
+				}
+			}
+		})
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	b := newBreaker("test", time.Hour, time.Hour, 2)
+	b.failure(errors.New("refused"))
+	if b.isDown() || b.open() || b.wait() <= 0 {
+		t.Errorf("after one failure: down %v, open %v, wait %v", b.isDown(), b.open(), b.wait())
+	}
+	b.failure(errors.New("refused"))
+	if !b.isDown() || !b.open() {
+		t.Errorf("after two failures: down %v, open %v", b.isDown(), b.open())
+	}
+	b.success()
+	if b.isDown() || b.open() || b.wait() != 0 {
+		t.Errorf("after a success: down %v, open %v, wait %v", b.isDown(), b.open(), b.wait())
+	}
+}
+
+// TestSetupSinksLeavesNothingOpen has a sink with an error after a disk queued one, which
+// is to have let go of its queue and file again.
+func TestSetupSinksLeavesNothingOpen(t *testing.T) {
+	dir := t.TempDir()
+	audit := filepath.Join(dir, "audit.jsonl")
+	c := &Config{QueueDir: filepath.Join(dir, "queue"), DeadLetterDir: filepath.Join(dir, "dead"), Sinks: []SinkEntry{
+		{Type: "audit", Arg: audit, Options: map[string]interface{}{"queue": "disk"}},
+		{Type: "stdout", Routes: []RouteEntry{{Class: "nosuch"}}},
+	}}
+	if _, err := setupSinks(c); err == nil {
+		t.Fatal("no error for the route")
+	}
+	if q := diskQueues[filepath.Join(c.QueueDir, "audit")]; q != nil {
+		t.Errorf("queue left open with %d refs", q.refs)
+	}
+	if chain := auditChains[audit]; chain != nil {
+		t.Errorf("audit file left open with %d refs", chain.refs)
+	}
+}
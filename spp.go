@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// Cordless scanners can also be paired as a serial port, Bluetooth's Serial Port Profile,
+// instead of a keyboard. What they send then is the same as over a cable, raw or SSI, all
+// of it with nothing lost to a keymap. The host connects to the scanner's RFCOMM channel
+// with a socket of its own, no rfcomm bind and no /dev/rfcomm0 needed, and again whenever
+// the connection drops when the scanner goes to sleep or out of range. Pairing is BlueZ's
+// business, `usbscanner pair` has bluetoothctl do it.
+
+// Linux Bluetooth socket constants the syscall package leaves out.
+const (
+	afBluetooth   = 31
+	btprotoRFCOMM = 3
+)
+
+// sockaddrRC is struct sockaddr_rc, the address of an RFCOMM channel.
+type sockaddrRC struct {
+	family  uint16
+	bdaddr  [6]byte // least significant byte first
+	channel uint8
+	_       uint8
+}
+
+// parseBDAddr parses a Bluetooth address like 00:11:22:33:44:55.
+func parseBDAddr(addr string) ([6]byte, error) {
+	var b [6]byte
+	parts := strings.Split(addr, ":")
+	if len(parts) != 6 {
+		return b, fmt.Errorf("%q is not a Bluetooth address like 00:11:22:33:44:55", addr)
+	}
+	for i, p := range parts {
+		v, err := strconv.ParseUint(p, 16, 8)
+		if err != nil || len(p) != 2 {
+			return b, fmt.Errorf("%q is not a Bluetooth address like 00:11:22:33:44:55", addr)
+		}
+		b[5-i] = byte(v)
+	}
+	return b, nil
+}
+
+// dialRFCOMM connects to the RFCOMM channel of the device at addr. The file is non-blocking
+// underneath like a serial port, so reads can be interrupted by closing it, or time out.
+func dialRFCOMM(addr string, channel int) (*os.File, error) {
+	bdaddr, err := parseBDAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	if channel < 1 || channel > 30 {
+		return nil, fmt.Errorf("rfcomm: channel should be 1 to 30, not %d", channel)
+	}
+	fd, err := syscall.Socket(afBluetooth, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, btprotoRFCOMM)
+	if err != nil {
+		return nil, fmt.Errorf("rfcomm: %v, is there a Bluetooth adapter?", err)
+	}
+	sa := sockaddrRC{family: afBluetooth, bdaddr: bdaddr, channel: uint8(channel)}
+	if _, _, errno := syscall.Syscall(syscall.SYS_CONNECT, uintptr(fd), uintptr(unsafe.Pointer(&sa)), unsafe.Sizeof(sa)); errno != 0 {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("rfcomm: could not connect to %s channel %d: %v", addr, channel, errno)
+	}
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), "rfcomm "+addr), nil
+}
+
+// runPair implements `usbscanner pair`: it has bluetoothctl find, pair and trust the
+// scanner, so BlueZ lets it reconnect on its own, and checks the channel can be connected to.
+func runPair(args []string) {
+	fs := flag.NewFlagSet("pair", flag.ExitOnError)
+	channel := fs.Int("channel", 1, "RFCOMM channel of the scanner's serial port")
+	protocol := fs.String("protocol", "raw", "what the scanner sends, for the config printed: raw or ssi")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: usbscanner pair [flags] <address>\n\nPut the scanner in Serial Port Profile mode and make it discoverable first, see its\nmanual for the programming barcodes.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	addr := strings.ToUpper(fs.Arg(0))
+	if _, err := parseBDAddr(addr); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	info, _ := exec.Command("bluetoothctl", "info", addr).Output()
+	if !bytes.Contains(info, []byte("Device "+addr)) {
+		fmt.Println("Looking for the scanner ...")
+		runCommand("bluetoothctl", "--timeout", "15", "scan", "on")
+	}
+	if !bytes.Contains(info, []byte("Paired: yes")) {
+		if err := runCommand("bluetoothctl", "--agent", "NoInputNoOutput", "pair", addr); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	if err := runCommand("bluetoothctl", "trust", addr); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	f, err := dialRFCOMM(addr, *channel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	f.Close()
+	fmt.Printf("Paired, channel %d works. For the config:\n\n[serial]\nbluetooth = %q\nchannel = %d\nprotocol = %q\n", *channel, addr, *channel, *protocol)
+}
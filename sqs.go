@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	RegisterSink("sqs", func(cfg *SinkConfig) (Sink, error) { return newSQSSink(cfg) })
+	RegisterSink("sns", func(cfg *SinkConfig) (Sink, error) { return newSNSSink(cfg) })
+}
+
+// newAWSClient sets up signing for an SQS or SNS sink. The region comes from the queue URL
+// or topic ARN unless overridden with the region option; the profile option picks a profile
+// from the shared credentials file and timeout (default 10s) limits each request.
+func newAWSClient(cfg *SinkConfig, service string, region string) (*awsClient, error) {
+	region = cfg.Option("region", region)
+	if region == "" {
+		return nil, fmt.Errorf("can't tell the AWS region, set the region option")
+	}
+	timeout, err := cfg.DurationOption("timeout", 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return &awsClient{
+		service: service,
+		region:  region,
+		creds:   newAWSCredentialSource(cfg.Option("profile", "")),
+		client:  &http.Client{Timeout: timeout, Transport: sinkTransport},
+	}, nil
+}
+
+// awsMessageBody is the default message for AWS sinks: the scan as JSON.
+func awsMessageBody(p *payload, scan Scan) (string, error) {
+	b, err := json.Marshal(scan)
+	if err != nil {
+		return "", err
+	}
+	return p.render(scan, string(b))
+}
+
+// awsDeduplicationID is the ID for FIFO queues and topics, which insist on one unless content
+// based deduplication is switched on. That is the scan's ID, or for scans queued on disk
+// before there were IDs, one made up of the code, device and time.
+func awsDeduplicationID(scan Scan) string {
+	if scan.ID != "" {
+		return scan.ID
+	}
+	return sha256Hex([]byte(scan.Device + "\x00" + scan.Code + "\x00" + strconv.FormatInt(scan.Time.UnixNano(), 10)))
+}
+
+// sqsSink sends every scan as a message to an SQS queue, given by its URL as in
+// sqs:https://sqs.eu-west-1.amazonaws.com/123456789012/scans. The device and symbology are
+// added as message attributes. For FIFO queues the device is used as message group, so
+// scans from one scanner stay in order; the group option sets a fixed group instead.
+type sqsSink struct {
+	payload
+	queue string
+	group string
+	aws   *awsClient
+}
+
+func newSQSSink(cfg *SinkConfig) (*sqsSink, error) {
+	u, err := url.Parse(cfg.Arg)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("sqs sink needs a queue URL")
+	}
+	// Queue URLs look like sqs.<region>.amazonaws.com or the older <region>.queue.amazonaws.com.
+	region := ""
+	if parts := strings.Split(u.Host, "."); len(parts) > 2 {
+		if parts[0] == "sqs" {
+			region = parts[1]
+		} else if parts[1] == "queue" {
+			region = parts[0]
+		}
+	}
+	client, err := newAWSClient(cfg, "sqs", region)
+	if err != nil {
+		return nil, err
+	}
+	return &sqsSink{queue: cfg.Arg, group: cfg.Option("group", ""), aws: client}, nil
+}
+
+func (s *sqsSink) Send(ctx context.Context, scan Scan) error {
+	body, err := awsMessageBody(&s.payload, scan)
+	if err != nil {
+		return err
+	}
+	form := url.Values{
+		"Action":      {"SendMessage"},
+		"Version":     {"2012-11-05"},
+		"MessageBody": {body},
+	}
+	n := 0
+	for _, attr := range [][2]string{{"device", scan.Device}, {"symbology", scan.Symbology}} {
+		if attr[1] == "" {
+			continue
+		}
+		n++
+		prefix := "MessageAttribute." + strconv.Itoa(n) + "."
+		form.Set(prefix+"Name", attr[0])
+		form.Set(prefix+"Value.DataType", "String")
+		form.Set(prefix+"Value.StringValue", attr[1])
+	}
+	if strings.HasSuffix(s.queue, ".fifo") {
+		form.Set("MessageGroupId", firstNonEmpty(s.group, scan.Device))
+		form.Set("MessageDeduplicationId", awsDeduplicationID(scan))
+	}
+	_, err = s.aws.post(ctx, s.queue, form)
+	return err
+}
+
+func (s *sqsSink) Close() error { return nil }
+
+// snsSink publishes every scan to an SNS topic, given by its ARN as in
+// sns:arn:aws:sns:eu-west-1:123456789012:scans. Attributes and FIFO topics are handled the
+// same way as for SQS. The endpoint option overrides the API endpoint, e.g. for testing
+// against a local emulator.
+type snsSink struct {
+	payload
+	topic    string
+	endpoint string
+	group    string
+	aws      *awsClient
+}
+
+func newSNSSink(cfg *SinkConfig) (*snsSink, error) {
+	// arn:<partition>:sns:<region>:<account>:<topic>
+	parts := strings.Split(cfg.Arg, ":")
+	if len(parts) != 6 || parts[0] != "arn" || parts[2] != "sns" {
+		return nil, fmt.Errorf("sns sink needs a topic ARN")
+	}
+	client, err := newAWSClient(cfg, "sns", parts[3])
+	if err != nil {
+		return nil, err
+	}
+	endpoint := "https://sns." + client.region + ".amazonaws.com/"
+	if parts[1] == "aws-cn" {
+		endpoint = "https://sns." + client.region + ".amazonaws.com.cn/"
+	}
+	return &snsSink{
+		topic:    cfg.Arg,
+		endpoint: cfg.Option("endpoint", endpoint),
+		group:    cfg.Option("group", ""),
+		aws:      client,
+	}, nil
+}
+
+func (s *snsSink) Send(ctx context.Context, scan Scan) error {
+	body, err := awsMessageBody(&s.payload, scan)
+	if err != nil {
+		return err
+	}
+	form := url.Values{
+		"Action":   {"Publish"},
+		"Version":  {"2010-03-31"},
+		"TopicArn": {s.topic},
+		"Message":  {body},
+	}
+	n := 0
+	for _, attr := range [][2]string{{"device", scan.Device}, {"symbology", scan.Symbology}} {
+		if attr[1] == "" {
+			continue
+		}
+		n++
+		prefix := "MessageAttributes.entry." + strconv.Itoa(n) + "."
+		form.Set(prefix+"Name", attr[0])
+		form.Set(prefix+"Value.DataType", "String")
+		form.Set(prefix+"Value.StringValue", attr[1])
+	}
+	if strings.HasSuffix(s.topic, ".fifo") {
+		form.Set("MessageGroupId", firstNonEmpty(s.group, scan.Device))
+		form.Set("MessageDeduplicationId", awsDeduplicationID(scan))
+	}
+	_, err = s.aws.post(ctx, s.endpoint, form)
+	return err
+}
+
+func (s *snsSink) Close() error { return nil }
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
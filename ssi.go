@@ -0,0 +1,518 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Zebra's Simple Serial Interface, for Zebra (Symbol) scanners in serial mode. Everything
+// goes in packets of a length byte, an opcode, the source (the decoder or the host), a
+// status byte and data, followed by a 16 bit checksum, the two's complement of the sum of
+// the other bytes. The side that gets a packet answers with an ACK, or a NAK asking to send
+// it again, and decode data longer than a packet is split over several, all but the last
+// marked as to be continued. Scans come as DECODE_DATA with the barcode type, the
+// symbology, in front of the data, so no keymap and no timeout are involved.
+
+const (
+	ssiParamSend    = 0xC6
+	ssiParamRequest = 0xC7
+	ssiAck          = 0xD0
+	ssiNak          = 0xD1
+	ssiStartDecode  = 0xE4
+	ssiStopDecode   = 0xE5
+	ssiBeep         = 0xE6
+	ssiLEDOn        = 0xE7
+	ssiLEDOff       = 0xE8
+	ssiScanEnable   = 0xE9
+	ssiScanDisable  = 0xEA
+	ssiDecodeData   = 0xF3
+
+	ssiFromDecoder = 0x00
+	ssiFromHost    = 0x04
+
+	ssiRetransmit   = 0x01 // status: sent again after a NAK or no answer
+	ssiContinuation = 0x02 // status: more of the same data follows in the next packet
+	ssiPermanent    = 0x08 // status of PARAM_SEND: keep the values over a power cycle
+
+	ssiNakResend = 0x01 // the checksum was wrong, send it again
+	ssiNakDenied = 0x06 // the host won't take it, for decode data in host ack mode
+)
+
+// ssiParamDecodeFormat is the parameter that makes the scanner send decode data in packets
+// rather than as plain characters, 1 for packets.
+const ssiParamDecodeFormat = 0xEE
+
+// ssiParamBeepAfterDecode is the parameter that has the scanner beep when it decoded a
+// barcode, 0 to leave that to the host.
+const ssiParamBeepAfterDecode = 0x38
+
+// ssiSerialSetup are the parameters a scanner on a serial port is set to on start.
+var ssiSerialSetup = map[int]int{ssiParamDecodeFormat: 1}
+
+// REQUEST_REVISION asks the scanner for its software revision, it answers with REPLY_REVISION.
+const (
+	ssiRequestRevision = 0xA3
+	ssiReplyRevision   = 0xA4
+)
+
+// ssiLEDDecode is the bit of the decode LED in LED_ON and LED_OFF.
+const ssiLEDDecode = 0x01
+
+// ssiSymbologies are the barcode types of DECODE_DATA, named like the AIM symbologies in
+// scan.go where there is one. The UPC and EAN variants are all ean, as with AIM.
+var ssiSymbologies = map[byte]string{
+	0x01: "code39",
+	0x02: "codabar",
+	0x03: "code128",
+	0x04: "d2of5",
+	0x05: "iata",
+	0x06: "itf",
+	0x07: "code93",
+	0x08: "ean", // UPC-A
+	0x09: "ean", // UPC-E0
+	0x0A: "ean", // EAN-8
+	0x0B: "ean", // EAN-13
+	0x0C: "code11",
+	0x0E: "msi",
+	0x0F: "code128", // GS1-128
+	0x10: "ean",     // UPC-E1
+	0x11: "pdf417",
+	0x13: "code39", // full ASCII
+	0x15: "trioptic",
+	0x16: "ean",     // Bookland
+	0x1A: "code128", // ISBT-128
+	0x1B: "pdf417",  // MicroPDF
+	0x1C: "datamatrix",
+	0x1D: "qr",
+	0x1F: "maxicode",
+	0x2C: "qr", // Micro QR
+	0x2D: "aztec",
+	0x30: "databar",
+	0x31: "databar", // limited
+	0x32: "databar", // expanded
+}
+
+// ssiPacket is a packet without its length and checksum.
+type ssiPacket struct {
+	opcode, source, status byte
+	data                   []byte
+}
+
+// ssiMaxData is as much data as fits in a packet, whose length is a byte.
+const ssiMaxData = 255 - 4
+
+func ssiChecksum(b []byte) uint16 {
+	var sum uint16
+	for _, c := range b {
+		sum += uint16(c)
+	}
+	return -sum
+}
+
+func (p ssiPacket) encode() []byte {
+	b := append([]byte{byte(4 + len(p.data)), p.opcode, p.source, p.status}, p.data...)
+	sum := ssiChecksum(b)
+	return append(b, byte(sum>>8), byte(sum))
+}
+
+// errSSIChecksum is a packet that didn't arrive as it was sent.
+var errSSIChecksum = errors.New("ssi: bad checksum")
+
+// readSSIPacket reads the next packet. A length that can't be right is skipped a byte at a
+// time, so a reader that started in the middle of a packet finds the start of the next.
+func readSSIPacket(r *bufio.Reader) (ssiPacket, error) {
+	var n byte
+	for {
+		var err error
+		if n, err = r.ReadByte(); err != nil {
+			return ssiPacket{}, err
+		}
+		if n >= 4 {
+			break
+		}
+	}
+	b := make([]byte, int(n)+2)
+	b[0] = n
+	if _, err := io.ReadFull(r, b[1:]); err != nil {
+		return ssiPacket{}, err
+	}
+	p := ssiPacket{opcode: b[1], source: b[2], status: b[3], data: b[4:n]}
+	if ssiChecksum(b[:n]) != uint16(b[n])<<8|uint16(b[n+1]) {
+		return p, errSSIChecksum
+	}
+	return p, nil
+}
+
+// ssiScanner is a scanner speaking SSI, on a serial port or anything else that carries the
+// bytes. A goroutine reads packets as they come, ACKs them and hands decode data to
+// readScan and everything else to the command waiting for an answer.
+type ssiScanner struct {
+	name  string
+	open  func() (io.ReadWriteCloser, error)
+	setup map[int]int // parameters set whenever the port is opened
+
+	// In host ack mode decode data is only ACKed once the scan passed validation, and NAKed
+	// if it didn't, so the scanner shows the verdict and not just that it decoded something.
+	hostAck bool
+
+	mu       sync.Mutex // one command at a time
+	wmu      sync.Mutex // one packet written at a time
+	port     io.ReadWriteCloser
+	decoded  chan ssiPacket
+	replies  chan ssiPacket
+	readErr  chan error
+	closed   bool
+	timeout  time.Duration // for an answer to a command
+	attempts int           // to send a command before giving up
+}
+
+// openSSIScanner opens a scanner on a serial port and has it send decode data in packets,
+// until it is reset. Its scans have the device name name.
+// With host_ack it doesn't beep on its own after a decode either.
+func openSSIScanner(sc SerialConfig, name string) (*ssiScanner, error) {
+	setup := ssiSerialSetup
+	if sc.HostAck {
+		setup = maps.Clone(setup)
+		setup[ssiParamBeepAfterDecode] = 0
+	}
+	return startSSIScanner(name, setup, sc.HostAck, func() (io.ReadWriteCloser, error) { return sc.open() })
+}
+
+func startSSIScanner(name string, setup map[int]int, hostAck bool, open func() (io.ReadWriteCloser, error)) (*ssiScanner, error) {
+	s := &ssiScanner{name: name, open: open, setup: setup, hostAck: hostAck, timeout: time.Second, attempts: 3}
+	if err := s.start(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// start opens the port, starts reading and sets the scanner up.
+func (s *ssiScanner) start() error {
+	port, err := s.open()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.port, s.closed = port, false
+	s.decoded, s.replies, s.readErr = make(chan ssiPacket, 8), make(chan ssiPacket, 1), make(chan error, 1)
+	go s.readPackets(port, s.decoded, s.replies, s.readErr)
+	s.mu.Unlock()
+	if len(s.setup) == 0 {
+		return nil
+	}
+	if err := s.setParams(false, s.setup); err != nil {
+		s.close()
+		return fmt.Errorf("ssi: could not set the scanner up: %v", err)
+	}
+	return nil
+}
+
+// readPackets reads from port until it fails. Packets continued over several are put back
+// together first. A packet sent again because our ACK got lost is only ACKed again.
+func (s *ssiScanner) readPackets(port io.ReadWriteCloser, decoded, replies chan ssiPacket, readErr chan error) {
+	r := bufio.NewReader(port)
+	var pending *ssiPacket
+	var last []byte // the packet before, without the status
+	for {
+		p, err := readSSIPacket(r)
+		if err == errSSIChecksum {
+			slog.Warn("Garbled packet from the scanner, asking for it again", "device", s.name, "opcode", fmt.Sprintf("%#02x", p.opcode))
+			s.write(port, ssiPacket{opcode: ssiNak, source: ssiFromHost, data: []byte{ssiNakResend}})
+			continue
+		} else if err != nil {
+			readErr <- err
+			return
+		}
+		if p.opcode == ssiAck || p.opcode == ssiNak {
+			offerReply(replies, p)
+			continue
+		}
+		// In host ack mode the last packet of decode data is answered by the scan's ack.
+		if !s.hostAck || p.opcode != ssiDecodeData || p.status&ssiContinuation != 0 {
+			s.write(port, ssiPacket{opcode: ssiAck, source: ssiFromHost})
+		}
+		key := append([]byte{p.opcode}, p.data...)
+		if p.status&ssiRetransmit != 0 && bytes.Equal(key, last) {
+			continue
+		}
+		last = key
+		if pending != nil && p.opcode == pending.opcode {
+			pending.data = append(pending.data, p.data...)
+			pending.status = p.status
+			p = *pending
+		}
+		if p.status&ssiContinuation != 0 {
+			if pending == nil {
+				pending = &ssiPacket{opcode: p.opcode, source: p.source, data: append([]byte(nil), p.data...)}
+			}
+			continue
+		}
+		pending = nil
+		if p.opcode == ssiDecodeData {
+			decoded <- p
+		} else {
+			offerReply(replies, p)
+		}
+	}
+}
+
+// offerReply passes on an answer to a command, dropping the one before if nobody took it.
+func offerReply(replies chan ssiPacket, p ssiPacket) {
+	for {
+		select {
+		case replies <- p:
+			return
+		default:
+		}
+		select {
+		case <-replies:
+		default:
+		}
+	}
+}
+
+func (s *ssiScanner) write(port io.Writer, p ssiPacket) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	_, err := port.Write(p.encode())
+	return err
+}
+
+// command sends a packet until the scanner ACKs it, or answers with a packet of its own if
+// reply is true, which it then returns. A NAK other than one asking to send it again is an
+// error.
+func (s *ssiScanner) command(p ssiPacket, reply bool) (ssiPacket, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ssiPacket{}, errors.New("ssi: scanner closed")
+	}
+	// Drop an answer that came too late for an earlier command.
+	select {
+	case <-s.replies:
+	default:
+	}
+	p.source = ssiFromHost
+	for attempt := 1; attempt <= s.attempts; attempt++ {
+		if attempt > 1 {
+			p.status |= ssiRetransmit
+		}
+		if err := s.write(s.port, p); err != nil {
+			return ssiPacket{}, err
+		}
+		select {
+		case r := <-s.replies:
+			switch {
+			case r.opcode == ssiNak && len(r.data) > 0 && r.data[0] == ssiNakResend:
+				continue
+			case r.opcode == ssiNak:
+				return r, fmt.Errorf("ssi: scanner refused command %#02x (NAK %v)", p.opcode, r.data)
+			case reply && r.opcode == ssiAck:
+				continue // keep waiting for the answer itself
+			}
+			return r, nil
+		case <-time.After(s.timeout):
+		}
+	}
+	return ssiPacket{}, fmt.Errorf("ssi: no answer to command %#02x", p.opcode)
+}
+
+// encodeParam is a parameter number as SSI has it: a byte up to 0xEF, and from 0x100 to
+// 0x3FF a 0xF0, 0xF1 or 0xF2 in front of the low byte.
+func encodeParam(num int) ([]byte, error) {
+	switch {
+	case num >= 0 && num <= 0xEF:
+		return []byte{byte(num)}, nil
+	case num >= 0x100 && num <= 0x3FF:
+		return []byte{byte(0xF0 + (num>>8 - 1)), byte(num)}, nil
+	}
+	return nil, fmt.Errorf("ssi: can't send parameter %#x", num)
+}
+
+// setParams sets parameters of the scanner, for good if permanent, otherwise until it is
+// reset or loses power. The values are a byte each.
+func (s *ssiScanner) setParams(permanent bool, params map[int]int) error {
+	data := []byte{0xFF} // no beep to confirm
+	nums := make([]int, 0, len(params))
+	for num := range params {
+		nums = append(nums, num)
+	}
+	sort.Ints(nums)
+	for _, num := range nums {
+		b, err := encodeParam(num)
+		if err != nil {
+			return err
+		}
+		if v := params[num]; v < 0 || v > 0xFF {
+			return fmt.Errorf("ssi: value %d of parameter %#x doesn't fit in a byte", v, num)
+		}
+		data = append(append(data, b...), byte(params[num]))
+	}
+	if len(data) > ssiMaxData {
+		return errors.New("ssi: too many parameters for one packet")
+	}
+	p := ssiPacket{opcode: ssiParamSend, data: data}
+	if permanent {
+		p.status = ssiPermanent
+	}
+	_, err := s.command(p, false)
+	return err
+}
+
+// params asks the scanner for the values of parameters. Values it doesn't say are missing
+// from the result.
+func (s *ssiScanner) params(nums ...int) (map[int]int, error) {
+	var data []byte
+	for _, num := range nums {
+		b, err := encodeParam(num)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, b...)
+	}
+	r, err := s.command(ssiPacket{opcode: ssiParamRequest, data: data}, true)
+	if err != nil {
+		return nil, err
+	}
+	if r.opcode != ssiParamSend || len(r.data) < 1 {
+		return nil, fmt.Errorf("ssi: unexpected answer %#02x to a parameter request", r.opcode)
+	}
+	values := map[int]int{}
+	b := r.data[1:] // after the beep code
+	for len(b) >= 2 {
+		num := int(b[0])
+		if b[0] >= 0xF0 && b[0] <= 0xF2 && len(b) >= 3 {
+			num = (int(b[0])-0xF0+1)<<8 | int(b[1])
+			b = b[1:]
+		}
+		values[num] = int(b[1])
+		b = b[2:]
+	}
+	return values, nil
+}
+
+// beep sounds one of the scanner's beep codes, 0 to 0x1A: 0 is a short high beep, 1 two of
+// them, 0x0B a long low one and so on.
+func (s *ssiScanner) beep(code int) error {
+	if code < 0 || code > 0x1A {
+		return fmt.Errorf("ssi: no beep code %d", code)
+	}
+	_, err := s.command(ssiPacket{opcode: ssiBeep, data: []byte{byte(code)}}, false)
+	return err
+}
+
+// setLED turns the decode LED on or off.
+func (s *ssiScanner) setLED(on bool) error {
+	p := ssiPacket{opcode: ssiLEDOff, data: []byte{ssiLEDDecode}}
+	if on {
+		p.opcode = ssiLEDOn
+	}
+	_, err := s.command(p, false)
+	return err
+}
+
+// setEnabled lets the operator scan, or not: a disabled scanner doesn't decode anything
+// until it is enabled again, or reset.
+func (s *ssiScanner) setEnabled(on bool) error {
+	p := ssiPacket{opcode: ssiScanDisable}
+	if on {
+		p.opcode = ssiScanEnable
+	}
+	_, err := s.command(p, false)
+	return err
+}
+
+// setTrigger pulls the trigger, as if the operator did, or lets go of it. The scanner tries
+// to decode until it did or its own timeout for a decode session is up, and only takes the
+// trigger from the host in a trigger mode that allows that.
+func (s *ssiScanner) setTrigger(pulled bool) error {
+	p := ssiPacket{opcode: ssiStopDecode}
+	if pulled {
+		p.opcode = ssiStartDecode
+	}
+	_, err := s.command(p, false)
+	return err
+}
+
+// readScan waits for the next decode data.
+func (s *ssiScanner) readScan() (Scan, error) {
+	s.mu.Lock()
+	decoded, readErr, port := s.decoded, s.readErr, s.port
+	s.mu.Unlock()
+	select {
+	case p := <-decoded:
+		scan := s.scan(p)
+		if s.hostAck {
+			scan.ack = func(taken bool) {
+				reply := ssiPacket{opcode: ssiAck, source: ssiFromHost}
+				if !taken {
+					reply = ssiPacket{opcode: ssiNak, source: ssiFromHost, data: []byte{ssiNakDenied}}
+				}
+				if err := s.write(port, reply); err != nil {
+					slog.Warn("Could not acknowledge the scan to the scanner", "device", s.name, "error", err)
+				}
+			}
+		}
+		return scan, nil
+	case err := <-readErr:
+		readErr <- err // for the next call, until reopened
+		return Scan{}, err
+	}
+}
+
+// scan makes a scan of decode data. An AIM identifier in the data, if the scanner is set
+// to send one, takes precedence over the barcode type.
+func (s *ssiScanner) scan(p ssiPacket) Scan {
+	var code string
+	var typ byte
+	if len(p.data) > 0 {
+		typ, code = p.data[0], string(p.data[1:])
+	}
+	scan := newScan(code, s.name, time.Now())
+	if scan.Symbology == "" {
+		scan.Symbology = ssiSymbologies[typ]
+	}
+	return scan
+}
+
+// identity asks the scanner for its revision, the software revision first and then the
+// board type and the engine, separated by spaces.
+func (s *ssiScanner) identity() (scannerIdentity, error) {
+	r, err := s.command(ssiPacket{opcode: ssiRequestRevision}, true)
+	if err != nil {
+		return scannerIdentity{}, err
+	}
+	if r.opcode != ssiReplyRevision {
+		return scannerIdentity{}, fmt.Errorf("ssi: unexpected answer %#02x to a revision request", r.opcode)
+	}
+	fields := strings.Fields(string(r.data))
+	if len(fields) == 0 {
+		return scannerIdentity{}, errors.New("ssi: the scanner didn't say its revision")
+	}
+	return scannerIdentity{Firmware: fields[0]}, nil
+}
+
+// reopen opens the port again after reading from it failed.
+func (s *ssiScanner) reopen() error {
+	s.close()
+	return s.start()
+}
+
+func (s *ssiScanner) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return s.port.Close()
+}
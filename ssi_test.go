@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeSSI is the scanner's end of an SSI connection. It ACKs parameters, answers parameter
+// requests with params and passes every other packet the host sends on to got, ACKing the
+// commands among them.
+type fakeSSI struct {
+	t      *testing.T
+	conn   net.Conn
+	wmu    sync.Mutex
+	params map[byte]byte
+	got    chan ssiPacket
+}
+
+func newFakeSSI(t *testing.T) (*fakeSSI, net.Conn) {
+	host, scanner := net.Pipe()
+	f := &fakeSSI{t: t, conn: scanner, params: map[byte]byte{}, got: make(chan ssiPacket, 16)}
+	go f.serve()
+	t.Cleanup(func() { scanner.Close() })
+	return f, host
+}
+
+func (f *fakeSSI) serve() {
+	r := bufio.NewReader(f.conn)
+	for {
+		p, err := readSSIPacket(r)
+		if err != nil {
+			return
+		}
+		switch p.opcode {
+		case ssiParamSend:
+			for i := 1; i+1 < len(p.data); i += 2 {
+				f.params[p.data[i]] = p.data[i+1]
+			}
+			f.send(ssiPacket{opcode: ssiAck})
+		case ssiParamRequest:
+			data := []byte{0xFF}
+			for _, num := range p.data {
+				data = append(data, num, f.params[num])
+			}
+			f.send(ssiPacket{opcode: ssiParamSend, data: data})
+		default:
+			if p.opcode != ssiAck && p.opcode != ssiNak {
+				f.send(ssiPacket{opcode: ssiAck})
+			}
+			f.got <- p
+		}
+	}
+}
+
+func (f *fakeSSI) send(p ssiPacket) {
+	f.writeRaw(p.encode())
+}
+
+func (f *fakeSSI) writeRaw(b []byte) {
+	f.wmu.Lock()
+	defer f.wmu.Unlock()
+	if _, err := f.conn.Write(b); err != nil {
+		f.t.Errorf("writing to the host: %v", err)
+	}
+}
+
+// expect waits for the host to send a packet with opcode.
+func (f *fakeSSI) expect(opcode byte) ssiPacket {
+	f.t.Helper()
+	select {
+	case p := <-f.got:
+		if p.opcode != opcode {
+			f.t.Fatalf("host sent %#02x, not %#02x", p.opcode, opcode)
+		}
+		return p
+	case <-time.After(5 * time.Second):
+		f.t.Fatalf("host didn't send %#02x", opcode)
+		return ssiPacket{}
+	}
+}
+
+func TestSSIScanner(t *testing.T) {
+	f, host := newFakeSSI(t)
+	s, err := startSSIScanner("ssi", ssiSerialSetup, false, func() (io.ReadWriteCloser, error) { return host, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	if f.params[ssiParamDecodeFormat] != 1 {
+		t.Fatal("decode data isn't set to packets")
+	}
+
+	// An EAN-13 in two packets, the first garbled on the way and sent again after the NAK.
+	first := ssiPacket{opcode: ssiDecodeData, status: ssiContinuation, data: []byte{0x0B, '4', '0', '0', '6', '3', '8'}}
+	garbled := first.encode()
+	garbled[5] ^= 0xFF
+	f.writeRaw(garbled)
+	if p := f.expect(ssiNak); len(p.data) != 1 || p.data[0] != ssiNakResend {
+		t.Fatalf("NAK %v, not a resend", p.data)
+	}
+	first.status |= ssiRetransmit
+	f.send(first)
+	f.expect(ssiAck)
+	f.send(ssiPacket{opcode: ssiDecodeData, data: []byte("1333931")})
+	f.expect(ssiAck)
+	scan, err := s.readScan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scan.Code != "4006381333931" || scan.Symbology != "ean" || scan.Device != "ssi" {
+		t.Fatalf("scan %q %s from %s", scan.Code, scan.Symbology, scan.Device)
+	}
+
+	// The ACK for a QR code got lost, the copy sent again is no second scan.
+	qr := ssiPacket{opcode: ssiDecodeData, data: append([]byte{0x1D}, "https://example.com/1"...)}
+	f.send(qr)
+	f.expect(ssiAck)
+	qr.status = ssiRetransmit
+	f.send(qr)
+	f.expect(ssiAck)
+	f.send(ssiPacket{opcode: ssiDecodeData, data: append([]byte{0x03}, "ABC-123"...)})
+	f.expect(ssiAck)
+	for _, want := range []string{"https://example.com/1", "ABC-123"} {
+		if scan, err := s.readScan(); err != nil || scan.Code != want {
+			t.Fatalf("scan %q, %v, not %q", scan.Code, err, want)
+		}
+	}
+
+	f.params[0x2D] = 1
+	values, err := s.params(0x2D, ssiParamDecodeFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values[0x2D] != 1 || values[ssiParamDecodeFormat] != 1 {
+		t.Fatalf("params %v", values)
+	}
+	f.expect(ssiAck) // for the values
+
+	f.params[0x08] = 1
+	if err := s.setSymbology("code128", false); err != nil || f.params[0x08] != 0 {
+		t.Fatalf("code 128 is still %d, %v", f.params[0x08], err)
+	}
+	if err := s.setSymbology("aztec", false); err == nil {
+		t.Fatal("no error turning off a symbology we have no parameter for")
+	}
+	if err := s.setParam("same_symbol_timeout", "1.5s"); err != nil || f.params[ssiParamSameSymbolTimeout] != 15 {
+		t.Fatalf("same symbol timeout %d, %v", f.params[ssiParamSameSymbolTimeout], err)
+	}
+	if v, err := s.getParam("same_symbol_timeout"); err != nil || v != "1.5s" {
+		t.Fatalf("same symbol timeout %q, %v", v, err)
+	}
+	f.expect(ssiAck) // for the value
+
+	if err := s.setTrigger(true); err != nil {
+		t.Fatal(err)
+	}
+	f.expect(ssiStartDecode)
+
+	host.Close()
+	if _, err := s.readScan(); err == nil {
+		t.Fatal("no error reading from a closed port")
+	}
+}
+
+// TestSSIHostAck checks that in host ack mode decode data is answered by the verdict on the
+// scan, not right away.
+func TestSSIHostAck(t *testing.T) {
+	f, host := newFakeSSI(t)
+	s, err := startSSIScanner("ssi", nil, true, func() (io.ReadWriteCloser, error) { return host, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	for _, taken := range []bool{true, false} {
+		f.send(ssiPacket{opcode: ssiDecodeData, data: append([]byte{0x03}, "ABC-123"...)})
+		scan, err := s.readScan()
+		if err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case p := <-f.got:
+			t.Fatalf("host sent %#02x before the verdict", p.opcode)
+		case <-time.After(50 * time.Millisecond):
+		}
+		scan.acknowledge(taken)
+		if taken {
+			f.expect(ssiAck)
+		} else if p := f.expect(ssiNak); len(p.data) != 1 || p.data[0] != ssiNakDenied {
+			t.Fatalf("NAK %v, not denied", p.data)
+		}
+	}
+}
+
+func TestSSIPacketChecksum(t *testing.T) {
+	// An ACK from the host, as in the SSI manual: 04 D0 04 00 FF 28.
+	got := ssiPacket{opcode: ssiAck, source: ssiFromHost}.encode()
+	want := []byte{0x04, 0xD0, 0x04, 0x00, 0xFF, 0x28}
+	if string(got) != string(want) {
+		t.Fatalf("ACK % X, not % X", got, want)
+	}
+}
+
+// TestSNAPIPort drives a scanner in SNAPI mode faked on the other end of a socket pair,
+// which keeps the reports apart like hidraw does.
+func TestSNAPIPort(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Skip(err)
+	}
+	syscall.SetNonblock(fds[0], true)
+	host, scanner := os.NewFile(uintptr(fds[0]), "host"), os.NewFile(uintptr(fds[1]), "scanner")
+	defer scanner.Close()
+
+	reports := make(chan []byte, 16)
+	go func() {
+		for {
+			b := make([]byte, 64)
+			n, err := scanner.Read(b)
+			if err != nil {
+				return
+			}
+			if n != snapiReportSize {
+				t.Errorf("report of %d bytes", n)
+			}
+			reports <- b[:n]
+		}
+	}()
+	expect := func(want ...byte) []byte {
+		t.Helper()
+		select {
+		case r := <-reports:
+			if !bytes.HasPrefix(r, want) {
+				t.Fatalf("report % X, not % X...", r, want)
+			}
+			return r
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no report % X...", want)
+			return nil
+		}
+	}
+
+	s, err := startSSIScanner("snapi", nil, false, func() (io.ReadWriteCloser, error) { return &snapiPort{f: host}, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+
+	// A command and its ACK, each an SSI packet in a report of its own.
+	done := make(chan error)
+	go func() { done <- s.beep(1) }()
+	beep := ssiPacket{opcode: ssiBeep, source: ssiFromHost, data: []byte{1}}.encode()
+	expect(append([]byte{snapiReportSSI, byte(len(beep))}, beep...)...)
+	ack := ssiPacket{opcode: ssiAck}.encode()
+	scanner.Write(append([]byte{snapiReportSSI, byte(len(ack))}, ack...))
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// A QR code in two reports, each ACKed, and no SSI ACK for the decode data.
+	code := "https://example.com/" + strings.Repeat("x", 40)
+	data := append([]byte{0x1D}, code...)
+	scanner.Write(append([]byte{snapiReportDecode, 2, 0, 28}, data[:28]...))
+	expect(snapiReportAck, snapiReportDecode, 0)
+	scanner.Write(append([]byte{snapiReportDecode, 2, 1, byte(len(data) - 28)}, data[28:]...))
+	expect(snapiReportAck, snapiReportDecode, 1)
+	scan, err := s.readScan()
+	if err != nil || scan.Code != code || scan.Symbology != "qr" {
+		t.Fatalf("scan %q %s, %v", scan.Code, scan.Symbology, err)
+	}
+	go func() { done <- s.setEnabled(false) }()
+	disable := ssiPacket{opcode: ssiScanDisable, source: ssiFromHost}.encode()
+	expect(append([]byte{snapiReportSSI, byte(len(disable))}, disable...)...)
+	scanner.Write(append([]byte{snapiReportSSI, byte(len(ack))}, ack...))
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,659 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gvalkov/golang-evdev"
+)
+
+// station is one scanner with everything behind it: the grabbed device, the event
+// processing and a dispatcher with its own pipeline. Without profiles there is a single
+// station, with profiles there is one per profile and they don't share anything.
+type station struct {
+	profile string // empty without profiles
+	device  *evdev.InputDevice
+	input   *captureInput  // events come from here instead of device with -input=stdin
+	source  scanSource     // or whole scans from here, device only names it, see serial.go
+	hid     *hidKeyboard   // or key presses from a hidraw node, device only names it
+	ctl     scannerControl // nil if the scanner takes no commands
+	btAddr  string         // address of a scanner paired over Bluetooth, see bluetooth.go
+	params  scannerParams  // set on the scanner whenever it is attached, see params.go
+	whole   chan Scan      // scans from source for the event processing to pass on
+	lock    *os.File
+	d       *dispatcher
+	live    *liveness
+	event   chan evdev.InputEvent
+	scans   chan Scan
+
+	// What to do when event or scans is full, see BackpressureConfig.
+	eventOverflow, scanOverflow overflowPolicy
+
+	stopping   atomic.Bool
+	readFailed atomic.Bool  // the last read from the device failed, e.g. because it's gone
+	reading    atomic.Int64 // unix nanoseconds since which the reader waits for the device, 0 if not
+	stuck      atomic.Bool  // the watchdog closed the device, see watchRead
+	fileMu     sync.Mutex   // guards device.File and Fn against the watchdog, see watchRead
+	asleep     atomic.Bool  // the scanner was put to sleep, see idle.go
+	lastErr    atomic.Pointer[deviceError]
+	stopEvents chan struct{}
+	scansDone  chan struct{}
+}
+
+// scanSource is a scanner that sends whole scans over a protocol of its own rather than key
+// presses through an input device.
+type scanSource interface {
+	readScan() (Scan, error) // waits for the next scan
+	reopen() error           // after reading failed, e.g. because the scanner was unplugged
+	close() error            // a readScan waiting returns
+}
+
+// scannerControl is a scanSource the host can send commands to, over the same protocol
+// its scans come in.
+type scannerControl interface {
+	beep(code int) error
+	setLED(on bool) error
+	setEnabled(on bool) error
+	setTrigger(pulled bool) error
+}
+
+// control is the scanner of the station if it takes commands.
+func (s *station) control() (scannerControl, error) {
+	if s.ctl == nil {
+		return nil, fmt.Errorf("the %s takes no commands, only scanners on SSI or SNAPI and Honeywell or Datalogic ones on a serial port do, or with feedback hid_led", s.label())
+	}
+	return s.ctl, nil
+}
+
+// deviceError is the last thing that went wrong with a device, for the status.
+type deviceError struct {
+	Time  time.Time `json:"time"`
+	Error string    `json:"error"`
+}
+
+// setError records a problem with the device.
+func (s *station) setError(err error) {
+	s.lastErr.Store(&deviceError{Time: time.Now(), Error: err.Error()})
+}
+
+// openStation finds the scanner for a configuration in devices, locks it against other
+// instances and grabs it.
+func openStation(profile string, cfg *Config, devices []*evdev.InputDevice) (*station, error) {
+	s := &station{profile: profile, live: newLiveness(), stopEvents: make(chan struct{}), scansDone: make(chan struct{})}
+	dev := cfg.findDevice(devices)
+	if dev == nil {
+		hint := cfg.keyboardHint(devices)
+		if profile != "" {
+			return nil, withExit(exitNoDevice, fmt.Errorf("Cound not find a scanner for %s, error.%s", profile, hint))
+		}
+		return nil, withExit(exitNoDevice, errors.New("Cound not find a scanner, error."+hint))
+	}
+	slog.Info("Found "+s.label(), "path", dev.Fn, "device", dev.Name)
+
+	// Two instances grabbing the same scanner would fight over it, so make sure we're alone.
+	lock, err := lockDevice(cfg.LockDir, dev.Fn)
+	if err != nil {
+		return nil, err
+	}
+	device, err := evdev.Open(dev.Fn)
+	if errors.Is(err, os.ErrPermission) {
+		lock.Close()
+		return nil, fmt.Errorf("%w; %s", err, permissionHint(dev.Fn))
+	} else if err != nil {
+		lock.Close()
+		return nil, err
+	}
+
+	// Need to grab the device so that we don't get additional input from the HID
+	// portion of the scanner connection
+	err = device.Grab()
+	if errors.Is(err, syscall.EBUSY) {
+		lock.Close()
+		return nil, fmt.Errorf("%s is grabbed by another program already.", dev.Fn)
+	} else if err != nil {
+		lock.Close()
+		return nil, err
+	}
+	s.device, s.lock = device, lock
+	if dev.Bustype == busBluetooth {
+		s.btAddr = inputUniq(dev.Fn)
+	}
+	return s, nil
+}
+
+// openSourceStation opens the station for a scanner at path that sends whole scans, locked
+// against other instances like an input device. open opens the scanner.
+func openSourceStation(profile string, cfg *Config, path, name, protocol string, open func() (scanSource, error)) (*station, error) {
+	lock, err := lockDevice(cfg.LockDir, path)
+	if err != nil {
+		return nil, err
+	}
+	src, err := open()
+	if errors.Is(err, os.ErrPermission) {
+		lock.Close()
+		return nil, fmt.Errorf("%v; %s", err, permissionHint(path))
+	} else if err != nil {
+		lock.Close()
+		return nil, noDevice(err)
+	}
+	s := &station{profile: profile, source: src, lock: lock, live: newLiveness(), stopEvents: make(chan struct{}), scansDone: make(chan struct{}),
+		device: &evdev.InputDevice{Fn: path, Name: name}}
+	slog.Info("Opened "+s.label(), "path", path, "device", name, "protocol", protocol)
+	return s, nil
+}
+
+// label names the station in messages.
+func (s *station) label() string {
+	if s.profile == "" {
+		return "scanner"
+	}
+	return "scanner for " + s.profile
+}
+
+// component names one of the station's goroutines for the supervisor.
+func (s *station) component(name string) string {
+	if s.profile == "" {
+		return name
+	}
+	return name + " " + s.profile
+}
+
+// start sets up the pipeline and starts processing events, but not reading them, see read.
+func (s *station) start(ctx context.Context, cfg *Config) error {
+	var err error
+	if s.eventOverflow, err = parseOverflow("backpressure events", cfg.Backpressure.Events, false); err != nil {
+		return err
+	}
+	if s.scanOverflow, err = parseOverflow("backpressure scans", cfg.Backpressure.Scans, false); err != nil {
+		return err
+	}
+	if c, ok := s.source.(scannerControl); ok {
+		s.ctl = c
+	} else if cfg.Feedback.HIDLED != "" && s.source == nil && s.input == nil && s.hid == nil {
+		if s.ctl, err = newInputControl(s.device, cfg.Feedback.HIDLED); err != nil {
+			return err
+		}
+	}
+	p, err := newPipeline(cfg)
+	if err != nil {
+		return err
+	}
+	p.setDevice(s.device.Name)
+	s.d = &dispatcher{current: p}
+	if s.ctl != nil {
+		s.d.feedback = make(chan feedbackSignal, 8)
+		go components.run(s.component("feedback"), func() { giveFeedback(s.device.Name, s.ctl, s.d.feedback) })
+	}
+
+	event := make(chan evdev.InputEvent, 256)
+	scannedBarcode := make(chan Scan, 8)
+	s.event, s.scans = event, scannedBarcode
+
+	p.start(ctx)
+	go func() {
+		components.run(s.component("dispatcher"), func() { s.d.processScans(scannedBarcode) })
+		close(s.scansDone)
+	}()
+	go components.run(s.component("schedule"), func() { s.d.watchSchedule(ctx) })
+	if s.source != nil {
+		s.whole = make(chan Scan, 8)
+		go components.run(s.component("events"), func() {
+			forwardScans(s.device.Name, s.live, s.whole, scannedBarcode, s.scanOverflow, s.stopEvents)
+		})
+	} else {
+		go components.run(s.component("events"), func() {
+			processEvents(s.device.Name, s.d, s.live, event, scannedBarcode, s.scanOverflow, systemClock, s.stopEvents)
+		})
+	}
+	if s.input == nil {
+		s.params = cfg.Params
+		go s.attached()
+	}
+	if cfg.IdleAfter.Duration > 0 && s.ctl != nil {
+		go components.run(s.component("idle"), func() { s.watchIdle(cfg.IdleAfter.Duration) })
+	}
+	if cfg.ReadTimeout.Duration > 0 && s.input == nil && s.source == nil && s.hid == nil {
+		go components.run(s.component("read watchdog"), func() { s.watchRead(cfg.ReadTimeout.Duration) })
+	}
+	return nil
+}
+
+// watchRead is the watchdog for a device that stops sending anything while it is still
+// there, a wedged HID. The kernel doesn't notice, so reading from it would wait forever. If
+// the reader waited for longer than timeout, the watchdog closes the device to get it
+// unstuck and the reader opens it again. A scanner that simply wasn't used for that long is
+// reopened too, which does no harm. That isn't the device's fault, so it has a metric of
+// its own rather than counting as a read error or reconnect.
+func (s *station) watchRead(timeout time.Duration) {
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+	for range ticker.C {
+		if s.stopping.Load() {
+			return
+		}
+		since := s.reading.Load()
+		if since == 0 || time.Since(time.Unix(0, since)) < timeout {
+			continue
+		}
+		s.fileMu.Lock()
+		if _, err := os.Stat(s.device.Fn); err != nil {
+			s.fileMu.Unlock()
+			continue // gone, reading fails on its own
+		}
+		slog.Warn("Nothing read from device for too long, reopening it", "device", s.device.Name, "path", s.device.Fn,
+			"waited", time.Since(time.Unix(0, since)).Round(time.Second))
+		s.stuck.Store(true)
+		s.device.File.Close()
+		s.fileMu.Unlock()
+	}
+}
+
+// reopen opens and grabs the device again in place of the closed one, trying until it
+// works or the station is stopping, and reports whether it did.
+func (s *station) reopen() bool {
+	b := backoff{min: time.Second, max: 30 * time.Second}
+	for !s.stopping.Load() {
+		dev, err := evdev.Open(s.device.Fn)
+		if err == nil {
+			if err = dev.Grab(); err != nil {
+				dev.File.Close()
+			}
+		}
+		if err == nil {
+			s.fileMu.Lock()
+			s.device.File = dev.File
+			s.fileMu.Unlock()
+			slog.Info("Reopened device", "device", s.device.Name, "path", s.device.Fn)
+			return true
+		}
+		s.setError(err)
+		delay := b.next()
+		if errors.Is(err, os.ErrPermission) {
+			slog.Error("Not allowed to open device, will retry", "device", s.device.Name, "path", s.device.Fn, "error", err,
+				"retry_in", delay.Round(time.Millisecond), "hint", permissionHint(s.device.Fn))
+		} else {
+			slog.Error("Could not reopen device", "device", s.device.Name, "path", s.device.Fn, "error", err, "retry_in", delay.Round(time.Millisecond))
+		}
+		time.Sleep(delay)
+	}
+	return false
+}
+
+// permissionHint says what to look at when we may no longer open a device.
+func permissionHint(path string) string {
+	return fmt.Sprintf("check that uid %d may still read %s (ls -l %s): a udev rule has to give it, or its group, access, "+
+		"and after udev rules were reloaded or the device moved to another seat that can be gone", os.Getuid(), path, path)
+}
+
+// recoverRead gets reading going again after it failed with err. A device that went away,
+// or was taken from us as logind does when the seat changes, is opened again, for as long
+// as that takes. Other errors are retried after the backoff.
+func (s *station) recoverRead(err error, b *backoff) {
+	switch {
+	case s.stopping.Load():
+	case s.hid != nil:
+		time.Sleep(b.next())
+		if err := s.hid.reopen(); err != nil {
+			s.setError(err)
+		} else {
+			deviceReconnects.inc(s.device.Name)
+		}
+		return
+	case errors.Is(err, syscall.ENODEV), errors.Is(err, os.ErrPermission):
+		s.device.File.Close()
+		if s.reopen() {
+			deviceReconnects.inc(s.device.Name)
+		}
+		return
+	}
+	time.Sleep(b.next())
+}
+
+// readEvents waits for the next events of the device, or the capture on stdin.
+func (s *station) readEvents() ([]evdev.InputEvent, error) {
+	if s.input != nil {
+		return s.input.read()
+	} else if s.hid != nil {
+		return s.hid.read()
+	}
+	return s.device.Read()
+}
+
+// forwardScans takes the place of processEvents for a scanner that sends whole scans: it
+// passes them on as they come from whole until stop is closed, then closes scannedBarcode.
+func forwardScans(device string, live *liveness, whole chan Scan, scannedBarcode chan Scan, overflow overflowPolicy, stop chan struct{}) {
+	for {
+		select {
+		case scan := <-whole:
+			offer(scannedBarcode, scan, overflow, device, "scans", func(scan Scan) {
+				slog.Warn("Dropping scan, the pipeline isn't keeping up", "code", scan.Code, "device", device)
+			})
+		case reply := <-live.heartbeat:
+			close(reply)
+		case <-stop:
+			close(scannedBarcode)
+			return
+		}
+	}
+}
+
+// readScans passes scans from the source on to forwardScans. Reading is retried for as
+// long as it fails, so it only returns at the end of the lines of stdin, once forwardScans
+// has taken every scan.
+func (s *station) readScans() {
+	b := backoff{min: 100 * time.Millisecond, max: 30 * time.Second}
+	for {
+		scan, err := s.source.readScan()
+		if err == errEndOfInput {
+			for len(s.whole) > 0 {
+				time.Sleep(time.Millisecond)
+			}
+			return
+		}
+		if err != nil {
+			if s.stopping.Load() {
+				select {} // closed for the shutdown
+			}
+			readErrors.inc(s.device.Name)
+			s.setError(err)
+			if !s.readFailed.Swap(true) {
+				slog.Warn("Could not read from scanner", "device", s.device.Name, "path", s.device.Fn, "error", err)
+			}
+			time.Sleep(b.next())
+			if err := s.source.reopen(); err != nil {
+				s.setError(err)
+			} else {
+				go s.attached()
+			}
+			continue
+		}
+		if s.readFailed.Swap(false) {
+			slog.Info("Reading from scanner again", "device", s.device.Name, "path", s.device.Fn)
+			deviceReconnects.inc(s.device.Name)
+		}
+		b.reset()
+		s.live.handingOver.Store(time.Now().UnixNano())
+		select {
+		case s.whole <- scan:
+		case <-s.stopEvents:
+		}
+		s.live.handingOver.Store(0)
+	}
+}
+
+// read passes events from the device on to the event processing. It only returns at the
+// end of a capture on stdin, once the event processing has taken every event, or of the
+// lines of input lines.
+func (s *station) read() {
+	if s.source != nil {
+		components.run(s.component("reader"), s.readScans)
+		return
+	}
+	components.run(s.component("reader"), func() {
+		defer s.live.handingOver.Store(0)
+		lost := false // events were dropped, the scan they were part of is damaged
+		b := backoff{min: 10 * time.Millisecond, max: 5 * time.Second}
+		for {
+			s.reading.Store(time.Now().UnixNano())
+			events, err := s.readEvents()
+			s.reading.Store(0)
+			if err == io.EOF && s.input != nil {
+				for len(s.event) > 0 {
+					time.Sleep(time.Millisecond)
+				}
+				return
+			}
+			if err != nil && s.stuck.Swap(false) {
+				if s.reopen() {
+					watchdogReopens.inc(s.device.Name)
+				}
+				continue
+			}
+			if err != nil && s.btAddr != "" && errors.Is(err, syscall.ENODEV) {
+				s.reconnect() // asleep, not an error
+				continue
+			}
+			if err != nil {
+				readErrors.inc(s.device.Name)
+				s.setError(err)
+				if !s.readFailed.Swap(true) {
+					slog.Warn("Could not read from device", "device", s.device.Name, "path", s.device.Fn, "error", err)
+				}
+				s.recoverRead(err, &b)
+				continue
+			}
+			if s.readFailed.Swap(false) {
+				slog.Info("Reading from device again", "device", s.device.Name, "path", s.device.Fn)
+			}
+			b.reset()
+			if s.stopping.Load() {
+				droppedEvents.add(float64(len(events)), s.device.Name)
+				continue // draining for shutdown, no new scans
+			}
+			s.live.handingOver.Store(time.Now().UnixNano())
+			for i := range events {
+				recording.event(s.device.Name, &events[i])
+				if lost {
+					// Tell the event processing, the way the kernel does when its buffer
+					// overflows, so it throws away the scan with the holes in it.
+					select {
+					case s.event <- evdev.InputEvent{Time: events[i].Time, Type: evdev.EV_SYN, Code: evdev.SYN_DROPPED}:
+						lost = false
+					default:
+					}
+				}
+				offer(s.event, events[i], s.eventOverflow, s.device.Name, "events", func(evdev.InputEvent) { lost = true })
+			}
+			s.live.handingOver.Store(0)
+		}
+	})
+}
+
+// shutdown stops taking new events, finishes a scan that was still coming in and gives the
+// sinks until timeout to deliver what they have queued. Then the device is released. It
+// reports whether the sinks made it in time.
+func (s *station) shutdown(timeout time.Duration) bool {
+	s.stopping.Store(true)
+	close(s.stopEvents)
+	<-s.scansDone
+	ok := s.d.stop(timeout)
+	switch {
+	case s.source != nil:
+		s.source.close()
+	case s.hid != nil:
+		s.hid.close()
+	case s.input == nil:
+		if err := s.device.Release(); err != nil {
+			slog.Warn("Could not release device", "path", s.device.Fn, "error", err)
+		}
+	}
+	return ok
+}
+
+// release lets go of a station that was opened but never started.
+func (s *station) release() {
+	switch {
+	case s.source != nil:
+		s.source.close()
+	case s.hid != nil:
+		s.hid.close()
+	case s.input != nil:
+		return
+	default:
+		s.device.Release()
+	}
+	s.lock.Close()
+}
+
+// openStations opens a station for every profile, or a single one without profiles. A
+// device taken by one profile isn't considered for the next. If any of them can't be opened
+// the ones opened so far are released again.
+func openStations(cfg *Config) ([]*station, error) {
+	switch cfg.Input {
+	case "", "device":
+	case "stdin":
+		return openInputStation(cfg, os.Stdin)
+	case "lines":
+		return openLinesStation(cfg, os.Stdin)
+	default:
+		return nil, fmt.Errorf("input should be device, stdin or lines, not %q", cfg.Input)
+	}
+	devices, _ := evdev.ListInputDevices()
+	var stations []*station
+	for _, name := range cfg.profileNames() {
+		pcfg, err := cfg.profile(name)
+		if err == nil {
+			var s *station
+			switch {
+			case pcfg.Serial.enabled():
+				s, err = openSerialStation(name, pcfg)
+			case pcfg.SNAPI.enabled():
+				s, err = openSNAPIStation(name, pcfg)
+			case pcfg.HIDPOS.enabled():
+				s, err = openHIDPOSStation(name, pcfg)
+			case pcfg.Hidraw.enabled():
+				s, err = openHIDKeyboardStation(name, pcfg)
+			case pcfg.PCSC.enabled():
+				s, err = openPCSCStation(name, pcfg)
+			case pcfg.Scale.enabled():
+				s, err = openScaleStation(name, pcfg)
+			case pcfg.Wiegand.enabled():
+				s, err = openWiegandStation(name, pcfg)
+			case pcfg.Camera.enabled():
+				s, err = openCameraStation(name, pcfg)
+			default:
+				s, err = openStation(name, pcfg, devices)
+			}
+			if err == nil {
+				stations = append(stations, s)
+				devices = withoutDevice(devices, s.device.Fn)
+				continue
+			}
+		}
+		for _, s := range stations {
+			s.release()
+		}
+		return nil, err
+	}
+	return stations, nil
+}
+
+// openInputStation opens the station for a capture read from r, named after the device of
+// the capture. There is only the one, so profiles can't be used with it.
+func openInputStation(cfg *Config, r io.Reader) ([]*station, error) {
+	if len(cfg.Profiles) > 0 {
+		return nil, errors.New("input stdin can't be used with profiles")
+	}
+	in, err := openCaptureInput(r)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Reading events from stdin", "device", in.device)
+	s := &station{input: in, live: newLiveness(), stopEvents: make(chan struct{}), scansDone: make(chan struct{}),
+		device: &evdev.InputDevice{Fn: "stdin", Name: in.device}}
+	return []*station{s}, nil
+}
+
+func withoutDevice(devices []*evdev.InputDevice, path string) []*evdev.InputDevice {
+	var rest []*evdev.InputDevice
+	for _, dev := range devices {
+		if dev.Fn != path {
+			rest = append(rest, dev)
+		}
+	}
+	return rest
+}
+
+// startStations starts every station with the configuration of its profile.
+func startStations(ctx context.Context, cfg *Config, stations []*station) error {
+	for _, s := range stations {
+		pcfg, err := cfg.profile(s.profile)
+		if err != nil {
+			return err
+		}
+		if err := s.start(ctx, pcfg); err != nil {
+			if s.profile != "" {
+				return fmt.Errorf("profile %s: %w", s.profile, err)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// reloadStations rebuilds the configuration from the config file, environment and flags and
+// swaps in new pipelines for all stations. If anything is wrong with the new configuration,
+// for any of the profiles, the old one stays in place everywhere. The devices stay grabbed,
+// so changes to device matchers or the list of profiles need a restart.
+func reloadStations(ctx context.Context, stations []*station, path string, flags *cmdlineFlags) error {
+	cfg, err := setupConfig(path, flags)
+	if err != nil {
+		return err
+	}
+	if err := setLogLevel(cfg.Log.Level); err != nil {
+		return err
+	}
+	pipelines := make([]*pipeline, len(stations))
+	for i, s := range stations {
+		var pcfg *Config
+		if pcfg, err = cfg.profile(s.profile); err == nil {
+			pipelines[i], err = newPipeline(pcfg)
+		}
+		if err != nil {
+			for _, p := range pipelines[:i] {
+				p.stop()
+			}
+			if s.profile != "" {
+				return fmt.Errorf("profile %s: %v", s.profile, err)
+			}
+			return err
+		}
+		pipelines[i].setDevice(s.device.Name)
+		pipelines[i].start(ctx)
+	}
+	var notes []string
+	for i, s := range stations {
+		if err := s.d.replace(pipelines[i]); err != nil {
+			return err
+		}
+		if s.d.config().findDevice([]*evdev.InputDevice{s.device}) == nil {
+			notes = append(notes, "the device matchers no longer match the current "+s.label())
+		}
+	}
+	if len(cfg.profileNames()) != len(stations) {
+		notes = append(notes, "profiles were added or removed")
+	}
+	if len(notes) > 0 {
+		slog.Warn("Reloaded configuration, " + strings.Join(notes, ", ") + "; restart to apply")
+	} else {
+		slog.Info("Reloaded configuration")
+	}
+	return nil
+}
+
+// shutdownStations shuts all stations down at once and reports whether all of them
+// delivered their scans in time.
+func shutdownStations(stations []*station, timeout time.Duration) bool {
+	var wg sync.WaitGroup
+	var late atomic.Bool
+	for _, s := range stations {
+		wg.Add(1)
+		go func(s *station) {
+			defer wg.Done()
+			if !s.shutdown(timeout) {
+				late.Store(true)
+			}
+		}(s)
+	}
+	wg.Wait()
+	return !late.Load()
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	minRestartDelay = 100 * time.Millisecond
+	// maxRestartDelay stays well below what the systemd watchdog allows, so a component that
+	// keeps failing gets a few more tries before systemd gives up on the whole process.
+	maxRestartDelay = 5 * time.Second
+	// A component that ran this long without failing starts over at minRestartDelay.
+	restartResetAfter = time.Minute
+)
+
+// supervisor keeps the goroutines that make up the scanner going: a panic in one of them is
+// logged and the component restarted after a backoff that doubles with every failure in a row,
+// instead of taking the whole process down with it.
+type supervisor struct {
+	mu       sync.Mutex
+	restarts map[string]int
+}
+
+// components supervises the reader, the event processing, the dispatcher and the sinks.
+var components = &supervisor{restarts: map[string]int{}}
+
+// run calls fn until it returns without panicking. It blocks, so start it with go for a
+// background component.
+func (s *supervisor) run(name string, fn func()) {
+	b := backoff{min: minRestartDelay, max: maxRestartDelay}
+	for {
+		started := time.Now()
+		err := protect(fn)
+		if err == nil {
+			return
+		}
+		if time.Since(started) > restartResetAfter {
+			b.reset()
+		}
+		delay := b.next()
+		s.mu.Lock()
+		s.restarts[name]++
+		n := s.restarts[name]
+		s.mu.Unlock()
+		slog.Error("Component failed, restarting", "component", name, "error", err, "delay", delay.Round(time.Millisecond), "restarts", n)
+		time.Sleep(delay)
+	}
+}
+
+// protect runs fn and turns a panic into an error, with the stack so it can be tracked down.
+func protect(fn func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v\n%s", r, debug.Stack())
+		}
+	}()
+	fn()
+	return nil
+}
+
+// componentRestarts lists every component that had to be restarted so far, by name.
+func (s *supervisor) componentRestarts() []componentStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var list []componentStatus
+	for name, n := range s.restarts {
+		list = append(list, componentStatus{Name: name, Restarts: n})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
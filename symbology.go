@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// A station that only expects Code 128 can have its scanner refuse everything else rather
+// than filter stray QR codes out afterwards. Symbologies are turned on and off with the
+// scanner's own parameters, over SSI the parameter numbers of the programming guides and on
+// Honeywell scanners the ENA menu commands, named like the symbologies of the scans. EAN
+// includes the UPC variants, as with AIM. The change lasts until the scanner is reset or
+// powered off; for good, use its programming barcodes.
+
+// symbologyControl is a scanner that symbologies can be turned on and off on.
+type symbologyControl interface {
+	setSymbology(name string, on bool) error
+}
+
+// ssiSymbologyParams are the parameters that enable the symbologies on Zebra scanners, 1 to
+// enable and 0 to disable.
+var ssiSymbologyParams = map[string][]int{
+	"code39":     {0x00},
+	"ean":        {0x01, 0x02, 0x03, 0x04}, // UPC-A, UPC-E, EAN-13, EAN-8
+	"itf":        {0x06},
+	"codabar":    {0x07},
+	"code128":    {0x08},
+	"code93":     {0x09},
+	"pdf417":     {0x0F},
+	"datamatrix": {0x124},
+	"qr":         {0x125},
+	"databar":    {0x152},
+}
+
+// honeywellSymbologyTags are the menu commands that enable the symbologies on Honeywell
+// scanners, with 1 to enable and 0 to disable.
+var honeywellSymbologyTags = map[string][]string{
+	"code39":     {"C39ENA"},
+	"ean":        {"UPAENA", "UPEEN0", "E13ENA", "EA8ENA"},
+	"itf":        {"I25ENA"},
+	"codabar":    {"CBRENA"},
+	"code128":    {"128ENA"},
+	"code93":     {"93ENA"},
+	"pdf417":     {"PDFENA"},
+	"datamatrix": {"IDMENA"},
+	"qr":         {"QRCENA"},
+	"databar":    {"RSSENA"},
+}
+
+// unknownSymbology is the error for a symbology that isn't one of known's.
+func unknownSymbology[T any](name string, known map[string]T) error {
+	names := make([]string, 0, len(known))
+	for n := range known {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return fmt.Errorf("symbology should be one of %s, not %q", strings.Join(names, ", "), name)
+}
+
+func (s *ssiScanner) setSymbology(name string, on bool) error {
+	nums, ok := ssiSymbologyParams[name]
+	if !ok {
+		return unknownSymbology(name, ssiSymbologyParams)
+	}
+	params := map[int]int{}
+	for _, num := range nums {
+		params[num] = 0
+		if on {
+			params[num] = 1
+		}
+	}
+	return s.setParams(false, params)
+}
+
+func (h *honeywellScanner) setSymbology(name string, on bool) error {
+	tags, ok := honeywellSymbologyTags[name]
+	if !ok {
+		return unknownSymbology(name, honeywellSymbologyTags)
+	}
+	value := "0"
+	if on {
+		value = "1"
+	}
+	commands := slices.Clone(tags)
+	for i := range commands {
+		commands[i] += value
+	}
+	_, err := h.menu(strings.Join(commands, ";") + "!")
+	return err
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// sdNotify sends a state change like "READY=1" to systemd if we were started by it with
+// Type=notify, see sd_notify(3). Without NOTIFY_SOCKET it does nothing.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// Go maps a leading @ to the abstract namespace on its own.
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns how often systemd expects a watchdog ping, from WATCHDOG_USEC,
+// or 0 if the watchdog isn't enabled for us.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// liveness keeps track of whether the read loop and event processing are still moving. The
+// read loop spends most of its time blocked in device.Read() waiting for the next scan, which
+// is fine; what isn't fine is being stuck handing events over because processing has hung.
+type liveness struct {
+	handingOver atomic.Int64 // unix nanoseconds since which the read loop is queueing events, 0 if not
+	heartbeat   chan chan struct{}
+}
+
+func newLiveness() *liveness {
+	return &liveness{heartbeat: make(chan chan struct{})}
+}
+
+// check reports whether things look alive: the read loop hasn't been stuck for longer than
+// limit, and processEvents answers a heartbeat within limit.
+func (l *liveness) check(limit time.Duration) bool {
+	if since := l.handingOver.Load(); since != 0 && time.Since(time.Unix(0, since)) > limit {
+		return false
+	}
+	reply := make(chan struct{})
+	select {
+	case l.heartbeat <- reply:
+	case <-time.After(limit):
+		return false
+	}
+	select {
+	case <-reply:
+		return true
+	case <-time.After(limit):
+		return false
+	}
+}
+
+// runWatchdog pings the systemd watchdog at half the interval it asks for, as long as the
+// liveness checks of all stations pass. Once one fails we stop pinging and let systemd restart us.
+func runWatchdog(interval time.Duration, lives ...*liveness) {
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		alive := true
+		for _, l := range lives {
+			alive = alive && l.check(interval/4)
+		}
+		if alive {
+			sdNotify("WATCHDOG=1")
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+	"unicode/utf8"
+)
+
+// templateFuncs are available in every sink template on top of the text/template builtins.
+// pad and padLeft exist mainly for building fixed-width records for older systems.
+var templateFuncs = template.FuncMap{
+	"pad":     func(width int, s string) string { return fixWidth(s, width, false) },
+	"padLeft": func(width int, s string) string { return fixWidth(s, width, true) },
+	"upper":   strings.ToUpper,
+	"lower":   strings.ToLower,
+	"join":    strings.Join,
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// fixWidth pads s with spaces to exactly width characters, cutting it off if it is too long.
+func fixWidth(s string, width int, right bool) string {
+	width = max(width, 0)
+	n := utf8.RuneCountInString(s)
+	if n >= width {
+		return string([]rune(s)[:width])
+	}
+	if right {
+		return strings.Repeat(" ", width-n) + s
+	}
+	return s + strings.Repeat(" ", width-n)
+}
+
+// parseTemplate parses a sink template. The template is executed with the Scan, so all its
+// fields are available, e.g. "{{.Time.Format \"15:04:05\"}} {{.Code | pad 20}}".
+func parseTemplate(name string, text string) (*template.Template, error) {
+	return template.New(name).Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+}
+
+// payload is embedded in sinks that turn a scan into text, so that their output can be
+// replaced with a template or a different format.
+type payload struct {
+	tmpl   *template.Template
+	csv    *csvFormat
+	asJSON bool // the scan as a line of JSON
+	raw    bool // only the code
+}
+
+func (p *payload) setTemplate(t *template.Template) { p.tmpl = t }
+
+// configureFormat reads the format option of a sink: raw for only the code, json for the
+// scan as a line, or csv, see newCSVFormat for its options.
+func (p *payload) configureFormat(cfg *SinkConfig) error {
+	switch format := cfg.Option("format", ""); format {
+	case "":
+	case "raw":
+		p.raw = true
+	case "json":
+		p.asJSON = true
+	case "csv":
+		f, err := newCSVFormat(cfg)
+		if err != nil {
+			return err
+		}
+		p.csv = f
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+	return nil
+}
+
+// header returns the line a stream of scans should start with, if any.
+func (p *payload) header() (string, bool) {
+	if p.tmpl == nil && p.csv != nil && p.csv.header {
+		return p.csv.headerRow(), true
+	}
+	return "", false
+}
+
+// render produces the text for a scan: the sink's own default, or the template output or
+// formatted record if one was configured. A template wins over a format.
+func (p *payload) render(scan Scan, def string) (string, error) {
+	if p.tmpl == nil {
+		switch {
+		case p.csv != nil:
+			return p.csv.record(scan), nil
+		case p.asJSON:
+			b, err := json.Marshal(scan)
+			return string(b), err
+		case p.raw:
+			return scan.Code, nil
+		}
+		return def, nil
+	}
+	var b strings.Builder
+	if err := p.tmpl.Execute(&b, scan); err != nil {
+		return "", permanent(err)
+	}
+	return b.String(), nil
+}
+
+// templater is implemented by sinks that support templates, i.e. those embedding payload.
+type templater interface {
+	setTemplate(t *template.Template)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// runTop implements `usbscanner top`, a dashboard for the terminal at the station: it asks
+// the control socket for the status every interval and redraws the screen with each
+// scanner, its scan rate, the recent scans, the sinks and whatever went wrong. Ctrl+c quits.
+func runTop(args []string) {
+	fs := flag.NewFlagSet("top", flag.ExitOnError)
+	socket := fs.String("socket", defaultControlSocket, "path of the control socket")
+	profile := fs.String("profile", "", "only show this profile")
+	interval := fs.Duration("interval", time.Second, "how often to refresh")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: usbscanner top [-socket path] [-profile name] [-interval 1s]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if env := os.Getenv("USBSCANNER_CONTROL_SOCKET"); env != "" && !flagWasSet(fs, "socket") {
+		*socket = env
+	}
+
+	rates := map[string]*scanRate{}
+	for {
+		var b bytes.Buffer
+		fmt.Fprintf(&b, "usbscanner top - %s - %s\n\n", *socket, time.Now().Format("15:04:05"))
+		resp, err := controlCall(*socket, controlRequest{Command: "status", Profile: *profile})
+		switch {
+		case err != nil:
+			fmt.Fprintf(&b, "Not running? %v\n", err)
+		case !resp.OK:
+			fmt.Fprintf(&b, "%s\n", resp.Error)
+		default:
+			statuses := resp.Profiles
+			if resp.Status != nil {
+				statuses = []*controlStatus{resp.Status}
+			}
+			for _, st := range statuses {
+				key := st.Profile + "\x00" + st.Device.Path
+				if rates[key] == nil {
+					rates[key] = &scanRate{}
+				}
+				writeTopStatus(&b, st, rates[key].update(st.Scans))
+			}
+			if len(statuses) > 0 {
+				writeTopRestarts(&b, statuses[0].Restarts)
+			}
+		}
+		// Home the cursor and clear the screen, then draw the whole frame at once so it
+		// doesn't flicker.
+		os.Stdout.WriteString("\x1b[H\x1b[2J" + b.String())
+		time.Sleep(*interval)
+	}
+}
+
+// scanRate works out scans per minute from the scan counts seen on each refresh.
+type scanRate struct {
+	scans int64
+	at    time.Time
+	rate  float64
+}
+
+func (r *scanRate) update(scans int64) float64 {
+	now := time.Now()
+	if !r.at.IsZero() && scans >= r.scans {
+		current := float64(scans-r.scans) / now.Sub(r.at).Minutes()
+		// Smooth it out a little, one scan every now and then would make it jump around.
+		r.rate = 0.7*r.rate + 0.3*current
+	}
+	r.scans, r.at = scans, now
+	return r.rate
+}
+
+func writeTopStatus(b *bytes.Buffer, st *controlStatus, rate float64) {
+	var flags []string
+	if st.Paused {
+		flags = append(flags, "PAUSED")
+	}
+	if st.Outside {
+		flags = append(flags, fmt.Sprintf("OUTSIDE HOURS, %d held", st.Held))
+	}
+	if st.Profile != "" {
+		fmt.Fprintf(b, "[%s] ", st.Profile)
+	}
+	fmt.Fprintf(b, "%s (%s) %s\n", st.Device.Name, st.Device.Path, strings.Join(flags, " "))
+	last := "never"
+	if st.LastScan != nil {
+		last = fmt.Sprintf("%s (%s ago)", st.LastScan.Format("15:04:05"), time.Since(*st.LastScan).Round(time.Second))
+	}
+	fmt.Fprintf(b, "  scans %d, %.1f/min, last %s", st.Scans, rate, last)
+	if d := st.ScanDuration; d != nil {
+		fmt.Fprintf(b, ", reading takes %s (p99 %s)", seconds(d.P50), seconds(d.P99))
+	}
+	b.WriteString("\n")
+	if e := st.Device.Errors; e.Read+e.Decode+e.Reconnects+e.Dropped+e.Overflows > 0 {
+		fmt.Fprintf(b, "  errors: %d read, %d decode, %d reconnects, %d dropped events, %d overflows\n", e.Read, e.Decode, e.Reconnects, e.Dropped, e.Overflows)
+		if e.Last != nil {
+			fmt.Fprintf(b, "  last error at %s: %s\n", e.Last.Time.Format("15:04:05"), e.Last.Error)
+		}
+	}
+	b.WriteString("\n")
+
+	w := tabwriter.NewWriter(b, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "  SINK\tTYPE\tQUEUED\tACK\tSTATUS\n")
+	for _, s := range st.Sinks {
+		ack := "-"
+		if s.AckLatency != nil {
+			ack = seconds(s.AckLatency.P50)
+		}
+		state := "ok"
+		if s.Down {
+			state = "DOWN: " + s.Error
+		} else if s.Error != "" {
+			state = "FAILING: " + s.Error
+		}
+		if s.Dead > 0 {
+			state += fmt.Sprintf(", %d dead letters", s.Dead)
+		}
+		fmt.Fprintf(w, "  %s\t%s\t%d\t%s\t%s\n", s.Name, s.Type, s.Queued, ack, state)
+	}
+	w.Flush()
+	b.WriteString("\n")
+
+	w = tabwriter.NewWriter(b, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "  TIME\tCODE\tSYMBOLOGY\n")
+	for _, scan := range st.Recent {
+		fmt.Fprintf(w, "  %s\t%s\t%s\n", scan.Time.Format("15:04:05"), scan.Code, scan.Symbology)
+	}
+	w.Flush()
+	b.WriteString("\n")
+}
+
+func writeTopRestarts(b *bytes.Buffer, restarts []componentStatus) {
+	if len(restarts) == 0 {
+		return
+	}
+	b.WriteString("Restarted components:\n")
+	for _, c := range restarts {
+		fmt.Fprintf(b, "  %s %dx\n", c.Name, c.Restarts)
+	}
+}
+
+// seconds formats a latency from the status for people.
+func seconds(s float64) string {
+	return time.Duration(s * float64(time.Second)).Round(100 * time.Microsecond).String()
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Tracing exports a trace per scan to an OpenTelemetry collector with OTLP over HTTP (the
+// JSON encoding). A scan's trace has a "scan" span with a "decode" span from the first key
+// event to the end of the scan, a "parse" span for validation and tagging, and a span for
+// every sink delivery. Sinks talking HTTP pass the trace on in a traceparent header, so the
+// trace continues in whatever receives the scan.
+
+// tracing is the exporter, nil while tracing is off. Everything below is a no-op then.
+var tracing *tracer
+
+// span is a finished or running span. All methods are fine to call on nil.
+type span struct {
+	t       *tracer
+	name    string
+	traceID [16]byte
+	spanID  [8]byte
+	parent  [8]byte
+	start   time.Time
+	end     time.Time
+	attrs   map[string]string
+	err     error
+
+	// open counts what the root span of a scan waits for: handle, and every sink the scan
+	// was queued for. The last one to let go ends it.
+	open atomic.Int32
+}
+
+type tracer struct {
+	endpoint string
+	service  string
+	client   *http.Client
+
+	mu      sync.Mutex
+	pending []*span
+}
+
+// setupTracing turns on tracing if an endpoint is configured, or set in the standard
+// OTEL_EXPORTER_OTLP_ENDPOINT (the collector's base URL, /v1/traces is added).
+func setupTracing(ctx context.Context, cfg TracingConfig) {
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		if base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); base != "" {
+			endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+		}
+	}
+	if endpoint == "" {
+		return
+	}
+	service := cfg.ServiceName
+	if service == "" {
+		service = firstNonEmpty(os.Getenv("OTEL_SERVICE_NAME"), "usbscanner")
+	}
+	tracing = &tracer{endpoint: endpoint, service: service, client: &http.Client{Timeout: 10 * time.Second}}
+	go tracing.run(ctx)
+	slog.Info("Tracing", "endpoint", endpoint)
+}
+
+// startScan starts the trace of a scan: the root span, from the first key event, and the
+// decode span, which is over already.
+func (t *tracer) startScan(scan Scan) *span {
+	if t == nil {
+		return nil
+	}
+	root := &span{t: t, name: "scan", start: scan.Started, attrs: map[string]string{
+		"scan.code":      scan.Code,
+		"scan.device":    scan.Device,
+		"scan.symbology": scan.Symbology,
+	}}
+	rand.Read(root.traceID[:])
+	rand.Read(root.spanID[:])
+	root.open.Store(1)
+	decode := root.child("decode")
+	decode.start = scan.Started
+	decode.end = scan.Time
+	t.finish(decode)
+	return root
+}
+
+// child starts a span below s, now.
+func (s *span) child(name string) *span {
+	if s == nil {
+		return nil
+	}
+	c := &span{t: s.t, name: name, traceID: s.traceID, parent: s.spanID, start: time.Now(), attrs: map[string]string{}}
+	rand.Read(c.spanID[:])
+	return c
+}
+
+func (s *span) setAttr(key, value string) {
+	if s != nil {
+		s.attrs[key] = value
+	}
+}
+
+// hold keeps the root span of a scan open until a matching release.
+func (s *span) hold() {
+	if s != nil {
+		s.open.Add(1)
+	}
+}
+
+// release ends the root span of a scan once nothing holds it anymore.
+func (s *span) release() {
+	if s != nil && s.open.Add(-1) == 0 {
+		s.finish(nil)
+	}
+}
+
+// finish ends the span, failed if err isn't nil, and queues it for export.
+func (s *span) finish(err error) {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	s.err = err
+	s.t.finish(s)
+}
+
+func (t *tracer) finish(s *span) {
+	t.mu.Lock()
+	t.pending = append(t.pending, s)
+	full := len(t.pending) >= 100
+	t.mu.Unlock()
+	if full {
+		go t.flush(context.Background())
+	}
+}
+
+// run exports the finished spans every few seconds.
+func (t *tracer) run(ctx context.Context) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			t.flush(context.Background())
+			return
+		case <-ticker.C:
+			t.flush(ctx)
+		}
+	}
+}
+
+func (t *tracer) flush(ctx context.Context) {
+	t.mu.Lock()
+	spans := t.pending
+	t.pending = nil
+	t.mu.Unlock()
+	if len(spans) == 0 {
+		return
+	}
+	if err := t.export(ctx, spans); err != nil {
+		slog.Warn("Could not export traces", "spans", len(spans), "error", err)
+	}
+}
+
+// otlpAttr is a string attribute in the OTLP JSON encoding.
+type otlpAttr struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+func otlpAttrs(m map[string]string) []otlpAttr {
+	var attrs []otlpAttr
+	for _, k := range sortedKeys(m) {
+		a := otlpAttr{Key: k}
+		a.Value.StringValue = m[k]
+		attrs = append(attrs, a)
+	}
+	return attrs
+}
+
+type otlpSpan struct {
+	TraceID      string     `json:"traceId"`
+	SpanID       string     `json:"spanId"`
+	ParentSpanID string     `json:"parentSpanId,omitempty"`
+	Name         string     `json:"name"`
+	Kind         int        `json:"kind"`
+	Start        string     `json:"startTimeUnixNano"`
+	End          string     `json:"endTimeUnixNano"`
+	Attributes   []otlpAttr `json:"attributes,omitempty"`
+	Status       struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttr `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+// export sends spans to the collector.
+func (t *tracer) export(ctx context.Context, spans []*span) error {
+	var out []otlpSpan
+	for _, s := range spans {
+		o := otlpSpan{
+			TraceID:    hex.EncodeToString(s.traceID[:]),
+			SpanID:     hex.EncodeToString(s.spanID[:]),
+			Name:       s.name,
+			Kind:       1, // internal
+			Start:      strconv.FormatInt(s.start.UnixNano(), 10),
+			End:        strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes: otlpAttrs(s.attrs),
+		}
+		if s.parent != [8]byte{} {
+			o.ParentSpanID = hex.EncodeToString(s.parent[:])
+		}
+		if strings.HasPrefix(s.name, "sink ") {
+			o.Kind = 3 // client
+		}
+		if s.err != nil {
+			o.Status.Code = 2
+			o.Status.Message = s.err.Error()
+		}
+		out = append(out, o)
+	}
+
+	host, _ := os.Hostname()
+	req := otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: otlpAttrs(map[string]string{"service.name": t.service, "host.name": host})},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "usbscanner"}, Spans: out}},
+	}}}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	resp, err := t.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", t.endpoint, resp.Status)
+	}
+	return nil
+}
+
+type spanKey struct{}
+
+// withSpan makes s the current span of ctx, for traceTransport to pass on.
+func withSpan(ctx context.Context, s *span) context.Context {
+	if s == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanKey{}, s)
+}
+
+// traceTransport adds a W3C traceparent header to requests made with a context carrying a
+// span, so the receiving end can continue the trace. The HTTP based sinks use it.
+type traceTransport struct{}
+
+var sinkTransport http.RoundTripper = traceTransport{}
+
+func (traceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if s, ok := req.Context().Value(spanKey{}).(*span); ok {
+		req = req.Clone(req.Context())
+		req.Header.Set("traceparent", "00-"+hex.EncodeToString(s.traceID[:])+"-"+hex.EncodeToString(s.spanID[:])+"-01")
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"unicode/utf8"
+	"unsafe"
+)
+
+// With -tui the terminal shows the scans as a list to scroll through rather than lines that
+// scroll away: when each was scanned, on which device, its symbology, whether it was taken
+// and the code, newest at the bottom, with the last few log lines below them. The arrow
+// keys, page up and down, home and end scroll, q quits. The viewer takes the place of the
+// stdout sink and of logging to stderr.
+
+// viewerHistory is how many scans the viewer keeps.
+const viewerHistory = 1000
+
+// viewerLogLines is how many log lines it shows.
+const viewerLogLines = 3
+
+type viewerRow struct {
+	scan   Scan
+	status string
+}
+
+// scanViewer draws the scans on the terminal. Its methods do nothing on a nil one, so the
+// pipeline can tell it about scans whether or not -tui was given.
+type scanViewer struct {
+	mu     sync.Mutex
+	rows   []viewerRow // oldest first
+	logs   []string
+	offset int // how many rows the view is scrolled up from the newest
+	saved  syscall.Termios
+	closed bool
+
+	redraw chan struct{}
+}
+
+var viewer *scanViewer
+
+type winsize struct {
+	Row, Col, X, Y uint16
+}
+
+func termios(fd uintptr, req uintptr, t *syscall.Termios) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(unsafe.Pointer(t))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// startViewer takes over the terminal: stdin to read keys from one at a time, without
+// echoing them, and stdout in its alternate screen, which the shell gets back as it was.
+func startViewer() (*scanViewer, error) {
+	v := &scanViewer{redraw: make(chan struct{}, 1)}
+	if err := termios(os.Stdin.Fd(), syscall.TCGETS, &v.saved); err != nil {
+		return nil, fmt.Errorf("-tui needs a terminal: %v", err)
+	}
+	raw := v.saved
+	raw.Lflag &^= syscall.ICANON | syscall.ECHO // but ISIG, so ctrl+c still stops us
+	raw.Cc[syscall.VMIN], raw.Cc[syscall.VTIME] = 1, 0
+	if err := termios(os.Stdin.Fd(), syscall.TCSETS, &raw); err != nil {
+		return nil, fmt.Errorf("-tui: %v", err)
+	}
+	os.Stdout.WriteString("\x1b[?1049h\x1b[?25l")
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, syscall.SIGWINCH)
+	go func() {
+		for range winch {
+			v.changed()
+		}
+	}()
+	go v.readKeys()
+	go v.draw()
+	v.changed()
+	return v, nil
+}
+
+// scan adds a scan to the list, with what became of it.
+func (v *scanViewer) scan(scan Scan, status string) {
+	if v == nil {
+		return
+	}
+	v.mu.Lock()
+	v.rows = append(v.rows, viewerRow{scan: scan, status: status})
+	if len(v.rows) > viewerHistory {
+		v.rows = v.rows[len(v.rows)-viewerHistory:]
+	}
+	if v.offset > 0 {
+		v.offset = min(v.offset+1, len(v.rows)) // keep the rows in view where they are
+	}
+	v.mu.Unlock()
+	v.changed()
+}
+
+// Write takes log lines, the viewer being where the log goes. Once it is closed they go to
+// stderr again, as they would without it.
+func (v *scanViewer) Write(p []byte) (int, error) {
+	v.mu.Lock()
+	if v.closed {
+		v.mu.Unlock()
+		return os.Stderr.Write(p)
+	}
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		v.logs = append(v.logs, line)
+	}
+	if len(v.logs) > viewerLogLines {
+		v.logs = v.logs[len(v.logs)-viewerLogLines:]
+	}
+	v.mu.Unlock()
+	v.changed()
+	return len(p), nil
+}
+
+func (v *scanViewer) changed() {
+	select {
+	case v.redraw <- struct{}{}:
+	default:
+	}
+}
+
+// readKeys scrolls on the keys pressed, and quits on q as on SIGTERM.
+func (v *scanViewer) readKeys() {
+	buf := make([]byte, 16)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			return
+		}
+		page := v.listHeight()
+		v.mu.Lock()
+		switch string(buf[:n]) {
+		case "\x1b[A", "k":
+			v.offset++
+		case "\x1b[B", "j":
+			v.offset--
+		case "\x1b[5~":
+			v.offset += page
+		case "\x1b[6~", " ":
+			v.offset -= page
+		case "\x1b[H", "\x1b[1~", "g":
+			v.offset = len(v.rows)
+		case "\x1b[F", "\x1b[4~", "G":
+			v.offset = 0
+		case "q":
+			syscall.Kill(os.Getpid(), syscall.SIGTERM)
+		}
+		v.offset = max(0, min(v.offset, len(v.rows)-page))
+		v.mu.Unlock()
+		v.changed()
+	}
+}
+
+func (v *scanViewer) height() int {
+	var ws winsize
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, os.Stdout.Fd(), syscall.TIOCGWINSZ, uintptr(unsafe.Pointer(&ws))); errno != 0 || ws.Row == 0 {
+		return 24
+	}
+	return int(ws.Row)
+}
+
+// listHeight is how many scans fit on the screen, under the title and the column names and
+// above the log lines.
+func (v *scanViewer) listHeight() int {
+	return max(v.height()-viewerLogLines-3, 1)
+}
+
+func (v *scanViewer) width() int {
+	var ws winsize
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, os.Stdout.Fd(), syscall.TIOCGWINSZ, uintptr(unsafe.Pointer(&ws))); errno != 0 || ws.Col == 0 {
+		return 80
+	}
+	return int(ws.Col)
+}
+
+// draw redraws the screen whenever something changed, all of it at once so it doesn't
+// flicker.
+func (v *scanViewer) draw() {
+	for range v.redraw {
+		width := v.width()
+		v.mu.Lock()
+		if v.closed {
+			v.mu.Unlock()
+			return
+		}
+		var b strings.Builder
+		b.WriteString("\x1b[H\x1b[2J")
+		line := func(s string) {
+			if utf8.RuneCountInString(s) > width {
+				s = string([]rune(s)[:width])
+			}
+			b.WriteString(s + "\x1b[K\r\n")
+		}
+		list := v.listHeight()
+		end := len(v.rows) - v.offset
+		start := max(0, end-list)
+		title := fmt.Sprintf("usbscanner - %d scans", len(v.rows))
+		if v.offset > 0 {
+			title += fmt.Sprintf(", %d newer below (end to follow)", v.offset)
+		}
+		line(title + " - arrows/page up/page down to scroll, q to quit")
+		line(fmt.Sprintf("%-12s %-16s %-10s %-20s %s", "TIME", "DEVICE", "SYMBOLOGY", "STATUS", "CODE"))
+		for _, r := range v.rows[start:end] {
+			line(fmt.Sprintf("%-12s %-16s %-10s %-20s %s", r.scan.Time.Format("15:04:05.000"), fixWidth(r.scan.Device, 16, false),
+				fixWidth(r.scan.Symbology, 10, false), fixWidth(r.status, 20, false), r.scan.Code))
+		}
+		for i := end - start; i < list; i++ {
+			line("")
+		}
+		line(strings.Repeat("-", width))
+		for i := len(v.logs); i < viewerLogLines; i++ {
+			line("")
+		}
+		for _, l := range v.logs {
+			line(l)
+		}
+		os.Stdout.WriteString(strings.TrimSuffix(b.String(), "\r\n"))
+		v.mu.Unlock()
+	}
+}
+
+// close gives the terminal back the way it was.
+func (v *scanViewer) close() {
+	if v == nil {
+		return
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.closed {
+		return
+	}
+	v.closed = true
+	os.Stdout.WriteString("\x1b[?25h\x1b[?1049l")
+	termios(os.Stdin.Fd(), syscall.TCSETS, &v.saved)
+}
+
+// viewerStatus is what the viewer shows for a scan that was taken: ok, and its tags.
+func viewerStatus(scan Scan) string {
+	if len(scan.Tags) == 0 {
+		return "ok"
+	}
+	return "ok " + strings.Join(scan.Tags, ",")
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gvalkov/golang-evdev"
+)
+
+// With input = "lines" every line typed or pasted on stdin is a scan, for keying in the
+// code of a label too damaged to scan. It goes through the same validation, dedup, tags
+// and sinks as a scan would, so it ends up where the scans do. A line may start with an AIM
+// identifier like a scanner would send. The end of stdin, ctrl+d on a terminal, shuts down
+// as SIGTERM would.
+
+// errEndOfInput is what readScan of a source returns once there will be no more scans.
+var errEndOfInput = errors.New("end of input")
+
+// lineSource reads the lines of stdin as scans.
+type lineSource struct {
+	name string
+	sc   *bufio.Scanner
+}
+
+func (l *lineSource) readScan() (Scan, error) {
+	for l.sc.Scan() {
+		if code := strings.TrimSpace(l.sc.Text()); code != "" {
+			return newScan(code, l.name, time.Now()), nil
+		}
+	}
+	if err := l.sc.Err(); err != nil {
+		return Scan{}, err
+	}
+	return Scan{}, errEndOfInput
+}
+
+func (l *lineSource) reopen() error { return nil }
+
+// close can't make a read of stdin return, but there is nothing of it to let go of, and we
+// exit after the shutdown anyway.
+func (l *lineSource) close() error { return nil }
+
+// openLinesStation opens the station for the lines read from r. There is only the one, so
+// profiles can't be used with it.
+func openLinesStation(cfg *Config, r io.Reader) ([]*station, error) {
+	if len(cfg.Profiles) > 0 {
+		return nil, errors.New("input lines can't be used with profiles")
+	}
+	slog.Info("Reading codes from stdin, one per line")
+	src := &lineSource{name: "stdin", sc: bufio.NewScanner(r)}
+	s := &station{source: src, live: newLiveness(), stopEvents: make(chan struct{}), scansDone: make(chan struct{}),
+		device: &evdev.InputDevice{Fn: os.Stdin.Name(), Name: src.name}}
+	return []*station{s}, nil
+}
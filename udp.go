@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+func init() {
+	RegisterSink("udp", func(cfg *SinkConfig) (Sink, error) {
+		if cfg.AtLeastOnce {
+			return nil, errors.New("udp never hears back whether a scan arrived, it can't deliver at least once")
+		}
+		s, err := newUDPSink(cfg.Arg)
+		if err != nil {
+			return nil, err
+		}
+		return s, s.configureFormat(cfg)
+	})
+}
+
+// udpSink sends every scan as a single UDP datagram, which is what a number of older
+// warehouse systems expect from networked scanner bridges. The datagram holds just the
+// code unless a template or format says otherwise; there is no line ending added, and no
+// CSV header since datagrams may get lost or arrive out of order anyway.
+type udpSink struct {
+	payload
+	conn net.Conn
+}
+
+// newUDPSink sets up a sink sending to addr, given as host:port. Go enables SO_BROADCAST on
+// UDP sockets, so a broadcast address like 192.168.1.255 works as well. As a shorthand
+// "broadcast:port" sends to the limited broadcast address.
+func newUDPSink(addr string) (*udpSink, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if host == "broadcast" {
+		host = net.IPv4bcast.String()
+	}
+	conn, err := net.Dial("udp", net.JoinHostPort(host, port))
+	if err != nil {
+		return nil, err
+	}
+	return &udpSink{conn: conn}, nil
+}
+
+func (s *udpSink) Send(ctx context.Context, scan Scan) error {
+	data, err := s.render(scan, scan.Code)
+	if err != nil {
+		return err
+	}
+	_, err = s.conn.Write([]byte(data))
+	return err
+}
+
+func (s *udpSink) Close() error {
+	return s.conn.Close()
+}
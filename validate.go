@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// validator checks scans against the [validate] rules. Scans that fail are not passed on to
+// any sink.
+type validator struct {
+	pattern    *regexp.Regexp
+	minLength  int
+	maxLength  int
+	checkDigit bool
+
+	stripPrefix, stripSuffix string
+}
+
+func newValidator(cfg ValidateConfig) (*validator, error) {
+	v := &validator{minLength: cfg.MinLength, maxLength: cfg.MaxLength, checkDigit: cfg.CheckDigit, stripPrefix: cfg.StripPrefix, stripSuffix: cfg.StripSuffix}
+	if cfg.Pattern != "" {
+		re, err := regexp.Compile(cfg.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("validate pattern: %v", err)
+		}
+		v.pattern = re
+	}
+	if v.maxLength > 0 && v.maxLength < v.minLength {
+		return nil, fmt.Errorf("validate max_length is less than min_length")
+	}
+	return v, nil
+}
+
+// strip takes strip_prefix and strip_suffix off the code, where it has them, before it is
+// checked.
+func (v *validator) strip(scan Scan) Scan {
+	scan.Code = strings.TrimSuffix(strings.TrimPrefix(scan.Code, v.stripPrefix), v.stripSuffix)
+	return scan
+}
+
+// check returns why a scan isn't valid, or nil if it is.
+func (v *validator) check(scan Scan) error {
+	n := utf8.RuneCountInString(scan.Code)
+	if n < v.minLength {
+		return fmt.Errorf("shorter than %d characters", v.minLength)
+	}
+	if v.maxLength > 0 && n > v.maxLength {
+		return fmt.Errorf("longer than %d characters", v.maxLength)
+	}
+	if v.pattern != nil && !v.pattern.MatchString(scan.Code) {
+		return fmt.Errorf("doesn't match %s", v.pattern)
+	}
+	if v.checkDigit && isGTIN(scan.Code) && gs1CheckDigit(scan.Code[:len(scan.Code)-1]) != scan.Code[len(scan.Code)-1] {
+		return fmt.Errorf("wrong check digit")
+	}
+	return nil
+}
+
+// isGTIN tells whether code looks like a GTIN: EAN-8, UPC-A, EAN-13 or GTIN-14.
+func isGTIN(code string) bool {
+	switch len(code) {
+	case 8, 12, 13, 14:
+	default:
+		return false
+	}
+	for _, c := range code {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
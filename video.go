@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Webcams are video4linux devices. Frames are captured by streaming: the driver is given a
+// few buffers mapped into our memory, fills one with a frame, hands it over and gets it back
+// once we are done with it. Most webcams send YUYV, whose every other byte is the luminance
+// that is all the barcode decoding needs, or else MJPEG, frames of JPEG.
+
+// From linux/videodev2.h, with the struct sizes of 64 bit architectures.
+const (
+	vidiocSFmt      = 0xC0D05605
+	vidiocReqBufs   = 0xC0145608
+	vidiocQueryBuf  = 0xC0585609
+	vidiocQBuf      = 0xC058560F
+	vidiocDQBuf     = 0xC0585611
+	vidiocStreamOn  = 0x40045612
+	vidiocStreamOff = 0x40045613
+
+	v4l2BufTypeCapture = 1
+	v4l2MemoryMmap     = 1
+	v4l2FieldAny       = 0
+	v4l2PixYUYV        = 'Y' | 'U'<<8 | 'Y'<<16 | 'V'<<24
+	v4l2PixMJPEG       = 'M' | 'J'<<8 | 'P'<<16 | 'G'<<24
+)
+
+// v4l2Format is struct v4l2_format with the struct v4l2_pix_format of a capture.
+type v4l2Format struct {
+	Type uint32
+	_    uint32
+	Pix  struct {
+		Width, Height, PixelFormat, Field, BytesPerLine, SizeImage uint32
+		_                                                          [6]uint32
+	}
+	_ [200 - 48]byte
+}
+
+type v4l2RequestBuffers struct {
+	Count, Type, Memory, Capabilities uint32
+	_                                 [4]byte
+}
+
+// v4l2Buffer is struct v4l2_buffer of the mmap kind.
+type v4l2Buffer struct {
+	Index, Type, BytesUsed, Flags, Field uint32
+	_                                    uint32
+	Timestamp                            syscall.Timeval
+	_                                    [16]byte // timecode
+	Sequence, Memory                     uint32
+	Offset                               uint64
+	Length                               uint32
+	_                                    [3]uint32
+}
+
+// videoBuffers is how many buffers the driver gets to fill.
+const videoBuffers = 4
+
+// videoCapture captures frames off a webcam.
+type videoCapture struct {
+	f             *os.File
+	width, height int
+	stride        int // bytes of a line of YUYV
+	format        uint32
+	buffers       [][]byte
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func videoIoctl(f *os.File, req uintptr, arg unsafe.Pointer) error {
+	for {
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), req, uintptr(arg))
+		if errno == syscall.EINTR {
+			continue
+		} else if errno != 0 {
+			return errno
+		}
+		return nil
+	}
+}
+
+// openVideo opens the webcam at path for frames of about width by height, as the driver
+// has them, and starts it streaming.
+func openVideo(path string, width, height int) (*videoCapture, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	v := &videoCapture{f: f}
+	if err := v.setUp(width, height); err != nil {
+		v.unmap()
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return v, nil
+}
+
+func (v *videoCapture) setUp(width, height int) error {
+	var format v4l2Format
+	format.Type = v4l2BufTypeCapture
+	format.Pix.Width, format.Pix.Height = uint32(width), uint32(height)
+	format.Pix.PixelFormat, format.Pix.Field = v4l2PixYUYV, v4l2FieldAny
+	if err := videoIoctl(v.f, vidiocSFmt, unsafe.Pointer(&format)); err != nil {
+		return fmt.Errorf("could not set the format: %v", err)
+	}
+	if format.Pix.PixelFormat != v4l2PixYUYV && format.Pix.PixelFormat != v4l2PixMJPEG {
+		return fmt.Errorf("the camera has neither YUYV nor MJPEG but %q", fourcc(format.Pix.PixelFormat))
+	}
+	v.width, v.height, v.format = int(format.Pix.Width), int(format.Pix.Height), format.Pix.PixelFormat
+	v.stride = max(int(format.Pix.BytesPerLine), 2*v.width)
+
+	req := v4l2RequestBuffers{Count: videoBuffers, Type: v4l2BufTypeCapture, Memory: v4l2MemoryMmap}
+	if err := videoIoctl(v.f, vidiocReqBufs, unsafe.Pointer(&req)); err != nil {
+		return fmt.Errorf("could not get buffers, is it a camera? %v", err)
+	}
+	for i := uint32(0); i < req.Count; i++ {
+		buf := v4l2Buffer{Index: i, Type: v4l2BufTypeCapture, Memory: v4l2MemoryMmap}
+		if err := videoIoctl(v.f, vidiocQueryBuf, unsafe.Pointer(&buf)); err != nil {
+			return err
+		}
+		b, err := syscall.Mmap(int(v.f.Fd()), int64(buf.Offset), int(buf.Length), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+		if err != nil {
+			return err
+		}
+		v.buffers = append(v.buffers, b)
+		if err := videoIoctl(v.f, vidiocQBuf, unsafe.Pointer(&buf)); err != nil {
+			return err
+		}
+	}
+	kind := uint32(v4l2BufTypeCapture)
+	return videoIoctl(v.f, vidiocStreamOn, unsafe.Pointer(&kind))
+}
+
+// fourcc is the name of a pixel format.
+func fourcc(v uint32) string {
+	return string([]byte{byte(v), byte(v >> 8), byte(v >> 16), byte(v >> 24)})
+}
+
+// frame waits for the next frame, in shades of gray.
+func (v *videoCapture) frame() (*image.Gray, error) {
+	buf := v4l2Buffer{Type: v4l2BufTypeCapture, Memory: v4l2MemoryMmap}
+	for {
+		v.mu.Lock()
+		if v.closed {
+			v.mu.Unlock()
+			return nil, errors.New("camera closed")
+		}
+		err := videoIoctl(v.f, vidiocDQBuf, unsafe.Pointer(&buf))
+		if err == syscall.EAGAIN {
+			v.mu.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			continue
+		} else if err != nil {
+			v.mu.Unlock()
+			return nil, err
+		}
+		gray, err := v.gray(v.buffers[buf.Index][:min(int(buf.BytesUsed), len(v.buffers[buf.Index]))])
+		videoIoctl(v.f, vidiocQBuf, unsafe.Pointer(&buf))
+		v.mu.Unlock()
+		return gray, err
+	}
+}
+
+// gray is the luminance of a frame captured into data.
+func (v *videoCapture) gray(data []byte) (*image.Gray, error) {
+	if v.format == v4l2PixMJPEG {
+		img, err := jpeg.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		return grayImage(img), nil
+	}
+	gray := image.NewGray(image.Rect(0, 0, v.width, v.height))
+	for y := 0; y < v.height; y++ {
+		for x := 0; x < v.width; x++ {
+			if i := y*v.stride + 2*x; i < len(data) {
+				gray.Pix[y*gray.Stride+x] = data[i]
+			}
+		}
+	}
+	return gray, nil
+}
+
+// grayImage is img in shades of gray, the Y of a JPEG as it is.
+func grayImage(img image.Image) *image.Gray {
+	if y, ok := img.(*image.YCbCr); ok {
+		return &image.Gray{Pix: y.Y, Stride: y.YStride, Rect: y.Rect}
+	}
+	b := img.Bounds()
+	gray := image.NewGray(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			gray.Set(x, y, img.At(x, y))
+		}
+	}
+	return gray
+}
+
+func (v *videoCapture) unmap() {
+	for _, b := range v.buffers {
+		syscall.Munmap(b)
+	}
+	v.buffers = nil
+}
+
+func (v *videoCapture) close() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.closed {
+		return nil
+	}
+	v.closed = true
+	kind := uint32(v4l2BufTypeCapture)
+	videoIoctl(v.f, vidiocStreamOff, unsafe.Pointer(&kind))
+	v.unmap()
+	return v.f.Close()
+}
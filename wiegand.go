@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Access control readers at doors speak Wiegand: two lines, D0 and D1, both high until the
+// reader pulls one of them low for a moment for each bit of a card, D0 for a 0 and D1 for a
+// 1, and nothing once the card is sent. On a gateway like a Raspberry Pi they go to two GPIO
+// lines, watched here for falling edges through the GPIO character device of the kernel.
+// The common formats have a parity bit at each end: 26 bits with an 8 bit facility code and
+// a 16 bit card number, 34 bits with 16 bits of each. Cards are passed on like those of a
+// badge reader, with the card number as the code and the symbology badge.
+
+// wiegandGap is how long the lines are quiet after the last bit of a card; the bits of a
+// card come a few ms apart at most.
+const wiegandGap = 25 * time.Millisecond
+
+// From linux/gpio.h, version 2 of the GPIO character device.
+const (
+	gpioGetLineIoctl  = 0xC250B407 // GPIO_V2_GET_LINE_IOCTL
+	gpioFlagInput     = 1 << 2
+	gpioFlagFalling   = 1 << 4
+	gpioFlagPullUp    = 1 << 8
+	gpioEventFalling  = 2
+	gpioLineEventSize = 48
+)
+
+// gpioLineRequest is struct gpio_v2_line_request.
+type gpioLineRequest struct {
+	Offsets  [64]uint32
+	Consumer [32]byte
+	Config   struct {
+		Flags    uint64
+		NumAttrs uint32
+		_        [5]uint32
+		Attrs    [10][3]uint64
+	}
+	NumLines        uint32
+	EventBufferSize uint32
+	_               [5]uint32
+	FD              int32
+}
+
+// WiegandCard is what an access control reader sent over Wiegand.
+type WiegandCard struct {
+	Bits     int    `json:"bits"`
+	Facility int    `json:"facility,omitempty"` // of the 26 and 34 bit formats
+	Card     uint64 `json:"card"`
+}
+
+// parseWiegand reads a card from its bits, the first one sent first. For the 26 and 34 bit
+// formats the parity bits are checked and stripped, other formats are passed on whole.
+func parseWiegand(bits []byte) (WiegandCard, error) {
+	var facilityBits int
+	switch len(bits) {
+	case 26:
+		facilityBits = 8
+	case 34:
+		facilityBits = 16
+	default:
+		if len(bits) == 0 || len(bits) > 64 {
+			return WiegandCard{}, fmt.Errorf("wiegand: %d bits", len(bits))
+		}
+		return WiegandCard{Bits: len(bits), Card: wiegandNumber(bits)}, nil
+	}
+	n := len(bits)
+	half := n / 2
+	// Even parity over the first half, odd over the second, each with its parity bit.
+	if wiegandOnes(bits[:half])%2 != 0 || wiegandOnes(bits[half:])%2 != 1 {
+		return WiegandCard{}, fmt.Errorf("wiegand: parity of %d bits is off", n)
+	}
+	data := bits[1 : n-1]
+	return WiegandCard{Bits: n, Facility: int(wiegandNumber(data[:facilityBits])), Card: wiegandNumber(data[facilityBits:])}, nil
+}
+
+func wiegandOnes(bits []byte) int {
+	n := 0
+	for _, b := range bits {
+		n += int(b)
+	}
+	return n
+}
+
+func wiegandNumber(bits []byte) uint64 {
+	var v uint64
+	for _, b := range bits {
+		v = v<<1 | uint64(b)
+	}
+	return v
+}
+
+// wiegandReader reads the cards of a reader on the two GPIO lines of cfg.
+type wiegandReader struct {
+	cfg  WiegandConfig
+	name string
+
+	mu sync.Mutex
+	f  *os.File // the events of both lines
+}
+
+func openWiegandReader(cfg WiegandConfig, name string) (*wiegandReader, error) {
+	r := &wiegandReader{cfg: cfg, name: name}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// open requests the two lines as inputs, pulled up, with events for their falling edges.
+func (r *wiegandReader) open() error {
+	chip, err := os.Open(r.cfg.Chip)
+	if err != nil {
+		return err
+	}
+	defer chip.Close()
+	var req gpioLineRequest
+	req.Offsets[0], req.Offsets[1] = uint32(r.cfg.D0), uint32(r.cfg.D1)
+	req.NumLines = 2
+	copy(req.Consumer[:31], "usbscanner")
+	req.Config.Flags = gpioFlagInput | gpioFlagFalling | gpioFlagPullUp
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, chip.Fd(), gpioGetLineIoctl, uintptr(unsafe.Pointer(&req))); errno != 0 {
+		return fmt.Errorf("could not get lines %d and %d of %s: %v", r.cfg.D0, r.cfg.D1, r.cfg.Chip, errno)
+	}
+	syscall.SetNonblock(int(req.FD), true) // so reads can time out
+	r.mu.Lock()
+	r.f = os.NewFile(uintptr(req.FD), fmt.Sprintf("%s lines %d and %d", r.cfg.Chip, r.cfg.D0, r.cfg.D1))
+	r.mu.Unlock()
+	return nil
+}
+
+// readScan waits for the bits of a card, which are over once the lines were quiet for
+// wiegandGap. A card that doesn't come through right is logged and skipped.
+func (r *wiegandReader) readScan() (Scan, error) {
+	r.mu.Lock()
+	f := r.f
+	r.mu.Unlock()
+	var bits []byte
+	buf := make([]byte, 16*gpioLineEventSize)
+	for {
+		if len(bits) > 0 {
+			f.SetReadDeadline(time.Now().Add(wiegandGap))
+		} else {
+			f.SetReadDeadline(time.Time{})
+		}
+		n, err := f.Read(buf)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			card, err := parseWiegand(bits)
+			bits = nil
+			if err != nil {
+				slog.Warn("Could not read the card", "device", r.name, "error", err)
+				continue
+			}
+			scan := newScan(strconv.FormatUint(card.Card, 10), r.name, time.Now())
+			scan.Symbology = "badge"
+			scan.Badge = &BadgeScan{Wiegand: &card}
+			return scan, nil
+		} else if err != nil {
+			return Scan{}, err
+		}
+		for ev := buf[:n]; len(ev) >= gpioLineEventSize; ev = ev[gpioLineEventSize:] {
+			// struct gpio_v2_line_event: timestamp, id, offset and sequence numbers.
+			id, offset := binary.NativeEndian.Uint32(ev[8:]), binary.NativeEndian.Uint32(ev[12:])
+			if id != gpioEventFalling {
+				continue
+			}
+			if offset == uint32(r.cfg.D1) {
+				bits = append(bits, 1)
+			} else {
+				bits = append(bits, 0)
+			}
+		}
+	}
+}
+
+func (r *wiegandReader) reopen() error {
+	r.close()
+	return r.open()
+}
+
+func (r *wiegandReader) close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
+
+// openWiegandStation opens the station for a Wiegand reader on GPIO lines.
+func openWiegandStation(profile string, cfg *Config) (*station, error) {
+	if cfg.Wiegand.D0 == cfg.Wiegand.D1 {
+		return nil, fmt.Errorf("wiegand: d0 and d1 should be two lines, not both %d", cfg.Wiegand.D0)
+	}
+	name := cfg.Wiegand.Name
+	if name == "" {
+		name = "wiegand"
+	}
+	path := fmt.Sprintf("%s:%d,%d", cfg.Wiegand.Chip, cfg.Wiegand.D0, cfg.Wiegand.D1)
+	return openSourceStation(profile, cfg, path, name, "wiegand", func() (scanSource, error) {
+		return openWiegandReader(cfg.Wiegand, name)
+	})
+}